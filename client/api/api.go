@@ -0,0 +1,176 @@
+// Package api describes HTTP API of client daemon. Endpoints is the contract served by the daemon, the OpenAPI
+// document is generated from it and Client calls it with types of this package.
+package api
+
+import (
+	"net/http"
+
+	"github.com/samoslab/nebula/client/auth"
+	"github.com/samoslab/nebula/client/backup"
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/daemon"
+	"github.com/samoslab/nebula/client/filesync"
+	"github.com/samoslab/nebula/client/order"
+	"github.com/samoslab/nebula/client/transfer"
+	"github.com/samoslab/nebula/client/util/filetype"
+	pb "github.com/samoslab/nebula/tracker/register/client/pb"
+)
+
+// media types of bodies
+const (
+	JSON        = "application/json"
+	OctetStream = "application/octet-stream"
+	Multipart   = "multipart/form-data"
+	EventStream = "text/event-stream"
+)
+
+// Binary content of body or file of form, it is binary string in spec
+type Binary []byte
+
+// oneOf data of response is one of values
+type oneOf []interface{}
+
+// Endpoint an API path of daemon. Query, Request and Response are values of types sent in query, request body
+// and data of unified response, nil if not used. Names of query parameters are json tags of Query fields.
+type Endpoint struct {
+	Path    string
+	Methods []string
+	Summary string
+	// Scope token must have, Public endpoint needs no token
+	Scope  auth.Scope
+	Public bool
+
+	Query       interface{}
+	Request     interface{}
+	RequestType string // media type of request body, JSON if empty
+	Response    interface{}
+	// ResponseType media type of response, JSON if empty. Raw response is Response itself, not unified response
+	ResponseType string
+	Raw          bool
+}
+
+// PackageQuery query of package endpoints
+type PackageQuery struct {
+	ID string `json:"id"`
+}
+
+// OrderListQuery query of all orders, expired orders are listed by default
+type OrderListQuery struct {
+	Expired bool `json:"expired"`
+}
+
+// OrderQuery query of order info
+type OrderQuery struct {
+	OrderID string `json:"orderid"`
+}
+
+// ProgressEventsQuery files of progress events, events of all files are sent if empty
+type ProgressEventsQuery struct {
+	Files []string `json:"file"`
+}
+
+// StreamUploadQuery query of stream upload, request body is content of file
+type StreamUploadQuery struct {
+	BodyUploadReq
+	Filename string `json:"filename"`
+}
+
+// UploadForm multipart form of form upload, fields must be before files
+type UploadForm struct {
+	BodyUploadReq
+	Files []Binary `json:"file"`
+}
+
+// DownloadContentQuery query of file content, inline content is shown by browser instead of saved
+type DownloadContentQuery struct {
+	Path   string `json:"path"`
+	Sno    uint32 `json:"space_no"`
+	Inline bool   `json:"inline"`
+}
+
+// OpenAPIPath path of OpenAPI document of daemon
+const OpenAPIPath = "/api/v1/openapi.json"
+
+var (
+	get     = []string{http.MethodGet}
+	post    = []string{http.MethodPost}
+	jobOrOK = oneOf{"ok", transfer.Job{}}
+)
+
+// Endpoints all API paths of daemon, paths not in it are refused by the daemon.
+// Endpoints taking paths of daemon host read or write any file of daemon user, they require admin scope.
+var Endpoints = []Endpoint{
+	{Path: OpenAPIPath, Methods: get, Public: true, Summary: "OpenAPI document of API", Response: map[string]interface{}{}, Raw: true},
+	{Path: "/api/v1/auth/login", Methods: post, Public: true, Summary: "Log in web session of token, session cookie is set", Request: auth.LoginReq{}, Response: auth.SessionRsp{}},
+	{Path: "/api/v1/auth/session", Methods: get, Public: true, Summary: "Session of cookie", Response: auth.SessionRsp{}},
+	{Path: "/api/v1/auth/logout", Methods: post, Public: true, Summary: "Log out session of cookie", Response: ""},
+
+	{Path: "/api/v1/store/register", Methods: post, Scope: auth.ScopeAdmin, Summary: "Register client with email", Request: RegisterReq{}, Response: ""},
+	{Path: "/api/v1/store/verifyemail", Methods: post, Scope: auth.ScopeAdmin, Summary: "Verify email with code", Request: VerifyEmailReq{}, Response: ""},
+	{Path: "/api/v1/store/folder/add", Methods: post, Scope: auth.ScopeWrite, Summary: "Make folders", Request: MkfolderReq{}, Response: true},
+	{Path: "/api/v1/store/upload", Methods: post, Scope: auth.ScopeAdmin, Summary: "Upload local file, job is returned if async", Request: UploadReq{}, Response: jobOrOK},
+	{Path: "/api/v1/store/upload/pending", Methods: get, Scope: auth.ScopeRead, Summary: "Uploads not finished", Response: []daemon.PendingUpload{}},
+	{Path: "/api/v1/store/upload/resume", Methods: post, Scope: auth.ScopeWrite, Summary: "Resume uploads not finished", Response: ""},
+	{Path: "/api/v1/store/upload/form", Methods: post, Scope: auth.ScopeWrite, Summary: "Upload files of multipart form", Request: UploadForm{}, RequestType: Multipart, Response: []string{}},
+	{Path: "/api/v1/store/upload/stream", Methods: []string{http.MethodPut, http.MethodPost}, Scope: auth.ScopeWrite, Summary: "Upload request body as file, body with Content-Range is a chunk", Query: StreamUploadQuery{}, Request: Binary{}, RequestType: OctetStream, Response: BodyUploadRsp{}},
+	{Path: "/api/v1/store/download", Methods: post, Scope: auth.ScopeAdmin, Summary: "Download file into local folder, job is returned if async", Request: DownloadReq{}, Response: jobOrOK},
+	{Path: "/api/v1/store/download/content", Methods: []string{http.MethodGet, http.MethodHead}, Scope: auth.ScopeRead, Summary: "Content of file, Range is supported", Query: DownloadContentQuery{}, Response: Binary{}, ResponseType: OctetStream, Raw: true},
+	{Path: "/api/v1/store/list", Methods: post, Scope: auth.ScopeRead, Summary: "List files of folder", Request: ListReq{}, Response: daemon.FilePages{}},
+	{Path: "/api/v1/store/remove", Methods: post, Scope: auth.ScopeWrite, Summary: "Remove file or folder", Request: RemoveReq{}, Response: ""},
+	{Path: "/api/v1/store/progress", Methods: post, Scope: auth.ScopeRead, Summary: "Progress rate of transfers", Request: ProgressReq{}, Response: map[string]float64{}},
+	{Path: "/api/v1/store/progress/events", Methods: get, Scope: auth.ScopeRead, Summary: "Stream of progress events", Query: ProgressEventsQuery{}, Response: common.Event{}, ResponseType: EventStream, Raw: true},
+	{Path: "/api/v1/store/uploaddir", Methods: post, Scope: auth.ScopeAdmin, Summary: "Upload local folder, job is returned if async", Request: UploadDirReq{}, Response: jobOrOK},
+	{Path: "/api/v1/store/downloaddir", Methods: post, Scope: auth.ScopeAdmin, Summary: "Download folder into local folder, job is returned if async", Request: DownloadDirReq{}, Response: jobOrOK},
+	{Path: "/api/v1/store/rename", Methods: post, Scope: auth.ScopeWrite, Summary: "Move or rename file", Request: RenameReq{}, Response: ""},
+
+	{Path: "/api/v1/package/all", Methods: get, Scope: auth.ScopeRead, Summary: "All packages", Response: []order.Package{}},
+	{Path: "/api/v1/package", Methods: get, Scope: auth.ScopeRead, Summary: "Package info", Query: PackageQuery{}, Response: order.Package{}},
+	{Path: "/api/v1/package/buy", Methods: post, Scope: auth.ScopeWrite, Summary: "Buy package", Request: BuyPackageReq{}, Response: order.Order{}},
+	{Path: "/api/v1/package/discount", Methods: get, Scope: auth.ScopeRead, Summary: "Discount of package by quanlity", Query: PackageQuery{}, Response: map[uint32]string{}},
+	{Path: "/api/v1/order/all", Methods: get, Scope: auth.ScopeRead, Summary: "All orders", Query: OrderListQuery{}, Response: []order.Order{}},
+	{Path: "/api/v1/order/getinfo", Methods: get, Scope: auth.ScopeRead, Summary: "Order info", Query: OrderQuery{}, Response: order.Order{}},
+	{Path: "/api/v1/order/recharge/address", Methods: get, Scope: auth.ScopeRead, Summary: "Recharge address and balance", Response: order.AddressBalance{}},
+	{Path: "/api/v1/order/pay", Methods: post, Scope: auth.ScopeWrite, Summary: "Pay order", Request: OnlyOrderReq{}, Response: pb.PayOrderResp{}},
+	{Path: "/api/v1/order/remove", Methods: post, Scope: auth.ScopeWrite, Summary: "Remove order", Request: OnlyOrderReq{}, Response: pb.RemoveOrderResp{}},
+	{Path: "/api/v1/usage/amount", Methods: get, Scope: auth.ScopeRead, Summary: "Usage of package", Response: order.UsageAmount{}},
+
+	{Path: "/api/v1/secret/encrypt", Methods: post, Scope: auth.ScopeAdmin, Summary: "Encrypt local file", Request: EncryFileReq{}, Response: true},
+	{Path: "/api/v1/secret/decrypt", Methods: post, Scope: auth.ScopeAdmin, Summary: "Decrypt local file", Request: DecryFileReq{}, Response: true},
+
+	{Path: "/api/v1/service/status", Methods: get, Scope: auth.ScopeRead, Summary: "Service status", Response: ServiceStatus{}, Raw: true},
+	{Path: "/api/v1/service/filetype", Methods: get, Scope: auth.ScopeRead, Summary: "File types known by MIME value", Response: filetype.SupportType{}, Raw: true},
+	{Path: "/api/v1/service/root", Methods: post, Scope: auth.ScopeAdmin, Summary: "Set root path", Request: RootPath{}, Response: ""},
+	{Path: "/api/v1/config/import", Methods: post, Scope: auth.ScopeAdmin, Summary: "Import config file", Request: ConfigImportReq{}, Response: ""},
+	{Path: "/api/v1/config/export", Methods: get, Scope: auth.ScopeAdmin, Summary: "Config file as attachment", Raw: true},
+
+	{Path: "/api/v1/space/verify", Methods: post, Scope: auth.ScopeWrite, Summary: "Verify password of privacy space", Request: PasswordReq{}, Response: ""},
+	{Path: "/api/v1/space/password", Methods: post, Scope: auth.ScopeAdmin, Summary: "Set password of privacy space", Request: PasswordReq{}, Response: ""},
+	{Path: "/api/v1/space/password/change", Methods: post, Scope: auth.ScopeAdmin, Summary: "Change password of privacy space", Request: ChangePasswordReq{}, Response: ""},
+	{Path: "/api/v1/space/status", Methods: post, Scope: auth.ScopeRead, Summary: "Check password of space is set", Request: SpaceStatusReq{}, Response: ""},
+
+	{Path: "/api/v1/sync/pair/add", Methods: post, Scope: auth.ScopeAdmin, Summary: "Add sync pair", Request: SyncPairReq{}, Response: filesync.Pair{}},
+	{Path: "/api/v1/sync/pair/remove", Methods: post, Scope: auth.ScopeWrite, Summary: "Remove sync pair", Request: SyncPairIDReq{}, Response: ""},
+	{Path: "/api/v1/sync/status", Methods: get, Scope: auth.ScopeRead, Summary: "Status of sync pairs", Response: []filesync.Status{}},
+	{Path: "/api/v1/sync/run", Methods: post, Scope: auth.ScopeWrite, Summary: "Sync a pair now, all pairs if id is empty", Request: SyncPairIDReq{}, Response: ""},
+
+	{Path: "/api/v1/backup/add", Methods: post, Scope: auth.ScopeAdmin, Summary: "Watch local folder to back up", Request: BackupReq{}, Response: backup.Watch{}},
+	{Path: "/api/v1/backup/remove", Methods: post, Scope: auth.ScopeWrite, Summary: "Remove backup watch", Request: BackupIDReq{}, Response: ""},
+	{Path: "/api/v1/backup/status", Methods: get, Scope: auth.ScopeRead, Summary: "Status of backup watches", Response: []backup.Status{}},
+	{Path: "/api/v1/backup/queue", Methods: get, Scope: auth.ScopeRead, Summary: "Files waiting for backup", Response: []backup.Item{}},
+
+	{Path: "/api/v1/transfer/list", Methods: get, Scope: auth.ScopeRead, Summary: "Transfer jobs", Response: []transfer.Job{}},
+	{Path: "/api/v1/transfer/pause", Methods: post, Scope: auth.ScopeWrite, Summary: "Pause transfer job", Request: TransferIDReq{}, Response: ""},
+	{Path: "/api/v1/transfer/resume", Methods: post, Scope: auth.ScopeWrite, Summary: "Resume paused transfer job", Request: TransferIDReq{}, Response: ""},
+	{Path: "/api/v1/transfer/cancel", Methods: post, Scope: auth.ScopeWrite, Summary: "Cancel transfer job", Request: TransferIDReq{}, Response: ""},
+	{Path: "/api/v1/transfer/retry", Methods: post, Scope: auth.ScopeWrite, Summary: "Retry failed transfer job", Request: TransferIDReq{}, Response: ""},
+}
+
+// Lookup returns endpoint of path
+func Lookup(path string) (Endpoint, bool) {
+	for _, e := range Endpoints {
+		if e.Path == path {
+			return e, true
+		}
+	}
+	return Endpoint{}, false
+}
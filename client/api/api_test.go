@@ -0,0 +1,335 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samoslab/nebula/client/common"
+	"github.com/stretchr/testify/require"
+)
+
+// structs returns struct types of api package used by v, fields of embedded structs included
+func structs(v interface{}, found map[reflect.Type]bool) {
+	if values, ok := v.(oneOf); ok {
+		for _, x := range values {
+			structs(x, found)
+		}
+		return
+	}
+	if v == nil {
+		return
+	}
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t.PkgPath() != reflect.TypeOf(Endpoint{}).PkgPath() || found[t] {
+		return
+	}
+	found[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		structs(reflect.Zero(t.Field(i).Type).Interface(), found)
+	}
+}
+
+func TestTags(t *testing.T) {
+	found := map[reflect.Type]bool{}
+	for _, e := range Endpoints {
+		structs(e.Query, found)
+		structs(e.Request, found)
+		structs(e.Response, found)
+	}
+	require.NotEmpty(t, found)
+	for st := range found {
+		for i := 0; i < st.NumField(); i++ {
+			f := st.Field(i)
+			if f.Anonymous {
+				continue
+			}
+			tag, ok := f.Tag.Lookup("json")
+			require.True(t, ok, "%s.%s has no valid json tag: %s", st.Name(), f.Name, f.Tag)
+			require.NotEmpty(t, strings.Split(tag, ",")[0], "%s.%s", st.Name(), f.Name)
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	doc := OpenAPI()
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+
+	components := doc["components"].(schema)["schemas"].(map[string]schema)
+	for _, ref := range strings.Split(string(data), `"$ref":"`)[1:] {
+		ref = ref[:strings.Index(ref, `"`)]
+		if ref == "#/components/responses/Error" {
+			continue
+		}
+		require.Contains(t, components, strings.TrimPrefix(ref, "#/components/schemas/"), ref)
+	}
+	require.Contains(t, components, "transfer.Job")
+	require.Contains(t, components, "daemon.FilePages")
+
+	parsed := struct {
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			Scope       string `json:"x-scope"`
+		} `json:"paths"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	require.Len(t, parsed.Paths, len(Endpoints))
+	ids := map[string]bool{}
+	for _, e := range Endpoints {
+		item, ok := parsed.Paths[e.Path]
+		require.True(t, ok, e.Path)
+		require.Len(t, item, len(e.Methods), e.Path)
+		for _, method := range e.Methods {
+			op := item[strings.ToLower(method)]
+			require.False(t, ids[op.OperationID], op.OperationID)
+			ids[op.OperationID] = true
+			if !e.Public {
+				require.Equal(t, e.Scope.String(), op.Scope)
+			}
+		}
+	}
+
+	upload := doc["paths"].(schema)["/api/v1/store/upload/stream"].(schema)["put"].(schema)
+	names := []string{}
+	for _, p := range upload["parameters"].([]schema) {
+		names = append(names, p["name"].(string))
+	}
+	require.Equal(t, []string{"dest_dir", "space_no", "newversion", "is_encrypt", "filename"}, names)
+}
+
+// fakeDaemon checks requests against Endpoints and answers zero values of responses
+func fakeDaemon(t *testing.T, called map[string]bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := Lookup(r.URL.Path)
+		if !ok {
+			t.Errorf("path %s not in endpoints", r.URL.Path)
+			return
+		}
+		allowed := false
+		for _, m := range e.Methods {
+			allowed = allowed || m == r.Method
+		}
+		if !allowed {
+			t.Errorf("method %s of %s not in endpoint", r.Method, r.URL.Path)
+		}
+		called[r.Method+" "+r.URL.Path] = true
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("no token sent to %s", r.URL.Path)
+		}
+
+		params := map[string]bool{}
+		if e.Query != nil {
+			fields(reflect.TypeOf(e.Query), func(name string, options []string, f reflect.StructField) {
+				params[name] = true
+			})
+		}
+		for name := range r.URL.Query() {
+			if !params[name] {
+				t.Errorf("query %s of %s not in endpoint", name, r.URL.Path)
+			}
+		}
+		switch {
+		case e.RequestType == Multipart:
+			if _, err := r.MultipartReader(); err != nil {
+				t.Errorf("%s body is not multipart: %v", r.URL.Path, err)
+			}
+		case e.Request != nil && e.RequestType == "":
+			if r.Header.Get("Content-Type") != JSON {
+				t.Errorf("%s content type %s", r.URL.Path, r.Header.Get("Content-Type"))
+			}
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(reflect.New(reflect.TypeOf(e.Request)).Interface()); err != nil {
+				t.Errorf("%s body does not match endpoint: %v", r.URL.Path, err)
+			}
+		}
+
+		var data interface{} = e.Response
+		if values, ok := data.(oneOf); ok {
+			data = values[0]
+		}
+		switch e.ResponseType {
+		case OctetStream:
+			w.Header().Set("Content-Disposition", "attachment")
+			w.Write([]byte("content"))
+			return
+		case EventStream:
+			w.Header().Set("Content-Type", EventStream)
+			fmt.Fprintf(w, "retry: 1000\n\nevent: progress\ndata: {\"file\":\"a\",\"stage\":\"uploading\"}\n\n: ping\n\n")
+			return
+		}
+		if e.Raw {
+			w.Header().Set("Content-Disposition", "attachment")
+			json.NewEncoder(w).Encode(data)
+			return
+		}
+		rsp, _ := common.MakeUnifiedHTTPResponse(0, data, "")
+		json.NewEncoder(w).Encode(rsp)
+	}))
+}
+
+func TestClient(t *testing.T) {
+	called := map[string]bool{}
+	server := fakeDaemon(t, called)
+	defer server.Close()
+	c := NewClient(strings.TrimPrefix(server.URL, "http://"), "token")
+	ctx := context.Background()
+	query := &StreamUploadQuery{BodyUploadReq: BodyUploadReq{Dest: "/a"}, Filename: "b"}
+	content := &DownloadContentQuery{Path: "/a/b"}
+
+	_, err := c.OpenAPI(ctx)
+	require.NoError(t, err)
+	_, err = c.Login(ctx, "token")
+	require.NoError(t, err)
+	_, err = c.Session(ctx)
+	require.NoError(t, err)
+	require.NoError(t, c.Logout(ctx, "csrf"))
+	require.NoError(t, c.Register(ctx, &RegisterReq{Email: "a@b.c", Resend: true}))
+	require.NoError(t, c.VerifyEmail(ctx, &VerifyEmailReq{}))
+	require.NoError(t, c.MkFolder(ctx, &MkfolderReq{}))
+	job, err := c.Upload(ctx, &UploadReq{})
+	require.NoError(t, err)
+	require.Nil(t, job)
+	_, err = c.PendingUploads(ctx)
+	require.NoError(t, err)
+	require.NoError(t, c.ResumeUploads(ctx))
+	uploaded, err := c.UploadForm(ctx, &query.BodyUploadReq, []FormFile{{Name: "b", Content: strings.NewReader("b")}})
+	require.NoError(t, err)
+	require.Empty(t, uploaded)
+	_, err = c.UploadStream(ctx, query, strings.NewReader("b"))
+	require.NoError(t, err)
+	_, err = c.UploadChunk(ctx, query, []byte("b"), 0, 1)
+	require.NoError(t, err)
+	_, err = c.Download(ctx, &DownloadReq{})
+	require.NoError(t, err)
+	body, err := c.DownloadContent(ctx, content, 0)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	require.Equal(t, "content", string(b))
+	body.Close()
+	_, err = c.StatContent(ctx, content)
+	require.NoError(t, err)
+	_, err = c.List(ctx, &ListReq{})
+	require.NoError(t, err)
+	require.NoError(t, c.Remove(ctx, &RemoveReq{}))
+	_, err = c.Progress(ctx, &ProgressReq{})
+	require.NoError(t, err)
+	events, err := c.ProgressEvents(ctx, []string{"a"})
+	require.NoError(t, err)
+	ev, err := events.Next()
+	require.NoError(t, err)
+	require.Equal(t, common.Event{File: "a", Stage: "uploading"}, *ev)
+	_, err = events.Next()
+	require.Error(t, err)
+	events.Close()
+	_, err = c.UploadDir(ctx, &UploadDirReq{})
+	require.NoError(t, err)
+	_, err = c.DownloadDir(ctx, &DownloadDirReq{})
+	require.NoError(t, err)
+	require.NoError(t, c.Rename(ctx, &RenameReq{}))
+
+	_, err = c.AllPackages(ctx)
+	require.NoError(t, err)
+	_, err = c.Package(ctx, "1")
+	require.NoError(t, err)
+	_, err = c.BuyPackage(ctx, &BuyPackageReq{})
+	require.NoError(t, err)
+	_, err = c.DiscountPackage(ctx, "1")
+	require.NoError(t, err)
+	_, err = c.AllOrders(ctx, false)
+	require.NoError(t, err)
+	_, err = c.Order(ctx, "1")
+	require.NoError(t, err)
+	_, err = c.RechargeAddress(ctx)
+	require.NoError(t, err)
+	_, err = c.PayOrder(ctx, "1")
+	require.NoError(t, err)
+	_, err = c.RemoveOrder(ctx, "1")
+	require.NoError(t, err)
+	_, err = c.UsageAmount(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, c.EncryptFile(ctx, &EncryFileReq{OutputFile: "b"}))
+	require.NoError(t, c.DecryptFile(ctx, &DecryFileReq{OutputFile: "b"}))
+	_, err = c.ServiceStatus(ctx)
+	require.NoError(t, err)
+	_, err = c.FileTypes(ctx)
+	require.NoError(t, err)
+	require.NoError(t, c.SetRoot(ctx, &RootPath{}))
+	require.NoError(t, c.ImportConfig(ctx, &ConfigImportReq{}))
+	var config bytes.Buffer
+	require.NoError(t, c.ExportConfig(ctx, &config))
+
+	require.NoError(t, c.VerifyPassword(ctx, &PasswordReq{}))
+	require.NoError(t, c.SetPassword(ctx, &PasswordReq{}))
+	require.NoError(t, c.ChangePassword(ctx, &ChangePasswordReq{}))
+	require.NoError(t, c.SpaceStatus(ctx, &SpaceStatusReq{}))
+
+	_, err = c.AddSyncPair(ctx, &SyncPairReq{})
+	require.NoError(t, err)
+	require.NoError(t, c.RemoveSyncPair(ctx, &SyncPairIDReq{}))
+	_, err = c.SyncStatus(ctx)
+	require.NoError(t, err)
+	require.NoError(t, c.RunSync(ctx, &SyncPairIDReq{}))
+
+	_, err = c.AddBackup(ctx, &BackupReq{})
+	require.NoError(t, err)
+	require.NoError(t, c.RemoveBackup(ctx, &BackupIDReq{}))
+	_, err = c.BackupStatus(ctx)
+	require.NoError(t, err)
+	_, err = c.BackupQueue(ctx)
+	require.NoError(t, err)
+
+	_, err = c.Transfers(ctx)
+	require.NoError(t, err)
+	require.NoError(t, c.PauseTransfer(ctx, &TransferIDReq{}))
+	require.NoError(t, c.ResumeTransfer(ctx, &TransferIDReq{}))
+	require.NoError(t, c.CancelTransfer(ctx, &TransferIDReq{}))
+	require.NoError(t, c.RetryTransfer(ctx, &TransferIDReq{}))
+
+	// every method of every endpoint has a method of client
+	for _, e := range Endpoints {
+		for _, method := range e.Methods {
+			if method == http.MethodPost && len(e.Methods) > 1 {
+				continue
+			}
+			require.True(t, called[method+" "+e.Path], "%s %s not called by client", method, e.Path)
+		}
+	}
+}
+
+func TestClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/service/status" {
+			// handlers answer errors as unified response of status 200
+			rsp, _ := common.MakeUnifiedHTTPResponse(http.StatusBadRequest, "", "register first")
+			json.NewEncoder(w).Encode(rsp)
+			return
+		}
+		rsp, _ := common.MakeUnifiedHTTPResponse(http.StatusForbidden, "", "scope admin required")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(rsp)
+	}))
+	defer server.Close()
+	c := NewClient(server.URL, "")
+	ctx := context.Background()
+	err := c.SetPassword(ctx, &PasswordReq{})
+	require.Equal(t, &Error{Status: http.StatusForbidden, Code: http.StatusForbidden, Errmsg: "scope admin required"}, err)
+	_, err = c.ServiceStatus(ctx)
+	require.Equal(t, &Error{Status: http.StatusOK, Code: http.StatusBadRequest, Errmsg: "register first"}, err)
+	require.Equal(t, "register first", err.Error())
+	_, err = c.DownloadContent(ctx, &DownloadContentQuery{Path: "/a"}, 0)
+	require.Error(t, err)
+}
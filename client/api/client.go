@@ -0,0 +1,658 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/samoslab/nebula/client/auth"
+	"github.com/samoslab/nebula/client/backup"
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/daemon"
+	"github.com/samoslab/nebula/client/filesync"
+	"github.com/samoslab/nebula/client/order"
+	"github.com/samoslab/nebula/client/transfer"
+	"github.com/samoslab/nebula/client/util/filetype"
+	pb "github.com/samoslab/nebula/tracker/register/client/pb"
+)
+
+// Error call refused or failed, Status is http status, Code and Errmsg are of unified response
+type Error struct {
+	Status int
+	Code   int
+	Errmsg string
+}
+
+func (e *Error) Error() string {
+	if e.Status != http.StatusOK {
+		return fmt.Sprintf("daemon response status %d, %s", e.Status, e.Errmsg)
+	}
+	return e.Errmsg
+}
+
+// Client calls API of a running daemon
+type Client struct {
+	// URL of daemon, such as http://127.0.0.1:7788
+	URL string
+	// Token API token sent as bearer token, no token is sent if empty
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewClient returns client of daemon at addr, addr without scheme is of http
+func NewClient(addr, token string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{URL: strings.TrimSuffix(addr, "/"), Token: token, HTTPClient: http.DefaultClient}
+}
+
+// values encodes query into url values, names are json tags of fields
+func values(query interface{}) url.Values {
+	v := url.Values{}
+	if query == nil {
+		return v
+	}
+	q := reflect.Indirect(reflect.ValueOf(query))
+	if !q.IsValid() {
+		return v
+	}
+	var visit func(q reflect.Value)
+	visit = func(q reflect.Value) {
+		t := q.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, ok := field(f)
+			if !ok {
+				continue
+			}
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				visit(q.Field(i))
+				continue
+			}
+			fv := q.Field(i)
+			if fv.Kind() == reflect.Slice {
+				for j := 0; j < fv.Len(); j++ {
+					v.Add(name, fmt.Sprint(fv.Index(j).Interface()))
+				}
+				continue
+			}
+			v.Set(name, fmt.Sprint(fv.Interface()))
+		}
+	}
+	visit(q)
+	return v
+}
+
+// unified decodes unified response of body, error of response is returned as *Error
+func unified(status int, body io.Reader) (*common.UnifiedResponse, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := common.DecodeResponse(data)
+	if err != nil {
+		if status != http.StatusOK {
+			return nil, &Error{Status: status, Errmsg: http.StatusText(status)}
+		}
+		return nil, err
+	}
+	if status != http.StatusOK || rsp.Code != 0 {
+		return nil, &Error{Status: status, Code: rsp.Code, Errmsg: rsp.Errmsg}
+	}
+	return rsp, nil
+}
+
+// do sends request of body to path, response not of status 200 is returned as *Error
+func (c *Client) do(ctx context.Context, method, path string, query interface{}, body io.Reader, contentType string, header http.Header) (*http.Response, error) {
+	u := c.URL + path
+	if q := values(query); len(q) != 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		for _, x := range v {
+			req.Header.Add(k, x)
+		}
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	rsp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusPartialContent {
+		defer rsp.Body.Close()
+		_, err := unified(rsp.StatusCode, rsp.Body)
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// call sends req as json to path and decodes data of unified response into data
+func (c *Client) call(ctx context.Context, method, path string, query, req, data interface{}) error {
+	var body io.Reader
+	contentType := ""
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(b), JSON
+	}
+	rsp, err := c.do(ctx, method, path, query, body, contentType, nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	u, err := unified(rsp.StatusCode, rsp.Body)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		return json.Unmarshal(u.Data, data)
+	}
+	return nil
+}
+
+// raw gets response of path which is data itself, unified response of error is returned as *Error
+func (c *Client) raw(ctx context.Context, path string, data interface{}) error {
+	rsp, err := c.do(ctx, http.MethodGet, path, nil, nil, "", nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	b, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if u, err := common.DecodeResponse(b); err == nil && u.Code != 0 && u.Errmsg != "" {
+		return &Error{Status: rsp.StatusCode, Code: u.Code, Errmsg: u.Errmsg}
+	}
+	return json.Unmarshal(b, data)
+}
+
+// job calls transfer endpoint, job is returned if req is async
+func (c *Client) job(ctx context.Context, path string, req interface{}) (*transfer.Job, error) {
+	var data json.RawMessage
+	if err := c.call(ctx, http.MethodPost, path, nil, req, &data); err != nil {
+		return nil, err
+	}
+	var ok string
+	if json.Unmarshal(data, &ok) == nil {
+		return nil, nil
+	}
+	job := &transfer.Job{}
+	return job, json.Unmarshal(data, job)
+}
+
+// OpenAPI returns OpenAPI document served by daemon
+func (c *Client) OpenAPI(ctx context.Context) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	return doc, c.raw(ctx, OpenAPIPath, &doc)
+}
+
+// Login logs in web session of token, cookie of session is kept if HTTPClient has a cookie jar
+func (c *Client) Login(ctx context.Context, token string) (*auth.SessionRsp, error) {
+	rsp := &auth.SessionRsp{}
+	return rsp, c.call(ctx, http.MethodPost, "/api/v1/auth/login", nil, &auth.LoginReq{Token: token}, rsp)
+}
+
+// Session returns session of cookie
+func (c *Client) Session(ctx context.Context) (*auth.SessionRsp, error) {
+	rsp := &auth.SessionRsp{}
+	return rsp, c.call(ctx, http.MethodGet, "/api/v1/auth/session", nil, nil, rsp)
+}
+
+// Logout ends session of cookie, csrf is CSRF token of session
+func (c *Client) Logout(ctx context.Context, csrf string) error {
+	rsp, err := c.do(ctx, http.MethodPost, "/api/v1/auth/logout", nil, nil, "", http.Header{auth.CSRFHeader: {csrf}})
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	_, err = unified(rsp.StatusCode, rsp.Body)
+	return err
+}
+
+// Register registers client with email, or sends verify code again if Resend
+func (c *Client) Register(ctx context.Context, req *RegisterReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/store/register", nil, req, nil)
+}
+
+// VerifyEmail verifies email with code
+func (c *Client) VerifyEmail(ctx context.Context, req *VerifyEmailReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/store/verifyemail", nil, req, nil)
+}
+
+// MkFolder makes folders
+func (c *Client) MkFolder(ctx context.Context, req *MkfolderReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/store/folder/add", nil, req, nil)
+}
+
+// Upload uploads local file, job is returned if req is async, otherwise it returns when file is uploaded
+func (c *Client) Upload(ctx context.Context, req *UploadReq) (*transfer.Job, error) {
+	return c.job(ctx, "/api/v1/store/upload", req)
+}
+
+// PendingUploads returns uploads not finished
+func (c *Client) PendingUploads(ctx context.Context) ([]*daemon.PendingUpload, error) {
+	pending := []*daemon.PendingUpload{}
+	return pending, c.call(ctx, http.MethodGet, "/api/v1/store/upload/pending", nil, nil, &pending)
+}
+
+// ResumeUploads resumes uploads not finished
+func (c *Client) ResumeUploads(ctx context.Context) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/store/upload/resume", nil, nil, nil)
+}
+
+// FormFile file of form upload
+type FormFile struct {
+	Name    string
+	Content io.Reader
+}
+
+// UploadForm uploads files as multipart form, paths of uploaded files are returned
+func (c *Client) UploadForm(ctx context.Context, req *BodyUploadReq, files []FormFile) ([]string, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		write := func() error {
+			for name, value := range values(req) {
+				if err := mw.WriteField(name, value[0]); err != nil {
+					return err
+				}
+			}
+			for _, f := range files {
+				part, err := mw.CreateFormFile("file", f.Name)
+				if err != nil {
+					return err
+				}
+				if _, err := io.Copy(part, f.Content); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		}
+		pw.CloseWithError(write())
+	}()
+	rsp, err := c.do(ctx, http.MethodPost, "/api/v1/store/upload/form", nil, pr, mw.FormDataContentType(), nil)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	u, err := unified(rsp.StatusCode, rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	uploaded := []string{}
+	return uploaded, json.Unmarshal(u.Data, &uploaded)
+}
+
+func (c *Client) stream(ctx context.Context, query *StreamUploadQuery, body io.Reader, header http.Header) (*BodyUploadRsp, error) {
+	rsp, err := c.do(ctx, http.MethodPut, "/api/v1/store/upload/stream", query, body, OctetStream, header)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	u, err := unified(rsp.StatusCode, rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := &BodyUploadRsp{}
+	return result, json.Unmarshal(u.Data, result)
+}
+
+// UploadStream uploads body as file Filename of query
+func (c *Client) UploadStream(ctx context.Context, query *StreamUploadQuery, body io.Reader) (*BodyUploadRsp, error) {
+	return c.stream(ctx, query, body, nil)
+}
+
+// UploadChunk uploads chunk at start of file of total size, file is uploaded after its last chunk is received.
+// Chunks must be sent in order, Received of result tells where to go on.
+func (c *Client) UploadChunk(ctx context.Context, query *StreamUploadQuery, chunk []byte, start, total int64) (*BodyUploadRsp, error) {
+	contentRange := fmt.Sprintf("bytes %d-%d/%d", start, start+int64(len(chunk))-1, total)
+	return c.stream(ctx, query, bytes.NewReader(chunk), http.Header{"Content-Range": {contentRange}})
+}
+
+// Download downloads file into local folder, job is returned if req is async, otherwise it returns when file is downloaded
+func (c *Client) Download(ctx context.Context, req *DownloadReq) (*transfer.Job, error) {
+	return c.job(ctx, "/api/v1/store/download", req)
+}
+
+// content requests content of file, error responses have no Content-Disposition
+func (c *Client) content(ctx context.Context, method string, query *DownloadContentQuery, header http.Header) (*http.Response, error) {
+	rsp, err := c.do(ctx, method, "/api/v1/store/download/content", query, nil, "", header)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Header.Get("Content-Disposition") == "" {
+		defer rsp.Body.Close()
+		if _, err := unified(rsp.StatusCode, rsp.Body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no content of %s", query.Path)
+	}
+	return rsp, nil
+}
+
+// DownloadContent returns content of file from offset, caller must close it
+func (c *Client) DownloadContent(ctx context.Context, query *DownloadContentQuery, offset int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	rsp, err := c.content(ctx, http.MethodGet, query, header)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Body, nil
+}
+
+// StatContent returns headers of content of file, such as Content-Length, Content-Type and ETag
+func (c *Client) StatContent(ctx context.Context, query *DownloadContentQuery) (http.Header, error) {
+	rsp, err := c.content(ctx, http.MethodHead, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	return rsp.Header, nil
+}
+
+// List lists files of folder
+func (c *Client) List(ctx context.Context, req *ListReq) (*daemon.FilePages, error) {
+	pages := &daemon.FilePages{}
+	return pages, c.call(ctx, http.MethodPost, "/api/v1/store/list", nil, req, pages)
+}
+
+// Remove removes file or folder
+func (c *Client) Remove(ctx context.Context, req *RemoveReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/store/remove", nil, req, nil)
+}
+
+// Progress returns progress rate of files
+func (c *Client) Progress(ctx context.Context, req *ProgressReq) (map[string]float64, error) {
+	progress := map[string]float64{}
+	return progress, c.call(ctx, http.MethodPost, "/api/v1/store/progress", nil, req, &progress)
+}
+
+// ProgressStream progress events sent by daemon
+type ProgressStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// Next returns next event, io.EOF is returned when daemon ends the stream
+func (s *ProgressStream) Next() (*common.Event, error) {
+	data := []string{}
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if line == "" {
+			if len(data) == 0 {
+				continue
+			}
+			ev := &common.Event{}
+			return ev, json.Unmarshal([]byte(strings.Join(data, "\n")), ev)
+		}
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close ends the stream
+func (s *ProgressStream) Close() error {
+	return s.body.Close()
+}
+
+// ProgressEvents returns stream of progress events of files, events of all files if files is empty.
+// Daemon ends stream before its write timeout, callers go on with a new stream.
+func (c *Client) ProgressEvents(ctx context.Context, files []string) (*ProgressStream, error) {
+	rsp, err := c.do(ctx, http.MethodGet, "/api/v1/store/progress/events", &ProgressEventsQuery{Files: files}, nil, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(rsp.Header.Get("Content-Type"), EventStream) {
+		defer rsp.Body.Close()
+		if _, err := unified(rsp.StatusCode, rsp.Body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("content type %s is not event stream", rsp.Header.Get("Content-Type"))
+	}
+	return &ProgressStream{body: rsp.Body, scanner: bufio.NewScanner(rsp.Body)}, nil
+}
+
+// UploadDir uploads local folder, job is returned if req is async
+func (c *Client) UploadDir(ctx context.Context, req *UploadDirReq) (*transfer.Job, error) {
+	return c.job(ctx, "/api/v1/store/uploaddir", req)
+}
+
+// DownloadDir downloads folder into local folder, job is returned if req is async
+func (c *Client) DownloadDir(ctx context.Context, req *DownloadDirReq) (*transfer.Job, error) {
+	return c.job(ctx, "/api/v1/store/downloaddir", req)
+}
+
+// Rename moves or renames file
+func (c *Client) Rename(ctx context.Context, req *RenameReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/store/rename", nil, req, nil)
+}
+
+// AllPackages returns all packages
+func (c *Client) AllPackages(ctx context.Context) ([]*order.Package, error) {
+	packages := []*order.Package{}
+	return packages, c.call(ctx, http.MethodGet, "/api/v1/package/all", nil, nil, &packages)
+}
+
+// Package returns package of id
+func (c *Client) Package(ctx context.Context, id string) (*order.Package, error) {
+	p := &order.Package{}
+	return p, c.call(ctx, http.MethodGet, "/api/v1/package", &PackageQuery{ID: id}, nil, p)
+}
+
+// BuyPackage buys package, order is returned
+func (c *Client) BuyPackage(ctx context.Context, req *BuyPackageReq) (*order.Order, error) {
+	o := &order.Order{}
+	return o, c.call(ctx, http.MethodPost, "/api/v1/package/buy", nil, req, o)
+}
+
+// DiscountPackage returns discount of package by quanlity
+func (c *Client) DiscountPackage(ctx context.Context, id string) (map[uint32]string, error) {
+	discount := map[uint32]string{}
+	return discount, c.call(ctx, http.MethodGet, "/api/v1/package/discount", &PackageQuery{ID: id}, nil, &discount)
+}
+
+// AllOrders returns orders, expired orders are included if expired
+func (c *Client) AllOrders(ctx context.Context, expired bool) ([]*order.Order, error) {
+	orders := []*order.Order{}
+	return orders, c.call(ctx, http.MethodGet, "/api/v1/order/all", &OrderListQuery{Expired: expired}, nil, &orders)
+}
+
+// Order returns order of id
+func (c *Client) Order(ctx context.Context, id string) (*order.Order, error) {
+	o := &order.Order{}
+	return o, c.call(ctx, http.MethodGet, "/api/v1/order/getinfo", &OrderQuery{OrderID: id}, nil, o)
+}
+
+// RechargeAddress returns recharge address and balance
+func (c *Client) RechargeAddress(ctx context.Context) (*order.AddressBalance, error) {
+	ab := &order.AddressBalance{}
+	return ab, c.call(ctx, http.MethodGet, "/api/v1/order/recharge/address", nil, nil, ab)
+}
+
+// PayOrder pays order of id
+func (c *Client) PayOrder(ctx context.Context, id string) (*pb.PayOrderResp, error) {
+	rsp := &pb.PayOrderResp{}
+	return rsp, c.call(ctx, http.MethodPost, "/api/v1/order/pay", nil, &OnlyOrderReq{ID: id}, rsp)
+}
+
+// RemoveOrder removes order of id
+func (c *Client) RemoveOrder(ctx context.Context, id string) (*pb.RemoveOrderResp, error) {
+	rsp := &pb.RemoveOrderResp{}
+	return rsp, c.call(ctx, http.MethodPost, "/api/v1/order/remove", nil, &OnlyOrderReq{ID: id}, rsp)
+}
+
+// UsageAmount returns usage of package
+func (c *Client) UsageAmount(ctx context.Context) (*order.UsageAmount, error) {
+	usage := &order.UsageAmount{}
+	return usage, c.call(ctx, http.MethodGet, "/api/v1/usage/amount", nil, nil, usage)
+}
+
+// EncryptFile encrypts local file
+func (c *Client) EncryptFile(ctx context.Context, req *EncryFileReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/secret/encrypt", nil, req, nil)
+}
+
+// DecryptFile decrypts local file
+func (c *Client) DecryptFile(ctx context.Context, req *DecryFileReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/secret/decrypt", nil, req, nil)
+}
+
+// ServiceStatus returns service status
+func (c *Client) ServiceStatus(ctx context.Context) (*ServiceStatus, error) {
+	status := &ServiceStatus{}
+	return status, c.raw(ctx, "/api/v1/service/status", status)
+}
+
+// FileTypes returns file types known by MIME value
+func (c *Client) FileTypes(ctx context.Context) (filetype.SupportType, error) {
+	types := filetype.SupportType{}
+	return types, c.raw(ctx, "/api/v1/service/filetype", &types)
+}
+
+// SetRoot sets root path
+func (c *Client) SetRoot(ctx context.Context, req *RootPath) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/service/root", nil, req, nil)
+}
+
+// ImportConfig imports config file
+func (c *Client) ImportConfig(ctx context.Context, req *ConfigImportReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/config/import", nil, req, nil)
+}
+
+// ExportConfig writes exported config file into w
+func (c *Client) ExportConfig(ctx context.Context, w io.Writer) error {
+	rsp, err := c.do(ctx, http.MethodGet, "/api/v1/config/export", nil, nil, "", nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.Header.Get("Content-Disposition") == "" {
+		_, err := unified(rsp.StatusCode, rsp.Body)
+		return err
+	}
+	_, err = io.Copy(w, rsp.Body)
+	return err
+}
+
+// VerifyPassword verifies password of privacy space
+func (c *Client) VerifyPassword(ctx context.Context, req *PasswordReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/space/verify", nil, req, nil)
+}
+
+// SetPassword sets password of privacy space
+func (c *Client) SetPassword(ctx context.Context, req *PasswordReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/space/password", nil, req, nil)
+}
+
+// ChangePassword changes password of privacy space
+func (c *Client) ChangePassword(ctx context.Context, req *ChangePasswordReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/space/password/change", nil, req, nil)
+}
+
+// SpaceStatus returns error if password of space is not set
+func (c *Client) SpaceStatus(ctx context.Context, req *SpaceStatusReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/space/status", nil, req, nil)
+}
+
+// AddSyncPair adds pair of local folder and folder of space kept in step
+func (c *Client) AddSyncPair(ctx context.Context, req *SyncPairReq) (*filesync.Pair, error) {
+	pair := &filesync.Pair{}
+	return pair, c.call(ctx, http.MethodPost, "/api/v1/sync/pair/add", nil, req, pair)
+}
+
+// RemoveSyncPair removes sync pair
+func (c *Client) RemoveSyncPair(ctx context.Context, req *SyncPairIDReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/sync/pair/remove", nil, req, nil)
+}
+
+// SyncStatus returns status of sync pairs
+func (c *Client) SyncStatus(ctx context.Context) ([]filesync.Status, error) {
+	status := []filesync.Status{}
+	return status, c.call(ctx, http.MethodGet, "/api/v1/sync/status", nil, nil, &status)
+}
+
+// RunSync starts syncing pair now, all pairs if ID is empty
+func (c *Client) RunSync(ctx context.Context, req *SyncPairIDReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/sync/run", nil, req, nil)
+}
+
+// AddBackup watches local folder to back up
+func (c *Client) AddBackup(ctx context.Context, req *BackupReq) (*backup.Watch, error) {
+	watch := &backup.Watch{}
+	return watch, c.call(ctx, http.MethodPost, "/api/v1/backup/add", nil, req, watch)
+}
+
+// RemoveBackup removes backup watch
+func (c *Client) RemoveBackup(ctx context.Context, req *BackupIDReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/backup/remove", nil, req, nil)
+}
+
+// BackupStatus returns status of backup watches
+func (c *Client) BackupStatus(ctx context.Context) ([]backup.Status, error) {
+	status := []backup.Status{}
+	return status, c.call(ctx, http.MethodGet, "/api/v1/backup/status", nil, nil, &status)
+}
+
+// BackupQueue returns files waiting for backup
+func (c *Client) BackupQueue(ctx context.Context) ([]backup.Item, error) {
+	queue := []backup.Item{}
+	return queue, c.call(ctx, http.MethodGet, "/api/v1/backup/queue", nil, nil, &queue)
+}
+
+// Transfers returns transfer jobs
+func (c *Client) Transfers(ctx context.Context) ([]transfer.Job, error) {
+	jobs := []transfer.Job{}
+	return jobs, c.call(ctx, http.MethodGet, "/api/v1/transfer/list", nil, nil, &jobs)
+}
+
+// PauseTransfer pauses transfer job
+func (c *Client) PauseTransfer(ctx context.Context, req *TransferIDReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/transfer/pause", nil, req, nil)
+}
+
+// ResumeTransfer resumes paused transfer job
+func (c *Client) ResumeTransfer(ctx context.Context, req *TransferIDReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/transfer/resume", nil, req, nil)
+}
+
+// CancelTransfer cancels transfer job
+func (c *Client) CancelTransfer(ctx context.Context, req *TransferIDReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/transfer/cancel", nil, req, nil)
+}
+
+// RetryTransfer retries failed transfer job
+func (c *Client) RetryTransfer(ctx context.Context, req *TransferIDReq) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/transfer/retry", nil, req, nil)
+}
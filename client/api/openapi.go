@@ -0,0 +1,278 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/samoslab/nebula/client/common"
+)
+
+const (
+	// OpenAPIVersion version of OpenAPI spec of document
+	OpenAPIVersion = "3.0.3"
+	// Version version of API
+	Version = "v1"
+)
+
+type schema map[string]interface{}
+
+var (
+	binaryType    = reflect.TypeOf(Binary{})
+	rawType       = reflect.TypeOf(json.RawMessage{})
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// generator makes schemas of Go types, named structs are components referred by name
+type generator struct {
+	components map[string]schema
+}
+
+// componentName returns name of named struct with its package, such as daemon.FilePages
+func componentName(t reflect.Type) string {
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+// field json name of struct field, false if it is not marshaled
+func field(f reflect.StructField) (string, []string, bool) {
+	if f.PkgPath != "" && !f.Anonymous {
+		return "", nil, false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", nil, false
+	}
+	parts := strings.Split(tag, ",")
+	name := parts[0]
+	if name == "" {
+		name = f.Name
+	}
+	return name, parts[1:], true
+}
+
+// fields visits marshaled fields of struct t, fields of embedded structs without tag are visited as fields of t
+func fields(t reflect.Type, visit func(name string, options []string, f reflect.StructField)) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, options, ok := field(f)
+		if !ok {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && f.Tag.Get("json") == "" && ft.Kind() == reflect.Struct {
+			fields(ft, visit)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		visit(name, options, f)
+	}
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// schema returns schema of values of t
+func (g *generator) schema(t reflect.Type) schema {
+	if t == nil {
+		return schema{}
+	}
+	switch t {
+	case binaryType:
+		return schema{"type": "string", "format": "binary"}
+	case rawType:
+		return schema{}
+	case timeType:
+		return schema{"type": "string", "format": "date-time"}
+	}
+	if t.Kind() != reflect.Ptr && (t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType)) {
+		// marshalers of API write names
+		return schema{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return schema{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return schema{"type": "integer", "format": "int32"}
+	case reflect.Uint, reflect.Uint64:
+		return schema{"type": "integer", "format": "int64", "minimum": 0}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return schema{"type": "integer", "format": "int32", "minimum": 0}
+	case reflect.Float32:
+		return schema{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return schema{"type": "number", "format": "double"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name := componentName(t)
+		if _, ok := g.components[name]; !ok {
+			// placeholder stops recursion of types referring to themselves
+			g.components[name] = schema{}
+			g.components[name] = g.object(t)
+		}
+		return schema{"$ref": "#/components/schemas/" + name}
+	}
+	return schema{}
+}
+
+func (g *generator) object(t reflect.Type) schema {
+	properties := schema{}
+	fields(t, func(name string, options []string, f reflect.StructField) {
+		s := g.schema(f.Type)
+		if hasOption(options, "string") {
+			s = schema{"type": "string"}
+		}
+		properties[name] = s
+	})
+	return schema{"type": "object", "properties": properties}
+}
+
+// data returns schema of value v of endpoint, one of schemas of oneOf values
+func (g *generator) data(v interface{}) schema {
+	if values, ok := v.(oneOf); ok {
+		schemas := []schema{}
+		for _, x := range values {
+			schemas = append(schemas, g.data(x))
+		}
+		return schema{"oneOf": schemas}
+	}
+	if v == nil {
+		return schema{}
+	}
+	return g.schema(reflect.TypeOf(v))
+}
+
+// unified returns schema of unified response with data of schema
+func (g *generator) unified(data schema) schema {
+	s := g.object(reflect.TypeOf(common.UnifiedResponse{}))
+	s["properties"].(schema)["Data"] = data
+	return s
+}
+
+// parameters returns query parameters of fields of query
+func (g *generator) parameters(query interface{}) []schema {
+	params := []schema{}
+	if query == nil {
+		return params
+	}
+	fields(reflect.TypeOf(query), func(name string, options []string, f reflect.StructField) {
+		params = append(params, schema{"name": name, "in": "query", "schema": g.schema(f.Type)})
+	})
+	return params
+}
+
+func mediaType(t string) string {
+	if t == "" {
+		return JSON
+	}
+	return t
+}
+
+// operationID returns id of operation of endpoint, such as postStoreUploadStream
+func operationID(method, p string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(strings.TrimPrefix(p, "/api/v1/"), func(r rune) bool {
+		return r == '/' || r == '.' || r == '_'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func (g *generator) operation(e Endpoint, method string) schema {
+	op := schema{
+		"operationId": operationID(method, e.Path),
+		"summary":     e.Summary,
+		"tags":        []string{strings.Split(strings.TrimPrefix(e.Path, "/api/v1/"), "/")[0]},
+	}
+	if e.Public {
+		op["security"] = []schema{}
+	} else {
+		op["x-scope"] = e.Scope.String()
+	}
+	if params := g.parameters(e.Query); len(params) != 0 {
+		op["parameters"] = params
+	}
+	if e.Request != nil {
+		op["requestBody"] = schema{
+			"required": true,
+			"content":  schema{mediaType(e.RequestType): schema{"schema": g.data(e.Request)}},
+		}
+	}
+	content := g.data(e.Response)
+	if !e.Raw {
+		content = g.unified(content)
+	}
+	ok := schema{"description": e.Summary}
+	if method != http.MethodHead {
+		ok["content"] = schema{mediaType(e.ResponseType): schema{"schema": content}}
+	}
+	op["responses"] = schema{
+		"200":     ok,
+		"default": schema{"$ref": "#/components/responses/Error"},
+	}
+	return op
+}
+
+// OpenAPI returns OpenAPI document of Endpoints
+func OpenAPI() map[string]interface{} {
+	g := &generator{components: map[string]schema{}}
+	paths := schema{}
+	for _, e := range Endpoints {
+		item := schema{}
+		for _, method := range e.Methods {
+			item[strings.ToLower(method)] = g.operation(e, method)
+		}
+		paths[e.Path] = item
+	}
+	errorContent := schema{JSON: schema{"schema": g.unified(schema{"type": "string"})}}
+	return map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info": schema{
+			"title":       "Nebula client API",
+			"description": "API of client daemon. Data of response is in Data of unified response, code is not 0 if call failed and errmsg tells why.",
+			"version":     Version,
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": g.components,
+			"responses": schema{
+				"Error": schema{"description": "Call refused or failed", "content": errorContent},
+			},
+			"securitySchemes": schema{
+				"token":   schema{"type": "http", "scheme": "bearer", "description": "API token of config or token of daemon run"},
+				"session": schema{"type": "apiKey", "in": "cookie", "name": "nebula_session", "description": "Session of web UI, requests changing state send X-CSRF-Token"},
+			},
+		},
+		"security": []schema{{"token": []string{}}, {"session": []string{}}},
+	}
+}
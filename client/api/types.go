@@ -0,0 +1,208 @@
+package api
+
+// RegisterReq request struct for register
+type RegisterReq struct {
+	Email  string `json:"email"`
+	Resend bool   `json:"resend"`
+}
+
+// VerifyEmailReq request struct for verify email
+type VerifyEmailReq struct {
+	Code string `json:"code"`
+}
+
+// MkfolderReq request struct for make folder
+type MkfolderReq struct {
+	Folders     []string `json:"folders"`
+	Parent      string   `json:"parent"`
+	Interactive bool     `json:"interactive"`
+	Sno         uint32   `json:"space_no"`
+}
+
+// UploadReq request struct for upload file
+type UploadReq struct {
+	Filename    string `json:"filename"`
+	Dest        string `json:"dest_dir"`
+	Interactive bool   `json:"interactive"`
+	NewVersion  bool   `json:"newversion"`
+	Sno         uint32 `json:"space_no"`
+	IsEncrypt   bool   `json:"is_encrypt"`
+	Async       bool   `json:"async"` // return transfer job at once
+}
+
+// UploadDirReq request struct for upload directory
+type UploadDirReq struct {
+	Parent      string `json:"parent"`
+	Dest        string `json:"dest_dir"`
+	Interactive bool   `json:"interactive"`
+	NewVersion  bool   `json:"newversion"`
+	Sno         uint32 `json:"space_no"`
+	IsEncrypt   bool   `json:"is_encrypt"`
+	Async       bool   `json:"async"` // return transfer job at once
+}
+
+// DownloadDirReq request struct for download directory
+type DownloadDirReq struct {
+	Parent string `json:"parent"`
+	Dest   string `json:"dest_dir"`
+	Sno    uint32 `json:"space_no"`
+	Async  bool   `json:"async"` // return transfer job at once
+}
+
+// RenameReq request struct for move file, src is source file id which get by list
+type RenameReq struct {
+	Source string `json:"src"`
+	Dest   string `json:"dest"`
+	Sno    uint32 `json:"space_no"`
+}
+
+// DownloadReq request struct for download file
+type DownloadReq struct {
+	FileHash string `json:"filehash"`
+	FileSize uint64 `json:"filesize"`
+	FileName string `json:"filename"`
+	Dest     string `json:"dest_dir"`
+	Sno      uint32 `json:"space_no"`
+	Async    bool   `json:"async"` // return transfer job at once
+}
+
+// ListReq request struct for list files
+type ListReq struct {
+	Path     string `json:"path"`
+	PageSize uint32 `json:"pagesize"`
+	PageNum  uint32 `json:"pagenum"`
+	SortType string `json:"sorttype"`
+	AscOrder bool   `json:"ascorder"`
+	Sno      uint32 `json:"space_no"`
+}
+
+// RemoveReq request struct for remove file
+type RemoveReq struct {
+	Target    string `json:"target"`
+	Recursion bool   `json:"recursion"`
+	IsPath    bool   `json:"ispath"`
+	Sno       uint32 `json:"space_no"`
+}
+
+// ProgressReq request struct for progress bar
+type ProgressReq struct {
+	Files []string `json:"files"`
+}
+
+// ProgressRsp response for progress bar
+type ProgressRsp struct {
+	Progress map[string]float64 `json:"progress"`
+}
+
+// EncryFileReq encrypt file request
+type EncryFileReq struct {
+	FileName   string `json:"file"`
+	Password   string `json:"password"`
+	OutputFile string `json:"output_file"`
+}
+
+// DecryFileReq decrypt file request
+type DecryFileReq struct {
+	FileName   string `json:"file"`
+	Password   string `json:"password"`
+	OutputFile string `json:"output_file"`
+}
+
+// ServiceStatus service status request
+type ServiceStatus struct {
+	Status bool `json:"status"`
+}
+
+// RootPath root path
+type RootPath struct {
+	Root string `json:"root"`
+}
+
+// PasswordReq set password for privacy space
+type PasswordReq struct {
+	Password string `json:"password"`
+	SpacoNo  uint32 `json:"space_no"`
+}
+
+// ChangePasswordReq change password of privacy space
+type ChangePasswordReq struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+	SpacoNo     uint32 `json:"space_no"`
+}
+
+// SpaceStatusReq space status
+type SpaceStatusReq struct {
+	SpacoNo uint32 `json:"space_no"`
+}
+
+// SyncPairReq add a pair of local folder and folder of space kept in step
+type SyncPairReq struct {
+	Local     string `json:"local"`
+	Remote    string `json:"remote"`
+	Sno       uint32 `json:"space_no"`
+	IsEncrypt bool   `json:"is_encrypt"`
+}
+
+// SyncPairIDReq sync pair id
+type SyncPairIDReq struct {
+	ID string `json:"id"`
+}
+
+// BackupReq watch a local folder and back up files changed in it
+type BackupReq struct {
+	Local         string   `json:"local"`
+	Remote        string   `json:"remote"`
+	Sno           uint32   `json:"space_no"`
+	IsEncrypt     bool     `json:"is_encrypt"`
+	Include       []string `json:"include"`
+	Exclude       []string `json:"exclude"`
+	StableSeconds int      `json:"stable_seconds"`
+}
+
+// BackupIDReq backup watch id
+type BackupIDReq struct {
+	ID string `json:"id"`
+}
+
+// TransferIDReq transfer job id
+type TransferIDReq struct {
+	ID string `json:"id"`
+}
+
+// ConfigImportReq import config
+type ConfigImportReq struct {
+	FileName string `json:"filename"`
+}
+
+// ConfigExportReq export config
+type ConfigExportReq struct {
+	Filename string `json:"filename"`
+}
+
+// BuyPackageReq request struct for buy package
+type BuyPackageReq struct {
+	ID       string `json:"id"`
+	Canceled bool   `json:"canceled"`
+	Quanlity uint32 `json:"quanlity"`
+}
+
+// OnlyOrderReq request struct for pay or remove order
+type OnlyOrderReq struct {
+	ID string `json:"order_id"`
+}
+
+// BodyUploadReq arguments of upload of request body, from query of stream upload or fields of form upload
+type BodyUploadReq struct {
+	Dest       string `json:"dest_dir"`
+	Sno        uint32 `json:"space_no"`
+	NewVersion bool   `json:"newversion"`
+	IsEncrypt  bool   `json:"is_encrypt"`
+}
+
+// BodyUploadRsp state of upload of request body, File is set when file is uploaded
+type BodyUploadRsp struct {
+	File     string `json:"file,omitempty"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`
+}
@@ -0,0 +1,467 @@
+// Package auth authenticates calls of client HTTP API. Calls carry a token of a scope in Authorization header,
+// or the cookie of a session logged in by web UI with CSRF token in header for requests which change state,
+// unless the browser sends them from the same origin.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Scope what a token may do, a scope includes lower ones
+type Scope int
+
+// scopes of API
+const (
+	ScopeNone Scope = iota
+	ScopeRead
+	ScopeWrite
+	ScopeAdmin
+)
+
+const (
+	// TokenFile file in config dir with token of current daemon run
+	TokenFile = "api_token"
+	// SessionCookie cookie of web UI session
+	SessionCookie = "nebula_session"
+	// CSRFHeader header with CSRF token of session
+	CSRFHeader = "X-CSRF-Token"
+	// LaunchPath logs in web UI opened by launcher with a one-time code
+	LaunchPath = "/launch"
+
+	tokenMinLen = 16
+)
+
+var (
+	// SessionExpire session not used for SessionExpire is logged out
+	SessionExpire = 24 * time.Hour
+	// LaunchExpire one-time code of launch URL not used for LaunchExpire is invalid
+	LaunchExpire = time.Minute
+
+	errInvalidToken = errors.New("invalid token")
+)
+
+var scopeNames = map[Scope]string{ScopeRead: "read", ScopeWrite: "write", ScopeAdmin: "admin"}
+
+func (s Scope) String() string {
+	if name, ok := scopeNames[s]; ok {
+		return name
+	}
+	return "none"
+}
+
+// MarshalJSON writes scope name
+func (s Scope) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON reads scope name
+func (s *Scope) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	if name == ScopeNone.String() {
+		*s = ScopeNone
+		return nil
+	}
+	scope, err := ParseScope(name)
+	if err != nil {
+		return err
+	}
+	*s = scope
+	return nil
+}
+
+// ParseScope returns scope of name
+func ParseScope(name string) (Scope, error) {
+	for s, n := range scopeNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return ScopeNone, fmt.Errorf("unknown scope %q", name)
+}
+
+type grant struct {
+	name  string
+	scope Scope
+}
+
+type session struct {
+	grant
+	csrf   string
+	expire time.Time
+}
+
+// Authenticator checks Host header, tokens and sessions of requests
+type Authenticator struct {
+	log      logrus.FieldLogger
+	disabled bool
+	token    string
+	tokens   map[[sha256.Size]byte]grant
+	hosts    map[string]bool
+	secure   bool
+
+	mutex    sync.Mutex
+	sessions map[string]*session
+	launches map[string]time.Time
+}
+
+// randomHex returns n random bytes in hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return strings.ToLower(host)
+	}
+	return strings.ToLower(strings.Trim(hostport, "[]"))
+}
+
+// New returns authenticator of tokens of cfg, an admin token is made for this run and written into TokenFile of
+// config dir for local tools. Invalid tokens of cfg are skipped, error is returned if token of this run is unusable.
+func New(log logrus.FieldLogger, cfg config.Config) (*Authenticator, error) {
+	a := &Authenticator{
+		log:      log,
+		disabled: cfg.APIAuthDisabled,
+		tokens:   map[[sha256.Size]byte]grant{},
+		hosts:    map[string]bool{"localhost": true},
+		secure:   cfg.HTTPAddr == "" && cfg.HTTPSAddr != "",
+		sessions: map[string]*session{},
+		launches: map[string]time.Time{},
+	}
+	for _, host := range append([]string{cfg.HTTPAddr, cfg.HTTPSAddr, cfg.AutoTLSHost}, cfg.AllowedHosts...) {
+		if host != "" {
+			a.hosts[hostname(host)] = true
+		}
+	}
+	for _, t := range cfg.APITokens {
+		scope, err := ParseScope(t.Scope)
+		if err != nil || len(t.Token) < tokenMinLen {
+			log.Errorf("API token %s skipped, token must have %d characters and scope must be read, write or admin", t.Name, tokenMinLen)
+			continue
+		}
+		a.tokens[sha256.Sum256([]byte(t.Token))] = grant{name: t.Name, scope: scope}
+	}
+	if a.disabled {
+		log.Warn("API authentication disabled")
+		return a, nil
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return a, err
+	}
+	a.token = token
+	a.tokens[sha256.Sum256([]byte(token))] = grant{name: "startup", scope: ScopeAdmin}
+	fileName := TokenFileName(cfg.ConfigDir)
+	if err := ioutil.WriteFile(fileName, []byte(token+"\n"), 0600); err != nil {
+		return a, fmt.Errorf("write %s error %v", fileName, err)
+	}
+	return a, nil
+}
+
+// Token returns admin token of this run, it is empty if authentication is disabled
+func (a *Authenticator) Token() string {
+	return a.token
+}
+
+// TokenFileName returns file of token of daemon using configDir, the file is readable only by its owner
+func TokenFileName(configDir string) string {
+	return filepath.Join(configDir, TokenFile)
+}
+
+// ReadTokenFile returns token written by the daemon using configDir
+func ReadTokenFile(configDir string) (string, error) {
+	data, err := ioutil.ReadFile(TokenFileName(configDir))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// reject writes unified response of error with status
+func reject(w http.ResponseWriter, status int, errmsg string) {
+	rsp, err := common.MakeUnifiedHTTPResponse(status, "", errmsg)
+	if err != nil {
+		http.Error(w, errmsg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// CheckHost refuses requests of Host not allowed, so pages of other domains resolved to this host by
+// DNS rebinding get nothing. Localhost, ip addresses and hosts of config are allowed.
+func (a *Authenticator) CheckHost(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := hostname(r.Host)
+		if !a.hosts[host] && net.ParseIP(host) == nil {
+			a.log.Warnf("Refuse request of host %s from %s", r.Host, r.RemoteAddr)
+			reject(w, http.StatusForbidden, "host not allowed")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func bearer(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:]), true
+	}
+	return "", false
+}
+
+// sameOrigin reports whether browser sent r from page of the daemon itself, pages of other sites
+// can not set Origin header, so same origin request needs no CSRF token
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// session returns session of cookie of r, expired session is removed
+func (a *Authenticator) session(r *http.Request) *session {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	for id, s := range a.sessions {
+		if now.After(s.expire) {
+			delete(a.sessions, id)
+		}
+	}
+	s, ok := a.sessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	s.expire = now.Add(SessionExpire)
+	return s
+}
+
+// authorize returns grant of request, CSRF token is checked for session request changing state
+func (a *Authenticator) authorize(r *http.Request) (grant, int, error) {
+	if token, ok := bearer(r); ok {
+		g, ok := a.tokens[sha256.Sum256([]byte(token))]
+		if !ok {
+			return grant{}, http.StatusUnauthorized, errInvalidToken
+		}
+		return g, http.StatusOK, nil
+	}
+	s := a.session(r)
+	if s == nil {
+		return grant{}, http.StatusUnauthorized, errors.New("token or login required")
+	}
+	if !safeMethod(r.Method) && !sameOrigin(r) && subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRFHeader)), []byte(s.csrf)) != 1 {
+		return grant{}, http.StatusForbidden, errors.New("invalid csrf token")
+	}
+	return s.grant, http.StatusOK, nil
+}
+
+// Require allows requests having at least scope to h
+func (a *Authenticator) Require(scope Scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.disabled {
+			h.ServeHTTP(w, r)
+			return
+		}
+		g, status, err := a.authorize(r)
+		if err != nil {
+			reject(w, status, err.Error())
+			return
+		}
+		if g.scope < scope {
+			a.log.Warnf("Refuse %s of token %s, scope %s required", r.URL.Path, g.name, scope)
+			reject(w, http.StatusForbidden, fmt.Sprintf("scope %s required", scope))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// LoginReq request of session login
+type LoginReq struct {
+	Token string `json:"token"`
+}
+
+// SessionRsp session of web UI, CSRFToken must be sent in header X-CSRF-Token by requests changing state
+type SessionRsp struct {
+	CSRFToken string `json:"csrf_token"`
+	Scope     Scope  `json:"scope"`
+}
+
+func respond(w http.ResponseWriter, data interface{}) {
+	rsp, err := common.MakeUnifiedHTTPResponse(0, data, "")
+	if err != nil {
+		reject(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// LoginHandler logs in a session of token, the session cookie is set and CSRF token returned
+func (a *Authenticator) LoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			reject(w, http.StatusMethodNotAllowed, "Invalid request method")
+			return
+		}
+		req := &LoginReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			reject(w, http.StatusBadRequest, fmt.Sprintf("Invalid json request body: %v", err))
+			return
+		}
+		g, ok := a.tokens[sha256.Sum256([]byte(req.Token))]
+		if !ok {
+			a.log.Warnf("Login with invalid token from %s", r.RemoteAddr)
+			reject(w, http.StatusUnauthorized, errInvalidToken.Error())
+			return
+		}
+		csrf, err := a.login(w, r, g)
+		if err != nil {
+			reject(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respond(w, SessionRsp{CSRFToken: csrf, Scope: g.scope})
+	}
+}
+
+// login creates session of g and sets its cookie, CSRF token of session is returned
+func (a *Authenticator) login(w http.ResponseWriter, r *http.Request, g grant) (string, error) {
+	id, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	csrf, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	a.mutex.Lock()
+	a.sessions[id] = &session{grant: g, csrf: csrf, expire: time.Now().Add(SessionExpire)}
+	a.mutex.Unlock()
+	cookie := &http.Cookie{
+		Name:     SessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   a.secure || r.TLS != nil,
+	}
+	// SameSite field of cookie needs Go 1.11, the attribute is appended for builds of former versions
+	w.Header().Add("Set-Cookie", cookie.String()+"; SameSite=Strict")
+	a.log.Infof("Session of token %s logged in from %s", g.name, r.RemoteAddr)
+	return csrf, nil
+}
+
+// LaunchURL returns URL of web UI at base, it logs in a session with admin scope once within LaunchExpire,
+// so the launched browser needs no token
+func (a *Authenticator) LaunchURL(base string) (string, error) {
+	if a.disabled {
+		return base + "/", nil
+	}
+	code, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	a.mutex.Lock()
+	a.launches[code] = time.Now().Add(LaunchExpire)
+	a.mutex.Unlock()
+	return base + LaunchPath + "?code=" + code, nil
+}
+
+// LaunchHandler logs in session of one-time code of launch URL and redirects to web UI
+func (a *Authenticator) LaunchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := r.URL.Query().Get("code")
+		a.mutex.Lock()
+		expire, ok := a.launches[code]
+		delete(a.launches, code)
+		a.mutex.Unlock()
+		if !ok || time.Now().After(expire) {
+			a.log.Warnf("Launch with invalid code from %s", r.RemoteAddr)
+			reject(w, http.StatusUnauthorized, "invalid or expired code")
+			return
+		}
+		if _, err := a.login(w, r, grant{name: "launch", scope: ScopeAdmin}); err != nil {
+			reject(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// SessionHandler returns session of cookie, so a reloaded web UI gets its CSRF token again
+func (a *Authenticator) SessionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := a.session(r)
+		if s == nil {
+			reject(w, http.StatusUnauthorized, "not logged in")
+			return
+		}
+		respond(w, SessionRsp{CSRFToken: s.csrf, Scope: s.scope})
+	}
+}
+
+// LogoutHandler ends session of cookie
+func (a *Authenticator) LogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			reject(w, http.StatusMethodNotAllowed, "Invalid request method")
+			return
+		}
+		s := a.session(r)
+		if s == nil {
+			reject(w, http.StatusUnauthorized, "not logged in")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRFHeader)), []byte(s.csrf)) != 1 {
+			reject(w, http.StatusForbidden, "invalid csrf token")
+			return
+		}
+		cookie, _ := r.Cookie(SessionCookie)
+		a.mutex.Lock()
+		delete(a.sessions, cookie.Value)
+		a.mutex.Unlock()
+		http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		respond(w, "ok")
+	}
+}
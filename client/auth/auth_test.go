@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+const readToken = "read-token-0123456789"
+
+func newTestAuthenticator(t *testing.T) (*Authenticator, string) {
+	dir, err := ioutil.TempDir("", "auth")
+	require.NoError(t, err)
+	cfg := config.Config{
+		ConfigDir:    dir,
+		HTTPAddr:     "127.0.0.1:7788",
+		AllowedHosts: []string{"nas.example.com"},
+		APITokens: []config.APIToken{
+			{Name: "viewer", Token: readToken, Scope: "read"},
+			{Name: "short", Token: "short", Scope: "admin"},
+		},
+	}
+	a, err := New(logrus.New(), cfg)
+	require.NoError(t, err)
+	return a, dir
+}
+
+func serve(h http.Handler, method, target, token string, cookie *http.Cookie, csrf string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader("{}"))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	if csrf != "" {
+		r.Header.Set(CSRFHeader, csrf)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestRequire(t *testing.T) {
+	a, dir := newTestAuthenticator(t)
+	defer os.RemoveAll(dir)
+	token, err := ReadTokenFile(dir)
+	require.NoError(t, err)
+	require.Equal(t, a.Token(), token)
+
+	read := a.Require(ScopeRead, ok)
+	admin := a.Require(ScopeAdmin, ok)
+	require.Equal(t, http.StatusUnauthorized, serve(read, "GET", "/api/v1/store/list", "", nil, "").Code)
+	require.Equal(t, http.StatusUnauthorized, serve(read, "GET", "/api/v1/store/list", "wrong", nil, "").Code)
+	require.Equal(t, http.StatusUnauthorized, serve(read, "GET", "/api/v1/store/list", "short", nil, "").Code)
+	require.Equal(t, http.StatusOK, serve(read, "GET", "/api/v1/store/list", readToken, nil, "").Code)
+	w := serve(admin, "POST", "/api/v1/config/export", readToken, nil, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	rsp, err := common.DecodeResponse(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, rsp.Code)
+	require.Equal(t, "scope admin required", rsp.Errmsg)
+	require.Equal(t, http.StatusOK, serve(admin, "POST", "/api/v1/config/export", token, nil, "").Code)
+
+	a.disabled = true
+	require.Equal(t, http.StatusOK, serve(admin, "POST", "/api/v1/config/export", "", nil, "").Code)
+}
+
+func TestSession(t *testing.T) {
+	a, dir := newTestAuthenticator(t)
+	defer os.RemoveAll(dir)
+	require.Equal(t, http.StatusUnauthorized, serve(a.LoginHandler(), "POST", "/api/v1/auth/login", "", nil, "").Code)
+
+	r := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"token":"`+a.Token()+`"}`))
+	w := httptest.NewRecorder()
+	a.LoginHandler().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	cookie := cookies[0]
+	require.True(t, cookie.HttpOnly)
+	require.Contains(t, w.Header().Get("Set-Cookie"), "; SameSite=Strict")
+	rsp, err := common.DecodeResponse(w.Body.Bytes())
+	require.NoError(t, err)
+	session := struct {
+		CSRFToken string `json:"csrf_token"`
+		Scope     string `json:"scope"`
+	}{}
+	require.NoError(t, json.Unmarshal(rsp.Data, &session))
+	require.Equal(t, "admin", session.Scope)
+
+	write := a.Require(ScopeWrite, ok)
+	require.Equal(t, http.StatusOK, serve(write, "GET", "/api/v1/store/progress/events", "", cookie, "").Code)
+	require.Equal(t, http.StatusForbidden, serve(write, "POST", "/api/v1/store/remove", "", cookie, "").Code)
+	require.Equal(t, http.StatusForbidden, serve(write, "POST", "/api/v1/store/remove", "", cookie, "wrong").Code)
+	require.Equal(t, http.StatusOK, serve(write, "POST", "/api/v1/store/remove", "", cookie, session.CSRFToken).Code)
+	require.Equal(t, http.StatusOK, serve(a.SessionHandler(), "GET", "/api/v1/auth/session", "", cookie, "").Code)
+
+	require.Equal(t, http.StatusForbidden, serve(a.LogoutHandler(), "POST", "/api/v1/auth/logout", "", cookie, "").Code)
+	require.Equal(t, http.StatusOK, serve(a.LogoutHandler(), "POST", "/api/v1/auth/logout", "", cookie, session.CSRFToken).Code)
+	require.Equal(t, http.StatusUnauthorized, serve(write, "GET", "/api/v1/store/list", "", cookie, "").Code)
+}
+
+func TestCheckHost(t *testing.T) {
+	a, dir := newTestAuthenticator(t)
+	defer os.RemoveAll(dir)
+	h := a.CheckHost(ok)
+	for host, code := range map[string]int{
+		"127.0.0.1:7788":       http.StatusOK,
+		"localhost:7788":       http.StatusOK,
+		"[::1]:7788":           http.StatusOK,
+		"192.168.1.5":          http.StatusOK,
+		"NAS.example.com:7788": http.StatusOK,
+		"evil.example.com":     http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("GET", "/index.html", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, code, w.Code, host)
+	}
+}
+
+func TestLaunch(t *testing.T) {
+	a, dir := newTestAuthenticator(t)
+	defer os.RemoveAll(dir)
+	launch, err := a.LaunchURL("http://127.0.0.1:7788")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(launch, "http://127.0.0.1:7788"+LaunchPath+"?code="))
+
+	w := serve(a.LaunchHandler(), "GET", launch, "", nil, "")
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	// code is used once
+	require.Equal(t, http.StatusUnauthorized, serve(a.LaunchHandler(), "GET", launch, "", nil, "").Code)
+
+	// session of web UI changes state from its own origin without CSRF token
+	write := a.Require(ScopeWrite, ok)
+	for origin, code := range map[string]int{
+		"http://127.0.0.1:7788":   http.StatusOK,
+		"http://evil.example.com": http.StatusForbidden,
+		"null":                    http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("POST", "http://127.0.0.1:7788/api/v1/store/remove", strings.NewReader("{}"))
+		r.Header.Set("Origin", origin)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		write.ServeHTTP(w, r)
+		require.Equal(t, code, w.Code, origin)
+	}
+}
@@ -0,0 +1,543 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DirName directory of backup state under config dir
+	DirName   = "backup"
+	stateFile = "backup.json"
+)
+
+var (
+	// StableTime a changed file is uploaded after it has not changed for StableTime
+	StableTime = 30 * time.Second
+	// RetryInterval failed upload is retried after RetryInterval multiplied by its failed times
+	RetryInterval = time.Minute
+	// checkInterval queue is checked for stable files every checkInterval
+	checkInterval = time.Second
+)
+
+// Uploader uploads files of watched folders, *daemon.ClientManager implements it
+type Uploader interface {
+	UploadFile(fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error
+	MkFolder(filepath string, folders []string, interactive bool, sno uint32) (bool, error)
+}
+
+// Item a file waiting for upload
+type Item struct {
+	FileName  string `json:"file_name"`
+	WatchID   string `json:"watch_id"`
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"modtime"`
+	Changed   int64  `json:"changed"`
+	Failed    int    `json:"failed"`
+	LastError string `json:"last_error"`
+	NextTry   int64  `json:"next_try"`
+}
+
+// stamp of a file uploaded, the file is uploaded again if it differs
+type stamp struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"modtime"`
+}
+
+// state is saved so queued files are uploaded and files changed while daemon stopped are found after restart
+type state struct {
+	Watches  []*Watch         `json:"watches"`
+	Queue    map[string]*Item `json:"queue"`
+	Uploaded map[string]stamp `json:"uploaded"`
+}
+
+// Status backup status of a watched folder
+type Status struct {
+	Watch
+	Queued    int    `json:"queued"`
+	Uploaded  int    `json:"uploaded"`
+	LastError string `json:"last_error"`
+}
+
+// Manager watches backup folders and uploads files once they are stable
+type Manager struct {
+	uploader Uploader
+	log      logrus.FieldLogger
+	dir      string
+	watcher  *fsnotify.Watcher
+
+	mutex   sync.Mutex
+	state   *state
+	dirty   bool
+	watched map[string]string // watched local folder to watch id
+	folders map[string]bool   // remote folders made
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewManager loads watches saved in dir and finds files changed since they were uploaded
+func NewManager(log logrus.FieldLogger, uploader Uploader, dir string) (*Manager, error) {
+	st := &state{Queue: map[string]*Item{}, Uploaded: map[string]stamp{}}
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, st); err != nil {
+			return nil, err
+		}
+		if st.Queue == nil {
+			st.Queue = map[string]*Item{}
+		}
+		if st.Uploaded == nil {
+			st.Uploaded = map[string]stamp{}
+		}
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		uploader: uploader,
+		log:      log.WithField("module", "backup"),
+		dir:      dir,
+		watcher:  watcher,
+		state:    st,
+		watched:  map[string]string{},
+		folders:  map[string]bool{},
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, w := range st.Watches {
+		if err := m.watchTree(w, w.Local); err != nil {
+			// folder may be back later, watch is kept
+			m.log.Errorf("Watch %s error %v", w.Local, err)
+		}
+	}
+	return m, nil
+}
+
+// save must be called with mutex held
+func (m *Manager) save() error {
+	data, err := json.Marshal(m.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	fileName := filepath.Join(m.dir, stateFile)
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0600); err != nil {
+		return err
+	}
+	m.dirty = false
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+func (m *Manager) findWatch(id string) *Watch {
+	for _, w := range m.state.Watches {
+		if w.ID == id {
+			return w
+		}
+	}
+	return nil
+}
+
+// watchOf returns watch of fileName, must be called with mutex held
+func (m *Manager) watchOf(fileName string) (*Watch, string) {
+	for _, w := range m.state.Watches {
+		if rel, ok := w.rel(fileName); ok {
+			return w, rel
+		}
+	}
+	return nil, ""
+}
+
+// nested tells whether a is b or under it
+func nested(a, b, sep string) bool {
+	return a == b || strings.HasPrefix(a, strings.TrimSuffix(b, sep)+sep)
+}
+
+// AddWatch watches local folder, files in it are uploaded to remote folder of space sno
+func (m *Manager) AddWatch(w Watch) (*Watch, error) {
+	if !filepath.IsAbs(w.Local) || !path.IsAbs(w.Remote) {
+		return nil, errors.New("local and remote path must absolute")
+	}
+	if err := validPatterns(append(append([]string{}, w.Include...), w.Exclude...)); err != nil {
+		return nil, err
+	}
+	w.Local, w.Remote = filepath.Clean(w.Local), path.Clean(w.Remote)
+	info, err := os.Stat(w.Local)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", w.Local)
+	}
+	w.ID = watchID(&w)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sep := string(filepath.Separator)
+	for _, other := range m.state.Watches {
+		if nested(w.Local, other.Local, sep) || nested(other.Local, w.Local, sep) {
+			return nil, fmt.Errorf("%s overlaps folder %s of backup %s", w.Local, other.Local, other.ID)
+		}
+	}
+	m.state.Watches = append(m.state.Watches, &w)
+	if err := m.watchTree(&w, w.Local); err != nil {
+		m.unwatch(&w)
+		m.state.Watches = m.state.Watches[:len(m.state.Watches)-1]
+		return nil, err
+	}
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	m.log.Infof("Add backup %s: %s to space %d %s", w.ID, w.Local, w.Sno, w.Remote)
+	return &w, nil
+}
+
+// RemoveWatch stops backup of watch id, files uploaded are kept
+func (m *Manager) RemoveWatch(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, w := range m.state.Watches {
+		if w.ID != id {
+			continue
+		}
+		m.unwatch(w)
+		m.state.Watches = append(m.state.Watches[:i], m.state.Watches[i+1:]...)
+		for fileName, item := range m.state.Queue {
+			if item.WatchID == id {
+				delete(m.state.Queue, fileName)
+			}
+		}
+		for fileName := range m.state.Uploaded {
+			if _, ok := w.rel(fileName); ok {
+				delete(m.state.Uploaded, fileName)
+			}
+		}
+		m.log.Infof("Remove backup %s", id)
+		return m.save()
+	}
+	return fmt.Errorf("backup %s not exists", id)
+}
+
+// Status returns status of all watches
+func (m *Manager) Status() []Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	all := []Status{}
+	for _, w := range m.state.Watches {
+		st := Status{Watch: *w}
+		for _, item := range m.state.Queue {
+			if item.WatchID == w.ID {
+				st.Queued++
+				if item.LastError != "" {
+					st.LastError = item.LastError
+				}
+			}
+		}
+		for fileName := range m.state.Uploaded {
+			if _, ok := w.rel(fileName); ok {
+				st.Uploaded++
+			}
+		}
+		all = append(all, st)
+	}
+	return all
+}
+
+// Queue returns files waiting for upload ordered by change time
+func (m *Manager) Queue() []Item {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	items := []Item{}
+	for _, item := range m.state.Queue {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Changed < items[j].Changed })
+	return items
+}
+
+// watchTree watches folder and its sub folders not excluded, files not uploaded yet or changed since are queued.
+// It must be called with mutex held.
+func (m *Manager) watchTree(w *Watch, folder string) error {
+	return filepath.Walk(folder, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, ok := w.rel(fileName)
+		if info.IsDir() {
+			if ok && w.excluded(rel) {
+				return filepath.SkipDir
+			}
+			if err := m.watcher.Add(fileName); err != nil {
+				return err
+			}
+			m.watched[fileName] = w.ID
+			return nil
+		}
+		if ok && info.Mode().IsRegular() && w.included(rel) {
+			if uploaded, ok := m.state.Uploaded[fileName]; !ok || uploaded != stampOf(info) {
+				m.enqueue(w, fileName, info)
+			}
+		}
+		return nil
+	})
+}
+
+// unwatch must be called with mutex held
+func (m *Manager) unwatch(w *Watch) {
+	for folder, id := range m.watched {
+		if id == w.ID {
+			m.watcher.Remove(folder)
+			delete(m.watched, folder)
+		}
+	}
+}
+
+func stampOf(info os.FileInfo) stamp {
+	return stamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+// enqueue must be called with mutex held, a changed file waits for stable time again
+func (m *Manager) enqueue(w *Watch, fileName string, info os.FileInfo) {
+	item, ok := m.state.Queue[fileName]
+	if !ok {
+		item = &Item{FileName: fileName, WatchID: w.ID}
+		m.state.Queue[fileName] = item
+	}
+	st := stampOf(info)
+	item.Size, item.ModTime = st.Size, st.ModTime
+	item.Changed = time.Now().UnixNano()
+	item.NextTry = 0
+	m.dirty = true
+}
+
+func (m *Manager) handleEvent(ev fsnotify.Event) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	w, rel := m.watchOf(ev.Name)
+	if w == nil {
+		return
+	}
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// the new name of a renamed file is created
+		if _, ok := m.state.Queue[ev.Name]; ok {
+			delete(m.state.Queue, ev.Name)
+			m.dirty = true
+		}
+		if _, ok := m.watched[ev.Name]; ok {
+			m.watcher.Remove(ev.Name)
+			delete(m.watched, ev.Name)
+		}
+		return
+	}
+	info, err := os.Lstat(ev.Name)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		if _, ok := m.watched[ev.Name]; !ok && ev.Op&fsnotify.Create != 0 {
+			// files may be created before the folder is watched
+			if err := m.watchTree(w, ev.Name); err != nil {
+				m.log.Errorf("Watch %s error %v", ev.Name, err)
+			}
+		}
+		return
+	}
+	if !info.Mode().IsRegular() || !w.included(rel) {
+		return
+	}
+	_, queued := m.state.Queue[ev.Name]
+	if uploaded, ok := m.state.Uploaded[ev.Name]; ok && !queued && uploaded == stampOf(info) {
+		// such as chmod of a file backed up
+		return
+	}
+	m.enqueue(w, ev.Name, info)
+}
+
+// ready returns items stable for stable time of their watch and due to try
+func (m *Manager) ready() []Item {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now().UnixNano()
+	items := []Item{}
+	for _, item := range m.state.Queue {
+		w := m.findWatch(item.WatchID)
+		if w == nil {
+			delete(m.state.Queue, item.FileName)
+			continue
+		}
+		if now-item.Changed >= int64(w.stableTime()) && now >= item.NextTry {
+			items = append(items, *item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Changed < items[j].Changed })
+	return items
+}
+
+// remoteFolder makes folder of space and its parents under remote folder of w
+func (m *Manager) remoteFolder(w *Watch, folder string) error {
+	key := fmt.Sprintf("%d:%s", w.Sno, folder)
+	m.mutex.Lock()
+	made := m.folders[key]
+	m.mutex.Unlock()
+	if made || folder == "/" {
+		return nil
+	}
+	if folder != w.Remote {
+		if err := m.remoteFolder(w, path.Dir(folder)); err != nil {
+			return err
+		}
+	}
+	if _, err := m.uploader.MkFolder(path.Dir(folder), []string{path.Base(folder)}, false, w.Sno); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.folders[key] = true
+	m.mutex.Unlock()
+	return nil
+}
+
+// prepare returns watch and folder of space to upload item to, nil if it changed or is gone since queued.
+// It must be called with mutex held.
+func (m *Manager) prepare(item Item) (*Watch, string) {
+	w := m.findWatch(item.WatchID)
+	current, ok := m.state.Queue[item.FileName]
+	if w == nil || !ok || current.Changed != item.Changed {
+		return nil, ""
+	}
+	info, err := os.Stat(item.FileName)
+	if err != nil {
+		m.log.Infof("Backup file %s gone %v", item.FileName, err)
+		delete(m.state.Queue, item.FileName)
+		m.dirty = true
+		return nil, ""
+	}
+	if stampOf(info) != (stamp{item.Size, item.ModTime}) {
+		m.enqueue(w, item.FileName, info)
+		return nil, ""
+	}
+	rel, _ := w.rel(item.FileName)
+	return w, w.dest(rel)
+}
+
+// finish records result of upload, it must be called with mutex held
+func (m *Manager) finish(item Item, err error) {
+	m.dirty = true
+	current, ok := m.state.Queue[item.FileName]
+	// changed again during upload, it waits for another upload
+	unchanged := ok && current.Changed == item.Changed
+	if err != nil {
+		// folders may be removed remotely, they are made again by retry
+		m.folders = map[string]bool{}
+		if unchanged {
+			current.Failed++
+			current.LastError = err.Error()
+			current.NextTry = time.Now().Add(RetryInterval * time.Duration(current.Failed)).UnixNano()
+		}
+		return
+	}
+	m.state.Uploaded[item.FileName] = stamp{item.Size, item.ModTime}
+	if unchanged {
+		delete(m.state.Queue, item.FileName)
+	}
+}
+
+func (m *Manager) upload(item Item) {
+	log := m.log.WithField("backup file", item.FileName)
+	m.mutex.Lock()
+	w, dest := m.prepare(item)
+	m.mutex.Unlock()
+	if w == nil {
+		return
+	}
+	log.Infof("Upload to %s", dest)
+	err := m.remoteFolder(w, dest)
+	if err == nil {
+		err = m.uploader.UploadFile(item.FileName, dest, false, true, w.IsEncrypt, w.Sno)
+	}
+	if err != nil {
+		log.Errorf("Upload error %v", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.finish(item, err)
+}
+
+// uploadReady uploads stable files one by one, it stops at quit
+func (m *Manager) uploadReady() {
+	for _, item := range m.ready() {
+		select {
+		case <-m.quit:
+			return
+		default:
+		}
+		m.upload(item)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.dirty {
+		if err := m.save(); err != nil {
+			m.log.Errorf("Save backup state error %v", err)
+		}
+	}
+}
+
+// Run watches folders and uploads stable files until Shutdown
+func (m *Manager) Run() {
+	defer close(m.done)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.quit:
+				return
+			case <-ticker.C:
+				m.uploadReady()
+			}
+		}
+	}()
+	for {
+		select {
+		case <-m.quit:
+			wg.Wait()
+			return
+		case ev := <-m.watcher.Events:
+			m.handleEvent(ev)
+		case err := <-m.watcher.Errors:
+			m.log.Errorf("Watch error %v", err)
+		}
+	}
+}
+
+// Shutdown stops Run after the running upload and saves the queue
+func (m *Manager) Shutdown() {
+	close(m.quit)
+	<-m.done
+	m.watcher.Close()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.save(); err != nil {
+		m.log.Errorf("Save backup state error %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeUploader struct {
+	mutex    sync.Mutex
+	folders  map[string]bool
+	uploaded map[string]string
+	fail     bool
+}
+
+func newFakeUploader() *fakeUploader {
+	return &fakeUploader{folders: map[string]bool{"/": true}, uploaded: map[string]string{}}
+}
+
+func (f *fakeUploader) UploadFile(fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.fail {
+		return errors.New("upload failed")
+	}
+	if !f.folders[dest] {
+		return errors.New(dest + " not exists")
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	f.uploaded[path.Join(dest, filepath.Base(fileName))] = string(data)
+	return nil
+}
+
+func (f *fakeUploader) MkFolder(parent string, folders []string, interactive bool, sno uint32) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.folders[parent] {
+		return false, errors.New(parent + " not exists")
+	}
+	for _, folder := range folders {
+		f.folders[path.Join(parent, folder)] = true
+	}
+	return true, nil
+}
+
+func (f *fakeUploader) get(name string) (string, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	data, ok := f.uploaded[name]
+	return data, ok
+}
+
+func shortTimes() func() {
+	stable, retry, check := StableTime, RetryInterval, checkInterval
+	StableTime, RetryInterval, checkInterval = 200*time.Millisecond, 100*time.Millisecond, 20*time.Millisecond
+	return func() { StableTime, RetryInterval, checkInterval = stable, retry, check }
+}
+
+func startManager(t *testing.T, uploader Uploader, dir string) *Manager {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	m, err := NewManager(log, uploader, dir)
+	require.NoError(t, err)
+	go m.Run()
+	return m
+}
+
+func waitUploaded(t *testing.T, f *fakeUploader, name, content string) {
+	for i := 0; i < 200; i++ {
+		if data, ok := f.get(name); ok && data == content {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	data, _ := f.get(name)
+	t.Fatalf("%s not uploaded, got %q", name, data)
+}
+
+func TestBackup(t *testing.T) {
+	defer shortTimes()()
+	dir, err := ioutil.TempDir("", "backup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "Documents")
+	require.NoError(t, os.Mkdir(local, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "old.txt"), []byte("old"), 0644))
+	f := newFakeUploader()
+	stateDir := filepath.Join(dir, DirName)
+	m := startManager(t, f, stateDir)
+
+	_, err = m.AddWatch(Watch{Local: local, Remote: "/docs", Include: []string{"[", "*.txt"}})
+	require.Error(t, err)
+	w, err := m.AddWatch(Watch{Local: local, Remote: "/docs", Sno: 1, Exclude: []string{"*.tmp", "cache"}})
+	require.NoError(t, err)
+	_, err = m.AddWatch(Watch{Local: filepath.Join(local, "sub"), Remote: "/other"})
+	require.Error(t, err)
+	// files existing when watch is added are backed up
+	waitUploaded(t, f, "/docs/old.txt", "old")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "a", "b"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "a", "b", "new.txt"), []byte("new"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "skip.tmp"), []byte("tmp"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "cache"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "cache", "c.txt"), []byte("c"), 0644))
+	waitUploaded(t, f, "/docs/a/b/new.txt", "new")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "old.txt"), []byte("old v2"), 0644))
+	waitUploaded(t, f, "/docs/old.txt", "old v2")
+	_, ok := f.get("/docs/skip.tmp")
+	require.False(t, ok)
+	_, ok = f.get("/docs/cache/c.txt")
+	require.False(t, ok)
+
+	status := m.Status()
+	require.Len(t, status, 1)
+	require.Equal(t, w.ID, status[0].ID)
+	require.Equal(t, 2, status[0].Uploaded)
+	require.Equal(t, 0, status[0].Queued)
+
+	// failed uploads stay in queue, which survives restart
+	f.mutex.Lock()
+	f.fail = true
+	f.mutex.Unlock()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "queued.txt"), []byte("queued"), 0644))
+	for i := 0; i < 100 && (len(m.Queue()) == 0 || m.Queue()[0].Failed == 0); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	queue := m.Queue()
+	require.Len(t, queue, 1)
+	require.Equal(t, "upload failed", queue[0].LastError)
+	m.Shutdown()
+
+	f.mutex.Lock()
+	f.fail = false
+	f.mutex.Unlock()
+	// changed while stopped
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "a", "b", "new.txt"), []byte("new v2"), 0644))
+	m = startManager(t, f, stateDir)
+	defer m.Shutdown()
+	waitUploaded(t, f, "/docs/queued.txt", "queued")
+	waitUploaded(t, f, "/docs/a/b/new.txt", "new v2")
+
+	require.NoError(t, m.RemoveWatch(w.ID))
+	require.Len(t, m.Status(), 0)
+	require.Error(t, m.RemoveWatch(w.ID))
+}
+
+func TestMatchRules(t *testing.T) {
+	w := &Watch{Local: "/home/u/docs", Include: []string{"*.txt", "photos/*.raw"}, Exclude: []string{"node_modules", "~*", "drafts/*"}}
+	cases := map[string]bool{
+		"a.txt":                   true,
+		"sub/a.txt":               true,
+		"a.doc":                   false,
+		"photos/a.raw":            true,
+		"sub/photos/a.raw":        false,
+		"node_modules/x/a.txt":    false,
+		"~lock.txt":               false,
+		"drafts/a.txt":            false,
+		"sub/drafts/a.txt":        true,
+		"notes.txt/inside.doc":    false,
+		"node_modules.txt":        true,
+		"deep/dir/tree/file.txt":  true,
+		"deep/dir/tree/file.txt~": false,
+	}
+	for rel, included := range cases {
+		require.Equal(t, included, w.included(rel), rel)
+	}
+	rel, ok := w.rel("/home/u/docs/sub/a.txt")
+	require.True(t, ok)
+	require.Equal(t, "sub/a.txt", rel)
+	_, ok = w.rel("/home/u/docs2/a.txt")
+	require.False(t, ok)
+	require.Equal(t, "/bak/sub", (&Watch{Remote: "/bak"}).dest("sub/a.txt"))
+	require.Equal(t, "/bak", (&Watch{Remote: "/bak"}).dest("a.txt"))
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Watch a local folder backed up to a folder of space, files changed in it are uploaded as new version
+type Watch struct {
+	ID        string `json:"id"`
+	Local     string `json:"local"`
+	Remote    string `json:"remote"`
+	Sno       uint32 `json:"space_no"`
+	IsEncrypt bool   `json:"is_encrypt"`
+	// Include patterns of files backed up, all files if empty
+	Include []string `json:"include"`
+	// Exclude patterns of files and folders not backed up
+	Exclude []string `json:"exclude"`
+	// StableSeconds a file is uploaded after it has not changed for, StableTime if 0
+	StableSeconds int `json:"stable_seconds"`
+}
+
+func watchID(w *Watch) string {
+	key := sha1.Sum([]byte(fmt.Sprintf("%s:%d:%s", w.Local, w.Sno, w.Remote)))
+	return hex.EncodeToString(key[:8])
+}
+
+func (w *Watch) stableTime() time.Duration {
+	if w.StableSeconds > 0 {
+		return time.Duration(w.StableSeconds) * time.Second
+	}
+	return StableTime
+}
+
+// validPatterns returns error of the first malformed pattern
+func validPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern %s error %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchAny tells whether rel matches one of patterns. A pattern with slash matches the whole relative path,
+// such as "photos/*.raw", otherwise it matches the base name, or any name of rel if anyName, such as "node_modules".
+func matchAny(patterns []string, rel string, anyName bool) bool {
+	names := []string{path.Base(rel)}
+	if anyName {
+		names = strings.Split(rel, "/")
+	}
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(strings.Trim(pattern, "/"), rel); ok {
+				return true
+			}
+			continue
+		}
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rel returns path of fileName relative to the watched folder, separated by slash
+func (w *Watch) rel(fileName string) (string, bool) {
+	rel, err := filepath.Rel(w.Local, fileName)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// excluded folder is not watched
+func (w *Watch) excluded(rel string) bool {
+	return matchAny(w.Exclude, rel, true)
+}
+
+// included file is backed up
+func (w *Watch) included(rel string) bool {
+	if w.excluded(rel) {
+		return false
+	}
+	return len(w.Include) == 0 || matchAny(w.Include, rel, false)
+}
+
+// dest returns folder of space a file is uploaded to
+func (w *Watch) dest(rel string) string {
+	return path.Join(w.Remote, path.Dir(rel))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/samoslab/nebula/client/api"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/samoslab/nebula/client/daemon"
+	"github.com/samoslab/nebula/client/order"
+	regclient "github.com/samoslab/nebula/client/register"
+	rpb "github.com/samoslab/nebula/tracker/register/client/pb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// backend operations of net disk, done by a client manager in this process or by a running daemon
+type backend interface {
+	Register(email string, resend bool) error
+	VerifyEmail(code string) error
+	ListFolder(path string, sno uint32) ([]*daemon.DownFile, error)
+	UploadFile(fileName, dest string, newVersion, isEncrypt bool, sno uint32) error
+	DownloadFile(fileName, destDir, fileHash string, fileSize uint64, sno uint32) error
+	MkFolder(parent string, folders []string, sno uint32) error
+	MoveFile(source, dest string, sno uint32) error
+	RemoveFile(id string, recursive bool, sno uint32) error
+	SpaceStatus(sno uint32) error
+	SetPassword(sno uint32, password string) error
+	VerifyPassword(sno uint32, password string) error
+	ChangePassword(sno uint32, oldPassword, newPassword string) error
+	Usage() (*order.UsageAmount, error)
+	Progress(files []string) (map[string]float64, error)
+	Close()
+}
+
+var errNotRegistered = errors.New("register first")
+
+// localBackend works through a client manager created on first use
+type localBackend struct {
+	log    logrus.FieldLogger
+	webcfg config.Config
+	conn   *grpc.ClientConn // to tracker, shared by register and client manager
+	cm     *daemon.ClientManager
+}
+
+func newLocalBackend(log logrus.FieldLogger, webcfg config.Config) *localBackend {
+	return &localBackend{log: log, webcfg: webcfg}
+}
+
+func (l *localBackend) tracker() (*grpc.ClientConn, error) {
+	if l.conn != nil {
+		return l.conn, nil
+	}
+	conn, err := grpc.Dial(l.webcfg.TrackerServer, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	l.conn = conn
+	return conn, nil
+}
+
+func (l *localBackend) manager() (*daemon.ClientManager, error) {
+	if l.cm != nil {
+		return l.cm, nil
+	}
+	cc, err := config.LoadConfig(l.webcfg.ConfigFile)
+	if err == config.ErrNoConf {
+		return nil, errNotRegistered
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := l.tracker()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := daemon.NewClientManager(l.log, l.webcfg, cc, daemon.WithTrackerConn(conn))
+	if err != nil {
+		return nil, err
+	}
+	l.cm = cm
+	return cm, nil
+}
+
+// muted runs f with stdout sent to stderr, register client prints messages which are not output of command
+func muted(f func() error) error {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+	return f()
+}
+
+func (l *localBackend) Register(email string, resend bool) error {
+	conn, err := l.tracker()
+	if err != nil {
+		return err
+	}
+	rc := rpb.NewClientRegisterServiceClient(conn)
+	return muted(func() error {
+		if resend {
+			return regclient.ResendVerifyCode(rc, l.webcfg.ConfigFile)
+		}
+		return regclient.RegisterClient(l.log, rc, l.webcfg.ConfigFile, email)
+	})
+}
+
+func (l *localBackend) VerifyEmail(code string) error {
+	conn, err := l.tracker()
+	if err != nil {
+		return err
+	}
+	return muted(func() error {
+		return regclient.VerifyEmail(rpb.NewClientRegisterServiceClient(conn), l.webcfg.ConfigFile, code)
+	})
+}
+
+func (l *localBackend) ListFolder(path string, sno uint32) ([]*daemon.DownFile, error) {
+	cm, err := l.manager()
+	if err != nil {
+		return nil, err
+	}
+	return cm.ListFolder(path, sno)
+}
+
+func (l *localBackend) UploadFile(fileName, dest string, newVersion, isEncrypt bool, sno uint32) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	return cm.UploadFile(fileName, dest, false, newVersion, isEncrypt, sno)
+}
+
+func (l *localBackend) DownloadFile(fileName, destDir, fileHash string, fileSize uint64, sno uint32) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	return cm.DownloadFile(fileName, destDir, fileHash, fileSize, sno)
+}
+
+func (l *localBackend) MkFolder(parent string, folders []string, sno uint32) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	_, err = cm.MkFolder(parent, folders, false, sno)
+	return err
+}
+
+func (l *localBackend) MoveFile(source, dest string, sno uint32) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	return cm.MoveFile(source, dest, sno)
+}
+
+func (l *localBackend) RemoveFile(id string, recursive bool, sno uint32) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	return cm.RemoveFile(id, recursive, false, sno)
+}
+
+func (l *localBackend) SpaceStatus(sno uint32) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	return cm.CheckSpaceStatus(sno)
+}
+
+func (l *localBackend) SetPassword(sno uint32, password string) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	return cm.SetPassword(sno, password)
+}
+
+func (l *localBackend) VerifyPassword(sno uint32, password string) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	return cm.VerifyPassword(sno, password)
+}
+
+func (l *localBackend) ChangePassword(sno uint32, oldPassword, newPassword string) error {
+	cm, err := l.manager()
+	if err != nil {
+		return err
+	}
+	return cm.ChangePassword(sno, oldPassword, newPassword)
+}
+
+func (l *localBackend) Usage() (*order.UsageAmount, error) {
+	cm, err := l.manager()
+	if err != nil {
+		return nil, err
+	}
+	return cm.OM.UsageAmount()
+}
+
+func (l *localBackend) Progress(files []string) (map[string]float64, error) {
+	if l.cm == nil {
+		return map[string]float64{}, nil
+	}
+	return l.cm.GetProgress(files)
+}
+
+func (l *localBackend) Close() {
+	if l.cm != nil {
+		l.cm.Shutdown()
+	}
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// daemonBackend works through HTTP API of a running daemon, local paths sent must be absolute
+type daemonBackend struct {
+	client *api.Client
+}
+
+func newDaemonBackend(addr, token string) *daemonBackend {
+	client := api.NewClient(addr, token)
+	// transfers are done in one request
+	client.HTTPClient = &http.Client{Timeout: 24 * time.Hour}
+	return &daemonBackend{client: client}
+}
+
+// check returns errNotRegistered if daemon is not registered
+func check(err error) error {
+	if e, ok := err.(*api.Error); ok && e.Errmsg == errNotRegistered.Error() {
+		return errNotRegistered
+	}
+	return err
+}
+
+func (d *daemonBackend) Register(email string, resend bool) error {
+	return check(d.client.Register(context.Background(), &api.RegisterReq{Email: email, Resend: resend}))
+}
+
+func (d *daemonBackend) VerifyEmail(code string) error {
+	return check(d.client.VerifyEmail(context.Background(), &api.VerifyEmailReq{Code: code}))
+}
+
+func (d *daemonBackend) ListFolder(path string, sno uint32) ([]*daemon.DownFile, error) {
+	return daemon.ListPages(path, func(pageSize, pageNum uint32) (*daemon.FilePages, error) {
+		pages, err := d.client.List(context.Background(), &api.ListReq{Path: path, PageSize: pageSize, PageNum: pageNum, SortType: "name", AscOrder: true, Sno: sno})
+		return pages, check(err)
+	})
+}
+
+func (d *daemonBackend) UploadFile(fileName, dest string, newVersion, isEncrypt bool, sno uint32) error {
+	_, err := d.client.Upload(context.Background(), &api.UploadReq{Filename: fileName, Dest: dest, NewVersion: newVersion, IsEncrypt: isEncrypt, Sno: sno})
+	return check(err)
+}
+
+func (d *daemonBackend) DownloadFile(fileName, destDir, fileHash string, fileSize uint64, sno uint32) error {
+	_, err := d.client.Download(context.Background(), &api.DownloadReq{FileName: fileName, Dest: destDir, FileHash: fileHash, FileSize: fileSize, Sno: sno})
+	return check(err)
+}
+
+func (d *daemonBackend) MkFolder(parent string, folders []string, sno uint32) error {
+	return check(d.client.MkFolder(context.Background(), &api.MkfolderReq{Parent: parent, Folders: folders, Sno: sno}))
+}
+
+func (d *daemonBackend) MoveFile(source, dest string, sno uint32) error {
+	return check(d.client.Rename(context.Background(), &api.RenameReq{Source: source, Dest: dest, Sno: sno}))
+}
+
+func (d *daemonBackend) RemoveFile(id string, recursive bool, sno uint32) error {
+	return check(d.client.Remove(context.Background(), &api.RemoveReq{Target: id, Recursion: recursive, Sno: sno}))
+}
+
+func (d *daemonBackend) SpaceStatus(sno uint32) error {
+	return check(d.client.SpaceStatus(context.Background(), &api.SpaceStatusReq{SpacoNo: sno}))
+}
+
+func (d *daemonBackend) SetPassword(sno uint32, password string) error {
+	return check(d.client.SetPassword(context.Background(), &api.PasswordReq{Password: password, SpacoNo: sno}))
+}
+
+func (d *daemonBackend) VerifyPassword(sno uint32, password string) error {
+	return check(d.client.VerifyPassword(context.Background(), &api.PasswordReq{Password: password, SpacoNo: sno}))
+}
+
+func (d *daemonBackend) ChangePassword(sno uint32, oldPassword, newPassword string) error {
+	return check(d.client.ChangePassword(context.Background(), &api.ChangePasswordReq{OldPassword: oldPassword, NewPassword: newPassword, SpacoNo: sno}))
+}
+
+func (d *daemonBackend) Usage() (*order.UsageAmount, error) {
+	usage, err := d.client.UsageAmount(context.Background())
+	return usage, check(err)
+}
+
+func (d *daemonBackend) Progress(files []string) (map[string]float64, error) {
+	progress, err := d.client.Progress(context.Background(), &api.ProgressReq{Files: files})
+	return progress, check(err)
+}
+
+func (d *daemonBackend) Close() {
+}
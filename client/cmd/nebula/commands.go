@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samoslab/nebula/client/daemon"
+)
+
+// cli runs commands on a space through backend
+type cli struct {
+	b        backend
+	sno      uint32
+	out      io.Writer
+	errOut   io.Writer
+	json     bool
+	progress bool
+}
+
+// remoteFile a file or folder of space with its absolute path
+type remoteFile struct {
+	path string
+	file *daemon.DownFile
+}
+
+// failure of a file of a command on many files
+type failure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// report result of a command on many files, it is printed as json if asked
+type report struct {
+	Done   []string  `json:"done"`
+	Failed []failure `json:"failed"`
+	first  error
+}
+
+func (r *report) fail(name string, err error) {
+	if r.first == nil {
+		r.first = err
+	}
+	r.Failed = append(r.Failed, failure{Path: name, Error: err.Error()})
+}
+
+// err returns error of the report, failure of some files of many is a partial failure
+func (r *report) err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%s: %s", r.Failed[0].Path, r.Failed[0].Error)
+	if len(r.Failed) > 1 {
+		msg = fmt.Sprintf("%s, and %d more failures", msg, len(r.Failed)-1)
+	}
+	if len(r.Done) > 0 {
+		return withCode(exitPartial, errors.New(msg))
+	}
+	return withCode(exitCode(r.first), errors.New(msg))
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, string(data))
+	return err
+}
+
+// finish prints report and returns its error
+func (c *cli) finish(r *report) error {
+	if c.json {
+		if r.Done == nil {
+			r.Done = []string{}
+		}
+		if r.Failed == nil {
+			r.Failed = []failure{}
+		}
+		if err := c.printJSON(r); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range r.Failed {
+			fmt.Fprintf(c.errOut, "%s: %s\n", f.Path, f.Error)
+		}
+	}
+	return r.err()
+}
+
+// remotePath returns clean absolute path of space
+func remotePath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func hasMeta(name string) bool {
+	return strings.ContainsAny(name, `*?[`)
+}
+
+// list returns all files of folder dir
+func (c *cli) list(dir string) ([]*daemon.DownFile, error) {
+	return c.b.ListFolder(dir, c.sno)
+}
+
+// stat returns file of path name, not found error if it not exists
+func (c *cli) stat(name string) (*remoteFile, error) {
+	name = remotePath(name)
+	if name == "/" {
+		return &remoteFile{path: "/", file: &daemon.DownFile{FileName: "/", Folder: true}}, nil
+	}
+	dir, base := path.Split(name)
+	files, err := c.list(path.Clean(dir))
+	if err != nil {
+		if parent, perr := c.stat(dir); perr != nil || !parent.file.Folder {
+			return nil, withCode(exitNotFound, fmt.Errorf("%s not exists", name))
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if file.FileName == base {
+			return &remoteFile{path: name, file: file}, nil
+		}
+	}
+	return nil, withCode(exitNotFound, fmt.Errorf("%s not exists", name))
+}
+
+// glob returns files matching pattern, every part of path may have wildcards of path.Match
+func (c *cli) glob(pattern string) ([]*remoteFile, error) {
+	pattern = remotePath(pattern)
+	if !hasMeta(pattern) {
+		f, err := c.stat(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return []*remoteFile{f}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, withCode(exitUsage, fmt.Errorf("bad pattern %s", pattern))
+	}
+	matches := []*remoteFile{{path: "/", file: &daemon.DownFile{FileName: "/", Folder: true}}}
+	for _, part := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		next := []*remoteFile{}
+		for _, m := range matches {
+			if !m.file.Folder {
+				continue
+			}
+			files, err := c.list(m.path)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if ok, _ := path.Match(part, file.FileName); ok {
+					next = append(next, &remoteFile{path: path.Join(m.path, file.FileName), file: file})
+				}
+			}
+		}
+		matches = next
+	}
+	if len(matches) == 0 {
+		return nil, withCode(exitNotFound, fmt.Errorf("no file matches %s", pattern))
+	}
+	return matches, nil
+}
+
+// mkdirAll makes folder name and its parents
+func (c *cli) mkdirAll(name string) error {
+	f, err := c.stat(name)
+	if err == nil {
+		if !f.file.Folder {
+			return fmt.Errorf("%s is a file", name)
+		}
+		return nil
+	}
+	if exitCode(err) != exitNotFound {
+		return err
+	}
+	if err := c.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	return c.b.MkFolder(path.Dir(name), []string{path.Base(name)}, c.sno)
+}
+
+type lsEntry struct {
+	Path    string `json:"path"`
+	ID      string `json:"id"`
+	Folder  bool   `json:"folder"`
+	Size    uint64 `json:"size"`
+	Hash    string `json:"hash"`
+	ModTime uint64 `json:"modtime"`
+}
+
+// ls lists folders matched and files matched, folders are listed recursively if recursive
+func (c *cli) ls(patterns []string, recursive, long bool) error {
+	if len(patterns) == 0 {
+		patterns = []string{"/"}
+	}
+	entries := []lsEntry{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		files, err := c.list(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name := path.Join(dir, file.FileName)
+			entries = append(entries, lsEntry{Path: name, ID: file.ID, Folder: file.Folder, Size: file.FileSize, Hash: file.FileHash, ModTime: file.ModTime})
+			if file.Folder && recursive {
+				if err := walk(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, pattern := range patterns {
+		matches, err := c.glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			if m.file.Folder && (!hasMeta(pattern) || recursive) {
+				if err := walk(m.path); err != nil {
+					return err
+				}
+				continue
+			}
+			entries = append(entries, lsEntry{Path: m.path, ID: m.file.ID, Folder: m.file.Folder, Size: m.file.FileSize, Hash: m.file.FileHash, ModTime: m.file.ModTime})
+		}
+	}
+	if c.json {
+		return c.printJSON(entries)
+	}
+	for _, e := range entries {
+		name := e.Path
+		if e.Folder {
+			name += "/"
+		}
+		if long {
+			kind := "-"
+			if e.Folder {
+				kind = "d"
+			}
+			fmt.Fprintf(c.out, "%s %12d %s %s\n", kind, e.Size, time.Unix(int64(e.ModTime), 0).Format("2006-01-02 15:04"), name)
+		} else {
+			fmt.Fprintln(c.out, name)
+		}
+	}
+	return nil
+}
+
+// localGlob returns local files matching pattern, pattern without wildcard is returned as it is
+func localGlob(pattern string) ([]string, error) {
+	if !hasMeta(pattern) {
+		return []string{pattern}, nil
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, withCode(exitUsage, fmt.Errorf("bad pattern %s", pattern))
+	}
+	if len(matches) == 0 {
+		return nil, withCode(exitNotFound, fmt.Errorf("no file matches %s", pattern))
+	}
+	return matches, nil
+}
+
+// put uploads local files into folder dest, folders are uploaded with their content if recursive
+func (c *cli) put(sources []string, dest string, recursive, newVersion, isEncrypt bool) error {
+	dest = remotePath(dest)
+	if err := c.mkdirAll(dest); err != nil {
+		return err
+	}
+	r := &report{}
+	upload := func(fileName, dir string) {
+		err := c.transfer(fileName, fileName, func() error {
+			return c.b.UploadFile(fileName, dir, newVersion, isEncrypt, c.sno)
+		})
+		if err != nil {
+			r.fail(fileName, err)
+		} else {
+			r.Done = append(r.Done, path.Join(dir, filepath.Base(fileName)))
+		}
+	}
+	for _, pattern := range sources {
+		names, err := localGlob(pattern)
+		if err != nil {
+			r.fail(pattern, err)
+			continue
+		}
+		for _, name := range names {
+			// daemon needs absolute path
+			name, err := filepath.Abs(name)
+			if err != nil {
+				r.fail(name, err)
+				continue
+			}
+			info, err := os.Stat(name)
+			if err != nil {
+				r.fail(name, withCode(exitNotFound, err))
+				continue
+			}
+			if !info.IsDir() {
+				upload(name, dest)
+				continue
+			}
+			if !recursive {
+				r.fail(name, withCode(exitUsage, errors.New("is a folder, use --recursive to upload folders")))
+				continue
+			}
+			base := filepath.Dir(name)
+			filepath.Walk(name, func(fileName string, info os.FileInfo, err error) error {
+				if err != nil {
+					r.fail(fileName, err)
+					return nil
+				}
+				rel, err := filepath.Rel(base, fileName)
+				if err != nil {
+					r.fail(fileName, err)
+					return nil
+				}
+				remote := path.Join(dest, filepath.ToSlash(rel))
+				if info.IsDir() {
+					if err := c.mkdirAll(remote); err != nil {
+						r.fail(fileName, err)
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				upload(fileName, path.Dir(remote))
+				return nil
+			})
+		}
+	}
+	return c.finish(r)
+}
+
+// get downloads files into local folder dest, folders are downloaded with their content if recursive
+func (c *cli) get(sources []string, dest string, recursive bool) error {
+	if err := os.MkdirAll(dest, 0744); err != nil {
+		return err
+	}
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	r := &report{}
+	download := func(f *remoteFile, dir string) {
+		var err error
+		if f.file.FileSize == 0 {
+			err = ioutil.WriteFile(filepath.Join(dir, f.file.FileName), []byte{}, 0644)
+		} else {
+			err = c.transfer(filepath.Join(dir, f.file.FileName), f.path, func() error {
+				return c.b.DownloadFile(f.path, dir, f.file.FileHash, f.file.FileSize, c.sno)
+			})
+		}
+		if err != nil {
+			r.fail(f.path, err)
+		} else {
+			r.Done = append(r.Done, filepath.Join(dir, f.file.FileName))
+		}
+	}
+	var walk func(dir, local string)
+	walk = func(dir, local string) {
+		if err := os.MkdirAll(local, 0744); err != nil {
+			r.fail(dir, err)
+			return
+		}
+		files, err := c.list(dir)
+		if err != nil {
+			r.fail(dir, err)
+			return
+		}
+		for _, file := range files {
+			f := &remoteFile{path: path.Join(dir, file.FileName), file: file}
+			if file.Folder {
+				walk(f.path, filepath.Join(local, file.FileName))
+			} else {
+				download(f, local)
+			}
+		}
+	}
+	for _, pattern := range sources {
+		matches, err := c.glob(pattern)
+		if err != nil {
+			r.fail(pattern, err)
+			continue
+		}
+		for _, m := range matches {
+			if !m.file.Folder {
+				download(m, dest)
+				continue
+			}
+			if !recursive {
+				r.fail(m.path, withCode(exitUsage, errors.New("is a folder, use --recursive to download folders")))
+				continue
+			}
+			local := dest
+			if m.path != "/" {
+				local = filepath.Join(dest, path.Base(m.path))
+			}
+			walk(m.path, local)
+		}
+	}
+	return c.finish(r)
+}
+
+// mkdir makes folders, parents are made if parents
+func (c *cli) mkdir(names []string, parents bool) error {
+	r := &report{}
+	for _, name := range names {
+		name = remotePath(name)
+		var err error
+		if parents {
+			err = c.mkdirAll(name)
+		} else if _, serr := c.stat(name); serr == nil {
+			err = fmt.Errorf("%s exists", name)
+		} else if parent, perr := c.stat(path.Dir(name)); perr != nil {
+			err = perr
+		} else if !parent.file.Folder {
+			err = fmt.Errorf("%s is a file", parent.path)
+		} else {
+			err = c.b.MkFolder(path.Dir(name), []string{path.Base(name)}, c.sno)
+		}
+		if err != nil {
+			r.fail(name, err)
+		} else {
+			r.Done = append(r.Done, name)
+		}
+	}
+	return c.finish(r)
+}
+
+// mv moves files matching sources into folder dest, or renames the only source to dest which not exists
+func (c *cli) mv(sources []string, dest string) error {
+	dest = remotePath(dest)
+	matches := []*remoteFile{}
+	for _, pattern := range sources {
+		m, err := c.glob(pattern)
+		if err != nil {
+			return err
+		}
+		matches = append(matches, m...)
+	}
+	target, err := c.stat(dest)
+	if err != nil && exitCode(err) != exitNotFound {
+		return err
+	}
+	into := err == nil && target.file.Folder
+	if !into && len(matches) > 1 {
+		return withCode(exitUsage, fmt.Errorf("%s is not a folder", dest))
+	}
+	r := &report{}
+	for _, m := range matches {
+		to := dest
+		if into {
+			to = path.Join(dest, path.Base(m.path))
+		}
+		if m.path == "/" {
+			r.fail(m.path, errors.New("root folder can not be moved"))
+		} else if err := c.b.MoveFile(m.file.ID, to, c.sno); err != nil {
+			r.fail(m.path, err)
+		} else {
+			r.Done = append(r.Done, to)
+		}
+	}
+	return c.finish(r)
+}
+
+// rm removes files matching patterns, folders are removed with their content if recursive
+func (c *cli) rm(patterns []string, recursive bool) error {
+	r := &report{}
+	for _, pattern := range patterns {
+		matches, err := c.glob(pattern)
+		if err != nil {
+			r.fail(pattern, err)
+			continue
+		}
+		// remove children before folders matched too
+		sort.Slice(matches, func(i, j int) bool { return matches[i].path > matches[j].path })
+		for _, m := range matches {
+			if m.path == "/" {
+				r.fail(m.path, errors.New("root folder can not be removed"))
+			} else if m.file.Folder && !recursive {
+				r.fail(m.path, withCode(exitUsage, errors.New("is a folder, use --recursive to remove folders")))
+			} else if err := c.b.RemoveFile(m.file.ID, m.file.Folder, c.sno); err != nil {
+				r.fail(m.path, err)
+			} else {
+				r.Done = append(r.Done, m.path)
+			}
+		}
+	}
+	return c.finish(r)
+}
+
+// space runs action on the space
+func (c *cli) space(action, password, newPassword string) error {
+	var err error
+	switch action {
+	case "status":
+		err = c.b.SpaceStatus(c.sno)
+	case "set-password":
+		err = c.b.SetPassword(c.sno, password)
+	case "verify":
+		err = c.b.VerifyPassword(c.sno, password)
+	case "change-password":
+		err = c.b.ChangePassword(c.sno, password, newPassword)
+	default:
+		return withCode(exitUsage, fmt.Errorf("unknown space action %q", action))
+	}
+	if err != nil {
+		return err
+	}
+	return c.ok(fmt.Sprintf("space %d %s ok", c.sno, action))
+}
+
+// ok prints message of a command done
+func (c *cli) ok(msg string) error {
+	if c.json {
+		return c.printJSON(map[string]string{"result": "ok"})
+	}
+	_, err := fmt.Fprintln(c.out, msg)
+	return err
+}
+
+// usage prints usage amount of package
+func (c *cli) usage() error {
+	u, err := c.b.Usage()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(u)
+	}
+	fmt.Fprintf(c.out, "package:       %d\n", u.PackageId)
+	fmt.Fprintf(c.out, "volume:        %d / %d\n", u.UsageVolume, u.Volume)
+	fmt.Fprintf(c.out, "netflow:       %d / %d\n", u.UsageNetflow, u.Netflow)
+	fmt.Fprintf(c.out, "up netflow:    %d / %d\n", u.UsageUpNetflow, u.UpNetflow)
+	fmt.Fprintf(c.out, "down netflow:  %d / %d\n", u.UsageDownNetflow, u.DownNetflow)
+	if u.EndTime != 0 {
+		fmt.Fprintf(c.out, "end time:      %s\n", time.Unix(int64(u.EndTime), 0).Format("2006-01-02 15:04"))
+	}
+	return nil
+}
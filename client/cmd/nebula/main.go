@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/samoslab/nebula/client/api"
+	"github.com/samoslab/nebula/client/auth"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/samoslab/nebula/client/daemon"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// exit codes of failure classes
+const (
+	exitOK            = 0
+	exitFailure       = 1
+	exitUsage         = 2
+	exitNotRegistered = 3
+	exitNotFound      = 4
+	exitNetwork       = 5
+	exitPartial       = 6
+)
+
+const usage = `nebula is a command line client of nebula net disk
+
+Usage:
+    nebula <command> [options] [arguments]
+
+Commands:
+    register        --email <email> [--resend]   register client, or resend verify code
+    verify-email    --code <code>                verify email with code of verify email
+    ls              [-r] [-l] [path...]          list files and folders
+    put             [-r] local... remotedir      upload files
+    get             [-r] remote... localdir      download files
+    mkdir           [-p] path...                 make folders
+    mv              src... dest                  move or rename files
+    rm              [-r] path...                 remove files
+    space           status|set-password|verify|change-password
+    usage                                        show usage amount of package
+
+Remote paths may contain wildcards *, ? and [...] in any part of path.
+Run "nebula <command> -h" for options of a command.
+
+Exit codes:
+    0 ok, 1 failure, 2 usage error, 3 not registered, 4 not found,
+    5 network error, 6 some of many files failed
+`
+
+var commands = map[string]bool{
+	"register": true, "verify-email": true, "ls": true, "put": true, "get": true,
+	"mkdir": true, "mv": true, "rm": true, "space": true, "usage": true,
+}
+
+// exitError error with exit code of its failure class
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func withCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns exit code of failure class of err
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+	if err == errNotRegistered || err == config.ErrNoConf {
+		return exitNotRegistered
+	}
+	if _, ok := err.(net.Error); ok {
+		return exitNetwork
+	}
+	if _, ok := err.(*daemon.NotExistError); ok {
+		return exitNotFound
+	}
+	// errors of daemon API are classified by the daemon
+	if e, ok := err.(*api.Error); ok {
+		switch e.Code {
+		case http.StatusNotFound:
+			return exitNotFound
+		case http.StatusServiceUnavailable:
+			return exitNetwork
+		}
+		return exitFailure
+	}
+	// grpc errors of tracker
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return exitNetwork
+	case codes.NotFound:
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+// options common to all commands
+type options struct {
+	daemon  string
+	token   string
+	conf    string
+	tracker string
+	space   uint32
+	json    bool
+	quiet   bool
+	verbose bool
+}
+
+func newFlagSet(name string, opts *options) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	fs.StringVar(&opts.daemon, "daemon", "", "address ip:port of a running client daemon, commands are done by this process if empty")
+	fs.StringVar(&opts.token, "token", "", "token of daemon API, token of daemon on this machine is read from its config dir if empty")
+	fs.StringVar(&opts.conf, "conf", "", "web config file, default config is used if empty")
+	fs.StringVar(&opts.tracker, "tracker", "", "tracker server format is ip:port")
+	fs.Uint32Var(&opts.space, "space", 0, "space number, 0 is the default space and 1 is the private space")
+	fs.BoolVar(&opts.json, "json", false, "print result as json")
+	fs.BoolVarP(&opts.quiet, "quiet", "q", false, "do not draw progress bars")
+	fs.BoolVarP(&opts.verbose, "verbose", "v", false, "print logs of client")
+	return fs
+}
+
+func (opts *options) backend(errOut io.Writer) (backend, error) {
+	webcfg := &config.Config{}
+	if opts.conf != "" {
+		cfg, err := config.LoadWebConfig(opts.conf)
+		if err != nil {
+			return nil, err
+		}
+		webcfg = cfg
+	}
+	webcfg.SetDefault()
+	if opts.daemon != "" {
+		token := opts.token
+		if token == "" {
+			// daemon writes token of its run into config dir
+			token, _ = auth.ReadTokenFile(webcfg.ConfigDir)
+		}
+		return newDaemonBackend(opts.daemon, token), nil
+	}
+	if opts.tracker != "" {
+		webcfg.TrackerServer = opts.tracker
+	}
+	if err := os.MkdirAll(webcfg.ConfigDir, 0744); err != nil {
+		return nil, err
+	}
+	log, err := daemon.NewLogger("", false)
+	if err != nil {
+		return nil, err
+	}
+	log.Out = errOut
+	log.Level = logrus.WarnLevel
+	if opts.verbose {
+		log.Level = logrus.DebugLevel
+	}
+	return newLocalBackend(log, *webcfg), nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs command of args and returns exit code
+func run(args []string, out, errOut io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(errOut, usage)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+	if !commands[args[0]] {
+		fmt.Fprintf(errOut, "nebula: unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+	opts := &options{}
+	fs := newFlagSet(args[0], opts)
+	fs.SetOutput(errOut)
+	recursive := fs.BoolP("recursive", "r", false, "")
+	switch args[0] {
+	case "ls":
+		fs.Lookup("recursive").Usage = "list folders recursively"
+	case "put":
+		fs.Lookup("recursive").Usage = "upload folders recursively"
+	case "get":
+		fs.Lookup("recursive").Usage = "download folders recursively"
+	case "rm":
+		fs.Lookup("recursive").Usage = "remove folders recursively"
+	default:
+		fs.MarkHidden("recursive")
+	}
+	long := fs.BoolP("long", "l", false, "ls: print kind, size and modify time")
+	parents := fs.BoolP("parents", "p", false, "mkdir: make parent folders as needed, no error if exists")
+	newVersion := fs.Bool("newversion", false, "put: upload as new version if file exists")
+	encrypt := fs.Bool("encrypt", true, "put: encrypt file")
+	email := fs.String("email", "", "register: email of user")
+	resend := fs.Bool("resend", false, "register: resend verify code")
+	code := fs.String("code", "", "verify-email: verify code from verify email")
+	password := fs.String("password", "", "space: password of space, old password of change-password")
+	newPassword := fs.String("new-password", "", "space: new password of change-password")
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == pflag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	err := runCommand(opts, out, errOut, func(c *cli) error {
+		rest := fs.Args()
+		switch args[0] {
+		case "register":
+			if *email == "" && !*resend {
+				return withCode(exitUsage, errors.New("--email is required"))
+			}
+			if err := c.b.Register(*email, *resend); err != nil {
+				return err
+			}
+			return c.ok("verify code is sent to email, run verify-email with it")
+		case "verify-email":
+			if *code == "" {
+				return withCode(exitUsage, errors.New("--code is required"))
+			}
+			if err := c.b.VerifyEmail(*code); err != nil {
+				return err
+			}
+			return c.ok("email verified")
+		case "ls":
+			return c.ls(rest, *recursive, *long)
+		case "put":
+			if len(rest) < 2 {
+				return withCode(exitUsage, errors.New("put needs local files and remote folder"))
+			}
+			return c.put(rest[:len(rest)-1], rest[len(rest)-1], *recursive, *newVersion, *encrypt)
+		case "get":
+			if len(rest) < 2 {
+				return withCode(exitUsage, errors.New("get needs remote files and local folder"))
+			}
+			return c.get(rest[:len(rest)-1], rest[len(rest)-1], *recursive)
+		case "mkdir":
+			if len(rest) == 0 {
+				return withCode(exitUsage, errors.New("mkdir needs folders"))
+			}
+			return c.mkdir(rest, *parents)
+		case "mv":
+			if len(rest) < 2 {
+				return withCode(exitUsage, errors.New("mv needs source and destination"))
+			}
+			return c.mv(rest[:len(rest)-1], rest[len(rest)-1])
+		case "rm":
+			if len(rest) == 0 {
+				return withCode(exitUsage, errors.New("rm needs files"))
+			}
+			return c.rm(rest, *recursive)
+		case "space":
+			if len(rest) != 1 {
+				return withCode(exitUsage, errors.New("space needs one of status, set-password, verify and change-password"))
+			}
+			return c.space(rest[0], *password, *newPassword)
+		default:
+			return c.usage()
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(errOut, "nebula %s: %v\n", args[0], err)
+	}
+	return exitCode(err)
+}
+
+// runCommand creates backend of opts and runs f on it
+func runCommand(opts *options, out, errOut io.Writer, f func(c *cli) error) error {
+	b, err := opts.backend(errOut)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	c := &cli{
+		b:        b,
+		sno:      opts.space,
+		out:      out,
+		errOut:   errOut,
+		json:     opts.json,
+		progress: !opts.quiet && !opts.json && isStderrTerminal(errOut),
+	}
+	return f(c)
+}
+
+func isStderrTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && isTerminal(f)
+}
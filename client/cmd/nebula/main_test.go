@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/samoslab/nebula/client/api"
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/daemon"
+	"github.com/samoslab/nebula/client/order"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// memBackend keeps files of one space in memory, folders have nil content
+type memBackend struct {
+	files map[string][]byte
+	ids   map[string]string
+	next  int
+}
+
+func newMemBackend() *memBackend {
+	m := &memBackend{files: map[string][]byte{}, ids: map[string]string{}}
+	m.add("/", nil)
+	return m
+}
+
+func (m *memBackend) add(name string, content []byte) {
+	m.next++
+	m.files[name] = content
+	m.ids[fmt.Sprintf("%032x", m.next)] = name
+}
+
+func (m *memBackend) byID(id string) (string, error) {
+	name, ok := m.ids[id]
+	if !ok {
+		return "", errors.New("file not exist")
+	}
+	return name, nil
+}
+
+func (m *memBackend) idOf(name string) string {
+	for id, n := range m.ids {
+		if n == name {
+			return id
+		}
+	}
+	return ""
+}
+
+func (m *memBackend) Register(email string, resend bool) error { return nil }
+func (m *memBackend) VerifyEmail(code string) error            { return nil }
+
+func (m *memBackend) ListFolder(dir string, sno uint32) ([]*daemon.DownFile, error) {
+	if content, ok := m.files[dir]; !ok || content != nil {
+		return nil, errors.New("folder not exist")
+	}
+	names := []string{}
+	for name := range m.files {
+		if name != "/" && path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	files := []*daemon.DownFile{}
+	for _, name := range names {
+		content := m.files[name]
+		files = append(files, &daemon.DownFile{ID: m.idOf(name), FileName: path.Base(name), Folder: content == nil, FileSize: uint64(len(content)), FileHash: "hash"})
+	}
+	return files, nil
+}
+
+func (m *memBackend) UploadFile(fileName, dest string, newVersion, isEncrypt bool, sno uint32) error {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	m.add(path.Join(dest, filepath.Base(fileName)), append([]byte{}, content...))
+	return nil
+}
+
+func (m *memBackend) DownloadFile(fileName, destDir, fileHash string, fileSize uint64, sno uint32) error {
+	content, ok := m.files[fileName]
+	if !ok {
+		return errors.New("file not exist")
+	}
+	return ioutil.WriteFile(filepath.Join(destDir, path.Base(fileName)), content, 0644)
+}
+
+func (m *memBackend) MkFolder(parent string, folders []string, sno uint32) error {
+	for _, folder := range folders {
+		m.add(path.Join(parent, folder), nil)
+	}
+	return nil
+}
+
+func (m *memBackend) MoveFile(source, dest string, sno uint32) error {
+	name, err := m.byID(source)
+	if err != nil {
+		return err
+	}
+	for id, n := range m.ids {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			to := dest + strings.TrimPrefix(n, name)
+			m.files[to] = m.files[n]
+			delete(m.files, n)
+			m.ids[id] = to
+		}
+	}
+	return nil
+}
+
+func (m *memBackend) RemoveFile(id string, recursive bool, sno uint32) error {
+	name, err := m.byID(id)
+	if err != nil {
+		return err
+	}
+	for id, n := range m.ids {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			delete(m.files, n)
+			delete(m.ids, id)
+		}
+	}
+	return nil
+}
+
+func (m *memBackend) SpaceStatus(sno uint32) error                             { return nil }
+func (m *memBackend) SetPassword(sno uint32, password string) error            { return nil }
+func (m *memBackend) VerifyPassword(sno uint32, password string) error         { return nil }
+func (m *memBackend) ChangePassword(sno uint32, oldPassword, new string) error { return nil }
+func (m *memBackend) Usage() (*order.UsageAmount, error)                       { return &order.UsageAmount{}, nil }
+func (m *memBackend) Progress(files []string) (map[string]float64, error)      { return nil, nil }
+func (m *memBackend) Close()                                                   {}
+
+func newTestCli(m *memBackend) (*cli, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &cli{b: m, out: out, errOut: ioutil.Discard}, out
+}
+
+func TestGlob(t *testing.T) {
+	m := newMemBackend()
+	m.add("/docs", nil)
+	m.add("/docs/a.txt", []byte("a"))
+	m.add("/docs/b.txt", []byte("b"))
+	m.add("/docs/c.md", []byte("c"))
+	m.add("/pics", nil)
+	m.add("/pics/d.txt", []byte("d"))
+	c, _ := newTestCli(m)
+
+	files, err := c.glob("/*/*.txt")
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.path)
+	}
+	require.Equal(t, []string{"/docs/a.txt", "/docs/b.txt", "/pics/d.txt"}, names)
+
+	_, err = c.glob("/docs/*.jpg")
+	require.Equal(t, exitNotFound, exitCode(err))
+	_, err = c.glob("/nothing/a.txt")
+	require.Equal(t, exitNotFound, exitCode(err))
+	_, err = c.glob("/docs/[")
+	require.Equal(t, exitUsage, exitCode(err))
+}
+
+func TestPutGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-cli")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("world"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "empty"), []byte{}, 0644))
+
+	m := newMemBackend()
+	c, out := newTestCli(m)
+	require.Equal(t, exitUsage, exitCode(c.put([]string{src}, "/backup", false, false, true)))
+	require.NoError(t, c.put([]string{src}, "/backup/today", true, false, true))
+	require.Equal(t, []byte("hello"), m.files["/backup/today/src/a.txt"])
+	require.Equal(t, []byte("world"), m.files["/backup/today/src/sub/b.txt"])
+
+	c.json = true
+	require.NoError(t, c.ls([]string{"/backup/today/src/*.txt"}, false, false))
+	entries := []lsEntry{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entries))
+	require.Len(t, entries, 1)
+	require.Equal(t, "/backup/today/src/a.txt", entries[0].Path)
+	require.Equal(t, uint64(5), entries[0].Size)
+
+	dst := filepath.Join(dir, "dst")
+	c.json = false
+	require.NoError(t, c.get([]string{"/backup/*"}, dst, true))
+	content, err := ioutil.ReadFile(filepath.Join(dst, "today", "src", "sub", "b.txt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), content)
+	info, err := os.Stat(filepath.Join(dst, "today", "src", "empty"))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+
+	err = c.get([]string{"/backup/today/src/a.txt", "/backup/missing"}, dst, false)
+	require.Equal(t, exitPartial, exitCode(err))
+}
+
+func TestMoveRemove(t *testing.T) {
+	m := newMemBackend()
+	m.add("/a", nil)
+	m.add("/a/x.txt", []byte("x"))
+	m.add("/a/y.txt", []byte("y"))
+	m.add("/b", nil)
+	c, _ := newTestCli(m)
+
+	require.NoError(t, c.mv([]string{"/a/*.txt"}, "/b"))
+	require.Contains(t, m.files, "/b/x.txt")
+	require.Contains(t, m.files, "/b/y.txt")
+	require.NoError(t, c.mv([]string{"/b/x.txt"}, "/b/z.txt"))
+	require.Contains(t, m.files, "/b/z.txt")
+	require.Equal(t, exitUsage, exitCode(c.mv([]string{"/b/*"}, "/c")))
+
+	require.Equal(t, exitUsage, exitCode(c.rm([]string{"/b"}, false)))
+	require.NoError(t, c.rm([]string{"/b"}, true))
+	require.NotContains(t, m.files, "/b/z.txt")
+	require.Equal(t, exitNotFound, exitCode(c.rm([]string{"/b"}, true)))
+
+	require.NoError(t, c.mkdir([]string{"/x/y/z"}, true))
+	require.Contains(t, m.files, "/x/y")
+	require.Error(t, c.mkdir([]string{"/x/y"}, false))
+}
+
+func TestExitCode(t *testing.T) {
+	require.Equal(t, exitOK, exitCode(nil))
+	require.Equal(t, exitNotRegistered, exitCode(errNotRegistered))
+	require.Equal(t, exitNetwork, exitCode(common.StatusErrFromError(status.Error(codes.Unavailable, "all SubConns are in TransientFailure"))))
+	require.Equal(t, exitNotFound, exitCode(common.StatusErrFromError(status.Error(codes.NotFound, "file not found"))))
+	require.Equal(t, exitFailure, exitCode(common.StatusErrFromError(status.Error(codes.Unknown, "unknown"))))
+	require.Equal(t, exitFailure, exitCode(errors.New("code 14, msg not found")))
+	require.Equal(t, exitNotFound, exitCode(&daemon.NotExistError{Name: "space 2"}))
+	require.Equal(t, exitNotFound, exitCode(&api.Error{Status: http.StatusOK, Code: http.StatusNotFound, Errmsg: "/a not exists"}))
+	require.Equal(t, exitNetwork, exitCode(&api.Error{Status: http.StatusOK, Code: http.StatusServiceUnavailable, Errmsg: "code 14, msg unavailable"}))
+	require.Equal(t, exitUsage, run([]string{"unknown"}, ioutil.Discard, ioutil.Discard))
+	require.Equal(t, exitUsage, run([]string{}, ioutil.Discard, ioutil.Discard))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// progressInterval interval of polling progress of a transfer
+	progressInterval = 500 * time.Millisecond
+
+	// progressWidth width of progress bar
+	progressWidth = 30
+)
+
+// isTerminal returns true if f is a terminal, progress bars are only drawn on a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBar returns progress line of ratio 0 to 1
+func progressBar(name string, ratio float64) string {
+	if ratio < 0 {
+		ratio = 0
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	done := int(ratio * float64(progressWidth))
+	bar := strings.Repeat("=", done)
+	if done < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-done-1)
+	}
+	return fmt.Sprintf("\r%s [%s] %3d%%", name, bar, int(ratio*100))
+}
+
+// transfer runs f which transfers file key, progress of key is drawn until f returns
+func (c *cli) transfer(key, name string, f func() error) error {
+	if !c.progress {
+		return f()
+	}
+	name = filepath.Base(name)
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		ratio := 0.0
+		for {
+			fmt.Fprint(c.errOut, progressBar(name, ratio))
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if progress, err := c.b.Progress([]string{key}); err == nil {
+				if r, ok := progress[key]; ok {
+					ratio = r
+				}
+			}
+		}
+	}()
+	err := f()
+	close(stop)
+	<-finished
+	if err == nil {
+		fmt.Fprintln(c.errOut, progressBar(name, 1))
+	} else {
+		fmt.Fprintln(c.errOut, " failed")
+	}
+	return err
+}
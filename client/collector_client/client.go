@@ -2,88 +2,130 @@ package collector_client
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	proto "github.com/golang/protobuf/proto"
 	"github.com/robfig/cron"
 	"github.com/samoslab/nebula/provider/node"
 	pb "github.com/samoslab/nebula/tracker/collector/client/pb"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
 
-var NodePtr *node.Node
+const batch_max = 500
+const send_immediate_min = 20
+const queue_size = 2000
 
-func Collect(al *pb.ActionLog) {
-	l := len(queue)
-	if l < cap(queue)*9/10 {
-		queue <- al
-	} else {
-		log.Warnf("queue will be full, abandon action log, ticket: %s", al.Ticket)
-	}
-	if l > send_immediate_min {
-		go send()
-	}
+// Collector receives action logs of transfers with providers
+type Collector interface {
+	Collect(al *pb.ActionLog)
 }
 
-const batch_max = 500
-const send_immediate_min = 20
+// Discard is a Collector that drops all action logs
+var Discard Collector = discard{}
+
+type discard struct{}
+
+func (discard) Collect(al *pb.ActionLog) {}
 
-var queue = make(chan *pb.ActionLog, 2000)
-var cronRunner *cron.Cron
-var sendLock = make(chan bool, 1)
-var conn *grpc.ClientConn
+// Client queues action logs and sends them to collector server in batches signed by node
+type Client struct {
+	log        logrus.FieldLogger
+	node       *node.Node
+	conn       *grpc.ClientConn
+	owned      bool
+	queue      chan *pb.ActionLog
+	sendLock   chan bool
+	cronRunner *cron.Cron
+}
 
-func sendLockOff() {
-	sendLock <- false
+// New creates collector client sending over conn, conn is not closed by Stop
+func New(log logrus.FieldLogger, conn *grpc.ClientConn, no *node.Node) *Client {
+	c := &Client{
+		log:      log,
+		node:     no,
+		conn:     conn,
+		queue:    make(chan *pb.ActionLog, queue_size),
+		sendLock: make(chan bool, 1),
+	}
+	c.sendLockOff()
+	return c
 }
-func Start(collectServer string) {
-	sendLockOff()
-	var err error
-	conn, err = grpc.Dial(collectServer, grpc.WithInsecure())
+
+// Dial creates collector client of collectServer, the connection is established in background
+func Dial(log logrus.FieldLogger, collectServer string, no *node.Node) (*Client, error) {
+	conn, err := grpc.Dial(collectServer, grpc.WithInsecure())
 	if err != nil {
-		log.Fatalf("dial collector failed: %s", err)
+		return nil, err
 	}
+	c := New(log, conn, no)
+	c.owned = true
+	return c, nil
+}
 
-	cronRunner = cron.New()
-	cronRunner.AddFunc("4,19,34,49 * * * * *", send)
-	cronRunner.Start()
+// Collect queues action log, queue is flushed at once when it holds enough logs
+func (c *Client) Collect(al *pb.ActionLog) {
+	l := len(c.queue)
+	if l < cap(c.queue)*9/10 {
+		c.queue <- al
+	} else {
+		c.log.Warnf("queue will be full, abandon action log, ticket: %s", al.Ticket)
+	}
+	if l > send_immediate_min {
+		go c.send()
+	}
 }
 
-func Stop() {
-	cronRunner.Stop()
-	conn.Close()
+// Start sends queued action logs periodically
+func (c *Client) Start() {
+	c.cronRunner = cron.New()
+	c.cronRunner.AddFunc("4,19,34,49 * * * * *", c.send)
+	c.cronRunner.Start()
 }
 
-func send() {
+// Stop stops sending, the connection is closed if it was dialed by client
+func (c *Client) Stop() {
+	if c.cronRunner != nil {
+		c.cronRunner.Stop()
+	}
+	if c.owned {
+		c.conn.Close()
+	}
+}
+
+func (c *Client) sendLockOff() {
+	c.sendLock <- false
+}
+
+func (c *Client) send() {
 	select {
-	case _ = <-sendLock:
-		defer sendLockOff()
-		if err := doSend(); err != nil {
-			log.Warnf("send action log to collector error: %s", err)
+	case _ = <-c.sendLock:
+		defer c.sendLockOff()
+		if err := c.doSend(); err != nil {
+			c.log.Warnf("send action log to collector error: %s", err)
 		}
 	default:
 	}
 }
 
-func doSend() error {
-	pcsc := pb.NewClientCollectorServiceClient(conn)
+func (c *Client) doSend() error {
+	if len(c.queue) == 0 {
+		return nil
+	}
+	pcsc := pb.NewClientCollectorServiceClient(c.conn)
 	stream, err := pcsc.Collect(context.Background())
-	var req *pb.CollectReq
 	if err != nil {
-		fmt.Printf("RPC Collect failed: %s", err.Error())
 		return err
 	}
 	for {
-		if len(queue) == 0 {
+		if len(c.queue) == 0 {
 			break
 		}
-		size := len(queue)
+		size := len(c.queue)
 		if size > batch_max {
 			size = batch_max
 		}
-		req = buildReq(size)
+		req := c.buildReq(size)
 		if req == nil {
 			continue
 		}
@@ -95,20 +137,19 @@ func doSend() error {
 	return err
 }
 
-func buildReq(size int) *pb.CollectReq {
+func (c *Client) buildReq(size int) *pb.CollectReq {
 	bs := make([]*pb.ActionLog, 0, size)
 	for i := 0; i < size; i++ {
-		bs = append(bs, <-queue)
+		bs = append(bs, <-c.queue)
 	}
-	//no := node.LoadFormConfig()
-	batch := &pb.Batch{NodeId: NodePtr.NodeId,
+	batch := &pb.Batch{NodeId: c.node.NodeId,
 		Timestamp: uint64(time.Now().UnixNano()),
 		ActionLog: bs}
-	batch.SignReq(NodePtr.PriKey)
+	batch.SignReq(c.node.PriKey)
 
 	data, err := proto.Marshal(batch)
 	if err != nil {
-		log.Errorf("buildReq marshal proto error: %s", err)
+		c.log.Errorf("buildReq marshal proto error: %s", err)
 		return nil
 	}
 	return &pb.CollectReq{Data: data}
@@ -5,24 +5,13 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"strconv"
-	"sync"
 	"time"
 )
 
-// ProgressCell for progress bar
-type ProgressCell struct {
-	Total   uint64
-	Current uint64
-	Rate    float64
-	Time    uint64
-}
-
 // UnifiedResponse for all reponse format
 type UnifiedResponse struct {
 	Errmsg string `json:"errmsg"`
@@ -109,77 +98,6 @@ type HashFile struct {
 	SliceIndex int
 }
 
-// ProgressManager progress stats
-type ProgressManager struct {
-	Progress             map[string]ProgressCell
-	PartitionToOriginMap map[string]string // a.txt.1 -> a.txt ; a.txt.2 -> a.txt for progress
-	Mutex                sync.Mutex
-}
-
-// NewProgressManager create progress status manager
-func NewProgressManager() *ProgressManager {
-	pm := &ProgressManager{}
-	pm.Progress = map[string]ProgressCell{}
-	pm.PartitionToOriginMap = map[string]string{}
-	return pm
-}
-
-// SetProgress set current progress file size
-func (pm *ProgressManager) SetProgress(fileName string, currentSize, totalSize uint64) {
-	pm.Progress[fileName] = ProgressCell{Total: totalSize, Current: currentSize, Rate: 0.0, Time: Now()}
-}
-
-// SetPartitionMap set progress file map
-func (pm *ProgressManager) SetPartitionMap(fileName, originFile string) {
-	pm.PartitionToOriginMap[fileName] = originFile
-}
-
-// SetIncrement set increment
-func (pm *ProgressManager) SetIncrement(fileName string, increment uint64) error {
-	pm.Mutex.Lock()
-	defer pm.Mutex.Unlock()
-	if cell, ok := pm.Progress[fileName]; ok {
-		cell.Current = cell.Current + increment
-		cell.Time = Now()
-		pm.Progress[fileName] = cell
-		return nil
-	}
-	return errors.New("not in progress map")
-}
-
-func match(fileMap map[string]struct{}, file string) bool {
-	if len(fileMap) == 0 {
-		return true
-	}
-	_, ok := fileMap[file]
-	return ok
-}
-
-// GetProgress return progress data
-func (pm *ProgressManager) GetProgress(files []string) (map[string]float64, error) {
-	mp := map[string]struct{}{}
-	for _, file := range files {
-		mp[file] = struct{}{}
-	}
-	a := map[string]float64{}
-	for k, v := range pm.Progress {
-		if !match(mp, k) {
-			continue
-		}
-		if v.Total != 0 {
-			rate := fmt.Sprintf("%0.2f", float64(v.Current)/float64(v.Total))
-			x, err := strconv.ParseFloat(rate, 10)
-			if err != nil {
-				return a, err
-			}
-			a[k] = x
-		} else {
-			a[k] = 0.0
-		}
-	}
-	return a, nil
-}
-
 // Now return current unix timestamp
 func Now() uint64 {
 	return uint64(time.Now().UTC().Unix())
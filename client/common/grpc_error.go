@@ -6,8 +6,22 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// StatusError grpc status error, status.Code and status.FromError get its status
+type StatusError struct {
+	st *status.Status
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("code %d, msg %s", e.st.Code(), e.st.Message())
+}
+
+// GRPCStatus returns status of the error
+func (e *StatusError) GRPCStatus() *status.Status {
+	return e.st
+}
+
 // StatusErrFromError return grpc status error
 func StatusErrFromError(err error) error {
 	st, _ := status.FromError(err)
-	return fmt.Errorf("code %d, msg %s", st.Code(), st.Message())
+	return &StatusError{st: st}
 }
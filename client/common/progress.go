@@ -0,0 +1,330 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// stages of a transfer
+const (
+	StageQueued      = "queued"
+	StageEncoding    = "encoding"
+	StageUploading   = "uploading"
+	StageDownloading = "downloading"
+	StageVerifying   = "verifying"
+	StagePaused      = "paused"
+	StageCancelled   = "cancelled"
+	StageDone        = "done"
+	StageFailed      = "failed"
+)
+
+var (
+	// ProgressExpire finished progress is removed after ProgressExpire
+	ProgressExpire = 5 * time.Minute
+	// ProgressEventInterval byte progress of a file is published at most once every ProgressEventInterval
+	ProgressEventInterval = 500 * time.Millisecond
+	// rateWindow rate is sampled once every rateWindow
+	rateWindow = time.Second
+	// subscriberBuffer events buffered for a subscriber, events are dropped for a subscriber too slow
+	subscriberBuffer = 256
+)
+
+// ProgressCell for progress bar, Rate is bytes per second
+type ProgressCell struct {
+	Total    uint64
+	Current  uint64
+	Rate     float64
+	Time     uint64
+	Stage    string
+	Block    int
+	Blocks   int
+	Error    string
+	Finished time.Time
+
+	sampleAt    time.Time
+	sampleBytes uint64
+	publishedAt time.Time
+}
+
+// eta returns seconds left at current rate, -1 if unknown
+func (cell *ProgressCell) eta() int64 {
+	if cell.Rate <= 0 || cell.Current >= cell.Total {
+		if cell.Current >= cell.Total && cell.Total != 0 {
+			return 0
+		}
+		return -1
+	}
+	return int64(float64(cell.Total-cell.Current) / cell.Rate)
+}
+
+// sample updates rate by bytes transferred since last sample
+func (cell *ProgressCell) sample(now time.Time) {
+	if cell.sampleAt.IsZero() || cell.Current < cell.sampleBytes {
+		cell.sampleAt, cell.sampleBytes = now, cell.Current
+		return
+	}
+	elapsed := now.Sub(cell.sampleAt)
+	if elapsed < rateWindow {
+		return
+	}
+	rate := float64(cell.Current-cell.sampleBytes) / elapsed.Seconds()
+	if cell.Rate == 0 {
+		cell.Rate = rate
+	} else {
+		// smooth rate of bursty block transfers
+		cell.Rate = 0.7*cell.Rate + 0.3*rate
+	}
+	cell.sampleAt, cell.sampleBytes = now, cell.Current
+}
+
+// Event progress or lifecycle event of a transfer, ETA is seconds left and -1 if unknown
+type Event struct {
+	File    string  `json:"file"`
+	Job     string  `json:"job,omitempty"`
+	Stage   string  `json:"stage"`
+	Current uint64  `json:"current"`
+	Total   uint64  `json:"total"`
+	Rate    float64 `json:"rate"`
+	ETA     int64   `json:"eta"`
+	Block   int     `json:"block,omitempty"`
+	Blocks  int     `json:"blocks,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	Time    int64   `json:"time"`
+}
+
+func newEvent(file string, cell *ProgressCell) Event {
+	return Event{
+		File:    file,
+		Stage:   cell.Stage,
+		Current: cell.Current,
+		Total:   cell.Total,
+		Rate:    cell.Rate,
+		ETA:     cell.eta(),
+		Block:   cell.Block,
+		Blocks:  cell.Blocks,
+		Error:   cell.Error,
+		Time:    time.Now().UnixNano(),
+	}
+}
+
+// ProgressManager progress stats, changes are published to subscribers
+type ProgressManager struct {
+	Progress             map[string]ProgressCell
+	PartitionToOriginMap map[string]string // a.txt.1 -> a.txt ; a.txt.2 -> a.txt for progress
+	Mutex                sync.Mutex
+
+	subscribers map[chan Event]bool
+}
+
+// NewProgressManager create progress status manager
+func NewProgressManager() *ProgressManager {
+	pm := &ProgressManager{}
+	pm.Progress = map[string]ProgressCell{}
+	pm.PartitionToOriginMap = map[string]string{}
+	pm.subscribers = map[chan Event]bool{}
+	return pm
+}
+
+// Subscribe returns channel of events and function to stop subscription
+func (pm *ProgressManager) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	pm.subscribers[ch] = true
+	return ch, func() {
+		pm.Mutex.Lock()
+		defer pm.Mutex.Unlock()
+		if pm.subscribers[ch] {
+			delete(pm.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends event to subscribers
+func (pm *ProgressManager) Publish(ev Event) {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	pm.publish(ev)
+}
+
+// publish must be called with mutex held
+func (pm *ProgressManager) publish(ev Event) {
+	for ch := range pm.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// expire removes progress finished ProgressExpire ago, must be called with mutex held
+func (pm *ProgressManager) expire(now time.Time) {
+	expired := map[string]bool{}
+	for file, cell := range pm.Progress {
+		if !cell.Finished.IsZero() && now.Sub(cell.Finished) > ProgressExpire {
+			delete(pm.Progress, file)
+			expired[file] = true
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	for part, origin := range pm.PartitionToOriginMap {
+		if expired[origin] {
+			delete(pm.PartitionToOriginMap, part)
+		}
+	}
+}
+
+// update changes cell of fileName by f and publishes it if publish, must be called with mutex held
+func (pm *ProgressManager) update(fileName string, publish bool, f func(cell *ProgressCell)) {
+	now := time.Now()
+	pm.expire(now)
+	cell := pm.Progress[fileName]
+	f(&cell)
+	cell.Time = Now()
+	if publish {
+		cell.publishedAt = now
+	}
+	pm.Progress[fileName] = cell
+	if publish {
+		pm.publish(newEvent(fileName, &cell))
+	}
+}
+
+// SetProgress set current progress file size
+func (pm *ProgressManager) SetProgress(fileName string, currentSize, totalSize uint64) {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	pm.update(fileName, true, func(cell *ProgressCell) {
+		cell.Total, cell.Current, cell.Rate = totalSize, currentSize, 0.0
+		cell.sampleAt, cell.sampleBytes = time.Time{}, 0
+		cell.Finished, cell.Error = time.Time{}, ""
+	})
+}
+
+// SetStage set stage of file, a finished file is started again
+func (pm *ProgressManager) SetStage(fileName, stage string) {
+	pm.SetBlock(fileName, stage, 0, 0)
+}
+
+// SetBlock set stage of file with block n of m blocks done
+func (pm *ProgressManager) SetBlock(fileName, stage string, n, m int) {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	pm.update(fileName, true, func(cell *ProgressCell) {
+		cell.Stage, cell.Block, cell.Blocks = stage, n, m
+		cell.Finished, cell.Error = time.Time{}, ""
+	})
+}
+
+// Finish set file done, or failed with reason of err, it is removed after ProgressExpire
+func (pm *ProgressManager) Finish(fileName string, err error) {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	pm.update(fileName, true, func(cell *ProgressCell) {
+		cell.Finished = time.Now()
+		cell.Rate = 0
+		switch {
+		case err == nil:
+			cell.Stage = StageDone
+			cell.Current = cell.Total
+		case err == context.Canceled:
+			cell.Stage = StageCancelled
+		default:
+			cell.Stage, cell.Error = StageFailed, err.Error()
+		}
+	})
+}
+
+// SetPartitionMap set progress file map
+func (pm *ProgressManager) SetPartitionMap(fileName, originFile string) {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	pm.PartitionToOriginMap[fileName] = originFile
+}
+
+// Origin returns file which partition fileName belongs to
+func (pm *ProgressManager) Origin(fileName string) (string, bool) {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	origin, ok := pm.PartitionToOriginMap[fileName]
+	return origin, ok
+}
+
+// SetIncrement set increment
+func (pm *ProgressManager) SetIncrement(fileName string, increment uint64) error {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	cell, ok := pm.Progress[fileName]
+	if !ok {
+		return errors.New("not in progress map")
+	}
+	now := time.Now()
+	pm.update(fileName, now.Sub(cell.publishedAt) >= ProgressEventInterval, func(cell *ProgressCell) {
+		cell.Current = cell.Current + increment
+		cell.sample(now)
+	})
+	return nil
+}
+
+func match(fileMap map[string]struct{}, file string) bool {
+	if len(fileMap) == 0 {
+		return true
+	}
+	_, ok := fileMap[file]
+	return ok
+}
+
+// GetProgress return progress data
+func (pm *ProgressManager) GetProgress(files []string) (map[string]float64, error) {
+	mp := map[string]struct{}{}
+	for _, file := range files {
+		mp[file] = struct{}{}
+	}
+	a := map[string]float64{}
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	pm.expire(time.Now())
+	for k, v := range pm.Progress {
+		if !match(mp, k) {
+			continue
+		}
+		if v.Total != 0 {
+			rate := fmt.Sprintf("%0.2f", float64(v.Current)/float64(v.Total))
+			x, err := strconv.ParseFloat(rate, 10)
+			if err != nil {
+				return a, err
+			}
+			a[k] = x
+		} else {
+			a[k] = 0.0
+		}
+	}
+	return a, nil
+}
+
+// Events returns current progress of files as events, all files if files is empty
+func (pm *ProgressManager) Events(files []string) []Event {
+	mp := map[string]struct{}{}
+	for _, file := range files {
+		mp[file] = struct{}{}
+	}
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	pm.expire(time.Now())
+	events := []Event{}
+	for k, v := range pm.Progress {
+		if match(mp, k) {
+			events = append(events, newEvent(k, &v))
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].File < events[j].File })
+	return events
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestProgressEvents(t *testing.T) {
+	pm := NewProgressManager()
+	events, cancel := pm.Subscribe()
+	defer cancel()
+
+	pm.SetStage("/a", StageEncoding)
+	require.Equal(t, StageEncoding, nextEvent(t, events).Stage)
+	pm.SetProgress("/a", 0, 1000)
+	nextEvent(t, events)
+	pm.SetBlock("/a", StageUploading, 1, 4)
+	ev := nextEvent(t, events)
+	require.Equal(t, StageUploading, ev.Stage)
+	require.Equal(t, 1, ev.Block)
+	require.Equal(t, 4, ev.Blocks)
+	require.Equal(t, int64(-1), ev.ETA)
+
+	require.Error(t, pm.SetIncrement("/b", 10))
+	// increments are throttled, rate is known after rateWindow
+	interval := ProgressEventInterval
+	ProgressEventInterval = 0
+	defer func() { ProgressEventInterval = interval }()
+	require.NoError(t, pm.SetIncrement("/a", 100))
+	nextEvent(t, events)
+	pm.Mutex.Lock()
+	cell := pm.Progress["/a"]
+	cell.sampleAt = cell.sampleAt.Add(-2 * time.Second)
+	pm.Progress["/a"] = cell
+	pm.Mutex.Unlock()
+	require.NoError(t, pm.SetIncrement("/a", 100))
+	ev = nextEvent(t, events)
+	require.Equal(t, uint64(200), ev.Current)
+	require.InDelta(t, 50, ev.Rate, 1)
+	require.InDelta(t, 16, ev.ETA, 1)
+	require.Equal(t, StageUploading, ev.Stage)
+
+	pm.Finish("/a", nil)
+	ev = nextEvent(t, events)
+	require.Equal(t, StageDone, ev.Stage)
+	require.Equal(t, uint64(1000), ev.Current)
+	require.Equal(t, int64(0), ev.ETA)
+	pm.SetProgress("/b", 0, 10)
+	nextEvent(t, events)
+	pm.Finish("/b", errors.New("provider down"))
+	ev = nextEvent(t, events)
+	require.Equal(t, StageFailed, ev.Stage)
+	require.Equal(t, "provider down", ev.Error)
+	pm.SetProgress("/c", 0, 10)
+	nextEvent(t, events)
+	pm.Finish("/c", context.Canceled)
+	require.Equal(t, StageCancelled, nextEvent(t, events).Stage)
+
+	evs := pm.Events([]string{"/b", "/c"})
+	require.Len(t, evs, 2)
+	require.Equal(t, "/b", evs[0].File)
+	require.Len(t, pm.Events(nil), 3)
+
+	cancel()
+	_, ok := <-events
+	require.False(t, ok)
+	pm.Publish(Event{File: "/a"})
+}
+
+func TestProgressExpire(t *testing.T) {
+	pm := NewProgressManager()
+	pm.SetProgress("/a", 0, 10)
+	pm.SetPartitionMap("/tmp/a.1", "/a")
+	pm.SetProgress("/b", 0, 10)
+	pm.SetPartitionMap("/tmp/b.1", "/b")
+	pm.Finish("/a", nil)
+
+	pm.Mutex.Lock()
+	cell := pm.Progress["/a"]
+	cell.Finished = cell.Finished.Add(-ProgressExpire - time.Second)
+	pm.Progress["/a"] = cell
+	pm.Mutex.Unlock()
+
+	progress, err := pm.GetProgress(nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{"/b": 0}, progress)
+	_, ok := pm.Origin("/tmp/a.1")
+	require.False(t, ok)
+	origin, ok := pm.Origin("/tmp/b.1")
+	require.True(t, ok)
+	require.Equal(t, "/b", origin)
+}
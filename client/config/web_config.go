@@ -26,6 +26,9 @@ const (
 
 	// DefaultWebDir default web dir
 	DefaultWebDir = "./web/build"
+
+	// DefaultThrottleDuration default duration of throttle
+	DefaultThrottleDuration = time.Minute
 )
 
 // Config config for web
@@ -41,10 +44,30 @@ type Config struct {
 	AutoTLSHost      string        `json:"auto_tls_host"`
 	TLSCert          string        `json:"tls_cert"`
 	TLSKey           string        `json:"tls_key"`
-	ThrottleMax      int64         `json:"throttle_max"` // Maximum number of requests per duration
-	ThrottleDuration time.Duration `json:"throttle_duration"`
-	BehindProxy      bool          `json:"behind_proxy"`
-	APIEnabled       bool          `json:"api_enabled"`
+	ThrottleMax      int64         `json:"throttle_max"`      // Maximum number of requests of a client per duration, no limit if 0
+	ThrottleDuration time.Duration `json:"throttle_duration"` // nanoseconds, one minute if 0
+	BehindProxy      bool          `json:"behind_proxy"`      // client address is taken from X-Forwarded-For of trusted proxies
+	TrustedProxies   []string      `json:"trusted_proxies"`   // CIDRs or ips of proxies, loopback if empty
+	APIEnabled       bool          `json:"api_enabled"`       // only static files are served if false, true if not in config file
+	WebDAVAddr       string        `json:"webdav_addr"`       // WebDAV is disabled if empty
+	WebDAVUser       string        `json:"webdav_user"`
+	WebDAVPassword   string        `json:"webdav_password"`
+	WebDAVEncrypt    bool          `json:"webdav_encrypt"` // files put by WebDAV are encrypted, true if not in config file
+	S3Addr           string        `json:"s3_addr"`        // S3 gateway is disabled if empty
+	S3AccessKey      string        `json:"s3_access_key"`
+	S3SecretKey      string        `json:"s3_secret_key"`
+	S3Space          uint32        `json:"s3_space"`          // space of buckets which are top level folders
+	S3Encrypt        bool          `json:"s3_encrypt"`        // objects put by S3 gateway are encrypted, true if not in config file
+	APIAuthDisabled  bool          `json:"api_auth_disabled"` // API needs no token, only for trusted networks
+	APITokens        []APIToken    `json:"api_tokens"`
+	AllowedHosts     []string      `json:"allowed_hosts"` // Host header names allowed besides localhost, ip and listen hosts
+}
+
+// APIToken token of API calls, Scope is read, write or admin
+type APIToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Scope string `json:"scope"`
 }
 
 // SetDefault set default value
@@ -68,6 +91,9 @@ func (cfg *Config) SetDefault() {
 	if cfg.StaticDir == "" {
 		cfg.StaticDir = DefaultWebDir
 	}
+	if cfg.ThrottleMax > 0 && cfg.ThrottleDuration == 0 {
+		cfg.ThrottleDuration = DefaultThrottleDuration
+	}
 }
 
 // Validate validate config correctness
@@ -92,7 +118,8 @@ func LoadWebConfig(configFilePath string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	cc := new(Config)
+	// API is enabled and uploads are encrypted unless they are turned off in config file
+	cc := &Config{APIEnabled: true, WebDAVEncrypt: true, S3Encrypt: true}
 	err = json.Unmarshal(byteValue, cc)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,220 @@
+// Package daemontest provides a net disk in memory for tests of packages using a client manager
+package daemontest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/samoslab/nebula/client/daemon"
+)
+
+// ModTime modification time of all files listed
+const ModTime = 1528000000
+
+// File a file or folder of Remote
+type File struct {
+	ID        string
+	Folder    bool
+	Data      []byte
+	Encrypted bool
+}
+
+// Remote net disk in memory keyed by space and absolute path, it does file operations of *daemon.ClientManager
+type Remote struct {
+	mutex     sync.Mutex
+	files     map[string]*File
+	nextID    int
+	Downloads int
+	Moves     int
+}
+
+// NewRemote returns an empty net disk
+func NewRemote() *Remote {
+	return &Remote{files: map[string]*File{}}
+}
+
+func key(sno uint32, name string) string {
+	return fmt.Sprintf("%d:%s", sno, name)
+}
+
+func hashOf(data []byte) string {
+	hash := sha1.Sum(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func (m *Remote) exists(sno uint32, dir string) bool {
+	f, ok := m.files[key(sno, dir)]
+	return dir == "/" || (ok && f.Folder)
+}
+
+func (m *Remote) add(sno uint32, name string, f *File) {
+	m.nextID++
+	f.ID = fmt.Sprintf("%04d", m.nextID)
+	m.files[key(sno, name)] = f
+}
+
+// Put writes file name of space sno, its folder is not checked
+func (m *Remote) Put(sno uint32, name string, data []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.add(sno, name, &File{Data: data})
+}
+
+// File returns file name of space sno, nil if it not exists
+func (m *Remote) File(sno uint32, name string) *File {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.files[key(sno, name)]
+}
+
+// ListFiles lists folder dir sorted by name
+func (m *Remote) ListFiles(dir string, pageSize, pageNum uint32, sortType string, ascOrder bool, sno uint32) (*daemon.FilePages, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.exists(sno, dir) {
+		return nil, fmt.Errorf("%s not exists", dir)
+	}
+	names := []string{}
+	for k := range m.files {
+		name := strings.SplitN(k, ":", 2)[1]
+		if strings.HasPrefix(k, key(sno, "")) && path.Dir(name) == dir && name != "/" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	files := []*daemon.DownFile{}
+	for i := int((pageNum - 1) * pageSize); i < len(names) && i < int(pageNum*pageSize); i++ {
+		f := m.files[key(sno, names[i])]
+		df := &daemon.DownFile{ID: f.ID, FileName: path.Base(names[i]), Folder: f.Folder, ModTime: ModTime}
+		if !f.Folder {
+			df.FileSize, df.FileHash = uint64(len(f.Data)), hashOf(f.Data)
+		}
+		files = append(files, df)
+	}
+	return &daemon.FilePages{Total: uint32(len(names)), Files: files}, nil
+}
+
+// ListFolder lists all files of folder dir
+func (m *Remote) ListFolder(dir string, sno uint32) ([]*daemon.DownFile, error) {
+	return daemon.ListPages(dir, func(pageSize, pageNum uint32) (*daemon.FilePages, error) {
+		return m.ListFiles(dir, pageSize, pageNum, "name", true, sno)
+	})
+}
+
+// UploadFile writes content of local file fileName to folder dest
+func (m *Remote) UploadFile(fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.exists(sno, dest) {
+		return fmt.Errorf("%s not exists", dest)
+	}
+	m.add(sno, path.Join(dest, filepath.Base(fileName)), &File{Data: data, Encrypted: isEncrypt})
+	return nil
+}
+
+// DownloadFile writes file downFileName of hash filehash to local folder destDir
+func (m *Remote) DownloadFile(downFileName, destDir, filehash string, fileSize uint64, sno uint32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f, ok := m.files[key(sno, downFileName)]
+	if !ok || hashOf(f.Data) != filehash {
+		return fmt.Errorf("%s not exists", downFileName)
+	}
+	m.Downloads++
+	return ioutil.WriteFile(filepath.Join(destDir, path.Base(downFileName)), f.Data, 0644)
+}
+
+// OpenFile returns content of file fileName of hash fileHash, it is counted as downloaded when it is read
+func (m *Remote) OpenFile(ctx context.Context, fileName, fileHash string, fileSize uint64, sno uint32) (daemon.File, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f, ok := m.files[key(sno, fileName)]
+	if !ok || hashOf(f.Data) != fileHash {
+		return nil, fmt.Errorf("%s not exists", fileName)
+	}
+	return &content{Reader: bytes.NewReader(f.Data), m: m}, nil
+}
+
+type content struct {
+	*bytes.Reader
+	m    *Remote
+	read bool
+}
+
+func (c *content) downloaded() {
+	if !c.read {
+		c.read = true
+		c.m.mutex.Lock()
+		c.m.Downloads++
+		c.m.mutex.Unlock()
+	}
+}
+
+func (c *content) Read(p []byte) (int, error) {
+	c.downloaded()
+	return c.Reader.Read(p)
+}
+
+func (c *content) ReadAt(p []byte, off int64) (int, error) {
+	c.downloaded()
+	return c.Reader.ReadAt(p, off)
+}
+
+func (c *content) Close() error {
+	return nil
+}
+
+// MkFolder creates folders in folder parent, existing ones are kept
+func (m *Remote) MkFolder(parent string, folders []string, interactive bool, sno uint32) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.exists(sno, parent) {
+		return false, fmt.Errorf("%s not exists", parent)
+	}
+	for _, folder := range folders {
+		if _, ok := m.files[key(sno, path.Join(parent, folder))]; !ok {
+			m.add(sno, path.Join(parent, folder), &File{Folder: true})
+		}
+	}
+	return true, nil
+}
+
+// RemoveFile removes path target and all under it
+func (m *Remote) RemoveFile(target string, recursive bool, isPath bool, sno uint32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for k := range m.files {
+		if k == key(sno, target) || strings.HasPrefix(k, key(sno, target)+"/") {
+			delete(m.files, k)
+		}
+	}
+	return nil
+}
+
+// MoveFile moves file of id source to path dest
+func (m *Remote) MoveFile(source, dest string, sno uint32) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for k, f := range m.files {
+		if f.ID == source && strings.HasPrefix(k, key(sno, "")) {
+			delete(m.files, k)
+			m.files[key(sno, dest)] = f
+			m.Moves++
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not exists", source)
+}
@@ -1,17 +1,18 @@
 package daemon
 
 import (
+	"container/list"
 	"context"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/hex"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -23,7 +24,6 @@ import (
 	"github.com/samoslab/nebula/client/config"
 	"github.com/samoslab/nebula/client/order"
 	client "github.com/samoslab/nebula/client/provider_client"
-	pb "github.com/samoslab/nebula/provider/pb"
 	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
 	"github.com/samoslab/nebula/util/aes"
 	util_file "github.com/samoslab/nebula/util/file"
@@ -31,15 +31,18 @@ import (
 	rsalong "github.com/samoslab/nebula/util/rsa"
 	"github.com/sirupsen/logrus"
 
-	"github.com/samoslab/nebula/client/register"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	// InfoForEncrypt info for encrypt
 	InfoForEncrypt = "this is a interesting info for encrypt msg"
-	// SysFile store password hash file
+	// SysFile keeps space key sealed by password of space in root of the space
 	SysFile = ".nebula"
+	// ListPageSize files of one page listing a whole folder
+	ListPageSize = 100
 )
 
 var (
@@ -67,81 +70,20 @@ type ClientManager struct {
 	SpaceM        *SpaceManager
 	TrackerPubkey *rsa.PublicKey
 	PubkeyHash    []byte
-	webcfg        config.Config
 	FileTypeMap   filetype.SupportType
-}
-
-// NewClientManager create manager
-func NewClientManager(log logrus.FieldLogger, webcfg config.Config, cfg *config.ClientConfig) (*ClientManager, error) {
-	if webcfg.TrackerServer == "" {
-		return nil, errors.New("tracker server nil")
-	}
-	if webcfg.CollectServer == "" {
-		return nil, errors.New("collect server nil")
-	}
-	if cfg == nil {
-		return nil, errors.New("client config nil")
-	}
-	//conn, err := grpc.Dial(webcfg.TrackerServer, grpc.WithBlock(), grpc.WithInsecure(), grpc.WithKeepaliveParams(keepalive.ClientParameters{
-	//	Time:                50 * time.Millisecond,
-	//	Timeout:             100 * time.Millisecond,
-	//	PermitWithoutStream: true,
-	//}))
-	conn, err := grpc.Dial(webcfg.TrackerServer, grpc.WithBlock(), grpc.WithInsecure())
-	if err != nil {
-		log.Errorf("Rpc dial failed: %s", err.Error())
-		return nil, err
-	}
-	log.Infof("Tracker server %s", webcfg.TrackerServer)
-
-	rsaPubkey, pubkeyHash, err := register.GetPublicKey(webcfg.TrackerServer)
-	if err != nil {
-		return nil, err
-	}
-
-	om := order.NewOrderManager(webcfg.TrackerServer, log, cfg.Node.PriKey, cfg.Node.NodeId)
-
-	spaceM := NewSpaceManager()
-	for _, sp := range cfg.Space {
-		log.Infof("Space %d name %s home %s", sp.SpaceNo, sp.Name, sp.Home)
-		spaceM.AddSpace(sp.SpaceNo, sp.Password, sp.Home)
-	}
-
-	c := &ClientManager{
-		serverConn:    conn,
-		Log:           log,
-		cfg:           cfg,
-		TempDir:       os.TempDir(),
-		NodeId:        cfg.Node.NodeId,
-		PM:            common.NewProgressManager(),
-		mclient:       mpb.NewMatadataServiceClient(conn),
-		OM:            om,
-		SpaceM:        spaceM,
-		TrackerPubkey: rsaPubkey,
-		PubkeyHash:    pubkeyHash,
-		webcfg:        webcfg,
-		FileTypeMap:   filetype.SupportTypes(),
-	}
-
-	collectClient.NodePtr = cfg.Node
-
-	log.Infof("Temp dir is %s", c.TempDir)
-	if _, err := os.Stat(c.TempDir); os.IsNotExist(err) {
-		//create the dir.
-		if err := os.MkdirAll(c.TempDir, 0744); err != nil {
-			panic(err)
-		}
-	}
-
-	collectClient.Start(webcfg.CollectServer)
-
-	return c, nil
-}
 
-// Shutdown shutdown tracker connection
-func (c *ClientManager) Shutdown() {
-	c.serverConn.Close()
-	collectClient.Stop()
+	configDir     string
+	transport     ProviderTransport
+	collector     collectClient.Collector
+	collectClient *collectClient.Client
+
+	uploadingMutex sync.Mutex
+	uploading      map[string]bool // journal path of running uploads
+	resolvedMutex  sync.Mutex
+	resolved       map[string]*list.Element // plaintext path to path in tracker of listed files of encrypted names
+	resolvedOrder  *list.List               // front is the most recently used
+	contentOnce    sync.Once
+	content        *partCache // decoded partitions of files read by ranges
 }
 
 // SetRoot set user root directory
@@ -199,13 +141,13 @@ func passwordPadding(originPasswd string, sno uint32) (string, error) {
 		}
 		realPasswd = originPasswd + padding(32-length)
 	default:
-		return "", fmt.Errorf("space %d not exist", sno)
+		return "", spaceNotExist(sno)
 	}
 
 	return realPasswd, nil
 }
 
-// SetPassword set user privacy space password
+// SetPassword set user privacy space password, a new space gets a random key sealed by the password
 func (c *ClientManager) SetPassword(sno uint32, password string) error {
 	var err error
 	log := c.Log
@@ -214,40 +156,51 @@ func (c *ClientManager) SetPassword(sno uint32, password string) error {
 		return err
 	}
 	data, err := c.GetSpaceSysFileData(sno)
-	if err == nil {
-		if len(data) != 0 {
-			log.Infof("Space %d password has been set", sno)
-			if verifyPassword(sno, password, data) {
-				log.Infof("Space %d password verified success", sno)
-				return c.SpaceM.SetSpacePasswd(sno, password)
-			}
-			return fmt.Errorf("Password incorrect")
+	if err != nil {
+		log.Errorf("Get space %d sys file error %v", sno, err)
+		return err
+	}
+	if len(data) != 0 {
+		log.Infof("Space %d password has been set", sno)
+		spaceKey, err := unlockSpaceKey(sno, password, data)
+		if err != nil {
+			return err
 		}
+		log.Infof("Space %d password verified success", sno)
+		return c.SpaceM.SetSpaceKey(sno, password, spaceKey)
 	}
 
-	log.Infof("Get space %d sys file error %v", sno, err)
-	err = c.SpaceM.SetSpacePasswd(sno, password)
+	log.Infof("Space %d sys file not found, create space key", sno)
+	spaceKey, err := randomKey()
+	if err != nil {
+		return err
+	}
+	kf, err := newSpaceKeyFile(password, spaceKey)
 	if err != nil {
 		return err
 	}
+	// key is used only after it is kept by tracker, or files are sealed by a key lost on restart
+	if err := c.saveSpaceKeyFile(sno, kf, false); err != nil {
+		return err
+	}
+	return c.SpaceM.SetSpaceKey(sno, password, spaceKey)
+}
 
-	encryDir := filepath.Join(c.webcfg.ConfigDir, fmt.Sprintf("space%d", sno))
+// uploadSpaceSysFile writes data to sys file of space and uploads it to space root
+func (c *ClientManager) uploadSpaceSysFile(sno uint32, data []byte, newVersion bool) error {
+	encryDir := filepath.Join(c.configDir, fmt.Sprintf("space%d", sno))
 	if !util_file.Exists(encryDir) {
 		if err := os.MkdirAll(encryDir, 0700); err != nil {
 			return fmt.Errorf("mkdir space %d nebula folder %s failed:%s", sno, encryDir, err)
 		}
 	}
 
-	shaData, err := genEncryptKey(sno, password)
-	if err != nil {
-		return err
-	}
 	encryFile := filepath.Join(encryDir, SysFile)
-	if err = ioutil.WriteFile(encryFile, shaData, 0600); err != nil {
+	if err := ioutil.WriteFile(encryFile, data, 0600); err != nil {
 		return err
 	}
 
-	return c.UploadFile(encryFile, "/", false, false, false, sno)
+	return c.UploadFile(encryFile, "/", false, newVersion, false, sno)
 }
 
 // VerifyPassword set user privacy space password
@@ -260,10 +213,8 @@ func (c *ClientManager) VerifyPassword(sno uint32, password string) error {
 	data, err := c.GetSpaceSysFileData(sno)
 	if err == nil {
 		if len(data) != 0 {
-			if verifyPassword(sno, password, data) {
-				return nil
-			}
-			return fmt.Errorf("Password incorrect")
+			_, err := unlockSpaceKey(sno, password, data)
+			return err
 		}
 	}
 	return fmt.Errorf("space %d password not set", sno)
@@ -282,7 +233,7 @@ func (c *ClientManager) CheckSpaceStatus(sno uint32) error {
 		return nil
 	}
 	data, err := c.GetSpaceSysFileData(sno)
-	if err == nil && len(data) >= 0 {
+	if err == nil && len(data) != 0 {
 		return nil
 	}
 	return fmt.Errorf("space %d password not set", sno)
@@ -291,20 +242,15 @@ func (c *ClientManager) CheckSpaceStatus(sno uint32) error {
 func (c *ClientManager) getPingTime(ip string, port uint32) int {
 	server := fmt.Sprintf("%s:%d", ip, port)
 	timeStart := time.Now().Unix()
-	conn, err := grpc.Dial(server, grpc.WithInsecure())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pclient, release, err := c.providers().Provider(ctx, server)
 	if err != nil {
 		c.Log.Errorf("Rpc dial failed: %s", err.Error())
 		return 99999
 	}
-	defer conn.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	pclient := pb.NewProviderServiceClient(conn)
-	req := &pb.PingReq{
-		Version: common.Version,
-	}
-	_, err = pclient.Ping(ctx, req)
-	if err != nil {
+	defer release()
+	if err = client.PingContext(ctx, pclient); err != nil {
 		return 99999
 	}
 	timeEnd := time.Now().Unix()
@@ -427,32 +373,20 @@ func createBackupProvicer(workedNum, backupNum int) map[int][]IndexStatus {
 	return backupMap
 }
 
-// BestRetrieveNode ping retrieve node
+// BestRetrieveNode returns the node with lowest latency
 func (c *ClientManager) BestRetrieveNode(pros []*mpb.RetrieveNode) *mpb.RetrieveNode {
-	//todo if provider ip is same
-	type SortablePro struct {
-		Pro   *mpb.RetrieveNode
-		Delay int
-	}
-
-	sortPros := []SortablePro{}
-	for _, bpa := range pros {
-		pingTime := c.getPingTime(bpa.GetServer(), bpa.GetPort())
-		sortPros = append(sortPros, SortablePro{Pro: bpa, Delay: pingTime})
-	}
-
-	sort.Slice(sortPros, func(i, j int) bool { return sortPros[i].Delay < sortPros[j].Delay })
-
-	availablePros := []*mpb.RetrieveNode{}
-	for _, proInfo := range sortPros {
-		availablePros = append(availablePros, proInfo.Pro)
-	}
-
-	return availablePros[0]
+	s := newRetrieveScheduler(c.Log)
+	s.ping = c.pingRetrieveNode
+	return s.rank(context.Background(), pros)[0]
 }
 
 // UploadDir upload all files in dir to provider
 func (c *ClientManager) UploadDir(parent, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error {
+	return c.UploadDirContext(context.Background(), parent, dest, interactive, newVersion, isEncrypt, sno)
+}
+
+// UploadDirContext is UploadDir which stops when ctx is done
+func (c *ClientManager) UploadDirContext(ctx context.Context, parent, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error {
 	log := c.Log
 	if !filepath.IsAbs(parent) {
 		return fmt.Errorf("path %s must absolute", parent)
@@ -474,15 +408,18 @@ func (c *ClientManager) UploadDir(parent, dest string, interactive, newVersion,
 	newDirs := dirAdjust(dirs, parent, dest, runtime.GOOS)
 	log.Debugf("New upload dirs %+v", newDirs)
 	for _, dpair := range newDirs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if dpair.Folder {
 			log.Debugf("Mkfolder %+v", dpair)
-			_, err := c.MkFolder(dpair.Parent, []string{dpair.Name}, interactive, sno)
+			_, err := c.MkFolderContext(ctx, dpair.Parent, []string{dpair.Name}, interactive, sno)
 			if err != nil {
 				return err
 			}
 		} else {
 			log.Debugf("Upload file %+v", dpair)
-			err := c.UploadFile(dpair.Name, dpair.Parent, interactive, newVersion, isEncrypt, sno)
+			err := c.UploadFileContext(ctx, dpair.Name, dpair.Parent, interactive, newVersion, isEncrypt, sno)
 			if err != nil {
 				return err
 			}
@@ -510,33 +447,65 @@ func (c *ClientManager) getSpacePassword(sno uint32) ([]byte, error) {
 
 // UploadFile upload file to provider
 func (c *ClientManager) UploadFile(fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error {
-	var err error
-	var password, encryptKey []byte
+	return c.UploadFileContext(context.Background(), fileName, dest, interactive, newVersion, isEncrypt, sno)
+}
+
+// UploadFileContext is UploadFile which is aborted when ctx is done, upload journal is kept for resume
+func (c *ClientManager) UploadFileContext(ctx context.Context, fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) (err error) {
+	var password, wrappedKey, encryptKey []byte
 	log := c.Log.WithField("upload file", fileName)
+	journalPath := c.journalPath(fileName, dest, sno)
+	if !c.beginUpload(journalPath) {
+		return fmt.Errorf("%s is uploading to %s", fileName, dest)
+	}
+	defer c.endUpload(journalPath)
+	c.PM.SetStage(fileName, common.StageEncoding)
+	defer func() {
+		c.PM.Finish(fileName, err)
+	}()
+	journal := c.openUploadJournal(fileName, dest, sno)
+	if journal != nil && journal.IsEncrypt != isEncrypt {
+		journal.discard(log)
+		journal = nil
+	}
 	if isEncrypt {
-		password, err = c.getSpacePassword(sno)
-		if err != nil {
-			log.WithError(err).Info("Get space password")
-			return err
-		}
-		fmt.Printf("password %s\n", string(password))
-		if len(password) == 0 {
-			log.Info("Space password not set")
-			return fmt.Errorf("Password not set")
+		if journal != nil {
+			// blocks stored already are encrypted by the data key of journal
+			if password, err = c.journalDataKey(journal); err != nil {
+				log.Infof("Data key of upload journal unavailable %v, discard upload journal", err)
+				journal.discard(log)
+				journal = nil
+			} else {
+				wrappedKey, encryptKey = journal.WrappedKey, journal.EncryptKey
+			}
 		}
-		encryptKey, err = rsalong.EncryptLong(c.TrackerPubkey, password, 256)
-		if err != nil {
-			log.WithError(err).Info("Encrypt password")
-			return err
+		if journal == nil {
+			var trackerKey []byte
+			password, trackerKey, err = c.newDataKey(sno)
+			if err != nil {
+				log.WithError(err).Info("Get space password")
+				return err
+			}
+			if sno != 0 {
+				wrappedKey = trackerKey
+			}
+			encryptKey, err = rsalong.EncryptLong(c.TrackerPubkey, trackerKey, 256)
+			if err != nil {
+				log.WithError(err).Info("Encrypt data key")
+				return err
+			}
 		}
 	}
-	req, rsp, err := c.CheckFileExists(fileName, dest, interactive, newVersion, password, encryptKey, sno)
+	req, rsp, err := c.CheckFileExists(ctx, fileName, dest, interactive, newVersion, password, encryptKey, sno)
 	if err != nil {
 		return common.StatusErrFromError(err)
 	}
 
 	log.Infof("Check file %s exists resp code:%d", fileName, rsp.GetCode())
 	if rsp.GetCode() == 0 {
+		if journal != nil {
+			journal.discard(log)
+		}
 		log.Infof("Upload %s success", fileName)
 		return nil
 	}
@@ -548,128 +517,194 @@ func (c *ClientManager) UploadFile(fileName, dest string, interactive, newVersio
 	switch rsp.GetStoreType() {
 	case mpb.FileStoreType_MultiReplica:
 		log.Infof("Upload manner is multi-replication")
+		if journal != nil {
+			journal.discard(log)
+		}
 		// encrypt file
-		originFileName := fileName
+		uploadFileName := fileName
 		if isEncrypt {
 			_, onlyFileName := filepath.Split(fileName)
-			originFileName := filepath.Join(c.TempDir, onlyFileName)
-			err := aes.EncryptFile(fileName, password, originFileName)
+			uploadFileName = filepath.Join(c.TempDir, onlyFileName)
+			err := aes.EncryptFile(fileName, password, uploadFileName)
 			if err != nil {
 				log.Errorf("Encrypt %s error %v", fileName, err)
 				return err
 			}
-			// change fileName to temp file avoid origin file modified
+			// upload the temp file, origin file is not modified
 			defer func() {
-				deleteTemporaryFile(log, originFileName)
+				deleteTemporaryFile(log, uploadFileName)
 			}()
-		} else {
-			c.PM.SetPartitionMap(fileName, fileName)
 		}
-		partitions, err := c.uploadFileByMultiReplica(originFileName, fileName, req, rsp)
+		partitions, err := c.uploadFileByMultiReplica(ctx, fileName, uploadFileName, req, rsp)
 		if err != nil {
 			return err
 		}
-		return c.UploadFileDone(req, partitions, encryptKey)
+		c.PM.SetStage(fileName, common.StageVerifying)
+		return c.UploadFileDone(ctx, req, partitions, encryptKey)
 	case mpb.FileStoreType_ErasureCode:
 		log.Infof("Upload manner is erasure")
-		partFiles := []string{}
-		var err error
-		fileSize := int64(req.GetFileSize())
-		if fileSize > PartitionMaxSize {
-			chunkSize, chunkNum := GetChunkSizeAndNum(fileSize, PartitionMaxSize)
-			partFiles, err = FileSplit(c.TempDir, fileName, fileSize, chunkSize, int64(chunkNum))
+		dataShards := int(rsp.GetDataPieceCount())
+		verifyShards := int(rsp.GetVerifyPieceCount())
+		log.Infof("Prepare response gave %d dataShards, %d verifyShards", dataShards, verifyShards)
+
+		if journal != nil {
+			if !journal.matches(req, dataShards, verifyShards) {
+				log.Info("File changed, discard upload journal")
+				journal.discard(log)
+				journal = nil
+			} else {
+				_, _, stored, total := journal.progress()
+				log.Infof("Resume upload, %d of %d blocks stored", stored, total)
+			}
+		}
+		if journal == nil {
+			journal, err = c.createUploadJournal(journalPath, fileName, dest, req, isEncrypt, password, wrappedKey, sno, dataShards, verifyShards)
 			if err != nil {
 				return err
 			}
-		} else {
-			partFiles = append(partFiles, fileName)
 		}
 
-		log.Infof("File %s need split to %d partitions", req.GetFileName(), len(partFiles))
+		if err := c.uploadFileByErasure(ctx, req, journal, password); err != nil {
+			// journal is kept for resume
+			return err
+		}
+		partitions, err := journal.storePartitions()
+		if err != nil {
+			return err
+		}
+		log.Infof("There are %d store partitions", len(partitions))
 
-		dataShards := int(rsp.GetDataPieceCount())
-		verifyShards := int(rsp.GetVerifyPieceCount())
+		c.PM.SetStage(fileName, common.StageVerifying)
+		if err := c.UploadFileDone(ctx, req, partitions, encryptKey); err != nil {
+			return err
+		}
+		journal.discard(log)
+		return nil
+	}
+	return nil
+}
 
-		log.Infof("Prepare response gave %d dataShards, %d verifyShards", dataShards, verifyShards)
+// beginUpload returns false if the same upload is running, e.g. resumed in background
+func (c *ClientManager) beginUpload(key string) bool {
+	c.uploadingMutex.Lock()
+	defer c.uploadingMutex.Unlock()
+	if c.uploading == nil {
+		c.uploading = map[string]bool{}
+	}
+	if c.uploading[key] {
+		return false
+	}
+	c.uploading[key] = true
+	return true
+}
 
-		fileInfos := []common.PartitionFile{}
+func (c *ClientManager) endUpload(key string) {
+	c.uploadingMutex.Lock()
+	defer c.uploadingMutex.Unlock()
+	delete(c.uploading, key)
+}
 
-		realSizeAfterRS := int64(0)
-		for _, fname := range partFiles {
-			fileSlices, err := c.onlyFileSplit(fname, dataShards, verifyShards, isEncrypt, password, sno)
-			if err != nil {
-				return err
-			}
-			fileInfos = append(fileInfos, common.PartitionFile{
-				FileName:       fname,
-				Pieces:         fileSlices,
-				OriginFileName: req.FileName,
-				OriginFileHash: req.FileHash,
-				OriginFileSize: req.FileSize,
-			})
-			log.Infof("File %s need split to %d blocks", fname, len(fileSlices))
-			for _, fs := range fileSlices {
-				log.Debugf("Erasure block files %s index %d", fs.FileName, fs.SliceIndex)
-				c.PM.SetPartitionMap(fs.FileName, fileName)
-				realSizeAfterRS += fs.FileSize
+// createUploadJournal encodes file to learn hashes of its blocks, then saves the journal before any block is sent.
+// Nothing is written to disk but the journal, blocks are encoded again when they are sent.
+func (c *ClientManager) createUploadJournal(path, fileName, dest string, req *mpb.CheckFileExistReq, isEncrypt bool, password, wrappedKey []byte, sno uint32, dataShards, verifyShards int) (*UploadJournal, error) {
+	log := c.Log.WithField("upload file", fileName)
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ranges := partitionRanges(int64(req.GetFileSize()))
+	log.Infof("File %s need split to %d partitions", req.GetFileName(), len(ranges))
+
+	if !isEncrypt {
+		password = nil
+	}
+	pieces := make([][]common.HashFile, 0, len(ranges))
+	nonces := make([][][]byte, len(ranges))
+	for i, r := range ranges {
+		if isEncrypt {
+			if nonces[i], err = shardNonces(dataShards + verifyShards); err != nil {
+				return nil, err
 			}
-			c.PM.SetPartitionMap(fname, fileName)
 		}
+		hashes, err := hashPartition(file, r, dataShards, verifyShards, password, nonces[i])
+		if err != nil {
+			log.Errorf("Reedsolomon encoder error %v", err)
+			return nil, err
+		}
+		pieces = append(pieces, hashes)
+		log.Infof("Partition %d need split to %d blocks", i, len(hashes))
+	}
 
-		c.PM.SetProgress(fileName, 0, uint64(realSizeAfterRS))
+	journal := newUploadJournal(path, req, fileName, dest, isEncrypt, sno, dataShards, verifyShards, ranges, pieces, nonces)
+	if isEncrypt {
+		if journal.WrappedKey, err = c.wrapJournalKey(sno, password, wrappedKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := journal.save(); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
 
-		// delete temporary file
-		defer func() {
-			for _, partInfo := range fileInfos {
-				for _, slice := range partInfo.Pieces {
-					deleteTemporaryFile(log, slice.FileName)
-				}
-				if len(fileInfos) != 1 {
-					deleteTemporaryFile(log, partInfo.FileName)
-				}
-			}
-		}()
+// uploadFileByErasure sends blocks not stored yet, asking for fresh tickets if needed, blocks are encrypted by password if it is set
+func (c *ClientManager) uploadFileByErasure(ctx context.Context, req *mpb.CheckFileExistReq, journal *UploadJournal, password []byte) error {
+	log := c.Log.WithField("upload file", journal.FileName)
+	fileInfos := journal.partitionFiles()
+	for _, partInfo := range fileInfos {
+		for _, fs := range partInfo.Pieces {
+			log.Debugf("Erasure block %s index %d", fs.FileName, fs.SliceIndex)
+			c.PM.SetPartitionMap(fs.FileName, journal.FileName)
+		}
+	}
+	stored, total, storedBlocks, totalBlocks := journal.progress()
+	c.PM.SetProgress(journal.FileName, stored, total)
+	c.PM.SetBlock(journal.FileName, common.StageUploading, storedBlocks, totalBlocks)
 
-		ufpr, err := c.createUploadPrepareRequest(req, len(partFiles), fileInfos)
+	if journal.needTickets(common.Now()) {
+		ufpr, err := c.createUploadPrepareRequest(req, len(fileInfos), fileInfos)
 		if err != nil {
 			return err
 		}
-
-		ctx := context.Background()
 		log.Info("Send prepare reques")
 		ufprsp, err := c.mclient.UploadFilePrepare(ctx, ufpr)
 		if err != nil {
 			log.Errorf("UploadFilePrepare error %v", err)
 			return common.StatusErrFromError(err)
 		}
-
 		rspPartitions := ufprsp.GetPartition()
 		log.Infof("Upload prepare response partitions count:%d", len(rspPartitions))
-
-		if len(rspPartitions) == 0 {
-			return fmt.Errorf("only 0 partitions, not correct")
+		if len(rspPartitions) != len(fileInfos) {
+			return fmt.Errorf("%d partitions in prepare response, expect %d", len(rspPartitions), len(fileInfos))
 		}
-
 		for i, part := range rspPartitions {
-			auth := part.GetProviderAuth()
-			for _, pa := range auth {
+			phas := part.GetProviderAuth()
+			for _, pa := range phas {
 				log.Debugf("Partition %d, %s:%d %v hashauth %d", i, pa.Server, pa.Port, pa.Spare, len(pa.HashAuth))
 			}
-		}
-
-		partitions := []*mpb.StorePartition{}
-		for i, partInfo := range fileInfos {
-			partition, err := c.uploadFileBatchByErasure(ufpr, rspPartitions[i], partInfo, dataShards)
+			providers, err := c.UsingBestProvider(phas, len(phas))
 			if err != nil {
 				return err
 			}
-			log.Debugf("Partition %d has %d store blocks", i, len(partition.GetBlock()))
-			partitions = append(partitions, partition)
+			if err := journal.assign(i, providers, part.GetTimestamp()); err != nil {
+				return err
+			}
 		}
-		log.Infof("There are %d store partitions", len(partitions))
-
-		return c.UploadFileDone(req, partitions, encryptKey)
+		if err := journal.save(); err != nil {
+			return err
+		}
+	}
 
+	file, err := os.Open(journal.FileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for i, partInfo := range fileInfos {
+		if err := c.uploadFileBatchByErasure(ctx, file, journal, i, partInfo, password); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -714,7 +749,7 @@ func deleteTemporaryFile(log logrus.FieldLogger, fileName string) {
 	}
 }
 
-func (c *ClientManager) CheckFileExists(fileName, dest string, interactive, newVersion bool, password, encryptKey []byte, sno uint32) (*mpb.CheckFileExistReq, *mpb.CheckFileExistResp, error) {
+func (c *ClientManager) CheckFileExists(ctx context.Context, fileName, dest string, interactive, newVersion bool, password, encryptKey []byte, sno uint32) (*mpb.CheckFileExistReq, *mpb.CheckFileExistResp, error) {
 	log := c.Log.WithField("filename", fileName)
 	hash, err := util_hash.Sha1File(fileName)
 	if err != nil {
@@ -726,7 +761,15 @@ func (c *ClientManager) CheckFileExists(fileName, dest string, interactive, newV
 	}
 	fileType := filetype.FileType(fileName)
 	_, fname := filepath.Split(fileName)
-	ctx := context.Background()
+	// sys file of space is found by its name
+	if !(fname == SysFile && dest == "/") {
+		if fname, err = c.encryptName(sno, fname); err != nil {
+			return nil, nil, err
+		}
+	}
+	if dest, err = c.resolvePath(ctx, sno, dest); err != nil {
+		return nil, nil, err
+	}
 	req := &mpb.CheckFileExistReq{
 		Version:       common.Version,
 		FileSize:      uint64(fileSize),
@@ -753,7 +796,7 @@ func (c *ClientManager) CheckFileExists(fileName, dest string, interactive, newV
 			return nil, nil, err
 		}
 		if len(password) != 0 {
-			fileData, err = aes.Encrypt(fileData, password)
+			fileData, err = aes.Seal(fileData, password)
 			if err != nil {
 				log.Errorf("Encrypt file error %v", err)
 				return nil, nil, err
@@ -773,21 +816,35 @@ func (c *ClientManager) CheckFileExists(fileName, dest string, interactive, newV
 
 // MkFolder create folder
 func (c *ClientManager) MkFolder(filepath string, folders []string, interactive bool, sno uint32) (bool, error) {
+	return c.MkFolderContext(context.Background(), filepath, folders, interactive, sno)
+}
+
+// MkFolderContext create folder, request is aborted when ctx is done
+func (c *ClientManager) MkFolderContext(ctx context.Context, filepath string, folders []string, interactive bool, sno uint32) (bool, error) {
 	log := c.Log.WithField("folder parent", filepath)
-	ctx := context.Background()
+	parent, err := c.resolvePath(ctx, sno, filepath)
+	if err != nil {
+		return false, err
+	}
+	names := make([]string, len(folders))
+	for i, folder := range folders {
+		if names[i], err = c.encryptName(sno, folder); err != nil {
+			return false, err
+		}
+	}
 	req := &mpb.MkFolderReq{
 		Version:     common.Version,
-		Parent:      &mpb.FilePath{OneOfPath: &mpb.FilePath_Path{filepath}, SpaceNo: sno},
-		Folder:      folders,
+		Parent:      &mpb.FilePath{OneOfPath: &mpb.FilePath_Path{parent}, SpaceNo: sno},
+		Folder:      names,
 		NodeId:      c.NodeId,
 		Interactive: interactive,
 		Timestamp:   common.Now(),
 	}
-	err := req.SignReq(c.cfg.Node.PriKey)
+	err = req.SignReq(c.cfg.Node.PriKey)
 	if err != nil {
 		return false, err
 	}
-	log.Infof("Make folder %+v", req.GetFolder())
+	log.Infof("Make folder %+v", folders)
 	rsp, err := c.mclient.MkFolder(ctx, req)
 	if err != nil {
 		return false, common.StatusErrFromError(err)
@@ -803,123 +860,87 @@ func (c *ClientManager) MkFolder(filepath string, folders []string, interactive
 	return true, nil
 }
 
-func (c *ClientManager) onlyFileSplit(fileName string, dataNum, verifyNum int, isEncrypt bool, password []byte, sno uint32) ([]common.HashFile, error) {
-	log := c.Log.WithField("filesplit", fileName)
-	fileSlices, err := RsEncoder(c.Log, c.TempDir, fileName, dataNum, verifyNum)
-	if err != nil {
-		log.Errorf("Reedsolomon encoder error %v", err)
-		return nil, err
-	}
-	if isEncrypt {
-		for i := range fileSlices {
-			err := aes.EncryptFile(fileSlices[i].FileName, password, fileSlices[i].FileName)
-			if err != nil {
-				log.Errorf("Encrypt error %v", err)
-				return nil, err
-			}
-			hash, err := util_hash.Sha1File(fileSlices[i].FileName)
-			if err != nil {
-				return nil, err
-			}
-			fileSlices[i].FileHash = hash
-			fileSize, err := GetFileSize(fileSlices[i].FileName)
-			if err != nil {
-				return nil, err
-			}
-			fileSlices[i].FileSize = fileSize
-		}
-	}
-
-	return fileSlices, nil
-
-}
-
-func (c *ClientManager) uploadFileBatchByErasure(req *mpb.UploadFilePrepareReq, rspPartition *mpb.ErasureCodePartition, partFile common.PartitionFile, dataShards int) (*mpb.StorePartition, error) {
+// uploadFileBatchByErasure encodes partition once and streams every block not stored yet to its provider
+func (c *ClientManager) uploadFileBatchByErasure(ctx context.Context, file io.ReaderAt, journal *UploadJournal, partIndex int, partFile common.PartitionFile, password []byte) error {
 	log := c.Log
-	partition := &mpb.StorePartition{}
-	partition.Block = []*mpb.StoreBlock{}
-	phas := rspPartition.GetProviderAuth()
-	providers, err := c.UsingBestProvider(phas, len(phas))
-	if err != nil {
-		return nil, err
-	}
-
-	var errResult []error
-	wg := sync.WaitGroup{}
-	var mutex sync.Mutex
-	for i, pro := range providers {
-		wg.Add(1)
-		checksum := i >= dataShards
-		uploadParas := &common.UploadParameter{
+	jp := journal.Partitions[partIndex]
+	consume := make([]func(io.Reader) error, len(jp.Blocks))
+	for i, block := range jp.Blocks {
+		if block.Stored {
+			continue
+		}
+		uploadPara := &common.UploadParameter{
 			OriginFileHash: partFile.OriginFileHash,
 			OriginFileSize: partFile.OriginFileSize,
 			HF:             partFile.Pieces[i],
-			Checksum:       checksum,
+			Checksum:       block.Checksum,
 		}
-		go func(pro *mpb.BlockProviderAuth, tm uint64, uploadPara *common.UploadParameter) {
-			defer wg.Done()
-			server := fmt.Sprintf("%s:%d", pro.GetServer(), pro.GetPort())
-			block, err := c.uploadFileToErasureProvider(pro, tm, uploadParas)
-			mutex.Lock()
-			defer mutex.Unlock()
-			if err != nil {
-				log.Errorf("Upload file %s error %v", uploadPara.HF.FileName, err)
-				errResult = append(errResult, err)
-				return
+		consume[i] = func(block *JournalBlock, tm uint64, uploadPara *common.UploadParameter) func(io.Reader) error {
+			return func(reader io.Reader) error {
+				server := fmt.Sprintf("%s:%d", block.Server, block.Port)
+				err := c.uploadFileToErasureProvider(ctx, block, tm, uploadPara, reader)
+				if err != nil {
+					log.Errorf("Upload block %s error %v", uploadPara.HF.FileName, err)
+					if ctx.Err() != nil {
+						// block is not failed, it is tried again on resume
+						return err
+					}
+					if jerr := journal.markFailed(block); jerr != nil {
+						log.Errorf("Save upload journal error %v", jerr)
+					}
+					return err
+				}
+				log.Debugf("Upload %s to privider %s success", uploadPara.HF.FileName, server)
+				if err := journal.markStored(block); err != nil {
+					return err
+				}
+				_, _, storedBlocks, totalBlocks := journal.progress()
+				c.PM.SetBlock(journal.FileName, common.StageUploading, storedBlocks, totalBlocks)
+				return nil
 			}
-			partition.Block = append(partition.Block, block)
-			log.Debugf("Upload %s to privider %s success", uploadParas.HF.FileName, server)
-		}(pro, rspPartition.GetTimestamp(), uploadParas)
+		}(block, jp.Timestamp, uploadPara)
 	}
-	wg.Wait()
-	if len(errResult) != 0 {
-		return partition, errResult[0]
+	errs, err := streamPartition(file, journal.partitionRange(partIndex), journal.DataShards, journal.VerifyShards, password, jp.nonces(), consume)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
-	return partition, nil
+	return nil
 }
 
-func (c *ClientManager) uploadFileToErasureProvider(pro *mpb.BlockProviderAuth, tm uint64, uploadPara *common.UploadParameter) (*mpb.StoreBlock, error) {
+func (c *ClientManager) uploadFileToErasureProvider(ctx context.Context, block *JournalBlock, tm uint64, uploadPara *common.UploadParameter, reader io.Reader) error {
 	log := c.Log
-	server := fmt.Sprintf("%s:%d", pro.GetServer(), pro.GetPort())
-	conn, err := grpc.Dial(server, grpc.WithInsecure())
+	server := fmt.Sprintf("%s:%d", block.Server, block.Port)
+	pclient, release, err := c.providers().Provider(ctx, server)
 	if err != nil {
 		log.Errorf("Rpc dial failed: %s", err.Error())
-		return nil, err
-	}
-	defer conn.Close()
-	pclient := pb.NewProviderServiceClient(conn)
-
-	ha := pro.GetHashAuth()[0]
-	err = client.StorePiece(log, pclient, uploadPara, ha.GetAuth(), ha.GetTicket(), tm, c.PM)
-	if err != nil {
-		return nil, err
-	}
-	block := &mpb.StoreBlock{
-		Hash:        uploadPara.HF.FileHash,
-		Size:        uint64(uploadPara.HF.FileSize),
-		BlockSeq:    uint32(uploadPara.HF.SliceIndex),
-		Checksum:    uploadPara.Checksum,
-		StoreNodeId: [][]byte{},
+		return err
 	}
-	block.StoreNodeId = append(block.StoreNodeId, []byte(pro.GetNodeId()))
+	defer release()
 
-	return block, nil
+	return client.StorePieceReaderContext(ctx, log, pclient, c.collector, uploadPara, reader, block.Auth, block.Ticket, tm, c.PM)
 }
 
-func (c *ClientManager) uploadFileToReplicaProvider(pro *mpb.ReplicaProvider, uploadPara *common.UploadParameter) ([]byte, error) {
+func (c *ClientManager) uploadFileToReplicaProvider(ctx context.Context, pro *mpb.ReplicaProvider, uploadPara *common.UploadParameter) ([]byte, error) {
 	fileInfo := uploadPara.HF
 	log := c.Log.WithField("filename", fileInfo.FileName)
 	server := fmt.Sprintf("%s:%d", pro.GetServer(), pro.GetPort())
-	conn, err := grpc.Dial(server, grpc.WithInsecure())
+	pclient, release, err := c.providers().Provider(ctx, server)
 	if err != nil {
 		log.Errorf("Rpc dail failed: %v", err)
 		return nil, err
 	}
-	defer conn.Close()
-	pclient := pb.NewProviderServiceClient(conn)
+	defer release()
 	log.Debugf("Upload file hash %x size %d to %s", fileInfo.FileHash, fileInfo.FileSize, server)
 
-	err = client.StorePiece(log, pclient, uploadPara, pro.Auth, pro.Ticket, pro.Timestamp, c.PM)
+	err = client.StorePieceContext(ctx, log, pclient, c.collector, uploadPara, pro.Auth, pro.Ticket, pro.Timestamp, c.PM)
 	if err != nil {
 		log.Errorf("Upload error %v", err)
 		return nil, err
@@ -930,7 +951,7 @@ func (c *ClientManager) uploadFileToReplicaProvider(pro *mpb.ReplicaProvider, up
 	return pro.GetNodeId(), nil
 }
 
-func (c *ClientManager) uploadFileByMultiReplica(originFileName, fileName string, req *mpb.CheckFileExistReq, rsp *mpb.CheckFileExistResp) ([]*mpb.StorePartition, error) {
+func (c *ClientManager) uploadFileByMultiReplica(ctx context.Context, originFileName, fileName string, req *mpb.CheckFileExistReq, rsp *mpb.CheckFileExistResp) ([]*mpb.StorePartition, error) {
 	log := c.Log
 	hash, err := util_hash.Sha1File(fileName)
 	if err != nil {
@@ -961,7 +982,6 @@ func (c *ClientManager) uploadFileByMultiReplica(originFileName, fileName string
 		return nil, err
 	}
 
-	ctx := context.Background()
 	log.Infof("Send prepare request for %s", req.GetFileName())
 	ufprsp, err := c.mclient.UploadFilePrepare(ctx, ufpr)
 	if err != nil {
@@ -984,20 +1004,18 @@ func (c *ClientManager) uploadFileByMultiReplica(originFileName, fileName string
 		StoreNodeId: [][]byte{},
 	}
 
-	c.PM.SetPartitionMap(originFileName, fileName)
+	c.PM.SetPartitionMap(fileName, originFileName)
 
 	providers := ufprsp.GetProvider()
-	if fileName == originFileName {
-		c.PM.SetProgress(fileName, 0, uint64(len(providers))*req.FileSize)
-	} else {
-		c.PM.SetProgress(fileName, 0, uint64(int64(len(providers))*fileSize))
-	}
+	c.PM.SetProgress(originFileName, 0, uint64(int64(len(providers))*fileSize))
+	c.PM.SetBlock(originFileName, common.StageUploading, 0, len(providers))
 
-	for _, pro := range providers {
-		proID, err := c.uploadFileToReplicaProvider(pro, uploadPara)
+	for i, pro := range providers {
+		proID, err := c.uploadFileToReplicaProvider(ctx, pro, uploadPara)
 		if err != nil {
 			return nil, err
 		}
+		c.PM.SetBlock(originFileName, common.StageUploading, i+1, len(providers))
 		block.StoreNodeId = append(block.StoreNodeId, proID)
 	}
 
@@ -1007,7 +1025,7 @@ func (c *ClientManager) uploadFileByMultiReplica(originFileName, fileName string
 	return partitions, nil
 }
 
-func (c *ClientManager) UploadFileDone(reqCheck *mpb.CheckFileExistReq, partitions []*mpb.StorePartition, encryptKey []byte) error {
+func (c *ClientManager) UploadFileDone(ctx context.Context, reqCheck *mpb.CheckFileExistReq, partitions []*mpb.StorePartition, encryptKey []byte) error {
 	req := &mpb.UploadFileDoneReq{
 		Version:       common.Version,
 		NodeId:        c.NodeId,
@@ -1028,7 +1046,6 @@ func (c *ClientManager) UploadFileDone(reqCheck *mpb.CheckFileExistReq, partitio
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
 	log := c.Log.WithField("filename", req.GetFileName())
 	log.Info("Upload file done request")
 	ufdrsp, err := c.mclient.UploadFileDone(ctx, req)
@@ -1044,6 +1061,11 @@ func (c *ClientManager) UploadFileDone(reqCheck *mpb.CheckFileExistReq, partitio
 
 // ListFiles list files on dir
 func (c *ClientManager) ListFiles(path string, pageSize, pageNum uint32, sortType string, ascOrder bool, sno uint32) (*FilePages, error) {
+	return c.ListFilesContext(context.Background(), path, pageSize, pageNum, sortType, ascOrder, sno)
+}
+
+// ListFilesContext list files on dir, request is aborted when ctx is done
+func (c *ClientManager) ListFilesContext(ctx context.Context, path string, pageSize, pageNum uint32, sortType string, ascOrder bool, sno uint32) (*FilePages, error) {
 	log := c.Log.WithField("list path", path)
 	log.Infof("Parameter size %d, num %d, sortype %s, asc %v", pageSize, pageNum, sortType, ascOrder)
 	req := &mpb.ListFilesReq{
@@ -1063,13 +1085,20 @@ func (c *ClientManager) ListFiles(path string, pageSize, pageNum uint32, sortTyp
 	default:
 		req.SortType = mpb.SortType_Name
 	}
-	req.Parent = &mpb.FilePath{OneOfPath: &mpb.FilePath_Path{path}, SpaceNo: sno}
+	siv, err := c.nameCipher(sno)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := c.resolvePath(ctx, sno, path)
+	if err != nil {
+		return nil, err
+	}
+	req.Parent = &mpb.FilePath{OneOfPath: &mpb.FilePath_Path{parent}, SpaceNo: sno}
 	req.AscOrder = ascOrder
-	err := req.SignReq(c.cfg.Node.PriKey)
+	err = req.SignReq(c.cfg.Node.PriKey)
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
 	log.Info("List path request")
 	rsp, err := c.mclient.ListFiles(ctx, req)
 
@@ -1086,10 +1115,15 @@ func (c *ClientManager) ListFiles(path string, pageSize, pageNum uint32, sortTyp
 		id := hex.EncodeToString(info.GetId())
 		storedFileType := info.GetFileType()
 		fileType, extension := c.FileTypeMap.GetTypeAndExtension(storedFileType)
+		name := info.GetName()
+		if siv != nil {
+			name = decryptName(siv, name)
+			c.addResolvedPath(sno, pathpkg.Join(path, name), pathpkg.Join(parent, info.GetName()))
+		}
 		df := &DownFile{
 			ID:        id,
 			FileHash:  hash,
-			FileName:  info.GetName(),
+			FileName:  name,
 			Folder:    info.GetFolder(),
 			ModTime:   info.GetModTime(),
 			FileType:  fileType,
@@ -1104,8 +1138,45 @@ func (c *ClientManager) ListFiles(path string, pageSize, pageNum uint32, sortTyp
 	}, nil
 }
 
+// ListFolder list all files of folder dir
+func (c *ClientManager) ListFolder(dir string, sno uint32) ([]*DownFile, error) {
+	return c.ListFolderContext(context.Background(), dir, sno)
+}
+
+// ListFolderContext list all files of folder dir, request is aborted when ctx is done
+func (c *ClientManager) ListFolderContext(ctx context.Context, dir string, sno uint32) ([]*DownFile, error) {
+	return ListPages(dir, func(pageSize, pageNum uint32) (*FilePages, error) {
+		return c.ListFilesContext(ctx, dir, pageSize, pageNum, "name", true, sno)
+	})
+}
+
+// ListPages lists all files of folder dir by pages of list, sys file of space is left out for it is not a file of user
+func ListPages(dir string, list func(pageSize, pageNum uint32) (*FilePages, error)) ([]*DownFile, error) {
+	all := []*DownFile{}
+	for page := uint32(1); ; page++ {
+		files, err := list(ListPageSize, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files.Files {
+			if dir == "/" && file.FileName == SysFile {
+				continue
+			}
+			all = append(all, file)
+		}
+		if len(files.Files) < ListPageSize || page*ListPageSize >= files.Total {
+			return all, nil
+		}
+	}
+}
+
 // DownloadDir download dir
 func (c *ClientManager) DownloadDir(path, destDir string, sno uint32) error {
+	return c.DownloadDirContext(context.Background(), path, destDir, sno)
+}
+
+// DownloadDirContext is DownloadDir which stops when ctx is done
+func (c *ClientManager) DownloadDirContext(ctx context.Context, path, destDir string, sno uint32) error {
 	log := c.Log.WithField("download dir", path)
 	if !filepath.IsAbs(path) {
 		return fmt.Errorf("path %s must absolute", path)
@@ -1114,7 +1185,7 @@ func (c *ClientManager) DownloadDir(path, destDir string, sno uint32) error {
 	page := uint32(1)
 	for {
 		// list 1 page 100 items order by name
-		downFiles, err := c.ListFiles(path, 100, page, "name", true, sno)
+		downFiles, err := c.ListFilesContext(ctx, path, 100, page, "name", true, sno)
 		if err != nil {
 			return err
 		}
@@ -1125,6 +1196,9 @@ func (c *ClientManager) DownloadDir(path, destDir string, sno uint32) error {
 		// next page
 		page++
 		for _, fileInfo := range downFiles.Files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			currentFile := filepath.Join(path, fileInfo.FileName)
 			destFile := filepath.Join(destDir, fileInfo.FileName)
 			if fileInfo.Folder {
@@ -1132,7 +1206,7 @@ func (c *ClientManager) DownloadDir(path, destDir string, sno uint32) error {
 				if _, err := os.Stat(currentFile); os.IsNotExist(err) {
 					os.Mkdir(currentFile, 0744)
 				}
-				err = c.DownloadDir(currentFile, destFile, sno)
+				err = c.DownloadDirContext(ctx, currentFile, destFile, sno)
 				if err != nil {
 					log.Errorf("Recursive download %s failed %v", currentFile, err)
 					return err
@@ -1143,7 +1217,7 @@ func (c *ClientManager) DownloadDir(path, destDir string, sno uint32) error {
 					log.Infof("Only create %s because file size is 0", fileInfo.FileName)
 					saveFile(currentFile, []byte{})
 				} else {
-					err = c.DownloadFile(currentFile, destDir, fileInfo.FileHash, fileInfo.FileSize, sno)
+					err = c.DownloadFileContext(ctx, currentFile, destDir, fileInfo.FileHash, fileInfo.FileSize, sno)
 					if err != nil {
 						log.Errorf("Download file %s error %v", currentFile, err)
 						errResult = append(errResult, fmt.Errorf("%s %v", currentFile, common.StatusErrFromError(err)))
@@ -1164,6 +1238,11 @@ func (c *ClientManager) DownloadDir(path, destDir string, sno uint32) error {
 
 // DownloadFile download file
 func (c *ClientManager) DownloadFile(downFileName, destDir, filehash string, fileSize uint64, sno uint32) error {
+	return c.DownloadFileContext(context.Background(), downFileName, destDir, filehash, fileSize, sno)
+}
+
+// DownloadFileContext is DownloadFile which is aborted when ctx is done
+func (c *ClientManager) DownloadFileContext(ctx context.Context, downFileName, destDir, filehash string, fileSize uint64, sno uint32) (err error) {
 	log := c.Log.WithField("download file", downFileName)
 	fileHash, err := hex.DecodeString(filehash)
 	if err != nil {
@@ -1177,36 +1256,23 @@ func (c *ClientManager) DownloadFile(downFileName, destDir, filehash string, fil
 		FileSize:  fileSize,
 		SpaceNo:   sno,
 	}
-	err = req.SignReq(c.cfg.Node.PriKey)
-	if err != nil {
-		return err
-	}
 	_, fileName := filepath.Split(downFileName)
 	downFileName = filepath.Join(destDir, fileName)
 	c.PM.SetProgress(downFileName, 0, req.FileSize)
+	c.PM.SetStage(downFileName, common.StageDownloading)
+	defer func() {
+		c.PM.Finish(downFileName, err)
+	}()
 
-	ctx := context.Background()
 	log.Infof("Download request file hash %x, size %d", fileHash, fileSize)
-	rsp, err := c.mclient.RetrieveFile(ctx, req)
+	rsp, password, err := c.retrieveFile(ctx, req)
 	if err != nil {
-		return common.StatusErrFromError(err)
-	}
-	if rsp.GetCode() != 0 {
-		return fmt.Errorf("%s", rsp.GetErrMsg())
-	}
-
-	password := []byte{}
-	encryptKey := rsp.GetEncryptKey()
-	if len(encryptKey) > 0 {
-		password, err = rsalong.DecryptLong(c.cfg.Node.PriKey, encryptKey, 256)
-		if err != nil {
-			return err
-		}
+		return err
 	}
 	// tiny file
 	if filedata := rsp.GetFileData(); filedata != nil {
 		if len(password) != 0 {
-			filedata, err = aes.Decrypt(filedata, password)
+			filedata, err = aes.Open(filedata, password)
 			if err != nil {
 				log.Errorf("Decrypted error %v", err)
 				return err
@@ -1229,11 +1295,12 @@ func (c *ClientManager) DownloadFile(downFileName, destDir, filehash string, fil
 			for _, block := range partitions[0].GetBlock() {
 				c.PM.SetPartitionMap(hex.EncodeToString(block.GetHash()), downFileName)
 			}
-			_, _, _, _, err := c.saveFileByPartition(downFileName, partitions[0], rsp.GetTimestamp(), req.FileHash, req.FileSize, true)
+			_, _, _, _, err := c.saveFileByPartition(ctx, downFileName, partitions[0], rsp.GetTimestamp(), req.FileHash, req.FileSize, true)
 			if err != nil {
 				return err
 			}
 			if len(password) != 0 {
+				c.PM.SetStage(downFileName, common.StageVerifying)
 				return aes.DecryptFile(downFileName, password, downFileName)
 			}
 			return nil
@@ -1254,150 +1321,133 @@ func (c *ClientManager) DownloadFile(downFileName, destDir, filehash string, fil
 	}
 	c.PM.SetProgress(downFileName, 0, realSizeAfterRS)
 
-	if len(partitions) == 1 {
-		partition := partitions[0]
-		datas, paritys, failedCount, middleFiles, err := c.saveFileByPartition(downFileName, partition, rsp.GetTimestamp(), req.FileHash, req.FileSize, false)
-		if failedCount > paritys {
-			log.Error("File cannot be recoved!!!")
-			return err
+	ranges := partitionRanges(int64(req.FileSize))
+	if len(ranges) != len(partitions) {
+		return fmt.Errorf("file of size %d has %d partitions, expect %d", req.FileSize, len(partitions), len(ranges))
+	}
+	// partitions are decoded into place, the file appears at once when all are done
+	tempDownFileName := downFileName + downloadSuffix
+	file, err := os.OpenFile(tempDownFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		// delete file in case download or rename failed
+		if util_file.Exists(tempDownFileName) {
+			deleteTemporaryFile(log, tempDownFileName)
 		}
-		if err != nil {
-			log.Errorf("Save file by partition error %v, but file still can be recoverd", err)
+	}()
+	if err := file.Truncate(int64(req.FileSize)); err != nil {
+		return err
+	}
+	for i, partition := range partitions {
+		partFileName := downFileName
+		if len(partitions) > 1 {
+			partFileName = fmt.Sprintf("%s.%s.%d", downFileName, TEMP_NAMESPACE, i)
 		}
-
-		if len(password) != 0 {
-			for _, file := range middleFiles {
-				if err := aes.DecryptFile(file, password, file); err != nil {
-					return err
-				}
-			}
+		c.PM.SetBlock(downFileName, common.StageDownloading, i, len(partitions))
+		verifying := func() {
+			c.PM.SetBlock(downFileName, common.StageVerifying, i, len(partitions))
 		}
-
-		// delete middle files
-		defer func() {
-			for _, file := range middleFiles {
-				deleteTemporaryFile(log, file)
-			}
-		}()
-
-		log.Infof("DataShards %d, parityShards %d, failedCount %d", datas, paritys, failedCount)
-
-		_, onlyFileName := filepath.Split(downFileName)
-		tempDownFileName := filepath.Join(c.TempDir, onlyFileName)
-		err = RsDecoder(log, tempDownFileName, "", int64(req.FileSize), datas, paritys)
-		if err != nil {
-			return err
-		}
-
-		defer func() {
-			// delete file in case rename failed
-			if util_file.Exists(tempDownFileName) {
-				deleteTemporaryFile(log, tempDownFileName)
-			}
-		}()
-
-		if err := os.Rename(tempDownFileName, downFileName); err != nil {
+		if err := c.retrievePartition(ctx, partFileName, partition, rsp.GetTimestamp(), req, ranges[i], password, file, verifying); err != nil {
 			return err
 		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempDownFileName, downFileName)
+}
 
-		return nil
+// retrieveFile requests blocks of file req asks, returns data key of the file, empty if it is not encrypted
+func (c *ClientManager) retrieveFile(ctx context.Context, req *mpb.RetrieveFileReq) (*mpb.RetrieveFileResp, []byte, error) {
+	if err := req.SignReq(c.cfg.Node.PriKey); err != nil {
+		return nil, nil, err
 	}
-	partFiles := []string{}
-	for i, partition := range partitions {
-		partFileName := fmt.Sprintf("%s.%s.%d", downFileName, TEMP_NAMESPACE, i)
-		datas, paritys, failedCount, middleFiles, err := c.saveFileByPartition(partFileName, partition, rsp.GetTimestamp(), req.FileHash, req.FileSize, false)
-		if failedCount > paritys {
-			log.Errorf("Middle file %s cannot be recoved!!!", partFileName)
-			return err
-		}
-		if err != nil {
-			log.Errorf("Save file by partition error %v, but file still can be recoverd", err)
-		}
-		if len(password) != 0 {
-			for _, file := range middleFiles {
-				if err := aes.DecryptFile(file, password, file); err != nil {
-					return err
-				}
-			}
-		}
-		log.Infof("DataShards %d, parityShards %d, failedCount %d", datas, paritys, failedCount)
-		_, onlyFileName := filepath.Split(partFileName)
-		tempDownFileName := filepath.Join(c.TempDir, onlyFileName)
-		// file real size can be calcauted by filesize and partition number
-		partitionFileSize := ReverseCalcuatePartFileSize(int64(req.FileSize), len(partitions), i)
-		log.Infof("Partition %d, size %d", i, partitionFileSize)
-		err = RsDecoder(log, tempDownFileName, "", int64(partitionFileSize), datas, paritys)
+	rsp, err := c.mclient.RetrieveFile(ctx, req)
+	if err != nil {
+		return nil, nil, common.StatusErrFromError(err)
+	}
+	if rsp.GetCode() != 0 {
+		return nil, nil, fmt.Errorf("%s", rsp.GetErrMsg())
+	}
+	password := []byte{}
+	if encryptKey := rsp.GetEncryptKey(); len(encryptKey) > 0 {
+		key, err := rsalong.DecryptLong(c.cfg.Node.PriKey, encryptKey, 256)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-
-		partFiles = append(partFiles, tempDownFileName)
-		// delete middle files
-		for _, file := range middleFiles {
-			deleteTemporaryFile(log, file)
+		if password, err = c.fileDataKey(req.SpaceNo, key); err != nil {
+			return nil, nil, err
 		}
-
 	}
+	return rsp, password, nil
+}
 
-	defer func() {
-		for _, file := range partFiles {
-			deleteTemporaryFile(log, file)
-		}
-	}()
-
-	if err := FileJoin(downFileName, partFiles); err != nil {
-		log.Errorf("File %s join failed, part files %+v", downFileName, partFiles)
+// retrievePartition retrieves blocks of erasure partition into temp dir by name of partFileName and decodes it
+// into dst at r.Offset, verifying is called before decoding
+func (c *ClientManager) retrievePartition(ctx context.Context, partFileName string, partition *mpb.RetrievePartition, tm uint64, req *mpb.RetrieveFileReq, r fileRange, password []byte, dst io.WriterAt, verifying func()) error {
+	log := c.Log.WithField("filename", partFileName)
+	datas, paritys, failedCount, middleFiles, err := c.saveFileByPartition(ctx, partFileName, partition, tm, req.FileHash, req.FileSize, false)
+	_, onlyFileName := filepath.Split(partFileName)
+	shardFileName := filepath.Join(c.TempDir, onlyFileName)
+	defer deleteShardFiles(log, shardFileName, datas+paritys)
+	if len(middleFiles) < datas {
+		log.Errorf("Partition at offset %d cannot be recoved!!!", r.Offset)
 		return err
 	}
-	return nil
+	if err != nil {
+		log.Errorf("Save file by partition error %v, but file still can be recoverd", err)
+	}
+	log.Infof("DataShards %d, parityShards %d, failedCount %d", datas, paritys, failedCount)
+	log.Infof("Partition offset %d size %d", r.Offset, r.Size)
+	if verifying != nil {
+		verifying()
+	}
+	return decodeShardFiles(shardFileName, middleFiles, r, datas, paritys, password, dst)
 }
 
-func (c *ClientManager) saveFileByPartition(fileName string, partition *mpb.RetrievePartition, tm uint64, fileHash []byte, fileSize uint64, multiReplica bool) (int, int, int, []string, error) {
+// saveFileByPartition retrieves blocks of partition. Blocks of erasure partition are requested at once,
+// when dataShards blocks arrive the rest are cancelled, the missing ones are reconstructed when decoding.
+func (c *ClientManager) saveFileByPartition(ctx context.Context, fileName string, partition *mpb.RetrievePartition, tm uint64, fileHash []byte, fileSize uint64, multiReplica bool) (int, int, int, []string, error) {
 	log := c.Log.WithField("filename", fileName)
-	log.Infof("There is %d blocks", len(partition.GetBlock()))
+	blocks := partition.GetBlock()
+	log.Infof("There is %d blocks", len(blocks))
 	dataShards := 0
 	parityShards := 0
-	failedCount := 0
-	middleFiles := []string{}
-	errArray := []string{}
-	for _, block := range partition.GetBlock() {
+	for _, block := range blocks {
 		if block.GetChecksum() {
 			parityShards++
 		} else {
 			dataShards++
 		}
-		node := c.BestRetrieveNode(block.GetStoreNode())
-		server := fmt.Sprintf("%s:%d", node.GetServer(), node.GetPort())
-		tempFileName := fileName
+	}
+	fileNames := make([]string, len(blocks))
+	for i, block := range blocks {
+		fileNames[i] = fileName
 		if !multiReplica {
 			_, onlyFileName := filepath.Split(fileName)
-			tempFileName = filepath.Join(c.TempDir, fmt.Sprintf("%s.%d", onlyFileName, block.GetBlockSeq()))
-		}
-		log = log.WithField("part file", tempFileName)
-		log.Infof("Hash %x retrieve from %s", block.GetHash(), server)
-		conn, err := grpc.Dial(server, grpc.WithInsecure(), grpc.WithTimeout(3*time.Second), grpc.WithBlock())
-		if err != nil {
-			log.Errorf("Rpc dial %s failed, error %v", server, err)
-			log.Error("Retrieve failed")
-			errArray = append(errArray, err.Error())
-			middleFiles = append(middleFiles, tempFileName)
-			failedCount++
-			continue
+			fileNames[i] = filepath.Join(c.TempDir, fmt.Sprintf("%s.%d", onlyFileName, block.GetBlockSeq()))
+			// a shard left by former download must not be taken for a retrieved one
+			os.Remove(fileNames[i])
 		}
-		pclient := pb.NewProviderServiceClient(conn)
-
-		err = client.Retrieve(log, pclient, tempFileName, node.GetAuth(), node.GetTicket(), tm, fileHash, block.GetHash(), fileSize, block.GetSize(), c.PM)
-		if err != nil {
-			failedCount++
-			errArray = append(errArray, err.Error())
-			conn.Close()
-			log.Error("Retrieve failed")
-			middleFiles = append(middleFiles, tempFileName)
-			continue
-		}
-		log.Info("Retrieve success")
-		middleFiles = append(middleFiles, tempFileName)
-		conn.Close()
+	}
+	scheduler := c.newRetrieveScheduler(log, tm, fileHash, fileSize)
+	var middleFiles []string
+	var errs []error
+	if multiReplica {
+		middleFiles, errs = scheduler.retrieveBlocks(ctx, blocks, fileNames, RetrieveParallel, len(blocks))
+	} else {
+		middleFiles, errs = scheduler.retrieveBlocks(ctx, blocks, fileNames, len(blocks), dataShards)
+	}
+	if err := ctx.Err(); err != nil {
+		return dataShards, parityShards, len(errs), middleFiles, err
+	}
+	failedCount := len(errs)
+	errArray := make([]string, 0, len(errs))
+	for _, err := range errs {
+		errArray = append(errArray, err.Error())
 	}
 
 	if len(errArray) > 0 {
@@ -1407,6 +1457,16 @@ func (c *ClientManager) saveFileByPartition(fileName string, partition *mpb.Retr
 	return dataShards, parityShards, failedCount, middleFiles, nil
 }
 
+// deleteShardFiles deletes retrieved and reconstructed shards of fileName
+func deleteShardFiles(log logrus.FieldLogger, fileName string, shards int) {
+	for i := 0; i < shards; i++ {
+		shard := fmt.Sprintf("%s.%d", fileName, i)
+		if util_file.Exists(shard) {
+			deleteTemporaryFile(log, shard)
+		}
+	}
+}
+
 func saveFile(fileName string, content []byte) error {
 	// open output file
 	fo, err := os.Create(fileName)
@@ -1422,6 +1482,11 @@ func saveFile(fileName string, content []byte) error {
 
 // RemoveFile remove file
 func (c *ClientManager) RemoveFile(target string, recursive bool, isPath bool, sno uint32) error {
+	return c.RemoveFileContext(context.Background(), target, recursive, isPath, sno)
+}
+
+// RemoveFileContext remove file, request is aborted when ctx is done
+func (c *ClientManager) RemoveFileContext(ctx context.Context, target string, recursive bool, isPath bool, sno uint32) error {
 	log := c.Log.WithField("target", target)
 	req := &mpb.RemoveReq{
 		Version:   common.Version,
@@ -1430,7 +1495,11 @@ func (c *ClientManager) RemoveFile(target string, recursive bool, isPath bool, s
 		Recursive: recursive,
 	}
 	if isPath {
-		req.Target = &mpb.FilePath{OneOfPath: &mpb.FilePath_Path{target}, SpaceNo: sno}
+		stored, err := c.resolvePath(ctx, sno, target)
+		if err != nil {
+			return err
+		}
+		req.Target = &mpb.FilePath{OneOfPath: &mpb.FilePath_Path{stored}, SpaceNo: sno}
 	} else {
 		id, err := hex.DecodeString(target)
 		if err != nil {
@@ -1446,7 +1515,7 @@ func (c *ClientManager) RemoveFile(target string, recursive bool, isPath bool, s
 	}
 
 	log.Infof("Remove file request")
-	rsp, err := c.mclient.Remove(context.Background(), req)
+	rsp, err := c.mclient.Remove(ctx, req)
 	if err != nil {
 		return common.StatusErrFromError(err)
 	}
@@ -1460,6 +1529,11 @@ func (c *ClientManager) RemoveFile(target string, recursive bool, isPath bool, s
 
 // MoveFile move file
 func (c *ClientManager) MoveFile(source, dest string, sno uint32) error {
+	return c.MoveFileContext(context.Background(), source, dest, sno)
+}
+
+// MoveFileContext move file, request is aborted when ctx is done
+func (c *ClientManager) MoveFileContext(ctx context.Context, source, dest string, sno uint32) error {
 	log := c.Log.WithField("move source", source)
 	req := &mpb.MoveReq{
 		Version:   common.Version,
@@ -1472,7 +1546,9 @@ func (c *ClientManager) MoveFile(source, dest string, sno uint32) error {
 	}
 	log.Infof("Move file binary id %s", id)
 	req.Source = &mpb.FilePath{OneOfPath: &mpb.FilePath_Id{id}, SpaceNo: sno}
-	req.Dest = dest
+	if req.Dest, err = c.resolvePath(ctx, sno, dest); err != nil {
+		return err
+	}
 
 	err = req.SignReq(c.cfg.Node.PriKey)
 	if err != nil {
@@ -1480,7 +1556,7 @@ func (c *ClientManager) MoveFile(source, dest string, sno uint32) error {
 	}
 
 	log.Infof("Move file to %s", dest)
-	rsp, err := c.mclient.Move(context.Background(), req)
+	rsp, err := c.mclient.Move(ctx, req)
 	if err != nil {
 		return common.StatusErrFromError(err)
 	}
@@ -1494,6 +1570,11 @@ func (c *ClientManager) MoveFile(source, dest string, sno uint32) error {
 
 // GetSpaceSysFileData get space password data
 func (c *ClientManager) GetSpaceSysFileData(sno uint32) ([]byte, error) {
+	return c.GetSpaceSysFileDataContext(context.Background(), sno)
+}
+
+// GetSpaceSysFileDataContext get space password data, empty if it is not found, request is aborted when ctx is done
+func (c *ClientManager) GetSpaceSysFileDataContext(ctx context.Context, sno uint32) ([]byte, error) {
 	log := c.Log
 	req := &mpb.SpaceSysFileReq{
 		Version:   common.Version,
@@ -1506,7 +1587,10 @@ func (c *ClientManager) GetSpaceSysFileData(sno uint32) ([]byte, error) {
 		return nil, err
 	}
 	log.Infof("Get space %d sys file", sno)
-	rsp, err := c.mclient.SpaceSysFile(context.Background(), req)
+	rsp, err := c.mclient.SpaceSysFile(ctx, req)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, common.StatusErrFromError(err)
 	}
@@ -0,0 +1,194 @@
+package daemon
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/samoslab/nebula/client/common"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	"github.com/samoslab/nebula/util/aes"
+)
+
+const (
+	// maxResolvedPaths entries of resolved path cache
+	maxResolvedPaths = 10000
+	// lookupPageSize files listed a request looking up a name
+	lookupPageSize = 100
+)
+
+// Names of files and folders in space other than 0 are encrypted deterministically by the space key, the same
+// name gives the same encrypted name, so the tracker still finds them by path but learns nothing of the names.
+// Names stored by former versions are plaintext, they are shown as they are.
+
+// nameCipher returns nil for space 0 whose names are not encrypted
+func (c *ClientManager) nameCipher(sno uint32) (*aes.SIV, error) {
+	if sno == 0 {
+		return nil, nil
+	}
+	spaceKey, err := c.SpaceM.GetSpacePasswd(sno)
+	if err != nil {
+		return nil, err
+	}
+	if len(spaceKey) == 0 {
+		return nil, fmt.Errorf("please set space %d password first", sno)
+	}
+	return aes.NewSIV(spaceKey)
+}
+
+func encryptName(siv *aes.SIV, name string) string {
+	return base64.RawURLEncoding.EncodeToString(siv.Seal([]byte(name), nil))
+}
+
+// decryptName returns name as it is if it is not encrypted by siv
+func decryptName(siv *aes.SIV, name string) string {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		return name
+	}
+	plain, err := siv.Open(data, nil)
+	if err != nil {
+		return name
+	}
+	return string(plain)
+}
+
+// encryptName returns name stored in tracker of a new file or folder of space sno
+func (c *ClientManager) encryptName(sno uint32, name string) (string, error) {
+	siv, err := c.nameCipher(sno)
+	if err != nil || siv == nil {
+		return name, err
+	}
+	return encryptName(siv, name), nil
+}
+
+// resolvePath returns path stored in tracker of a plaintext path of space sno. A name not resolved before is
+// looked up in its parent folder, so plaintext names of former versions are kept, names not found are encrypted.
+func (c *ClientManager) resolvePath(ctx context.Context, sno uint32, target string) (string, error) {
+	if target == "/" {
+		// root is resolved without space key, sys file of space is kept there before the key is set
+		return target, nil
+	}
+	siv, err := c.nameCipher(sno)
+	if err != nil || siv == nil {
+		return target, err
+	}
+	if !strings.HasPrefix(target, "/") {
+		names := strings.Split(target, "/")
+		for i, name := range names {
+			if name != "" {
+				names[i] = encryptName(siv, name)
+			}
+		}
+		return strings.Join(names, "/"), nil
+	}
+	plain, resolved := "/", "/"
+	// names below a folder not found are not looked up, they are new
+	exists := true
+	for _, name := range strings.Split(target, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		dir := plain
+		plain = path.Join(plain, name)
+		if p, ok := c.resolvedPath(sno, plain); ok {
+			resolved = p
+			continue
+		}
+		stored := ""
+		if exists {
+			if stored, err = c.lookupName(ctx, sno, siv, dir, resolved, name); err != nil {
+				return "", err
+			}
+		}
+		if stored == "" {
+			exists = false
+			stored = encryptName(siv, name)
+		}
+		resolved = path.Join(resolved, stored)
+	}
+	return resolved, nil
+}
+
+// lookupName lists folder parent stored in tracker of plaintext folder dir, returns stored name of name, empty if
+// it is not in the folder. All listed names are recorded as resolved.
+func (c *ClientManager) lookupName(ctx context.Context, sno uint32, siv *aes.SIV, dir, parent, name string) (string, error) {
+	found := ""
+	for page := uint32(1); ; page++ {
+		req := &mpb.ListFilesReq{
+			Version:   common.Version,
+			Timestamp: common.Now(),
+			NodeId:    c.NodeId,
+			PageSize:  lookupPageSize,
+			PageNum:   page,
+			SortType:  mpb.SortType_Name,
+			AscOrder:  true,
+			Parent:    &mpb.FilePath{OneOfPath: &mpb.FilePath_Path{Path: parent}, SpaceNo: sno},
+		}
+		if err := req.SignReq(c.cfg.Node.PriKey); err != nil {
+			return "", err
+		}
+		rsp, err := c.mclient.ListFiles(ctx, req)
+		if err != nil {
+			return "", common.StatusErrFromError(err)
+		}
+		if rsp.GetCode() != 0 {
+			return "", fmt.Errorf("errmsg %s", rsp.GetErrMsg())
+		}
+		for _, info := range rsp.GetFof() {
+			plain := decryptName(siv, info.GetName())
+			c.addResolvedPath(sno, path.Join(dir, plain), path.Join(parent, info.GetName()))
+			if plain == name {
+				found = info.GetName()
+			}
+		}
+		if found != "" || len(rsp.GetFof()) < lookupPageSize || page*lookupPageSize >= rsp.GetTotalRecord() {
+			return found, nil
+		}
+	}
+}
+
+func resolvedPathKey(sno uint32, plain string) string {
+	return fmt.Sprintf("%d:%s", sno, plain)
+}
+
+type resolvedEntry struct {
+	key    string
+	stored string
+}
+
+func (c *ClientManager) resolvedPath(sno uint32, plain string) (string, bool) {
+	c.resolvedMutex.Lock()
+	defer c.resolvedMutex.Unlock()
+	elem, ok := c.resolved[resolvedPathKey(sno, plain)]
+	if !ok {
+		return "", false
+	}
+	c.resolvedOrder.MoveToFront(elem)
+	return elem.Value.(*resolvedEntry).stored, true
+}
+
+// addResolvedPath records the path in tracker of a listed file or folder, the least recently used is evicted when full
+func (c *ClientManager) addResolvedPath(sno uint32, plain, stored string) {
+	c.resolvedMutex.Lock()
+	defer c.resolvedMutex.Unlock()
+	if c.resolved == nil {
+		c.resolved = map[string]*list.Element{}
+		c.resolvedOrder = list.New()
+	}
+	key := resolvedPathKey(sno, plain)
+	if elem, ok := c.resolved[key]; ok {
+		elem.Value.(*resolvedEntry).stored = stored
+		c.resolvedOrder.MoveToFront(elem)
+		return
+	}
+	c.resolved[key] = c.resolvedOrder.PushFront(&resolvedEntry{key: key, stored: stored})
+	for c.resolvedOrder.Len() > maxResolvedPaths {
+		oldest := c.resolvedOrder.Back()
+		c.resolvedOrder.Remove(oldest)
+		delete(c.resolved, oldest.Value.(*resolvedEntry).key)
+	}
+}
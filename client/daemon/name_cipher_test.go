@@ -0,0 +1,165 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/samoslab/nebula/client/config"
+	"github.com/samoslab/nebula/provider/node"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// listMetadata lists names stored in tracker by stored path of folder
+type listMetadata struct {
+	mpb.MatadataServiceClient
+	folders map[string][]string
+	listed  []string
+}
+
+func (f *listMetadata) ListFiles(ctx context.Context, req *mpb.ListFilesReq, opts ...grpc.CallOption) (*mpb.ListFilesResp, error) {
+	parent := req.GetParent().GetPath()
+	f.listed = append(f.listed, parent)
+	names, ok := f.folders[parent]
+	if !ok {
+		return &mpb.ListFilesResp{Code: 1, ErrMsg: fmt.Sprintf("%s not exists", parent)}, nil
+	}
+	rsp := &mpb.ListFilesResp{TotalRecord: uint32(len(names))}
+	for i := int(req.GetPageNum()-1) * int(req.GetPageSize()); i < len(names) && len(rsp.Fof) < int(req.GetPageSize()); i++ {
+		rsp.Fof = append(rsp.Fof, &mpb.FileOrFolder{Name: names[i]})
+	}
+	return rsp, nil
+}
+
+func testNameClient(t *testing.T) *ClientManager {
+	spaceKey, err := randomKey()
+	require.NoError(t, err)
+	m := NewSpaceManager()
+	m.AddSpace(0, "", "")
+	m.AddSpace(1, "", "")
+	require.NoError(t, m.SetSpaceKey(1, "password", spaceKey))
+	meta := &listMetadata{folders: map[string][]string{"/": nil}}
+	return &ClientManager{SpaceM: m, mclient: meta, cfg: &config.ClientConfig{Node: node.NewNode(1)}}
+}
+
+func TestEncryptName(t *testing.T) {
+	c := testNameClient(t)
+	name, err := c.encryptName(0, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", name)
+
+	name, err = c.encryptName(1, "a.txt")
+	require.NoError(t, err)
+	require.NotEqual(t, "a.txt", name)
+	require.False(t, strings.Contains(name, "/"))
+	again, err := c.encryptName(1, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, name, again)
+
+	siv, err := c.nameCipher(1)
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", decryptName(siv, name))
+	// plaintext names of former versions
+	require.Equal(t, "old name.txt", decryptName(siv, "old name.txt"))
+	require.Equal(t, "YWJj", decryptName(siv, "YWJj"))
+
+	c.SpaceM.AS[1].EncryptKey = nil
+	_, err = c.encryptName(1, "a.txt")
+	require.Error(t, err)
+}
+
+func TestResolvePath(t *testing.T) {
+	c := testNameClient(t)
+	ctx := context.Background()
+	meta := c.mclient.(*listMetadata)
+	p, err := c.resolvePath(ctx, 0, "/docs/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "/docs/a.txt", p)
+	require.Empty(t, meta.listed)
+
+	docs, err := c.encryptName(1, "docs")
+	require.NoError(t, err)
+	a, err := c.encryptName(1, "a.txt")
+	require.NoError(t, err)
+	// new names are encrypted, folders below one not found are not listed
+	p, err = c.resolvePath(ctx, 1, "/docs/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "/"+docs+"/"+a, p)
+	require.Equal(t, []string{"/"}, meta.listed)
+	p, err = c.resolvePath(ctx, 1, "/")
+	require.NoError(t, err)
+	require.Equal(t, "/", p)
+	p, err = c.resolvePath(ctx, 1, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, a, p)
+
+	// folder of plaintext name listed before keeps its name
+	meta.folders["/docs"] = nil
+	c.addResolvedPath(1, "/docs", "/docs")
+	p, err = c.resolvePath(ctx, 1, "/docs/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "/docs/"+a, p)
+}
+
+func TestResolvePathLookup(t *testing.T) {
+	c := testNameClient(t)
+	ctx := context.Background()
+	meta := c.mclient.(*listMetadata)
+	docs, err := c.encryptName(1, "docs")
+	require.NoError(t, err)
+	// folder of former version in root among more names than a page, a folder of encrypted name in it
+	root := []string{"legacy"}
+	for i := 0; i < lookupPageSize; i++ {
+		name, err := c.encryptName(1, fmt.Sprintf("file%d", i))
+		require.NoError(t, err)
+		root = append(root, name)
+	}
+	meta.folders["/"] = append(root, docs)
+	meta.folders["/legacy"] = []string{docs}
+
+	// nothing is resolved after restart, names are looked up in tracker
+	p, err := c.resolvePath(ctx, 1, "/legacy/docs")
+	require.NoError(t, err)
+	require.Equal(t, "/legacy/"+docs, p)
+	require.Equal(t, []string{"/", "/legacy"}, meta.listed)
+	p, err = c.resolvePath(ctx, 1, "/docs")
+	require.NoError(t, err)
+	require.Equal(t, "/"+docs, p)
+	require.Equal(t, []string{"/", "/legacy", "/", "/"}, meta.listed)
+
+	// resolved names are not looked up again
+	meta.listed = nil
+	p, err = c.resolvePath(ctx, 1, "/legacy/docs")
+	require.NoError(t, err)
+	require.Equal(t, "/legacy/"+docs, p)
+	require.Empty(t, meta.listed)
+
+	// error of listing is returned
+	delete(meta.folders, "/legacy")
+	meta.folders["/"] = []string{"other"}
+	c.resolved = nil
+	_, err = c.resolvePath(ctx, 1, "/other/a.txt")
+	require.Error(t, err)
+}
+
+func TestResolvedPathEviction(t *testing.T) {
+	c := testNameClient(t)
+	for i := 0; i < maxResolvedPaths; i++ {
+		c.addResolvedPath(1, fmt.Sprintf("/%d", i), fmt.Sprintf("/stored%d", i))
+	}
+	// used entry is kept, the least recently used is evicted
+	_, ok := c.resolvedPath(1, "/0")
+	require.True(t, ok)
+	c.addResolvedPath(1, "/new", "/stored new")
+	require.Len(t, c.resolved, maxResolvedPaths)
+	p, ok := c.resolvedPath(1, "/0")
+	require.True(t, ok)
+	require.Equal(t, "/stored0", p)
+	_, ok = c.resolvedPath(1, "/1")
+	require.False(t, ok)
+	_, ok = c.resolvedPath(1, "/new")
+	require.True(t, ok)
+}
@@ -0,0 +1,263 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"os"
+
+	collectClient "github.com/samoslab/nebula/client/collector_client"
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/samoslab/nebula/client/order"
+	client "github.com/samoslab/nebula/client/provider_client"
+	"github.com/samoslab/nebula/client/register"
+	"github.com/samoslab/nebula/client/util/filetype"
+	pb "github.com/samoslab/nebula/provider/pb"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	rpb "github.com/samoslab/nebula/tracker/register/client/pb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// ProviderTransport opens clients of provider service by server:port address
+type ProviderTransport interface {
+	// Provider returns client of provider at addr, release must be called once the client is not used
+	Provider(ctx context.Context, addr string) (client pb.ProviderServiceClient, release func(), err error)
+}
+
+// dialTransport dials provider for every client and closes the connection on release,
+// it is used by client manager not created by New
+type dialTransport struct{}
+
+func (dialTransport) Provider(ctx context.Context, addr string) (pb.ProviderServiceClient, func(), error) {
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pb.NewProviderServiceClient(conn), func() { conn.Close() }, nil
+}
+
+// Option configures client manager created by New
+type Option func(*options)
+
+type options struct {
+	log           logrus.FieldLogger
+	trackerAddr   string
+	trackerConn   *grpc.ClientConn
+	metadata      mpb.MatadataServiceClient
+	orderClient   rpb.OrderServiceClient
+	trackerPubkey *rsa.PublicKey
+	pubkeyHash    []byte
+	transport     ProviderTransport
+	collector     collectClient.Collector
+	collectAddr   string
+	configDir     string
+	tempDir       string
+	resumeUploads bool
+}
+
+// WithLogger sets logger, default logger is logrus standard logger
+func WithLogger(log logrus.FieldLogger) Option {
+	return func(o *options) { o.log = log }
+}
+
+// WithTrackerAddr dials tracker at addr, the connection is established in background and closed by Shutdown
+func WithTrackerAddr(addr string) Option {
+	return func(o *options) { o.trackerAddr = addr }
+}
+
+// WithTrackerConn uses conn for all tracker services, conn is not closed by Shutdown
+func WithTrackerConn(conn *grpc.ClientConn) Option {
+	return func(o *options) { o.trackerConn = conn }
+}
+
+// WithMetadataClient uses mc for file metadata instead of tracker connection
+func WithMetadataClient(mc mpb.MatadataServiceClient) Option {
+	return func(o *options) { o.metadata = mc }
+}
+
+// WithOrderClient uses oc for packages and orders instead of tracker connection
+func WithOrderClient(oc rpb.OrderServiceClient) Option {
+	return func(o *options) { o.orderClient = oc }
+}
+
+// WithTrackerPubkey sets tracker public key and its hash, otherwise they are fetched from tracker
+func WithTrackerPubkey(pubkey *rsa.PublicKey, pubkeyHash []byte) Option {
+	return func(o *options) { o.trackerPubkey, o.pubkeyHash = pubkey, pubkeyHash }
+}
+
+// WithProviderTransport sets transport to providers, default transport is a provider_client.Pool
+// with provider_client.DefaultPoolConfig, t is closed by Shutdown if it is an io.Closer
+func WithProviderTransport(t ProviderTransport) Option {
+	return func(o *options) { o.transport = t }
+}
+
+// WithCollector reports action logs of provider transfers to collector, default drops them
+func WithCollector(collector collectClient.Collector) Option {
+	return func(o *options) { o.collector = collector }
+}
+
+// WithCollectorAddr sends action logs to collector server at addr, the client is stopped by Shutdown
+func WithCollectorAddr(addr string) Option {
+	return func(o *options) { o.collectAddr = addr }
+}
+
+// WithConfigDir sets directory of upload journals and space files, default is temp dir
+func WithConfigDir(dir string) Option {
+	return func(o *options) { o.configDir = dir }
+}
+
+// WithTempDir sets directory of temporary files, default is os.TempDir
+func WithTempDir(dir string) Option {
+	return func(o *options) { o.tempDir = dir }
+}
+
+// WithResumeUploads resumes unfinished uploads of former run in background after creating
+func WithResumeUploads(resume bool) Option {
+	return func(o *options) { o.resumeUploads = resume }
+}
+
+// New creates client manager of node in cfg, it does not wait for connections,
+// ctx only bounds fetching tracker public key.
+func New(ctx context.Context, cfg *config.ClientConfig, opts ...Option) (*ClientManager, error) {
+	if cfg == nil || cfg.Node == nil {
+		return nil, errors.New("client config nil")
+	}
+	o := &options{log: logrus.StandardLogger(), tempDir: os.TempDir()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.configDir == "" {
+		o.configDir = o.tempDir
+	}
+	log := o.log
+
+	c := &ClientManager{
+		Log:         log,
+		cfg:         cfg,
+		TempDir:     o.tempDir,
+		NodeId:      cfg.Node.NodeId,
+		PM:          common.NewProgressManager(),
+		SpaceM:      NewSpaceManager(),
+		configDir:   o.configDir,
+		collector:   o.collector,
+		FileTypeMap: filetype.SupportTypes(),
+	}
+	c.transport = o.transport
+	if c.transport == nil {
+		c.transport = client.NewPool(log, client.DefaultPoolConfig)
+	}
+	fail := func(err error) (*ClientManager, error) {
+		if closer, ok := c.transport.(io.Closer); ok && o.transport == nil {
+			closer.Close()
+		}
+		if c.serverConn != nil {
+			c.serverConn.Close()
+		}
+		return nil, err
+	}
+	conn := o.trackerConn
+	if conn == nil && o.trackerAddr != "" {
+		var err error
+		if conn, err = grpc.Dial(o.trackerAddr, grpc.WithInsecure()); err != nil {
+			log.Errorf("Rpc dial failed: %s", err.Error())
+			return fail(err)
+		}
+		c.serverConn = conn
+		log.Infof("Tracker server %s", o.trackerAddr)
+	}
+	c.mclient = o.metadata
+	if c.mclient == nil && conn != nil {
+		c.mclient = mpb.NewMatadataServiceClient(conn)
+	}
+	if c.mclient == nil {
+		return fail(errors.New("tracker server nil"))
+	}
+	oc := o.orderClient
+	if oc == nil && conn != nil {
+		oc = rpb.NewOrderServiceClient(conn)
+	}
+	if oc != nil {
+		c.OM = order.NewOrderManagerWithClient(oc, log, cfg.Node.PriKey, cfg.Node.NodeId)
+	}
+	c.TrackerPubkey, c.PubkeyHash = o.trackerPubkey, o.pubkeyHash
+	if c.TrackerPubkey == nil {
+		if conn == nil {
+			return fail(errors.New("tracker public key nil"))
+		}
+		var err error
+		c.TrackerPubkey, c.PubkeyHash, err = register.GetPublicKeyContext(ctx, rpb.NewClientRegisterServiceClient(conn))
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	for _, sp := range cfg.Space {
+		log.Infof("Space %d name %s home %s", sp.SpaceNo, sp.Name, sp.Home)
+		c.SpaceM.AddSpace(sp.SpaceNo, sp.Password, sp.Home)
+	}
+
+	log.Infof("Temp dir is %s", c.TempDir)
+	if err := os.MkdirAll(c.TempDir, 0744); err != nil {
+		return fail(err)
+	}
+
+	if o.collectAddr != "" {
+		cc, err := collectClient.Dial(log, o.collectAddr, cfg.Node)
+		if err != nil {
+			return fail(err)
+		}
+		cc.Start()
+		c.collectClient, c.collector = cc, cc
+	}
+
+	if o.resumeUploads {
+		go func() {
+			if err := c.ResumeUploads(); err != nil {
+				log.Errorf("Resume uploads error %v", err)
+			}
+		}()
+	}
+
+	return c, nil
+}
+
+// NewClientManager create manager of web daemon, tracker and collector servers are taken from webcfg,
+// opts are applied after, eg: WithTrackerConn shares connection to tracker of caller.
+func NewClientManager(log logrus.FieldLogger, webcfg config.Config, cfg *config.ClientConfig, opts ...Option) (*ClientManager, error) {
+	if webcfg.TrackerServer == "" {
+		return nil, errors.New("tracker server nil")
+	}
+	if webcfg.CollectServer == "" {
+		return nil, errors.New("collect server nil")
+	}
+	return New(context.Background(), cfg, append([]Option{
+		WithLogger(log),
+		WithTrackerAddr(webcfg.TrackerServer),
+		WithCollectorAddr(webcfg.CollectServer),
+		WithConfigDir(webcfg.ConfigDir),
+		WithResumeUploads(true)}, opts...)...)
+}
+
+// Shutdown closes connections to tracker and collector opened by client manager
+func (c *ClientManager) Shutdown() {
+	if c.serverConn != nil {
+		c.serverConn.Close()
+	}
+	if c.collectClient != nil {
+		c.collectClient.Stop()
+	}
+	if closer, ok := c.transport.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// providers returns transport to providers
+func (c *ClientManager) providers() ProviderTransport {
+	if c.transport == nil {
+		return dialTransport{}
+	}
+	return c.transport
+}
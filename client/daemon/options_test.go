@@ -0,0 +1,155 @@
+package daemon
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/samoslab/nebula/provider/node"
+	pb "github.com/samoslab/nebula/provider/pb"
+	tcppb "github.com/samoslab/nebula/tracker/collector/client/pb"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type fakeMetadata struct {
+	mpb.MatadataServiceClient
+	node    *node.Node
+	removed [][]byte
+}
+
+func (f *fakeMetadata) Remove(ctx context.Context, req *mpb.RemoveReq, opts ...grpc.CallOption) (*mpb.RemoveResp, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := req.VerifySign(f.node.PubKey); err != nil {
+		return nil, err
+	}
+	f.removed = append(f.removed, req.GetTarget().GetId())
+	return &mpb.RemoveResp{}, nil
+}
+
+type fakeProvider struct {
+	pb.ProviderServiceClient
+	addr   string
+	stored []*pb.StoreReq
+}
+
+func (f *fakeProvider) Ping(ctx context.Context, req *pb.PingReq, opts ...grpc.CallOption) (*pb.PingResp, error) {
+	if f.addr == "down:6666" {
+		return nil, errors.New("unreachable")
+	}
+	return &pb.PingResp{}, nil
+}
+
+func (f *fakeProvider) StoreSmall(ctx context.Context, req *pb.StoreReq, opts ...grpc.CallOption) (*pb.StoreResp, error) {
+	f.stored = append(f.stored, req)
+	return &pb.StoreResp{Success: true}, nil
+}
+
+type fakeTransport struct {
+	mutex     sync.Mutex
+	providers map[string]*fakeProvider
+	inUse     int
+	closed    bool
+}
+
+func (f *fakeTransport) Provider(ctx context.Context, addr string) (pb.ProviderServiceClient, func(), error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	p, ok := f.providers[addr]
+	if !ok {
+		p = &fakeProvider{addr: addr}
+		f.providers[addr] = p
+	}
+	f.inUse++
+	return p, func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		f.inUse--
+	}, nil
+}
+
+func (f *fakeTransport) Close() error {
+	f.closed = true
+	return nil
+}
+
+type fakeCollector struct {
+	mutex sync.Mutex
+	logs  []*tcppb.ActionLog
+}
+
+func (f *fakeCollector) Collect(al *tcppb.ActionLog) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.logs = append(f.logs, al)
+}
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLogger("", true)
+	require.NoError(t, err)
+	no := node.NewNode(1)
+	cfg := &config.ClientConfig{Node: no}
+
+	_, err = New(context.Background(), cfg, WithLogger(log))
+	require.EqualError(t, err, "tracker server nil")
+	meta := &fakeMetadata{node: no}
+	_, err = New(context.Background(), cfg, WithLogger(log), WithMetadataClient(meta))
+	require.EqualError(t, err, "tracker public key nil")
+
+	transport := &fakeTransport{providers: map[string]*fakeProvider{}}
+	collector := &fakeCollector{}
+	c, err := New(context.Background(), cfg,
+		WithLogger(log),
+		WithMetadataClient(meta),
+		WithTrackerPubkey(no.PubKey, []byte("hash")),
+		WithProviderTransport(transport),
+		WithCollector(collector),
+		WithConfigDir(dir),
+		WithTempDir(filepath.Join(dir, "tmp")))
+	require.NoError(t, err)
+	require.Nil(t, c.OM)
+	require.Equal(t, filepath.Join(dir, JournalDirName), c.journalDir())
+	require.DirExists(t, c.TempDir)
+
+	// tracker requests use context of caller
+	id := []byte("file id")
+	require.NoError(t, c.RemoveFileContext(context.Background(), hex.EncodeToString(id), false, false, 0))
+	require.Equal(t, [][]byte{id}, meta.removed)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, c.RemoveFileContext(ctx, hex.EncodeToString(id), false, false, 0))
+
+	// blocks are stored by transport and reported to collector
+	fileName := filepath.Join(dir, "block")
+	require.NoError(t, ioutil.WriteFile(fileName, []byte("block data"), 0644))
+	para := &common.UploadParameter{HF: common.HashFile{FileName: fileName, FileSize: 10, FileHash: []byte("block hash")}}
+	nodeId, err := c.uploadFileToReplicaProvider(context.Background(), &mpb.ReplicaProvider{NodeId: []byte("provider"), Server: "up", Port: 6666, Ticket: "ticket"}, para)
+	require.NoError(t, err)
+	require.Equal(t, []byte("provider"), nodeId)
+	stored := transport.providers["up:6666"].stored
+	require.Len(t, stored, 1)
+	require.Equal(t, []byte("block data"), stored[0].Data)
+	require.Len(t, collector.logs, 1)
+	require.True(t, collector.logs[0].Success)
+	require.Equal(t, "ticket", collector.logs[0].Ticket)
+
+	best := c.BestRetrieveNode([]*mpb.RetrieveNode{{Server: "down", Port: 6666}, {Server: "up", Port: 6666}})
+	require.Equal(t, "up", best.Server)
+	require.Zero(t, transport.inUse)
+
+	c.Shutdown()
+	require.True(t, transport.closed)
+}
@@ -0,0 +1,318 @@
+package daemon
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/samoslab/nebula/client/common"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	"github.com/samoslab/nebula/util/aes"
+)
+
+// contentDirName folder of temp dir keeping decoded partitions of files read by ranges
+const contentDirName = "content"
+
+// ContentCacheSize bytes of decoded partitions kept in temp dir, the least recently used are removed beyond it
+var ContentCacheSize = int64(1 << 30)
+
+// File content of a file of net disk read by ranges
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// OpenFile returns content of file fileName of hash fileHash. Nothing is retrieved until it is read, a read retrieves
+// and decodes only the partitions it covers, they are kept for later reads of the same file. Retrieving is aborted
+// when ctx is done.
+func (c *ClientManager) OpenFile(ctx context.Context, fileName, fileHash string, fileSize uint64, sno uint32) (File, error) {
+	hash, err := hex.DecodeString(fileHash)
+	if err != nil {
+		return nil, err
+	}
+	return &fileReader{c: c, ctx: ctx, name: fileName, hash: hash, size: int64(fileSize), sno: sno, parts: map[int]*os.File{}}, nil
+}
+
+type fileReader struct {
+	c      *ClientManager
+	ctx    context.Context
+	name   string
+	hash   []byte
+	size   int64
+	sno    uint32
+	offset int64
+
+	mutex    sync.Mutex
+	req      *mpb.RetrieveFileReq
+	rsp      *mpb.RetrieveFileResp
+	password []byte
+	data     []byte      // content of tiny file
+	ranges   []fileRange // ranges of partitions
+	replica  bool
+	parts    map[int]*os.File
+}
+
+// retrieve requests blocks of file once
+func (f *fileReader) retrieve() error {
+	if f.rsp != nil {
+		return nil
+	}
+	req := &mpb.RetrieveFileReq{
+		Version:   common.Version,
+		NodeId:    f.c.NodeId,
+		Timestamp: common.Now(),
+		FileHash:  f.hash,
+		FileSize:  uint64(f.size),
+		SpaceNo:   f.sno,
+	}
+	f.c.Log.Infof("Read request %s file hash %x, size %d", f.name, f.hash, f.size)
+	rsp, password, err := f.c.retrieveFile(f.ctx, req)
+	if err != nil {
+		return err
+	}
+	if data := rsp.GetFileData(); data != nil {
+		if len(password) != 0 {
+			if data, err = aes.Open(data, password); err != nil {
+				return err
+			}
+		}
+		f.data = data
+	} else {
+		partitions := rsp.GetPartition()
+		if len(partitions) == 1 && len(partitions[0].GetBlock()) == 1 {
+			f.replica = true
+			f.ranges = []fileRange{{Offset: 0, Size: f.size}}
+		} else if f.ranges = partitionRanges(f.size); len(f.ranges) != len(partitions) {
+			return fmt.Errorf("file of size %d has %d partitions, expect %d", f.size, len(partitions), len(f.ranges))
+		}
+	}
+	f.req, f.rsp, f.password = req, rsp, password
+	return nil
+}
+
+// partition opens decoded partition i, it is retrieved if it is not cached
+func (f *fileReader) partition(i int) (*os.File, error) {
+	if part, ok := f.parts[i]; ok {
+		return part, nil
+	}
+	partition := f.rsp.GetPartition()[i]
+	key := fmt.Sprintf("%x.%d", f.hash, i)
+	part, err := f.c.contentCache().open(f.ctx, key, func(fileName string) error {
+		if f.replica {
+			if _, _, _, _, err := f.c.saveFileByPartition(f.ctx, fileName, partition, f.rsp.GetTimestamp(), f.hash, uint64(f.size), true); err != nil {
+				return err
+			}
+			if len(f.password) != 0 {
+				return aes.DecryptFile(fileName, f.password, fileName)
+			}
+			return nil
+		}
+		file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		r := fileRange{Offset: 0, Size: f.ranges[i].Size}
+		err = f.c.retrievePartition(f.ctx, fileName, partition, f.rsp.GetTimestamp(), f.req, r, f.password, file, nil)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.parts[i] = part
+	return part, nil
+}
+
+func (f *fileReader) ReadAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if err := f.retrieve(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) && off+int64(n) < f.size {
+		pos := off + int64(n)
+		if f.data != nil {
+			if pos >= int64(len(f.data)) {
+				break
+			}
+			n += copy(p[n:], f.data[pos:])
+			continue
+		}
+		i := 0
+		for i < len(f.ranges)-1 && pos >= f.ranges[i+1].Offset {
+			i++
+		}
+		part, err := f.partition(i)
+		if err != nil {
+			return n, err
+		}
+		r := f.ranges[i]
+		end := len(p)
+		if left := r.Offset + r.Size - pos; int64(end-n) > left {
+			end = n + int(left)
+		}
+		m, err := part.ReadAt(p[n:end], pos-r.Offset)
+		n += m
+		if m == 0 && err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *fileReader) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *fileReader) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, part := range f.parts {
+		part.Close()
+		delete(f.parts, i)
+	}
+	return nil
+}
+
+// contentCache returns cache of decoded partitions, partitions left by former runs are removed
+func (c *ClientManager) contentCache() *partCache {
+	c.contentOnce.Do(func() {
+		dir := filepath.Join(c.TempDir, contentDirName)
+		if err := os.RemoveAll(dir); err != nil {
+			c.Log.Errorf("Remove content cache %s error %v", dir, err)
+		}
+		c.content = newPartCache(dir, ContentCacheSize)
+	})
+	return c.content
+}
+
+// partCache decoded partitions in dir, the least recently used are removed when they take more than max bytes
+type partCache struct {
+	dir     string
+	max     int64
+	mutex   sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently used
+	loading map[string]chan struct{}
+}
+
+type partEntry struct {
+	key  string
+	size int64
+}
+
+func newPartCache(dir string, max int64) *partCache {
+	return &partCache{dir: dir, max: max, entries: map[string]*list.Element{}, order: list.New(), loading: map[string]chan struct{}{}}
+}
+
+// open opens partition key, load writes it into the file named if it is not cached. A partition is loaded by
+// one caller at a time, the others wait for it.
+func (pc *partCache) open(ctx context.Context, key string, load func(fileName string) error) (*os.File, error) {
+	fileName := filepath.Join(pc.dir, key)
+	for {
+		pc.mutex.Lock()
+		if elem, ok := pc.entries[key]; ok {
+			pc.order.MoveToFront(elem)
+			// an evicted file opened before stays readable
+			f, err := os.Open(fileName)
+			pc.mutex.Unlock()
+			return f, err
+		}
+		wait, ok := pc.loading[key]
+		if !ok {
+			break
+		}
+		pc.mutex.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	pc.loading[key] = done
+	pc.mutex.Unlock()
+	defer func() {
+		pc.mutex.Lock()
+		delete(pc.loading, key)
+		pc.mutex.Unlock()
+		close(done)
+	}()
+
+	if err := os.MkdirAll(pc.dir, 0700); err != nil {
+		return nil, err
+	}
+	tempFileName := fileName + downloadSuffix
+	if err := load(tempFileName); err != nil {
+		os.Remove(tempFileName)
+		return nil, err
+	}
+	info, err := os.Stat(tempFileName)
+	if err == nil {
+		err = os.Rename(tempFileName, fileName)
+	}
+	if err != nil {
+		os.Remove(tempFileName)
+		return nil, err
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.entries[key] = pc.order.PushFront(&partEntry{key: key, size: info.Size()})
+	pc.size += info.Size()
+	for pc.size > pc.max && pc.order.Len() > 1 {
+		oldest := pc.order.Back()
+		entry := oldest.Value.(*partEntry)
+		pc.order.Remove(oldest)
+		delete(pc.entries, entry.key)
+		pc.size -= entry.size
+		os.Remove(filepath.Join(pc.dir, entry.key))
+	}
+	return f, nil
+}
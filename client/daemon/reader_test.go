@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/samoslab/nebula/client/config"
+	"github.com/samoslab/nebula/provider/node"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type retrieveMetadata struct {
+	mpb.MatadataServiceClient
+	data      []byte
+	retrieved int
+}
+
+func (f *retrieveMetadata) RetrieveFile(ctx context.Context, req *mpb.RetrieveFileReq, opts ...grpc.CallOption) (*mpb.RetrieveFileResp, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.retrieved++
+	return &mpb.RetrieveFileResp{FileData: f.data}, nil
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLogger("", true)
+	require.NoError(t, err)
+	no := node.NewNode(1)
+	meta := &retrieveMetadata{data: []byte("0123456789")}
+	c, err := New(context.Background(), &config.ClientConfig{Node: no},
+		WithLogger(log),
+		WithMetadataClient(meta),
+		WithTrackerPubkey(no.PubKey, []byte("hash")),
+		WithProviderTransport(&fakeTransport{providers: map[string]*fakeProvider{}}),
+		WithCollector(&fakeCollector{}),
+		WithConfigDir(dir))
+	require.NoError(t, err)
+	defer c.Shutdown()
+
+	_, err = c.OpenFile(context.Background(), "/a.txt", "not hex", 10, 0)
+	require.Error(t, err)
+	f, err := c.OpenFile(context.Background(), "/a.txt", hex.EncodeToString([]byte("hash")), 10, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	// size is known without retrieving
+	n, err := f.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+	require.Zero(t, meta.retrieved)
+
+	buf := make([]byte, 3)
+	_, err = f.ReadAt(buf, 2)
+	require.NoError(t, err)
+	require.Equal(t, "234", string(buf))
+	m, err := f.ReadAt(buf, 8)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, "89", string(buf[:m]))
+	_, err = f.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "56789", string(data))
+	require.Equal(t, 1, meta.retrieved)
+
+	// retrieving is aborted by context of reader
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f, err = c.OpenFile(ctx, "/a.txt", hex.EncodeToString([]byte("hash")), 10, 0)
+	require.NoError(t, err)
+	_, err = f.Read(buf)
+	require.Error(t, err)
+}
+
+func TestPartCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "content")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pc := newPartCache(filepath.Join(dir, contentDirName), 10)
+	ctx := context.Background()
+	loads := 0
+	load := func(content string) func(string) error {
+		return func(fileName string) error {
+			loads++
+			return ioutil.WriteFile(fileName, []byte(content), 0600)
+		}
+	}
+	read := func(f *os.File, err error) string {
+		require.NoError(t, err)
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// a partition is loaded once by concurrent readers
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := pc.open(ctx, "a.0", func(fileName string) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return load("aaaaaa")(fileName)
+			})
+			require.Equal(t, "aaaaaa", read(f, err))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, loads)
+
+	// failed load is not cached
+	_, err = pc.open(ctx, "b.0", func(fileName string) error { return errors.New("unavailable") })
+	require.Error(t, err)
+	require.Equal(t, "bbbbbb", read(pc.open(ctx, "b.0", load("bbbbbb"))))
+	require.Equal(t, 2, loads)
+
+	// the least recently used is removed when partitions take more than max bytes
+	require.Equal(t, "bbbbbb", read(pc.open(ctx, "b.0", load("bbbbbb"))))
+	require.Equal(t, 2, loads)
+	_, err = os.Stat(filepath.Join(pc.dir, "a.0"))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, "aaaaaa", read(pc.open(ctx, "a.0", load("aaaaaa"))))
+	require.Equal(t, 3, loads)
+	require.Equal(t, int64(6), pc.size)
+}
@@ -0,0 +1,364 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	client "github.com/samoslab/nebula/client/provider_client"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	util_hash "github.com/samoslab/nebula/util/hash"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// RetrieveAttempts tries of one block, failed nodes are retried after all nodes of the block are tried
+	RetrieveAttempts = 4
+	// RetrieveHedgeDelay a request is hedged on the next node if it is not done within this delay plus the time of RetrieveMinRate
+	RetrieveHedgeDelay = 5 * time.Second
+	// RetrieveMinRate bytes per second a node is expected to send
+	RetrieveMinRate = uint64(256 * 1024)
+	// RetrieveParallel blocks retrieved concurrently
+	RetrieveParallel = 4
+	// RetrieveDialTimeout timeout of connecting to provider
+	RetrieveDialTimeout = 3 * time.Second
+)
+
+// unreachableLatency ranks nodes which can not be pinged last
+const unreachableLatency = time.Hour
+
+type retrieveFetcher func(ctx context.Context, node *mpb.RetrieveNode, block *mpb.RetrieveBlock, fileName string, received func(n uint64)) error
+
+// retrieveScheduler downloads blocks from their store nodes in ranked order, it fails over to
+// the next node on error, hedges slow nodes and verifies block hash before accepting it.
+type retrieveScheduler struct {
+	log         logrus.FieldLogger
+	attempts    int
+	hedgeDelay  time.Duration
+	minRate     uint64
+	ping        func(ctx context.Context, node *mpb.RetrieveNode) (time.Duration, error)
+	fetch       retrieveFetcher
+	progress    func(block *mpb.RetrieveBlock, n uint64)
+	mutex       sync.Mutex
+	latency     map[string]time.Duration
+	failures    map[string]int
+	pingWaiters map[string]chan struct{}
+}
+
+func nodeAddr(node *mpb.RetrieveNode) string {
+	return fmt.Sprintf("%s:%d", node.GetServer(), node.GetPort())
+}
+
+func (c *ClientManager) newRetrieveScheduler(log logrus.FieldLogger, tm uint64, fileHash []byte, fileSize uint64) *retrieveScheduler {
+	s := newRetrieveScheduler(log)
+	s.ping = c.pingRetrieveNode
+	s.fetch = func(ctx context.Context, node *mpb.RetrieveNode, block *mpb.RetrieveBlock, fileName string, received func(n uint64)) error {
+		dialCtx, cancel := context.WithTimeout(ctx, RetrieveDialTimeout)
+		defer cancel()
+		pclient, release, err := c.providers().Provider(dialCtx, nodeAddr(node))
+		if err != nil {
+			return err
+		}
+		defer release()
+		return client.RetrieveContext(ctx, log, pclient, c.collector, fileName, node.GetAuth(), node.GetTicket(), tm, fileHash, block.GetHash(), fileSize, block.GetSize(), received)
+	}
+	s.progress = func(block *mpb.RetrieveBlock, n uint64) {
+		realfile, ok := c.PM.Origin(hex.EncodeToString(block.GetHash()))
+		if ok {
+			c.PM.SetIncrement(realfile, n)
+		}
+	}
+	return s
+}
+
+func newRetrieveScheduler(log logrus.FieldLogger) *retrieveScheduler {
+	return &retrieveScheduler{
+		log:         log,
+		attempts:    RetrieveAttempts,
+		hedgeDelay:  RetrieveHedgeDelay,
+		minRate:     RetrieveMinRate,
+		progress:    func(*mpb.RetrieveBlock, uint64) {},
+		latency:     map[string]time.Duration{},
+		failures:    map[string]int{},
+		pingWaiters: map[string]chan struct{}{},
+	}
+}
+
+func (c *ClientManager) pingRetrieveNode(ctx context.Context, node *mpb.RetrieveNode) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, RetrieveDialTimeout)
+	defer cancel()
+	start := time.Now()
+	pclient, release, err := c.providers().Provider(ctx, nodeAddr(node))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if err = client.PingContext(ctx, pclient); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// nodeLatency pings node once per scheduler, concurrent callers wait for the same ping.
+// Latency of a ping cancelled by ctx is not kept.
+func (s *retrieveScheduler) nodeLatency(ctx context.Context, node *mpb.RetrieveNode) time.Duration {
+	addr := nodeAddr(node)
+	s.mutex.Lock()
+	if d, ok := s.latency[addr]; ok {
+		s.mutex.Unlock()
+		return d
+	}
+	if wait, ok := s.pingWaiters[addr]; ok {
+		s.mutex.Unlock()
+		<-wait
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if d, ok := s.latency[addr]; ok {
+			return d
+		}
+		return unreachableLatency
+	}
+	wait := make(chan struct{})
+	s.pingWaiters[addr] = wait
+	s.mutex.Unlock()
+
+	d, err := s.ping(ctx, node)
+	if err != nil {
+		s.log.Infof("Ping %s error %v", addr, err)
+		d = unreachableLatency
+	}
+	s.mutex.Lock()
+	if ctx.Err() == nil {
+		s.latency[addr] = d
+	}
+	delete(s.pingWaiters, addr)
+	s.mutex.Unlock()
+	close(wait)
+	return d
+}
+
+// rank sorts nodes by failures in this download, then by latency
+func (s *retrieveScheduler) rank(ctx context.Context, nodes []*mpb.RetrieveNode) []*mpb.RetrieveNode {
+	latency := make([]time.Duration, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *mpb.RetrieveNode) {
+			defer wg.Done()
+			latency[i] = s.nodeLatency(ctx, node)
+		}(i, node)
+	}
+	wg.Wait()
+	idx := make([]int, len(nodes))
+	for i := range idx {
+		idx[i] = i
+	}
+	s.mutex.Lock()
+	sort.SliceStable(idx, func(a, b int) bool {
+		fa, fb := s.failures[nodeAddr(nodes[idx[a]])], s.failures[nodeAddr(nodes[idx[b]])]
+		if fa != fb {
+			return fa < fb
+		}
+		return latency[idx[a]] < latency[idx[b]]
+	})
+	s.mutex.Unlock()
+	res := make([]*mpb.RetrieveNode, len(nodes))
+	for i, k := range idx {
+		res[i] = nodes[k]
+	}
+	return res
+}
+
+func (s *retrieveScheduler) reportFailure(node *mpb.RetrieveNode) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[nodeAddr(node)]++
+}
+
+// blockHedgeDelay is the time a node may take for the block before it is hedged
+func (s *retrieveScheduler) blockHedgeDelay(size uint64) time.Duration {
+	if s.minRate == 0 {
+		return s.hedgeDelay
+	}
+	return s.hedgeDelay + time.Duration(size*uint64(time.Second)/s.minRate)
+}
+
+type retrieveAttempt struct {
+	node     *mpb.RetrieveNode
+	fileName string
+	err      error
+}
+
+// blockProgress reports the furthest attempt of a block, so retries and hedged requests are not counted twice
+type blockProgress struct {
+	mutex    sync.Mutex
+	max      uint64
+	attempts map[int]uint64
+	report   func(n uint64)
+}
+
+func (p *blockProgress) received(attempt int) func(n uint64) {
+	return func(n uint64) {
+		p.mutex.Lock()
+		p.attempts[attempt] += n
+		var delta uint64
+		if cur := p.attempts[attempt]; cur > p.max {
+			delta, p.max = cur-p.max, cur
+		}
+		p.mutex.Unlock()
+		if delta > 0 {
+			p.report(delta)
+		}
+	}
+}
+
+// retrieveBlock downloads block to fileName, the content is verified by block hash.
+// It returns parent.Err() if parent is done before any node succeeds.
+func (s *retrieveScheduler) retrieveBlock(parent context.Context, block *mpb.RetrieveBlock, fileName string) error {
+	nodes := s.rank(parent, block.GetStoreNode())
+	if len(nodes) == 0 {
+		return fmt.Errorf("block %x has no store node", block.GetHash())
+	}
+	budget := s.attempts
+	if budget < 1 {
+		budget = 1
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	results := make(chan *retrieveAttempt, budget)
+	// losers of hedged requests and cancelled requests clean their files
+	drain := func(n int) {
+		go func() {
+			for i := 0; i < n; i++ {
+				os.Remove((<-results).fileName)
+			}
+		}()
+	}
+	progress := &blockProgress{attempts: map[int]uint64{}, report: func(n uint64) { s.progress(block, n) }}
+	started, running := 0, 0
+	start := func() {
+		node := nodes[started%len(nodes)]
+		attempt := &retrieveAttempt{node: node, fileName: fmt.Sprintf("%s.retrieve%d", fileName, started)}
+		received := progress.received(started)
+		started++
+		running++
+		s.log.Infof("Hash %x retrieve from %s", block.GetHash(), nodeAddr(node))
+		go func() {
+			attempt.err = s.fetch(ctx, node, block, attempt.fileName, received)
+			if attempt.err == nil {
+				attempt.err = verifyBlock(attempt.fileName, block)
+			}
+			results <- attempt
+		}()
+	}
+	start()
+	hedgeDelay := s.blockHedgeDelay(block.GetSize())
+	hedge := time.NewTimer(hedgeDelay)
+	defer hedge.Stop()
+	errs := []string{}
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				cancel()
+				drain(running)
+				return os.Rename(r.fileName, fileName)
+			}
+			os.Remove(r.fileName)
+			if parent.Err() != nil {
+				drain(running)
+				return parent.Err()
+			}
+			s.reportFailure(r.node)
+			s.log.Errorf("Retrieve %x from %s error %v", block.GetHash(), nodeAddr(r.node), r.err)
+			errs = append(errs, fmt.Sprintf("%s: %v", nodeAddr(r.node), r.err))
+			if started < budget {
+				start()
+				hedge.Reset(hedgeDelay)
+			}
+		case <-parent.Done():
+			cancel()
+			drain(running)
+			return parent.Err()
+		case <-hedge.C:
+			// hedge only on nodes not tried yet
+			if started < budget && started < len(nodes) {
+				s.log.Infof("Retrieve %x from %s is slow, hedge on next node", block.GetHash(), nodeAddr(nodes[started-1]))
+				start()
+				hedge.Reset(hedgeDelay)
+			}
+		}
+	}
+	return fmt.Errorf("retrieve block %x failed after %d attempts: %s", block.GetHash(), started, strings.Join(errs, "; "))
+}
+
+func verifyBlock(fileName string, block *mpb.RetrieveBlock) error {
+	hash, err := util_hash.Sha1File(fileName)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, block.GetHash()) {
+		return fmt.Errorf("hash mismatch, got %x", hash)
+	}
+	return nil
+}
+
+// retrieveBlocks retrieves blocks to fileNames with at most parallel blocks at a time, when enough blocks
+// are retrieved the others are cancelled. Cancelled blocks are neither in retrieved nor in errs.
+func (s *retrieveScheduler) retrieveBlocks(parent context.Context, blocks []*mpb.RetrieveBlock, fileNames []string, parallel int, enough int) (retrieved []string, errs []error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	if parallel < 1 {
+		parallel = 1
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i, block := range blocks {
+		// blocks waiting for a slot are not started once enough are retrieved
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(block *mpb.RetrieveBlock, fileName string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			log := s.log.WithField("part file", fileName)
+			err := s.retrieveBlock(ctx, block, fileName)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == context.Canceled {
+				if parent.Err() != nil {
+					log.Info("Retrieve cancelled")
+				} else {
+					log.Info("Retrieve cancelled, enough blocks retrieved")
+				}
+				return
+			}
+			if err != nil {
+				log.Errorf("Retrieve failed %v", err)
+				errs = append(errs, err)
+				return
+			}
+			log.Info("Retrieve success")
+			retrieved = append(retrieved, fileName)
+			if len(retrieved) == enough {
+				log.Infof("%d blocks retrieved, cancel the rest", enough)
+				cancel()
+			}
+		}(block, fileNames[i])
+	}
+	wg.Wait()
+	return
+}
@@ -0,0 +1,219 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func testRetrieveScheduler(t *testing.T, latency map[string]time.Duration, fetch retrieveFetcher) *retrieveScheduler {
+	log, err := NewLogger("", true)
+	require.NoError(t, err)
+	s := newRetrieveScheduler(log)
+	s.hedgeDelay, s.minRate = 50*time.Millisecond, 0
+	s.ping = func(ctx context.Context, node *mpb.RetrieveNode) (time.Duration, error) {
+		if d, ok := latency[node.GetServer()]; ok {
+			return d, nil
+		}
+		return 0, errors.New("unreachable")
+	}
+	s.fetch = fetch
+	return s
+}
+
+func testBlock(data []byte, servers ...string) *mpb.RetrieveBlock {
+	hash := sha1.Sum(data)
+	block := &mpb.RetrieveBlock{Hash: hash[:], Size: uint64(len(data))}
+	for _, server := range servers {
+		block.StoreNode = append(block.StoreNode, &mpb.RetrieveNode{Server: server, Port: 6666})
+	}
+	return block
+}
+
+func TestRetrieveRank(t *testing.T) {
+	s := testRetrieveScheduler(t, map[string]time.Duration{"a": 30 * time.Millisecond, "b": 10 * time.Millisecond, "c": 20 * time.Millisecond}, nil)
+	block := testBlock(nil, "d", "a", "b", "c")
+	servers := func() []string {
+		res := []string{}
+		for _, node := range s.rank(context.Background(), block.GetStoreNode()) {
+			res = append(res, node.GetServer())
+		}
+		return res
+	}
+	require.Equal(t, []string{"b", "c", "a", "d"}, servers())
+	s.reportFailure(block.GetStoreNode()[2])
+	require.Equal(t, []string{"c", "a", "d", "b"}, servers())
+}
+
+func TestRetrieveFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrieve")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	data := []byte("block content of nebula")
+	var calls int32
+	s := testRetrieveScheduler(t, map[string]time.Duration{"bad": time.Millisecond, "corrupt": 2 * time.Millisecond, "good": 3 * time.Millisecond},
+		func(ctx context.Context, node *mpb.RetrieveNode, block *mpb.RetrieveBlock, fileName string, received func(n uint64)) error {
+			atomic.AddInt32(&calls, 1)
+			switch node.GetServer() {
+			case "bad":
+				received(10)
+				return errors.New("connection reset")
+			case "corrupt":
+				received(uint64(len(data)))
+				return ioutil.WriteFile(fileName, []byte("tampered content"), 0644)
+			}
+			received(uint64(len(data)))
+			return ioutil.WriteFile(fileName, data, 0644)
+		})
+	var reported uint64
+	s.progress = func(block *mpb.RetrieveBlock, n uint64) { atomic.AddUint64(&reported, n) }
+	fileName := filepath.Join(dir, "block")
+	require.NoError(t, s.retrieveBlock(context.Background(), testBlock(data, "good", "corrupt", "bad"), fileName))
+	content, err := ioutil.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, data, content)
+	require.Equal(t, int32(3), calls)
+	require.Equal(t, uint64(len(data)), reported)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+}
+
+func TestRetrieveBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrieve")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var calls int32
+	s := testRetrieveScheduler(t, map[string]time.Duration{"a": time.Millisecond},
+		func(ctx context.Context, node *mpb.RetrieveNode, block *mpb.RetrieveBlock, fileName string, received func(n uint64)) error {
+			atomic.AddInt32(&calls, 1)
+			return errors.New("unavailable")
+		})
+	s.attempts = 3
+	require.Error(t, s.retrieveBlock(context.Background(), testBlock([]byte("x"), "a", "b"), filepath.Join(dir, "block")))
+	require.Equal(t, int32(3), calls)
+}
+
+func TestRetrieveHedge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrieve")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	data := []byte("block content of nebula")
+	cancelled := make(chan struct{})
+	s := testRetrieveScheduler(t, map[string]time.Duration{"slow": time.Millisecond, "fast": 2 * time.Millisecond},
+		func(ctx context.Context, node *mpb.RetrieveNode, block *mpb.RetrieveBlock, fileName string, received func(n uint64)) error {
+			if node.GetServer() == "slow" {
+				<-ctx.Done()
+				close(cancelled)
+				return ctx.Err()
+			}
+			return ioutil.WriteFile(fileName, data, 0644)
+		})
+	start := time.Now()
+	require.NoError(t, s.retrieveBlock(context.Background(), testBlock(data, "slow", "fast"), filepath.Join(dir, "block")))
+	require.True(t, time.Since(start) < 5*time.Second)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request not cancelled")
+	}
+}
+
+func TestRetrieveEarlyK(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrieve")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var cancelled int32
+	contents := map[string][]byte{}
+	s := testRetrieveScheduler(t, map[string]time.Duration{"fast": time.Millisecond, "slow": time.Millisecond, "down": time.Millisecond},
+		func(ctx context.Context, node *mpb.RetrieveNode, block *mpb.RetrieveBlock, fileName string, received func(n uint64)) error {
+			switch node.GetServer() {
+			case "slow":
+				<-ctx.Done()
+				atomic.AddInt32(&cancelled, 1)
+				return ctx.Err()
+			case "down":
+				return errors.New("unavailable")
+			}
+			return ioutil.WriteFile(fileName, contents[string(block.GetHash())], 0644)
+		})
+	s.hedgeDelay = time.Hour
+	blocks, fileNames := []*mpb.RetrieveBlock{}, []string{}
+	for i, server := range []string{"fast", "slow", "fast", "down", "fast", "slow"} {
+		data := []byte(fmt.Sprintf("content of shard %d", i))
+		block := testBlock(data, server)
+		contents[string(block.GetHash())] = data
+		blocks, fileNames = append(blocks, block), append(fileNames, filepath.Join(dir, fmt.Sprintf("shard.%d", i)))
+	}
+	retrieved, errs := s.retrieveBlocks(context.Background(), blocks, fileNames, len(blocks), 3)
+	require.Equal(t, 3, len(retrieved))
+	// the failing block may be cancelled before its attempts are used up
+	require.True(t, len(errs) <= 1)
+	// cancelled requests finish in background
+	for i := 0; i < 100 && atomic.LoadInt32(&cancelled) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&cancelled))
+	for _, i := range []int{1, 3, 5} {
+		_, err := os.Stat(fileNames[i])
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestRetrieveBlocksCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrieve")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var fetched, pinged int32
+	s := testRetrieveScheduler(t, map[string]time.Duration{"fast": time.Millisecond}, nil)
+	blocks, fileNames := []*mpb.RetrieveBlock{}, []string{}
+	contents := map[string][]byte{}
+	for i := 0; i < 4; i++ {
+		data := []byte(fmt.Sprintf("content of shard %d", i))
+		block := testBlock(data, "fast")
+		contents[string(block.GetHash())] = data
+		blocks, fileNames = append(blocks, block), append(fileNames, filepath.Join(dir, fmt.Sprintf("shard.%d", i)))
+	}
+	s.fetch = func(ctx context.Context, node *mpb.RetrieveNode, block *mpb.RetrieveBlock, fileName string, received func(n uint64)) error {
+		atomic.AddInt32(&fetched, 1)
+		return ioutil.WriteFile(fileName, contents[string(block.GetHash())], 0644)
+	}
+
+	// blocks waiting for a slot are not started after enough are retrieved
+	retrieved, errs := s.retrieveBlocks(context.Background(), blocks, fileNames, 1, 2)
+	require.Len(t, retrieved, 2)
+	require.Empty(t, errs)
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetched))
+
+	// nothing is started when parent is cancelled
+	atomic.StoreInt32(&fetched, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s = testRetrieveScheduler(t, nil, s.fetch)
+	s.ping = func(ctx context.Context, node *mpb.RetrieveNode) (time.Duration, error) {
+		atomic.AddInt32(&pinged, 1)
+		return 0, ctx.Err()
+	}
+	retrieved, errs = s.retrieveBlocks(ctx, blocks, fileNames, 2, len(blocks))
+	require.Empty(t, retrieved)
+	require.Empty(t, errs)
+	require.Zero(t, atomic.LoadInt32(&fetched))
+	require.Zero(t, atomic.LoadInt32(&pinged))
+
+	// ping is cancelled with the block and its latency is not kept
+	s.ping = func(ctx context.Context, node *mpb.RetrieveNode) (time.Duration, error) {
+		return 0, ctx.Err()
+	}
+	s.nodeLatency(ctx, blocks[0].GetStoreNode()[0])
+	require.Empty(t, s.latency)
+}
@@ -2,6 +2,20 @@ package daemon
 
 import "fmt"
 
+// NotExistError tells what is looked up does not exist
+type NotExistError struct {
+	Name string
+}
+
+func (e *NotExistError) Error() string {
+	return e.Name + " not exists"
+}
+
+// spaceNotExist error of space no not exists
+func spaceNotExist(no uint32) error {
+	return &NotExistError{Name: fmt.Sprintf("space %d", no)}
+}
+
 // Space user space
 type Space struct {
 	SpaceNo    uint32
@@ -45,28 +59,28 @@ func (m *SpaceManager) AddSpace(no uint32, password, root string) {
 // Switch switch space
 func (m *SpaceManager) Switch(no uint32) error {
 	if no >= m.Count {
-		return fmt.Errorf("space %d not exists", no)
+		return spaceNotExist(no)
 	}
 	m.Current = no
 	return nil
 }
 
-// GetSpacePasswd return passord of space no
+// GetSpacePasswd return key of space no encrypting data keys of files, empty if password not set
 func (m *SpaceManager) GetSpacePasswd(no uint32) ([]byte, error) {
 	if no >= m.Count {
-		return nil, fmt.Errorf("space %d not exists", no)
+		return nil, spaceNotExist(no)
 	}
 
 	return m.AS[no].EncryptKey, nil
 }
 
-// SetSpacePasswd  set passord of some space
-func (m *SpaceManager) SetSpacePasswd(no uint32, password string) error {
+// SetSpaceKey set password of some space and the space key unlocked by it
+func (m *SpaceManager) SetSpaceKey(no uint32, password string, key []byte) error {
 	if no >= m.Count {
-		return fmt.Errorf("space %d not exists", no)
+		return spaceNotExist(no)
 	}
 
 	m.AS[no].Password = password
-	m.AS[no].EncryptKey = []byte(password)
+	m.AS[no].EncryptKey = key
 	return nil
 }
@@ -0,0 +1,225 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/samoslab/nebula/util/aes"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// SpaceKeyVersion version of space sys file with key
+	SpaceKeyVersion = 1
+	// SpaceKeySize bytes of space key and file data key
+	SpaceKeySize = 32
+	kdfScrypt    = "scrypt"
+)
+
+// scrypt cost of deriving key from space password
+var (
+	ScryptN = 1 << 15
+	ScryptR = 8
+	ScryptP = 1
+)
+
+var (
+	// ErrPasswordIncorrect password of space is wrong
+	ErrPasswordIncorrect = errors.New("Password incorrect")
+	// wrappedKeyPrefix tells a file data key wrapped by space key from the space password used by former versions
+	wrappedKeyPrefix = []byte("nebula-wrapped-key:1:")
+)
+
+// SpaceKeyFile content of space sys file. The space key encrypting data keys of files is random, it is
+// sealed by the key derived from space password, so changing password only seals the space key again.
+type SpaceKeyFile struct {
+	Version    int    `json:"version"`
+	Kdf        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+func randomKey() ([]byte, error) {
+	key := make([]byte, SpaceKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newSpaceKeyFile seals spaceKey by password with a new salt
+func newSpaceKeyFile(password string, spaceKey []byte) (*SpaceKeyFile, error) {
+	salt, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+	kf := &SpaceKeyFile{Version: SpaceKeyVersion, Kdf: kdfScrypt, Salt: salt, N: ScryptN, R: ScryptR, P: ScryptP}
+	kek, err := kf.deriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	if kf.WrappedKey, err = aes.Seal(spaceKey, kek); err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+func (kf *SpaceKeyFile) deriveKey(password string) ([]byte, error) {
+	if kf.Kdf != kdfScrypt {
+		return nil, fmt.Errorf("unsupported kdf %s", kf.Kdf)
+	}
+	return scrypt.Key([]byte(password), kf.Salt, kf.N, kf.R, kf.P, SpaceKeySize)
+}
+
+// unwrap returns space key, ErrPasswordIncorrect if password is wrong
+func (kf *SpaceKeyFile) unwrap(password string) ([]byte, error) {
+	kek, err := kf.deriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	key, err := aes.Open(kf.WrappedKey, kek)
+	if err == aes.ErrAuthFailed {
+		return nil, ErrPasswordIncorrect
+	}
+	return key, err
+}
+
+// parseSpaceKeyFile returns nil if data is password digest of former versions
+func parseSpaceKeyFile(data []byte) (*SpaceKeyFile, error) {
+	if len(data) == sha256.Size {
+		return nil, nil
+	}
+	kf := &SpaceKeyFile{}
+	if err := json.Unmarshal(data, kf); err != nil {
+		return nil, err
+	}
+	if kf.Version != SpaceKeyVersion {
+		return nil, fmt.Errorf("unsupported space key version %d", kf.Version)
+	}
+	return kf, nil
+}
+
+// unlockSpaceKey returns key of space from content of space sys file. The padded password of a space
+// created by former versions is its key, all files of such space are encrypted by the password.
+func unlockSpaceKey(sno uint32, password string, data []byte) ([]byte, error) {
+	kf, err := parseSpaceKeyFile(data)
+	if err != nil {
+		return nil, err
+	}
+	if kf != nil {
+		return kf.unwrap(password)
+	}
+	if !verifyPassword(sno, password, data) {
+		return nil, ErrPasswordIncorrect
+	}
+	return []byte(password), nil
+}
+
+// wrapDataKey seals data key of a file by space key, it is sent to tracker instead of the space password
+func wrapDataKey(dataKey, spaceKey []byte) ([]byte, error) {
+	sealed, err := aes.Seal(dataKey, spaceKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, wrappedKeyPrefix...), sealed...), nil
+}
+
+// unwrapDataKey returns data key of a file, key of files uploaded by former versions is the space password itself
+func unwrapDataKey(key, spaceKey []byte) ([]byte, error) {
+	if !bytes.HasPrefix(key, wrappedKeyPrefix) {
+		return key, nil
+	}
+	if len(spaceKey) == 0 {
+		return nil, errors.New("space password not set")
+	}
+	dataKey, err := aes.Open(key[len(wrappedKeyPrefix):], spaceKey)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key error %v", err)
+	}
+	return dataKey, nil
+}
+
+// newDataKey returns a random key encrypting a file of space sno and the key kept by tracker.
+// Files of space 0 are not protected by password, tracker keeps their data key.
+func (c *ClientManager) newDataKey(sno uint32) ([]byte, []byte, error) {
+	if sno == 0 {
+		key := []byte(aes.RandStr(16))
+		return key, key, nil
+	}
+	spaceKey, err := c.getSpacePassword(sno)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey, err := randomKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := wrapDataKey(dataKey, spaceKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, wrapped, nil
+}
+
+// fileDataKey returns data key of a downloaded file from the key kept by tracker
+func (c *ClientManager) fileDataKey(sno uint32, key []byte) ([]byte, error) {
+	if sno == 0 {
+		return key, nil
+	}
+	spaceKey, err := c.SpaceM.GetSpacePasswd(sno)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapDataKey(key, spaceKey)
+}
+
+// saveSpaceKeyFile writes space sys file and uploads it, newVersion replaces the former one
+func (c *ClientManager) saveSpaceKeyFile(sno uint32, kf *SpaceKeyFile, newVersion bool) error {
+	data, err := json.Marshal(kf)
+	if err != nil {
+		return err
+	}
+	return c.uploadSpaceSysFile(sno, data, newVersion)
+}
+
+// ChangePassword seals space key by new password, files of the space are not touched
+func (c *ClientManager) ChangePassword(sno uint32, oldPassword, newPassword string) error {
+	log := c.Log
+	oldPassword, err := passwordPadding(oldPassword, sno)
+	if err != nil {
+		return err
+	}
+	newPassword, err = passwordPadding(newPassword, sno)
+	if err != nil {
+		return err
+	}
+	data, err := c.GetSpaceSysFileData(sno)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("space %d password not set", sno)
+	}
+	spaceKey, err := unlockSpaceKey(sno, oldPassword, data)
+	if err != nil {
+		return err
+	}
+	// space of former versions keeps its password as space key, files encrypted by it stay readable
+	kf, err := newSpaceKeyFile(newPassword, spaceKey)
+	if err != nil {
+		return err
+	}
+	if err := c.saveSpaceKeyFile(sno, kf, true); err != nil {
+		return err
+	}
+	log.Infof("Space %d password changed", sno)
+	return c.SpaceM.SetSpaceKey(sno, newPassword, spaceKey)
+}
@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/samoslab/nebula/client/config"
+	"github.com/samoslab/nebula/provider/node"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func lowScryptCost() func() {
+	n := ScryptN
+	ScryptN = 1 << 4
+	return func() { ScryptN = n }
+}
+
+func TestSpaceKeyFile(t *testing.T) {
+	defer lowScryptCost()()
+	spaceKey, err := randomKey()
+	require.NoError(t, err)
+	password, err := passwordPadding("secret", 1)
+	require.NoError(t, err)
+	kf, err := newSpaceKeyFile(password, spaceKey)
+	require.NoError(t, err)
+	data, err := json.Marshal(kf)
+	require.NoError(t, err)
+
+	key, err := unlockSpaceKey(1, password, data)
+	require.NoError(t, err)
+	require.Equal(t, spaceKey, key)
+	wrong, err := passwordPadding("wrong", 1)
+	require.NoError(t, err)
+	_, err = unlockSpaceKey(1, wrong, data)
+	require.Equal(t, ErrPasswordIncorrect, err)
+
+	// changing password seals the same space key by a new salt
+	newPassword, err := passwordPadding("new secret", 1)
+	require.NoError(t, err)
+	changed, err := newSpaceKeyFile(newPassword, spaceKey)
+	require.NoError(t, err)
+	require.NotEqual(t, kf.Salt, changed.Salt)
+	data, err = json.Marshal(changed)
+	require.NoError(t, err)
+	key, err = unlockSpaceKey(1, newPassword, data)
+	require.NoError(t, err)
+	require.Equal(t, spaceKey, key)
+	_, err = unlockSpaceKey(1, password, data)
+	require.Equal(t, ErrPasswordIncorrect, err)
+}
+
+func TestLegacySpaceKey(t *testing.T) {
+	password, err := passwordPadding("secret", 1)
+	require.NoError(t, err)
+	digest, err := genEncryptKey(1, password)
+	require.NoError(t, err)
+	key, err := unlockSpaceKey(1, password, digest)
+	require.NoError(t, err)
+	require.Equal(t, []byte(password), key)
+	wrong, err := passwordPadding("wrong", 1)
+	require.NoError(t, err)
+	_, err = unlockSpaceKey(1, wrong, digest)
+	require.Equal(t, ErrPasswordIncorrect, err)
+}
+
+func TestWrapDataKey(t *testing.T) {
+	spaceKey, err := randomKey()
+	require.NoError(t, err)
+	dataKey, err := randomKey()
+	require.NoError(t, err)
+	wrapped, err := wrapDataKey(dataKey, spaceKey)
+	require.NoError(t, err)
+	key, err := unwrapDataKey(wrapped, spaceKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, key)
+
+	other, err := randomKey()
+	require.NoError(t, err)
+	_, err = unwrapDataKey(wrapped, other)
+	require.Error(t, err)
+	_, err = unwrapDataKey(wrapped, nil)
+	require.Error(t, err)
+
+	// key of file uploaded by former versions is the space password
+	legacy := []byte("12345678901234567890123456789012")
+	key, err = unwrapDataKey(legacy, spaceKey)
+	require.NoError(t, err)
+	require.Equal(t, legacy, key)
+}
+
+type sysFileMetadata struct {
+	mpb.MatadataServiceClient
+	sysFileErr error
+	uploadErr  error
+	uploaded   int
+}
+
+func (f *sysFileMetadata) SpaceSysFile(ctx context.Context, req *mpb.SpaceSysFileReq, opts ...grpc.CallOption) (*mpb.SpaceSysFileResp, error) {
+	if f.sysFileErr != nil {
+		return nil, f.sysFileErr
+	}
+	return &mpb.SpaceSysFileResp{}, nil
+}
+
+func (f *sysFileMetadata) CheckFileExist(ctx context.Context, req *mpb.CheckFileExistReq, opts ...grpc.CallOption) (*mpb.CheckFileExistResp, error) {
+	if f.uploadErr != nil {
+		return nil, f.uploadErr
+	}
+	f.uploaded++
+	return &mpb.CheckFileExistResp{Code: 0}, nil
+}
+
+func TestSetPassword(t *testing.T) {
+	defer lowScryptCost()()
+	dir, err := ioutil.TempDir("", "daemon")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLogger("", true)
+	require.NoError(t, err)
+	no := node.NewNode(1)
+	cfg := &config.ClientConfig{Node: no, Space: []config.ReadableSpace{{SpaceNo: 0}, {SpaceNo: 1}}}
+	meta := &sysFileMetadata{}
+	c, err := New(context.Background(), cfg,
+		WithLogger(log),
+		WithMetadataClient(meta),
+		WithTrackerPubkey(no.PubKey, []byte("hash")),
+		WithProviderTransport(&fakeTransport{providers: map[string]*fakeProvider{}}),
+		WithCollector(&fakeCollector{}),
+		WithConfigDir(dir))
+	require.NoError(t, err)
+	defer c.Shutdown()
+	spaceKey := func() []byte {
+		key, err := c.SpaceM.GetSpacePasswd(1)
+		require.NoError(t, err)
+		return key
+	}
+
+	// a failed request is not taken as a space without password
+	meta.sysFileErr = errors.New("unavailable")
+	require.Error(t, c.SetPassword(1, "secret"))
+	require.Empty(t, spaceKey())
+
+	// key is not used when it is not saved
+	meta.sysFileErr = status.Error(codes.NotFound, "not found")
+	meta.uploadErr = errors.New("unavailable")
+	require.Error(t, c.SetPassword(1, "secret"))
+	require.Empty(t, spaceKey())
+	require.Zero(t, meta.uploaded)
+
+	meta.uploadErr = nil
+	require.NoError(t, c.SetPassword(1, "secret"))
+	require.Len(t, spaceKey(), 32)
+	require.Equal(t, 1, meta.uploaded)
+}
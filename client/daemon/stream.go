@@ -0,0 +1,351 @@
+package daemon
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/util/aes"
+)
+
+// downloadSuffix of the file being decoded in destination directory
+const downloadSuffix = ".download"
+
+// StripeSize bytes of every shard coded at a time, a partition in flight takes StripeSize*(dataShards+parityShards) memory
+var StripeSize = int64(256 * 1024)
+
+// fileRange byte range of a partition in the origin file
+type fileRange struct {
+	Offset int64
+	Size   int64
+}
+
+// partitionRanges splits file like FileSplit does, without writing part files
+func partitionRanges(fileSize int64) []fileRange {
+	if fileSize <= PartitionMaxSize {
+		return []fileRange{{Offset: 0, Size: fileSize}}
+	}
+	chunkSize, chunkNum := GetChunkSizeAndNum(fileSize, PartitionMaxSize)
+	ranges := make([]fileRange, chunkNum)
+	for i := range ranges {
+		ranges[i] = fileRange{Offset: int64(i) * chunkSize, Size: ReverseCalcuatePartFileSize(fileSize, chunkNum, i)}
+	}
+	return ranges
+}
+
+// shardSize bytes of every shard of a partition before encryption
+func shardSize(size int64, dataShards int) int64 {
+	return (size + int64(dataShards) - 1) / int64(dataShards)
+}
+
+// encodePartition encodes partition r of src stripe by stripe and writes shard i to dst[i], nil writers are skipped.
+// The shards are the same as RsEncoder creates: data shard i is the i-th part of the partition padded by zero.
+func encodePartition(src io.ReaderAt, r fileRange, dataShards, parityShards int, dst []io.Writer) error {
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	if r.Size == 0 {
+		return reedsolomon.ErrShortData
+	}
+	needParity := false
+	for _, w := range dst[dataShards:] {
+		needParity = needParity || w != nil
+	}
+	perShard := shardSize(r.Size, dataShards)
+	bufs := make([][]byte, dataShards+parityShards)
+	for i := range bufs {
+		bufs[i] = make([]byte, StripeSize)
+	}
+	shards := make([][]byte, len(bufs))
+	for pos := int64(0); pos < perShard; pos += StripeSize {
+		n := perShard - pos
+		if n > StripeSize {
+			n = StripeSize
+		}
+		for i := range shards {
+			shards[i] = bufs[i][:n]
+		}
+		for i := 0; i < dataShards; i++ {
+			start := int64(i)*perShard + pos
+			read := r.Size - start
+			if read > n {
+				read = n
+			}
+			if read < 0 {
+				read = 0
+			}
+			if read > 0 {
+				if _, err := src.ReadAt(shards[i][:read], r.Offset+start); err != nil && err != io.EOF {
+					return err
+				}
+			}
+			for k := read; k < n; k++ {
+				shards[i][k] = 0
+			}
+		}
+		if needParity {
+			if err := enc.Encode(shards); err != nil {
+				return err
+			}
+		}
+		for i, w := range dst {
+			if w == nil {
+				continue
+			}
+			if _, err := w.Write(shards[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// shardWriter encrypts shard if password is set, Close flushes the padding
+type shardWriter struct {
+	io.Writer
+	closer io.Closer
+}
+
+func newShardWriter(w io.Writer, password, nonce []byte) (*shardWriter, error) {
+	if len(password) == 0 {
+		return &shardWriter{Writer: w}, nil
+	}
+	ew, err := aes.NewWriterWithNonce(w, password, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &shardWriter{Writer: ew, closer: ew}, nil
+}
+
+func (w *shardWriter) Close() error {
+	if w.closer != nil {
+		return w.closer.Close()
+	}
+	return nil
+}
+
+// hashPartition encodes partition only to learn hash and size of its shards, nothing is written to disk.
+// Shard i is encrypted with nonces[i] if password is set, so it is the same when streamPartition sends it.
+func hashPartition(src io.ReaderAt, r fileRange, dataShards, parityShards int, password []byte, nonces [][]byte) ([]common.HashFile, error) {
+	total := dataShards + parityShards
+	hashes := make([]hash.Hash, total)
+	counts := make([]*countWriter, total)
+	writers := make([]*shardWriter, total)
+	dst := make([]io.Writer, total)
+	for i := range dst {
+		hashes[i], counts[i] = sha1.New(), &countWriter{}
+		w, err := newShardWriter(io.MultiWriter(hashes[i], counts[i]), password, shardNonce(nonces, i))
+		if err != nil {
+			return nil, err
+		}
+		writers[i], dst[i] = w, w
+	}
+	if err := encodePartition(src, r, dataShards, parityShards, dst); err != nil {
+		return nil, err
+	}
+	res := make([]common.HashFile, total)
+	for i, w := range writers {
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		res[i] = common.HashFile{FileSize: counts[i].n, FileHash: hashes[i].Sum(nil), SliceIndex: i}
+	}
+	return res, nil
+}
+
+// shardNonces returns random nonces to encrypt shards of a partition
+func shardNonces(shards int) ([][]byte, error) {
+	nonces := make([][]byte, shards)
+	for i := range nonces {
+		nonce, err := aes.NewNonce()
+		if err != nil {
+			return nil, err
+		}
+		nonces[i] = nonce
+	}
+	return nonces, nil
+}
+
+func shardNonce(nonces [][]byte, i int) []byte {
+	if i < len(nonces) {
+		return nonces[i]
+	}
+	return nil
+}
+
+var errShardAbandoned = errors.New("shard abandoned")
+
+// guardWriter drops data after the consumer failed, so a failed block does not stop the other shards of a stripe
+type guardWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *guardWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// streamPartition encodes partition once and feeds shard i to consume[i] as a reader, nil consumers are skipped.
+// Shards are produced in lock step with bounded memory, consumers run concurrently and their errors are returned by index.
+func streamPartition(src io.ReaderAt, r fileRange, dataShards, parityShards int, password []byte, nonces [][]byte, consume []func(io.Reader) error) ([]error, error) {
+	total := dataShards + parityShards
+	dst := make([]io.Writer, total)
+	writers := make([]*shardWriter, total)
+	pipes := make([]*io.PipeWriter, total)
+	errs := make([]error, total)
+	done := make(chan struct{}, total)
+	running := 0
+	for i, fn := range consume {
+		if fn == nil {
+			continue
+		}
+		pr, pw := io.Pipe()
+		w, err := newShardWriter(&guardWriter{w: pw}, password, shardNonce(nonces, i))
+		if err != nil {
+			return nil, err
+		}
+		pipes[i], writers[i], dst[i] = pw, w, w
+		running++
+		go func(i int, fn func(io.Reader) error) {
+			errs[i] = fn(pr)
+			if errs[i] == nil {
+				// drain what the consumer left, eg: provider has the block already
+				io.Copy(ioutil.Discard, pr)
+			}
+			pr.CloseWithError(errShardAbandoned)
+			done <- struct{}{}
+		}(i, fn)
+	}
+	err := encodePartition(src, r, dataShards, parityShards, dst)
+	for i, pw := range pipes {
+		if pw == nil {
+			continue
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			continue
+		}
+		writers[i].Close()
+		pw.Close()
+	}
+	for ; running > 0; running-- {
+		<-done
+	}
+	if err != nil {
+		return errs, fmt.Errorf("encode partition error %v", err)
+	}
+	return errs, nil
+}
+
+// decodePartition joins shards of partition r into dst at r.Offset, missing data shards are reconstructed stripe by stripe.
+// shards[i] is nil if shard i is missing, encrypted shards are decrypted by password.
+func decodePartition(shards []io.Reader, r fileRange, dataShards, parityShards int, password []byte, dst io.WriterAt) error {
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	total := dataShards + parityShards
+	if len(shards) != total {
+		return reedsolomon.ErrTooFewShards
+	}
+	readers := make([]io.Reader, total)
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		readers[i] = s
+		if len(password) != 0 {
+			if readers[i], err = aes.NewReader(s, password); err != nil {
+				return err
+			}
+		}
+	}
+	perShard := shardSize(r.Size, dataShards)
+	bufs := make([][]byte, total)
+	for i := range bufs {
+		bufs[i] = make([]byte, StripeSize)
+	}
+	stripe := make([][]byte, total)
+	for pos := int64(0); pos < perShard; pos += StripeSize {
+		n := perShard - pos
+		if n > StripeSize {
+			n = StripeSize
+		}
+		missing := false
+		for i := range stripe {
+			stripe[i] = bufs[i][:0]
+			if readers[i] == nil {
+				missing = missing || i < dataShards
+				continue
+			}
+			if _, err := io.ReadFull(readers[i], bufs[i][:n]); err != nil {
+				// shard is short or broken, reconstruct it from the others from now on
+				readers[i] = nil
+				missing = missing || i < dataShards
+				continue
+			}
+			stripe[i] = bufs[i][:n]
+		}
+		if missing {
+			if err := enc.ReconstructData(stripe); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < dataShards; i++ {
+			start := int64(i)*perShard + pos
+			if start >= r.Size {
+				break
+			}
+			data := stripe[i][:n]
+			if left := r.Size - start; left < n {
+				data = data[:left]
+			}
+			if _, err := dst.WriteAt(data, r.Offset+start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeShardFiles decodes partition r from shard files of fileName into dst, shards not in retrieved are missing
+func decodeShardFiles(fileName string, retrieved []string, r fileRange, dataShards, parityShards int, password []byte, dst io.WriterAt) error {
+	got := map[string]bool{}
+	for _, name := range retrieved {
+		got[name] = true
+	}
+	shards := make([]io.Reader, dataShards+parityShards)
+	for i := range shards {
+		name := fmt.Sprintf("%s.%d", fileName, i)
+		if !got[name] {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		shards[i] = bufio.NewReader(f)
+	}
+	return decodePartition(shards, r, dataShards, parityShards, password, dst)
+}
@@ -0,0 +1,126 @@
+package daemon
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/samoslab/nebula/util/aes"
+	util_hash "github.com/samoslab/nebula/util/hash"
+	"github.com/stretchr/testify/require"
+)
+
+// memWriterAt collects WriteAt into a buffer of fixed size
+type memWriterAt []byte
+
+func (m memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m[off:], p), nil
+}
+
+func TestHashPartition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLogger("", true)
+	require.NoError(t, err)
+	defer func(size int64) { StripeSize = size }(StripeSize)
+	// several stripes and a short last stripe
+	StripeSize = 100 * 1024
+
+	for _, fname := range []string{"testdata/test.zip", "testdata/odd_filesize.txt"} {
+		hashFiles, err := RsEncoder(log, dir, fname, 4, 2)
+		require.NoError(t, err)
+		file, err := os.Open(fname)
+		require.NoError(t, err)
+		fileSize, err := GetFileSize(fname)
+		require.NoError(t, err)
+		hashes, err := hashPartition(file, fileRange{Size: fileSize}, 4, 2, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, len(hashFiles), len(hashes))
+		password := []byte("0123456789abcdef")
+		nonces, err := shardNonces(6)
+		require.NoError(t, err)
+		encrypted, err := hashPartition(file, fileRange{Size: fileSize}, 4, 2, password, nonces)
+		require.NoError(t, err)
+		for i, hf := range hashFiles {
+			require.Equal(t, hf.FileHash, hashes[i].FileHash)
+			require.Equal(t, hf.FileSize, hashes[i].FileSize)
+			data, err := ioutil.ReadFile(hf.FileName)
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			w, err := aes.NewWriterWithNonce(&buf, password, nonces[i])
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			require.Equal(t, util_hash.Sha1(buf.Bytes()), encrypted[i].FileHash)
+			require.Equal(t, int64(buf.Len()), encrypted[i].FileSize)
+		}
+		file.Close()
+	}
+}
+
+func TestStreamPartition(t *testing.T) {
+	defer func(size int64) { StripeSize = size }(StripeSize)
+	StripeSize = 1000
+	data, err := ioutil.ReadFile("testdata/test.zip")
+	require.NoError(t, err)
+	// a partition in the middle of the file
+	r := fileRange{Offset: 12345, Size: 54321}
+	for _, password := range [][]byte{nil, []byte("0123456789abcdef")} {
+		var nonces [][]byte
+		if password != nil {
+			var err error
+			nonces, err = shardNonces(6)
+			require.NoError(t, err)
+		}
+		shards := make([][]byte, 6)
+		consume := make([]func(io.Reader) error, 6)
+		for i := range consume {
+			i := i
+			consume[i] = func(reader io.Reader) error {
+				if i == 0 {
+					// failed consumer does not stop the others
+					return io.ErrClosedPipe
+				}
+				var err error
+				shards[i], err = ioutil.ReadAll(reader)
+				return err
+			}
+		}
+		errs, err := streamPartition(bytes.NewReader(data), r, 4, 2, password, nonces, consume)
+		require.NoError(t, err)
+		require.Equal(t, io.ErrClosedPipe, errs[0])
+		hashes, err := hashPartition(bytes.NewReader(data), r, 4, 2, password, nonces)
+		require.NoError(t, err)
+		for i := 1; i < 6; i++ {
+			require.NoError(t, errs[i])
+			require.Equal(t, hashes[i].FileSize, int64(len(shards[i])))
+			require.Equal(t, hashes[i].FileHash, util_hash.Sha1(shards[i]))
+		}
+
+		// lose two data shards, one of them truncated
+		readers := []io.Reader{nil, bytes.NewReader(shards[1][:100]), bytes.NewReader(shards[2]), bytes.NewReader(shards[3]), bytes.NewReader(shards[4]), bytes.NewReader(shards[5])}
+		out := make(memWriterAt, len(data))
+		require.NoError(t, decodePartition(readers, r, 4, 2, password, out))
+		require.Equal(t, data[r.Offset:r.Offset+r.Size], []byte(out[r.Offset:r.Offset+r.Size]))
+
+		readers = []io.Reader{nil, nil, bytes.NewReader(shards[2]), bytes.NewReader(shards[3]), bytes.NewReader(shards[4][:100]), bytes.NewReader(shards[5])}
+		require.Error(t, decodePartition(readers, r, 4, 2, password, out))
+	}
+}
+
+func TestPartitionRanges(t *testing.T) {
+	require.Equal(t, []fileRange{{Offset: 0, Size: 100}}, partitionRanges(100))
+	size := PartitionMaxSize*2 + 12345
+	ranges := partitionRanges(size)
+	require.Equal(t, 3, len(ranges))
+	end := int64(0)
+	for _, r := range ranges {
+		require.Equal(t, end, r.Offset)
+		end += r.Size
+	}
+	require.Equal(t, size, end)
+}
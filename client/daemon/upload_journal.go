@@ -0,0 +1,477 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/samoslab/nebula/client/common"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	"github.com/samoslab/nebula/util/aes"
+	rsalong "github.com/samoslab/nebula/util/rsa"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// JournalDirName directory of upload journals under config dir
+	JournalDirName = "upload_journal"
+	journalSuffix  = ".json"
+	// TicketLifetime seconds tickets of upload prepare are used, provider rejects auth older than 900 seconds
+	TicketLifetime = 600
+)
+
+// UploadJournal records an erasure code upload on disk, so an interrupted upload resumes
+// with the blocks already stored instead of starting over.
+type UploadJournal struct {
+	FileName     string              `json:"file_name"`
+	Dest         string              `json:"dest"`
+	SpaceNo      uint32              `json:"space_no"`
+	Interactive  bool                `json:"interactive"`
+	NewVersion   bool                `json:"new_version"`
+	IsEncrypt    bool                `json:"is_encrypt"`
+	WrappedKey   []byte              `json:"wrapped_key,omitempty"` // data key encrypted by node public key in space 0, sealed by space key in others
+	EncryptKey   []byte              `json:"encrypt_key,omitempty"`
+	FileHash     []byte              `json:"file_hash"`
+	FileSize     uint64              `json:"file_size"`
+	FileModTime  uint64              `json:"file_mod_time"`
+	DataShards   int                 `json:"data_shards"`
+	VerifyShards int                 `json:"verify_shards"`
+	Partitions   []*JournalPartition `json:"partitions"`
+	Created      uint64              `json:"created"`
+	Updated      uint64              `json:"updated"`
+
+	path  string
+	mutex sync.Mutex
+}
+
+// JournalPartition one partition of the upload, its shards are encoded from the byte range of the file
+type JournalPartition struct {
+	Offset    int64           `json:"offset"`
+	Size      int64           `json:"size"`
+	Timestamp uint64          `json:"timestamp"` // timestamp of tickets
+	Blocks    []*JournalBlock `json:"blocks"`
+}
+
+// JournalBlock one erasure block and the provider it is assigned to
+type JournalBlock struct {
+	Hash       []byte `json:"hash"`
+	Size       int64  `json:"size"`
+	SliceIndex int    `json:"slice_index"`
+	Checksum   bool   `json:"checksum"`
+	Nonce      []byte `json:"nonce,omitempty"` // nonce of encrypted block, the block is encrypted again the same on resume
+	NodeId     []byte `json:"node_id,omitempty"`
+	Server     string `json:"server,omitempty"`
+	Port       uint32 `json:"port,omitempty"`
+	Ticket     string `json:"ticket,omitempty"`
+	Auth       []byte `json:"auth,omitempty"`
+	Stored     bool   `json:"stored"`
+}
+
+// PendingUpload summary of an unfinished upload
+type PendingUpload struct {
+	FileName      string `json:"file_name"`
+	Dest          string `json:"dest"`
+	SpaceNo       uint32 `json:"space_no"`
+	FileSize      uint64 `json:"file_size"`
+	StoredBlocks  int    `json:"stored_blocks"`
+	TotalBlocks   int    `json:"total_blocks"`
+	StoredSize    uint64 `json:"stored_size"`
+	TotalSize     uint64 `json:"total_size"`
+	LastUpdated   uint64 `json:"last_updated"`
+	PasswordReady bool   `json:"password_ready"`
+}
+
+// wrapJournalKey returns data key of space 0 encrypted by node public key, data key of other spaces is sealed by
+// space key already. The data key is never saved in plain.
+func (c *ClientManager) wrapJournalKey(sno uint32, dataKey, wrappedKey []byte) ([]byte, error) {
+	if sno != 0 {
+		return wrappedKey, nil
+	}
+	if c.cfg == nil || c.cfg.Node == nil {
+		return nil, errors.New("node key nil")
+	}
+	return rsalong.EncryptLong(c.cfg.Node.PubKey, dataKey, 256)
+}
+
+// journalDataKey returns data key encrypting blocks of journal
+func (c *ClientManager) journalDataKey(j *UploadJournal) ([]byte, error) {
+	if len(j.WrappedKey) == 0 {
+		return nil, errors.New("journal of former version has no data key")
+	}
+	if j.SpaceNo == 0 {
+		if c.cfg == nil || c.cfg.Node == nil {
+			return nil, errors.New("node key nil")
+		}
+		return rsalong.DecryptLong(c.cfg.Node.PriKey, j.WrappedKey, 256)
+	}
+	spaceKey, err := c.SpaceM.GetSpacePasswd(j.SpaceNo)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapDataKey(j.WrappedKey, spaceKey)
+}
+
+func (c *ClientManager) journalDir() string {
+	return filepath.Join(c.configDir, JournalDirName)
+}
+
+// journalPath the journal of one upload is identified by local file, destination and space
+func (c *ClientManager) journalPath(fileName, dest string, sno uint32) string {
+	if abs, err := filepath.Abs(fileName); err == nil {
+		fileName = abs
+	}
+	key := sha1.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%d", fileName, dest, sno)))
+	return filepath.Join(c.journalDir(), hex.EncodeToString(key[:])+journalSuffix)
+}
+
+func loadUploadJournal(path string) (*UploadJournal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &UploadJournal{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	j.path = path
+	return j, nil
+}
+
+// openUploadJournal returns nil if the upload has no journal
+func (c *ClientManager) openUploadJournal(fileName, dest string, sno uint32) *UploadJournal {
+	path := c.journalPath(fileName, dest, sno)
+	j, err := loadUploadJournal(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.Log.Errorf("Load upload journal %s error %v", path, err)
+			os.Remove(path)
+		}
+		return nil
+	}
+	return j
+}
+
+func newUploadJournal(path string, req *mpb.CheckFileExistReq, fileName, dest string, isEncrypt bool, sno uint32, dataShards, verifyShards int, ranges []fileRange, pieces [][]common.HashFile, nonces [][][]byte) *UploadJournal {
+	j := &UploadJournal{
+		FileName:     fileName,
+		Dest:         dest,
+		SpaceNo:      sno,
+		Interactive:  req.GetInteractive(),
+		NewVersion:   req.GetNewVersion(),
+		IsEncrypt:    isEncrypt,
+		EncryptKey:   req.GetEncryptKey(),
+		FileHash:     req.GetFileHash(),
+		FileSize:     req.GetFileSize(),
+		FileModTime:  req.GetFileModTime(),
+		DataShards:   dataShards,
+		VerifyShards: verifyShards,
+		Partitions:   make([]*JournalPartition, 0, len(ranges)),
+		Created:      common.Now(),
+		path:         path,
+	}
+	for k, r := range ranges {
+		jp := &JournalPartition{Offset: r.Offset, Size: r.Size, Blocks: make([]*JournalBlock, 0, len(pieces[k]))}
+		for i, piece := range pieces[k] {
+			jp.Blocks = append(jp.Blocks, &JournalBlock{
+				Hash:       piece.FileHash,
+				Size:       piece.FileSize,
+				SliceIndex: piece.SliceIndex,
+				Checksum:   i >= dataShards,
+				Nonce:      shardNonce(nonces[k], i),
+			})
+		}
+		j.Partitions = append(j.Partitions, jp)
+	}
+	return j
+}
+
+// save writes journal to a temporary file and renames it, a crash never leaves a half written journal
+func (j *UploadJournal) save() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.saveLocked()
+}
+
+func (j *UploadJournal) saveLocked() error {
+	j.Updated = common.Now()
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// matches tells if journal is made for the same file content and erasure parameters
+func (j *UploadJournal) matches(req *mpb.CheckFileExistReq, dataShards, verifyShards int) bool {
+	if !bytes.Equal(j.FileHash, req.GetFileHash()) || j.FileSize != req.GetFileSize() ||
+		j.DataShards != dataShards || j.VerifyShards != verifyShards || len(j.Partitions) == 0 {
+		return false
+	}
+	for _, jp := range j.Partitions {
+		// journal of former versions has no partition range
+		if jp.Size <= 0 {
+			return false
+		}
+		for _, b := range jp.Blocks {
+			// or has blocks encrypted by legacy AES-CBC
+			if j.IsEncrypt && len(b.Nonce) != aes.NonceSize {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nonces of blocks of partition
+func (jp *JournalPartition) nonces() [][]byte {
+	nonces := make([][]byte, len(jp.Blocks))
+	for i, b := range jp.Blocks {
+		nonces[i] = b.Nonce
+	}
+	return nonces
+}
+
+// blockName identifies block k of partition i in progress map, the block has no file on disk
+func (j *UploadJournal) blockName(i, k int) string {
+	return fmt.Sprintf("%s#%d.%d", j.FileName, i, k)
+}
+
+// partitionRange byte range of partition i in the file
+func (j *UploadJournal) partitionRange(i int) fileRange {
+	return fileRange{Offset: j.Partitions[i].Offset, Size: j.Partitions[i].Size}
+}
+
+// partitionFiles converts journal back to partition files for upload prepare request
+func (j *UploadJournal) partitionFiles() []common.PartitionFile {
+	fileInfos := make([]common.PartitionFile, 0, len(j.Partitions))
+	for i, jp := range j.Partitions {
+		pieces := make([]common.HashFile, 0, len(jp.Blocks))
+		for k, b := range jp.Blocks {
+			pieces = append(pieces, common.HashFile{FileSize: b.Size, FileName: j.blockName(i, k), FileHash: b.Hash, SliceIndex: b.SliceIndex})
+		}
+		fileInfos = append(fileInfos, common.PartitionFile{
+			FileName:       fmt.Sprintf("%s#%d", j.FileName, i),
+			Pieces:         pieces,
+			OriginFileName: filepath.Base(j.FileName),
+			OriginFileHash: j.FileHash,
+			OriginFileSize: j.FileSize,
+		})
+	}
+	return fileInfos
+}
+
+// needTickets tells if any block to upload has no provider or its ticket will expire soon
+func (j *UploadJournal) needTickets(now uint64) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, jp := range j.Partitions {
+		for _, b := range jp.Blocks {
+			if !b.Stored && (b.Ticket == "" || jp.Timestamp+TicketLifetime < now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// assign records providers of partition i for blocks not stored yet, providers[k] stores block k
+func (j *UploadJournal) assign(i int, providers []*mpb.BlockProviderAuth, timestamp uint64) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if i >= len(j.Partitions) {
+		return fmt.Errorf("partition %d out of range", i)
+	}
+	jp := j.Partitions[i]
+	if len(providers) < len(jp.Blocks) {
+		return fmt.Errorf("partition %d needs %d providers, got %d", i, len(jp.Blocks), len(providers))
+	}
+	jp.Timestamp = timestamp
+	for k, b := range jp.Blocks {
+		if b.Stored {
+			continue
+		}
+		pro := providers[k]
+		if len(pro.GetHashAuth()) == 0 {
+			return fmt.Errorf("provider %s:%d has no auth", pro.GetServer(), pro.GetPort())
+		}
+		ha := pro.GetHashAuth()[0]
+		b.NodeId, b.Server, b.Port = pro.GetNodeId(), pro.GetServer(), pro.GetPort()
+		b.Ticket, b.Auth = ha.GetTicket(), ha.GetAuth()
+	}
+	return nil
+}
+
+// markStored records block stored and saves journal
+func (j *UploadJournal) markStored(b *JournalBlock) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	b.Stored = true
+	return j.saveLocked()
+}
+
+// markFailed drops the ticket of block, a new provider is asked for next time
+func (j *UploadJournal) markFailed(b *JournalBlock) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	b.Ticket, b.Auth = "", nil
+	return j.saveLocked()
+}
+
+// storePartitions builds the partitions of upload done request, all blocks must be stored
+func (j *UploadJournal) storePartitions() ([]*mpb.StorePartition, error) {
+	partitions := make([]*mpb.StorePartition, 0, len(j.Partitions))
+	for i, jp := range j.Partitions {
+		partition := &mpb.StorePartition{Block: make([]*mpb.StoreBlock, 0, len(jp.Blocks))}
+		for _, b := range jp.Blocks {
+			if !b.Stored {
+				return nil, fmt.Errorf("block %d of partition %d not stored", b.SliceIndex, i)
+			}
+			partition.Block = append(partition.Block, &mpb.StoreBlock{
+				Hash:        b.Hash,
+				Size:        uint64(b.Size),
+				BlockSeq:    uint32(b.SliceIndex),
+				Checksum:    b.Checksum,
+				StoreNodeId: [][]byte{b.NodeId},
+			})
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions, nil
+}
+
+// progress returns stored and total block size
+func (j *UploadJournal) progress() (stored, total uint64, storedBlocks, totalBlocks int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, jp := range j.Partitions {
+		for _, b := range jp.Blocks {
+			total += uint64(b.Size)
+			totalBlocks++
+			if b.Stored {
+				stored += uint64(b.Size)
+				storedBlocks++
+			}
+		}
+	}
+	return
+}
+
+// discard deletes journal
+func (j *UploadJournal) discard(log logrus.FieldLogger) {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Remove upload journal %s error %v", j.path, err)
+	}
+}
+
+// PendingUploads lists uploads interrupted before done
+func (c *ClientManager) PendingUploads() ([]*PendingUpload, error) {
+	journals, err := c.loadUploadJournals()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*PendingUpload, 0, len(journals))
+	for _, j := range journals {
+		stored, total, storedBlocks, totalBlocks := j.progress()
+		ready := true
+		if j.IsEncrypt && j.SpaceNo != 0 {
+			_, err := c.journalDataKey(j)
+			ready = err == nil
+		}
+		res = append(res, &PendingUpload{
+			FileName:      j.FileName,
+			Dest:          j.Dest,
+			SpaceNo:       j.SpaceNo,
+			FileSize:      j.FileSize,
+			StoredBlocks:  storedBlocks,
+			TotalBlocks:   totalBlocks,
+			StoredSize:    stored,
+			TotalSize:     total,
+			LastUpdated:   j.Updated,
+			PasswordReady: ready,
+		})
+	}
+	return res, nil
+}
+
+func (c *ClientManager) loadUploadJournals() ([]*UploadJournal, error) {
+	dir := c.journalDir()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	res := []*UploadJournal{}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), journalSuffix) {
+			continue
+		}
+		j, err := loadUploadJournal(filepath.Join(dir, info.Name()))
+		if err != nil {
+			c.Log.Errorf("Load upload journal %s error %v", info.Name(), err)
+			continue
+		}
+		res = append(res, j)
+	}
+	return res, nil
+}
+
+// ResumeUploads continues all interrupted uploads, journals whose local file is gone are discarded.
+// Uploads of encrypted space wait until the space password is set.
+func (c *ClientManager) ResumeUploads() error {
+	journals, err := c.loadUploadJournals()
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, j := range journals {
+		log := c.Log.WithField("upload file", j.FileName)
+		if _, err := os.Stat(j.FileName); os.IsNotExist(err) {
+			log.Infof("File removed, discard upload journal")
+			j.discard(log)
+			continue
+		}
+		if j.IsEncrypt && j.SpaceNo != 0 {
+			if password, err := c.SpaceM.GetSpacePasswd(j.SpaceNo); err != nil || len(password) == 0 {
+				log.Infof("Space %d password not set, resume later", j.SpaceNo)
+				continue
+			}
+		}
+		log.Infof("Resume upload to %s", j.Dest)
+		if err := c.UploadFile(j.FileName, j.Dest, j.Interactive, j.NewVersion, j.IsEncrypt, j.SpaceNo); err != nil {
+			log.Errorf("Resume upload error %v", err)
+			errs = append(errs, fmt.Sprintf("%s: %v", j.FileName, err))
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/samoslab/nebula/provider/node"
+	mpb "github.com/samoslab/nebula/tracker/metadata/pb"
+	util_hash "github.com/samoslab/nebula/util/hash"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJournal(t *testing.T, isEncrypt bool) (*ClientManager, *UploadJournal, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	log, err := NewLogger("", true)
+	require.NoError(t, err)
+	c := &ClientManager{Log: log, TempDir: dir, configDir: dir, cfg: &config.ClientConfig{Node: node.NewNode(1)}}
+	fname, err := filepath.Abs("testdata/test.zip")
+	require.NoError(t, err)
+	hash, err := util_hash.Sha1File(fname)
+	require.NoError(t, err)
+	fileSize, err := GetFileSize(fname)
+	require.NoError(t, err)
+	req := &mpb.CheckFileExistReq{FileHash: hash, FileSize: uint64(fileSize), FileName: "test.zip"}
+	password := []byte("0123456789abcdef")
+	if !isEncrypt {
+		password = nil
+	}
+	file, err := os.Open(fname)
+	require.NoError(t, err)
+	defer file.Close()
+	ranges := partitionRanges(fileSize)
+	nonces, err := shardNonces(3)
+	require.NoError(t, err)
+	pieces, err := hashPartition(file, ranges[0], 2, 1, password, nonces)
+	require.NoError(t, err)
+	j := newUploadJournal(c.journalPath(fname, "/bak", 0), req, fname, "/bak", isEncrypt, 0, 2, 1, ranges, [][]common.HashFile{pieces}, [][][]byte{nonces})
+	if isEncrypt {
+		j.WrappedKey, err = c.wrapJournalKey(0, password, nil)
+		require.NoError(t, err)
+	}
+	return c, j, func() { os.RemoveAll(dir) }
+}
+
+func testProviders(n int, ticket string) []*mpb.BlockProviderAuth {
+	pros := []*mpb.BlockProviderAuth{}
+	for i := 0; i < n; i++ {
+		pros = append(pros, &mpb.BlockProviderAuth{NodeId: []byte{byte(i)}, Server: "127.0.0.1", Port: uint32(6666 + i),
+			HashAuth: []*mpb.PieceHashAuth{{Ticket: ticket, Auth: []byte(ticket)}}})
+	}
+	return pros
+}
+
+func TestUploadJournalResume(t *testing.T) {
+	c, j, clean := newTestJournal(t, false)
+	defer clean()
+	require.NoError(t, j.save())
+
+	now := common.Now()
+	require.True(t, j.needTickets(now))
+	require.NoError(t, j.assign(0, testProviders(3, "t1"), now))
+	require.False(t, j.needTickets(now))
+	require.True(t, j.needTickets(now+TicketLifetime+1))
+
+	require.NoError(t, j.markStored(j.Partitions[0].Blocks[0]))
+	require.NoError(t, j.markFailed(j.Partitions[0].Blocks[1]))
+	_, err := j.storePartitions()
+	require.Error(t, err)
+
+	// reload as after restart
+	loaded := c.openUploadJournal(j.FileName, "/bak", 0)
+	require.NotNil(t, loaded)
+	require.True(t, loaded.Partitions[0].Blocks[0].Stored)
+	require.True(t, loaded.needTickets(now))
+
+	// fresh tickets do not touch stored blocks
+	require.NoError(t, loaded.assign(0, testProviders(3, "t2"), now+TicketLifetime))
+	require.Equal(t, "t1", loaded.Partitions[0].Blocks[0].Ticket)
+	require.Equal(t, "t2", loaded.Partitions[0].Blocks[1].Ticket)
+	require.Equal(t, "t2", loaded.Partitions[0].Blocks[2].Ticket)
+
+	for _, b := range loaded.Partitions[0].Blocks[1:] {
+		require.NoError(t, loaded.markStored(b))
+	}
+	partitions, err := loaded.storePartitions()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(partitions))
+	require.Equal(t, 3, len(partitions[0].Block))
+	require.Equal(t, []byte{0}, partitions[0].Block[0].StoreNodeId[0])
+	require.True(t, partitions[0].Block[2].Checksum)
+
+	pending, err := c.loadUploadJournals()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pending))
+
+	loaded.discard(c.Log)
+	require.Nil(t, c.openUploadJournal(j.FileName, "/bak", 0))
+	_, err = os.Stat(j.FileName)
+	require.NoError(t, err)
+}
+
+func TestUploadJournalMatches(t *testing.T) {
+	_, j, clean := newTestJournal(t, true)
+	defer clean()
+	req := &mpb.CheckFileExistReq{FileHash: j.FileHash, FileSize: j.FileSize}
+	require.True(t, j.matches(req, 2, 1))
+	require.False(t, j.matches(req, 4, 1))
+	require.False(t, j.matches(&mpb.CheckFileExistReq{FileHash: []byte("changed"), FileSize: j.FileSize}, 2, 1))
+
+	// journal of blocks encrypted by AES-CBC
+	j.Partitions[0].Blocks[1].Nonce = nil
+	require.False(t, j.matches(req, 2, 1))
+	j.Partitions[0].Blocks[1].Nonce = j.Partitions[0].Blocks[0].Nonce
+
+	// journal with shard files on disk has no partition range
+	j.Partitions[0].Size = 0
+	require.False(t, j.matches(req, 2, 1))
+}
+
+func TestUploadJournalDataKey(t *testing.T) {
+	c, j, clean := newTestJournal(t, true)
+	defer clean()
+	require.NoError(t, j.save())
+	data, err := ioutil.ReadFile(j.path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "0123456789abcdef")
+	require.NotContains(t, string(data), base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")))
+
+	loaded := c.openUploadJournal(j.FileName, "/bak", 0)
+	require.NotNil(t, loaded)
+	key, err := c.journalDataKey(loaded)
+	require.NoError(t, err)
+	require.Equal(t, []byte("0123456789abcdef"), key)
+
+	// journal of former version keeps no wrapped key
+	loaded.WrappedKey = nil
+	_, err = c.journalDataKey(loaded)
+	require.Error(t, err)
+}
@@ -0,0 +1,104 @@
+package dav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samoslab/nebula/client/daemon/daemontest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebDAV(t *testing.T) {
+	defer func(d time.Duration) { ListCacheTime = d }(ListCacheTime)
+	ListCacheTime = 0
+	dir, err := ioutil.TempDir("", "dav")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	remote := daemontest.NewRemote()
+	_, err = NewHandler(log, NewFileSystem(log, remote, 2, dir, true), "user", "")
+	require.Error(t, err)
+	handler, err := NewHandler(log, NewFileSystem(log, remote, 2, dir, true), "user", "secret")
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	do := func(method, name, body string, header map[string]string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+name, strings.NewReader(body))
+		require.NoError(t, err)
+		req.SetBasicAuth("user", "secret")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		return rsp.StatusCode, string(data)
+	}
+
+	rsp, err := http.Get(server.URL + "/")
+	require.NoError(t, err)
+	rsp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+
+	code, body := do("PROPFIND", "/", "", map[string]string{"Depth": "1"})
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.Contains(t, body, "<D:href>/0/</D:href>")
+	require.Contains(t, body, "<D:href>/1/</D:href>")
+	code, _ = do("PROPFIND", "/2/", "", map[string]string{"Depth": "1"})
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do("MKCOL", "/1/docs", "", nil)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do("MKCOL", "/1/docs", "", nil)
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = do("MKCOL", "/1/none/docs", "", nil)
+	require.Equal(t, http.StatusConflict, code)
+	code, _ = do("PUT", "/1/docs/a.txt", "0123456789", nil)
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, "0123456789", string(remote.File(1, "/docs/a.txt").Data))
+	require.True(t, remote.File(1, "/docs/a.txt").Encrypted)
+
+	code, body = do("PROPFIND", "/1/docs", "", map[string]string{"Depth": "1"})
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.Contains(t, body, "<D:href>/1/docs/a.txt</D:href>")
+	require.Contains(t, body, "<D:getcontentlength>10</D:getcontentlength>")
+	require.Equal(t, 0, remote.Downloads)
+
+	code, body = do("GET", "/1/docs/a.txt", "", map[string]string{"Range": "bytes=2-4"})
+	require.Equal(t, http.StatusPartialContent, code)
+	require.Equal(t, "234", body)
+	code, body = do("GET", "/1/docs/a.txt", "", nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "0123456789", body)
+	code, _ = do("GET", "/1/docs/none.txt", "", nil)
+	require.Equal(t, http.StatusNotFound, code)
+	// files of the same path in other space are others
+	code, _ = do("GET", "/0/docs/a.txt", "", nil)
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do("MOVE", "/1/docs/a.txt", "", map[string]string{"Destination": server.URL + "/1/b.txt"})
+	require.Equal(t, http.StatusCreated, code)
+	require.Nil(t, remote.File(1, "/docs/a.txt"))
+	require.Equal(t, "0123456789", string(remote.File(1, "/b.txt").Data))
+
+	code, _ = do("DELETE", "/1/docs", "", nil)
+	require.Equal(t, http.StatusNoContent, code)
+	require.Nil(t, remote.File(1, "/docs"))
+	code, _ = do("DELETE", "/1", "", nil)
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// temp files are removed
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 0)
+}
@@ -0,0 +1,111 @@
+package dav
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/samoslab/nebula/client/daemon"
+)
+
+var errNotFile = errors.New("not a file")
+
+// folderFile a folder opened to list
+type folderFile struct {
+	fs     *FileSystem
+	loc    location
+	info   *fileInfo
+	offset int
+}
+
+func (f *folderFile) Close() error {
+	return nil
+}
+
+func (f *folderFile) Read(p []byte) (int, error) {
+	return 0, errNotFile
+}
+
+func (f *folderFile) Write(p []byte) (int, error) {
+	return 0, errNotFile
+}
+
+func (f *folderFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errNotFile
+}
+
+func (f *folderFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Readdir returns files of folder, the collection of all spaces has a folder of each space
+func (f *folderFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos := []os.FileInfo{}
+	if f.loc.space < 0 {
+		for sno := uint32(0); sno < f.fs.spaces; sno++ {
+			info, err := f.fs.stat(location{int64(sno), "/"})
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, info)
+		}
+	} else {
+		files, err := f.fs.list(f.loc.sno(), f.loc.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			infos = append(infos, newFileInfo(file))
+		}
+	}
+	if count <= 0 {
+		return infos, nil
+	}
+	if f.offset >= len(infos) {
+		return nil, io.EOF
+	}
+	infos = infos[f.offset:]
+	if len(infos) > count {
+		infos = infos[:count]
+	}
+	f.offset += len(infos)
+	return infos, nil
+}
+
+// readFile a file opened to read, only ranges read are retrieved so stat and seek need no download
+type readFile struct {
+	daemon.File
+	info *fileInfo
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errNotFile
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// writeFile a temp file written, it is uploaded when closed
+type writeFile struct {
+	*os.File
+	fs      *FileSystem
+	loc     location
+	tempDir string
+}
+
+func (f *writeFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errNotFile
+}
+
+func (f *writeFile) Close() error {
+	defer os.RemoveAll(f.tempDir)
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return f.fs.upload(f.loc, f.File.Name())
+}
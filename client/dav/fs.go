@@ -0,0 +1,347 @@
+package dav
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samoslab/nebula/client/daemon"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// ListCacheTime folder listed is reused in ListCacheTime, a PROPFIND stats every child of the folder it lists
+var ListCacheTime = 2 * time.Second
+
+// Remote net disk operations WebDAV needs, *daemon.ClientManager implements it
+type Remote interface {
+	ListFolder(path string, sno uint32) ([]*daemon.DownFile, error)
+	UploadFile(fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error
+	OpenFile(ctx context.Context, fileName, fileHash string, fileSize uint64, sno uint32) (daemon.File, error)
+	MkFolder(filepath string, folders []string, interactive bool, sno uint32) (bool, error)
+	RemoveFile(target string, recursive bool, isPath bool, sno uint32) error
+	MoveFile(source, dest string, sno uint32) error
+}
+
+type listing struct {
+	files []*daemon.DownFile
+	time  time.Time
+}
+
+// FileSystem webdav.FileSystem of net disk, collection "/<space no>" is root folder of the space
+type FileSystem struct {
+	remote    Remote
+	spaces    uint32
+	tempDir   string
+	isEncrypt bool
+	log       logrus.FieldLogger
+
+	mutex sync.Mutex
+	cache map[string]*listing
+}
+
+// NewFileSystem returns file system of spaces 0 to spaces-1, files are uploaded through tempDir and encrypted if isEncrypt
+func NewFileSystem(log logrus.FieldLogger, remote Remote, spaces uint32, tempDir string, isEncrypt bool) *FileSystem {
+	return &FileSystem{
+		remote:    remote,
+		spaces:    spaces,
+		tempDir:   tempDir,
+		isEncrypt: isEncrypt,
+		log:       log,
+		cache:     map[string]*listing{},
+	}
+}
+
+// location of a name in WebDAV, space is -1 for the root collection of all spaces
+type location struct {
+	space int64
+	path  string
+}
+
+func (l location) sno() uint32 {
+	return uint32(l.space)
+}
+
+func (fs *FileSystem) parse(name string) (location, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return location{space: -1, path: "/"}, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+	no, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || uint32(no) >= fs.spaces {
+		return location{}, os.ErrNotExist
+	}
+	loc := location{space: int64(no), path: "/"}
+	if len(parts) == 2 {
+		loc.path = "/" + parts[1]
+	}
+	return loc, nil
+}
+
+func cacheKey(sno uint32, dir string) string {
+	return fmt.Sprintf("%d:%s", sno, dir)
+}
+
+// list returns all files of folder dir of space sno
+func (fs *FileSystem) list(sno uint32, dir string) ([]*daemon.DownFile, error) {
+	key := cacheKey(sno, dir)
+	fs.mutex.Lock()
+	cached, ok := fs.cache[key]
+	fs.mutex.Unlock()
+	if ok && time.Since(cached.time) < ListCacheTime {
+		return cached.files, nil
+	}
+	all, err := fs.remote.ListFolder(dir, sno)
+	if err != nil {
+		return nil, err
+	}
+	fs.mutex.Lock()
+	fs.cache[key] = &listing{files: all, time: time.Now()}
+	fs.mutex.Unlock()
+	return all, nil
+}
+
+// changed drops listing of folder dir of space sno
+func (fs *FileSystem) changed(sno uint32, dir string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	delete(fs.cache, cacheKey(sno, dir))
+}
+
+func (fs *FileSystem) stat(loc location) (*fileInfo, error) {
+	if loc.space < 0 {
+		return &fileInfo{name: "/", folder: true}, nil
+	}
+	if loc.path == "/" {
+		return &fileInfo{name: strconv.FormatInt(loc.space, 10), folder: true}, nil
+	}
+	dir, name := path.Split(loc.path)
+	files, err := fs.list(loc.sno(), path.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.FileName == name {
+			return newFileInfo(file), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// Stat returns file info of name
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	loc, err := fs.parse(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.stat(loc)
+}
+
+// Mkdir makes folder, parent folder must exist
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	loc, err := fs.parse(name)
+	if err != nil {
+		return err
+	}
+	if loc.space < 0 || loc.path == "/" {
+		return os.ErrExist
+	}
+	if _, err := fs.stat(loc); err == nil {
+		return os.ErrExist
+	}
+	dir, folder := path.Split(loc.path)
+	dir = path.Clean(dir)
+	if info, err := fs.stat(location{loc.space, dir}); err != nil || !info.IsDir() {
+		return os.ErrNotExist
+	}
+	if _, err := fs.remote.MkFolder(dir, []string{folder}, false, loc.sno()); err != nil {
+		return err
+	}
+	fs.changed(loc.sno(), dir)
+	return nil
+}
+
+// RemoveAll removes file or folder with its content
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	loc, err := fs.parse(name)
+	if err != nil {
+		return err
+	}
+	if loc.space < 0 || loc.path == "/" {
+		return os.ErrPermission
+	}
+	info, err := fs.stat(loc)
+	if err != nil {
+		return err
+	}
+	if err := fs.remote.RemoveFile(loc.path, info.IsDir(), true, loc.sno()); err != nil {
+		return err
+	}
+	fs.changed(loc.sno(), path.Dir(loc.path))
+	if info.IsDir() {
+		fs.mutex.Lock()
+		prefix := cacheKey(loc.sno(), loc.path)
+		for key := range fs.cache {
+			if key == prefix || strings.HasPrefix(key, prefix+"/") {
+				delete(fs.cache, key)
+			}
+		}
+		fs.mutex.Unlock()
+	}
+	return nil
+}
+
+// Rename moves file or folder in the same space
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldLoc, err := fs.parse(oldName)
+	if err != nil {
+		return err
+	}
+	newLoc, err := fs.parse(newName)
+	if err != nil {
+		return err
+	}
+	if oldLoc.space < 0 || oldLoc.path == "/" || newLoc.space < 0 || newLoc.path == "/" {
+		return os.ErrPermission
+	}
+	if oldLoc.space != newLoc.space {
+		return fmt.Errorf("move between spaces is not supported")
+	}
+	info, err := fs.stat(oldLoc)
+	if err != nil {
+		return err
+	}
+	if err := fs.remote.MoveFile(info.file.ID, newLoc.path, oldLoc.sno()); err != nil {
+		return err
+	}
+	fs.changed(oldLoc.sno(), path.Dir(oldLoc.path))
+	fs.changed(newLoc.sno(), path.Dir(newLoc.path))
+	return nil
+}
+
+// OpenFile opens folder or file to read, or file to write which is uploaded when closed
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	loc, err := fs.parse(name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return fs.create(loc)
+	}
+	info, err := fs.stat(loc)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &folderFile{fs: fs, loc: loc, info: info}, nil
+	}
+	fs.log.Infof("WebDAV read space %d %s", loc.space, loc.path)
+	content, err := fs.remote.OpenFile(ctx, loc.path, info.file.FileHash, info.file.FileSize, loc.sno())
+	if err != nil {
+		return nil, err
+	}
+	return &readFile{File: content, info: info}, nil
+}
+
+func (fs *FileSystem) create(loc location) (webdav.File, error) {
+	if loc.space < 0 || loc.path == "/" {
+		return nil, os.ErrPermission
+	}
+	dir, name := path.Split(loc.path)
+	dir = path.Clean(dir)
+	if info, err := fs.stat(location{loc.space, dir}); err != nil || !info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	if info, err := fs.stat(loc); err == nil && info.IsDir() {
+		return nil, os.ErrExist
+	}
+	// name of uploaded file is the name of local file
+	tempDir, err := ioutil.TempDir(fs.tempDir, "dav")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(tempDir, name))
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+	return &writeFile{File: f, fs: fs, loc: loc, tempDir: tempDir}, nil
+}
+
+// upload uploads file written as new version
+func (fs *FileSystem) upload(loc location, fileName string) error {
+	dir := path.Dir(loc.path)
+	fs.log.Infof("WebDAV upload %s to space %d %s", filepath.Base(fileName), loc.space, dir)
+	err := fs.remote.UploadFile(fileName, dir, false, true, fs.isEncrypt, loc.sno())
+	fs.changed(loc.sno(), dir)
+	return err
+}
+
+// fileInfo os.FileInfo of a listed file, it tells webdav content type and etag without downloading
+type fileInfo struct {
+	name   string
+	folder bool
+	file   *daemon.DownFile
+}
+
+func newFileInfo(file *daemon.DownFile) *fileInfo {
+	return &fileInfo{name: file.FileName, folder: file.Folder, file: file}
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	if fi.file == nil {
+		return 0
+	}
+	return int64(fi.file.FileSize)
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.folder {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	if fi.file == nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(fi.file.ModTime), 0)
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.folder
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return fi.file
+}
+
+// ContentType implements webdav.ContentTyper
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(fi.name)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// ETag implements webdav.ETager, hash of file content
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.file == nil || fi.file.FileHash == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.file.FileHash + `"`, nil
+}
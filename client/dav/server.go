@@ -0,0 +1,38 @@
+package dav
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// realm of basic auth
+const realm = "nebula"
+
+// NewHandler returns WebDAV handler of fs, every request must have basic auth of user and password
+func NewHandler(log logrus.FieldLogger, fs *FileSystem, user, password string) (http.Handler, error) {
+	if user == "" || password == "" {
+		return nil, errors.New("webdav user and password must not empty")
+	}
+	dav := &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Errorf("WebDAV %s %s error %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,447 @@
+package filesync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samoslab/nebula/client/daemon"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrSideEmpty one side of a pair synced before is empty, removing all files of the other side is refused.
+// Removing and adding the pair again syncs it as a new one.
+var ErrSideEmpty = errors.New("one side of sync pair is empty, remove and add the pair again to sync it")
+
+// Remote net disk operations sync needs, *daemon.ClientManager implements it
+type Remote interface {
+	ListFolder(path string, sno uint32) ([]*daemon.DownFile, error)
+	UploadFile(fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error
+	DownloadFile(downFileName, destDir, filehash string, fileSize uint64, sno uint32) error
+	MkFolder(filepath string, folders []string, interactive bool, sno uint32) (bool, error)
+	RemoveFile(target string, recursive bool, isPath bool, sno uint32) error
+	MoveFile(source, dest string, sno uint32) error
+}
+
+// Pair a local folder kept in step with a folder of space
+type Pair struct {
+	ID        string `json:"id"`
+	Local     string `json:"local"`
+	Remote    string `json:"remote"`
+	Sno       uint32 `json:"space_no"`
+	IsEncrypt bool   `json:"is_encrypt"`
+}
+
+// Result changes propagated by one sync
+type Result struct {
+	Uploaded      int `json:"uploaded"`
+	Downloaded    int `json:"downloaded"`
+	RemovedLocal  int `json:"removed_local"`
+	RemovedRemote int `json:"removed_remote"`
+	Moved         int `json:"moved"`
+	Conflicts     int `json:"conflicts"`
+}
+
+// syncer propagates changes of one pair since its last sync. Either side differing from state has changed,
+// a path changed on one side only is copied to the other, a path changed on both sides differently keeps
+// the local one as conflict copy and takes the remote one.
+type syncer struct {
+	pair   *Pair
+	remote Remote
+	log    logrus.FieldLogger
+	state  *State
+	local  map[string]*Entry
+	remo   map[string]*Entry
+	result Result
+	now    func() time.Time
+}
+
+func newSyncer(pair *Pair, remote Remote, log logrus.FieldLogger, state *State) *syncer {
+	return &syncer{pair: pair, remote: remote, log: log, state: state, now: time.Now}
+}
+
+func (s *syncer) localPath(rel string) string {
+	return filepath.Join(s.pair.Local, filepath.FromSlash(rel))
+}
+
+func (s *syncer) remotePath(rel string) string {
+	return path.Join(s.pair.Remote, rel)
+}
+
+// sync scans both sides and propagates changes, state is updated for every change done even if a later one fails
+func (s *syncer) sync() error {
+	var err error
+	if s.pair.Remote != "/" {
+		parent, name := path.Split(s.pair.Remote)
+		if _, err = s.remote.MkFolder(path.Clean(parent), []string{name}, false, s.pair.Sno); err != nil {
+			return err
+		}
+	}
+	if s.local, err = scanLocal(s.pair.Local, s.state); err != nil {
+		return err
+	}
+	if s.remo, err = scanRemote(s.remote, s.pair.Remote, s.pair.Sno); err != nil {
+		return err
+	}
+	// a side emptied at once is more likely an unmounted disk or a wrong folder than files removed by user
+	if len(s.state.Entries) != 0 && (len(s.local) == 0 || len(s.remo) == 0) {
+		return ErrSideEmpty
+	}
+	if err = s.renames(); err != nil {
+		return err
+	}
+	for _, rel := range s.paths() {
+		if err = s.syncPath(rel); err != nil {
+			return fmt.Errorf("sync %s error %v", rel, err)
+		}
+	}
+	return nil
+}
+
+// paths of both sides and state, a folder comes before its content
+func (s *syncer) paths() []string {
+	all := map[string]bool{}
+	for _, entries := range []map[string]*Entry{s.local, s.remo, s.state.Entries} {
+		for rel := range entries {
+			all[rel] = true
+		}
+	}
+	paths := make([]string, 0, len(all))
+	for rel := range all {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *syncer) syncPath(rel string) error {
+	l, r, b := s.local[rel], s.remo[rel], s.state.Entries[rel]
+	switch {
+	case l != nil && r != nil && l.Folder != r.Folder:
+		return s.conflict(rel)
+	case sameContent(l, r):
+		if l == nil {
+			delete(s.state.Entries, rel)
+		} else {
+			s.state.agreed(l, r)
+		}
+		return nil
+	case sameContent(l, b):
+		if r == nil {
+			return s.removeLocal(rel)
+		}
+		return s.download(rel)
+	case sameContent(r, b):
+		if l == nil {
+			return s.removeRemote(rel)
+		}
+		return s.upload(rel)
+	case l == nil:
+		// changing wins over removing
+		return s.download(rel)
+	case r == nil:
+		return s.upload(rel)
+	}
+	return s.conflict(rel)
+}
+
+// renames moves a file on the other side instead of removing and copying it again. A file missing from
+// one side and unchanged on the other is renamed if a new file of that side has the same content, or for
+// remote the same id.
+func (s *syncer) renames() error {
+	olds := []string{}
+	for rel, b := range s.state.Entries {
+		if !b.Folder {
+			olds = append(olds, rel)
+		}
+	}
+	sort.Strings(olds)
+	for _, old := range olds {
+		b := s.state.Entries[old]
+		l, r := s.local[old], s.remo[old]
+		if l == nil && sameContent(r, b) && r.RemoteID != "" {
+			if rel := s.renamedLocal(b); rel != "" {
+				if err := s.moveRemote(old, rel); err != nil {
+					return err
+				}
+			}
+		} else if r == nil && sameContent(l, b) && b.RemoteID != "" {
+			if rel := s.renamedRemote(b); rel != "" {
+				if err := s.moveLocal(old, rel); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// renamedLocal returns the only new local file of the content of b
+func (s *syncer) renamedLocal(b *Entry) string {
+	found := ""
+	for rel, l := range s.local {
+		if l.Folder || l.Hash != b.Hash || l.Size != b.Size || s.state.Entries[rel] != nil || s.remo[rel] != nil {
+			continue
+		}
+		if found != "" {
+			return ""
+		}
+		found = rel
+	}
+	return found
+}
+
+// renamedRemote returns the new remote path of file id of b
+func (s *syncer) renamedRemote(b *Entry) string {
+	for rel, r := range s.remo {
+		if r.RemoteID == b.RemoteID && !r.Folder && r.Hash == b.Hash && s.state.Entries[rel] == nil && s.local[rel] == nil {
+			return rel
+		}
+	}
+	return ""
+}
+
+func (s *syncer) moveRemote(old, rel string) error {
+	r := s.remo[old]
+	if err := s.remoteDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	s.log.Infof("Move remote %s to %s", s.remotePath(old), s.remotePath(rel))
+	if err := s.remote.MoveFile(r.RemoteID, s.remotePath(rel), s.pair.Sno); err != nil {
+		return err
+	}
+	moved := *r
+	moved.Path = rel
+	s.remo[rel] = &moved
+	delete(s.remo, old)
+	delete(s.state.Entries, old)
+	s.state.agreed(s.local[rel], &moved)
+	s.result.Moved++
+	return nil
+}
+
+func (s *syncer) moveLocal(old, rel string) error {
+	if err := s.localDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	if !s.unchanged(old) {
+		return nil
+	}
+	s.log.Infof("Move local %s to %s", s.localPath(old), s.localPath(rel))
+	if err := os.Rename(s.localPath(old), s.localPath(rel)); err != nil {
+		return err
+	}
+	moved := *s.local[old]
+	moved.Path = rel
+	s.local[rel] = &moved
+	delete(s.local, old)
+	delete(s.state.Entries, old)
+	s.state.agreed(&moved, s.remo[rel])
+	s.result.Moved++
+	return nil
+}
+
+// remoteDir makes folder rel and its parents not existing remotely
+func (s *syncer) remoteDir(rel string) error {
+	if rel == "." || rel == "" || s.remo[rel] != nil {
+		return nil
+	}
+	if err := s.remoteDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	parent, name := path.Split(s.remotePath(rel))
+	if _, err := s.remote.MkFolder(path.Clean(parent), []string{name}, false, s.pair.Sno); err != nil {
+		return err
+	}
+	s.remo[rel] = &Entry{Path: rel, Folder: true}
+	return nil
+}
+
+// localDir makes folder rel and its parents not existing locally
+func (s *syncer) localDir(rel string) error {
+	if rel == "." || rel == "" || s.local[rel] != nil {
+		return nil
+	}
+	if err := s.localDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.localPath(rel), 0755); err != nil {
+		return err
+	}
+	s.local[rel] = &Entry{Path: rel, Folder: true}
+	return nil
+}
+
+// unchanged tells whether local file is still what scan found, it is not overwritten or removed otherwise
+func (s *syncer) unchanged(rel string) bool {
+	l := s.local[rel]
+	info, err := os.Lstat(s.localPath(rel))
+	if l == nil {
+		return os.IsNotExist(err)
+	}
+	if err != nil {
+		return false
+	}
+	if l.Folder {
+		return info.IsDir()
+	}
+	return info.Mode().IsRegular() && uint64(info.Size()) == l.Size && info.ModTime().UnixNano() == l.ModTime
+}
+
+// changedBelow tells whether something under folder rel changed on the side other than the removed one
+func (s *syncer) changedBelow(rel string, other map[string]*Entry) bool {
+	prefix := rel + "/"
+	for _, entries := range []map[string]*Entry{other, s.state.Entries} {
+		for p := range entries {
+			if strings.HasPrefix(p, prefix) && !sameContent(other[p], s.state.Entries[p]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *syncer) upload(rel string) error {
+	l := s.local[rel]
+	if err := s.remoteDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	if l.Folder {
+		if err := s.remoteDir(rel); err != nil {
+			return err
+		}
+		s.state.agreed(l, nil)
+		return nil
+	}
+	dest := s.remotePath(path.Dir(rel))
+	s.log.Infof("Upload %s to %s", s.localPath(rel), dest)
+	if err := s.remote.UploadFile(s.localPath(rel), dest, false, true, s.pair.IsEncrypt, s.pair.Sno); err != nil {
+		return err
+	}
+	// id of the new version is known by the next listing
+	s.state.agreed(l, nil)
+	s.result.Uploaded++
+	return nil
+}
+
+func (s *syncer) download(rel string) error {
+	r := s.remo[rel]
+	if err := s.localDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	if r.Folder {
+		if err := s.localDir(rel); err != nil {
+			return err
+		}
+		s.state.agreed(s.local[rel], r)
+		return nil
+	}
+	if !s.unchanged(rel) {
+		s.log.Infof("%s changed during sync, skip download", s.localPath(rel))
+		return nil
+	}
+	fileName := s.localPath(rel)
+	s.log.Infof("Download %s to %s", s.remotePath(rel), fileName)
+	if r.Size == 0 {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	} else if err := s.remote.DownloadFile(s.remotePath(rel), filepath.Dir(fileName), r.Hash, r.Size, s.pair.Sno); err != nil {
+		return err
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	l := &Entry{Path: rel, Size: uint64(info.Size()), ModTime: info.ModTime().UnixNano(), Hash: r.Hash}
+	s.local[rel] = l
+	s.state.agreed(l, r)
+	s.result.Downloaded++
+	return nil
+}
+
+func (s *syncer) removeLocal(rel string) error {
+	l := s.local[rel]
+	if l.Folder && s.changedBelow(rel, s.local) {
+		// something new inside, the folder is made remotely again
+		return s.upload(rel)
+	}
+	if !l.Folder && !s.unchanged(rel) {
+		return nil
+	}
+	s.log.Infof("Remove local %s", s.localPath(rel))
+	if err := os.RemoveAll(s.localPath(rel)); err != nil {
+		return err
+	}
+	s.forget(rel, s.local)
+	s.result.RemovedLocal++
+	return nil
+}
+
+func (s *syncer) removeRemote(rel string) error {
+	r := s.remo[rel]
+	if r.Folder && s.changedBelow(rel, s.remo) {
+		return s.download(rel)
+	}
+	s.log.Infof("Remove remote %s", s.remotePath(rel))
+	if err := s.remote.RemoveFile(s.remotePath(rel), r.Folder, true, s.pair.Sno); err != nil {
+		return err
+	}
+	s.forget(rel, s.remo)
+	s.result.RemovedRemote++
+	return nil
+}
+
+// forget removes rel and what is under it from entries and state
+func (s *syncer) forget(rel string, entries map[string]*Entry) {
+	prefix := rel + "/"
+	for _, m := range []map[string]*Entry{entries, s.state.Entries} {
+		for p := range m {
+			if p == rel || strings.HasPrefix(p, prefix) {
+				delete(m, p)
+			}
+		}
+	}
+}
+
+// conflictName returns name of the conflict copy of rel, such as "dir/a (conflict 20060102-150405).txt"
+func conflictName(rel string, t time.Time) string {
+	dir, name := path.Split(rel)
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return dir + fmt.Sprintf("%s (conflict %s)%s", strings.TrimSuffix(name, ext), t.Format("20060102-150405"), ext)
+}
+
+// conflict keeps the local version as conflict copy, then takes the remote one
+func (s *syncer) conflict(rel string) error {
+	l := s.local[rel]
+	if !s.unchanged(rel) {
+		return nil
+	}
+	copyName := conflictName(rel, s.now())
+	s.log.Infof("Conflict of %s, keep local one as %s", rel, copyName)
+	if err := os.Rename(s.localPath(rel), s.localPath(copyName)); err != nil {
+		return err
+	}
+	s.result.Conflicts++
+	s.forget(rel, s.local)
+	if !l.Folder {
+		moved := *l
+		moved.Path = copyName
+		s.local[copyName] = &moved
+		if err := s.upload(copyName); err != nil {
+			return err
+		}
+	}
+	// a folder kept as conflict copy is uploaded by the next sync
+	return s.download(rel)
+}
@@ -0,0 +1,226 @@
+package filesync
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samoslab/nebula/client/daemon/daemontest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type syncTest struct {
+	t      *testing.T
+	dir    string
+	local  string
+	remote *daemontest.Remote
+	state  *State
+	pair   *Pair
+}
+
+func newSyncTest(t *testing.T) (*syncTest, func()) {
+	dir, err := ioutil.TempDir("", "filesync")
+	require.NoError(t, err)
+	local := filepath.Join(dir, "local")
+	require.NoError(t, os.Mkdir(local, 0755))
+	st := &syncTest{
+		t:      t,
+		dir:    dir,
+		local:  local,
+		remote: daemontest.NewRemote(),
+		state:  newState(),
+		pair:   &Pair{ID: "test", Local: local, Remote: "/sync"},
+	}
+	return st, func() { os.RemoveAll(dir) }
+}
+
+func (st *syncTest) sync() Result {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	s := newSyncer(st.pair, st.remote, log, st.state)
+	s.now = func() time.Time { return time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC) }
+	require.NoError(st.t, s.sync())
+	// state survives saving and loading
+	fileName := filepath.Join(st.dir, "state.json")
+	require.NoError(st.t, st.state.save(fileName))
+	state, err := loadState(fileName)
+	require.NoError(st.t, err)
+	st.state = state
+	return s.result
+}
+
+func (st *syncTest) writeLocal(rel, content string) {
+	fileName := filepath.Join(st.local, filepath.FromSlash(rel))
+	require.NoError(st.t, os.MkdirAll(filepath.Dir(fileName), 0755))
+	require.NoError(st.t, ioutil.WriteFile(fileName, []byte(content), 0644))
+	// mtime of a quick rewrite may not change
+	future := time.Now().Add(time.Duration(len(content)) * time.Second)
+	require.NoError(st.t, os.Chtimes(fileName, future, future))
+}
+
+func (st *syncTest) readLocal(rel string) string {
+	data, err := ioutil.ReadFile(filepath.Join(st.local, filepath.FromSlash(rel)))
+	require.NoError(st.t, err)
+	return string(data)
+}
+
+func (st *syncTest) localExists(rel string) bool {
+	_, err := os.Stat(filepath.Join(st.local, filepath.FromSlash(rel)))
+	return err == nil
+}
+
+func (st *syncTest) readRemote(rel string) string {
+	f := st.remote.File(0, path.Join("/sync", rel))
+	require.NotNil(st.t, f, "remote %s not exists", rel)
+	return string(f.Data)
+}
+
+func (st *syncTest) remoteExists(rel string) bool {
+	return st.remote.File(0, path.Join("/sync", rel)) != nil
+}
+
+func TestSyncBothWays(t *testing.T) {
+	st, clean := newSyncTest(t)
+	defer clean()
+	st.writeLocal("a.txt", "local a")
+	st.writeLocal("docs/b.txt", "local b")
+	st.remote.MkFolder("/", []string{"sync"}, false, 0)
+	st.remote.MkFolder("/sync", []string{"photos"}, false, 0)
+	st.remote.Put(0, "/sync/photos/c.jpg", []byte("remote c"))
+	st.remote.Put(0, "/sync/empty", []byte{})
+
+	result := st.sync()
+	require.Equal(t, Result{Uploaded: 2, Downloaded: 2}, result)
+	require.Equal(t, "local a", st.readRemote("a.txt"))
+	require.Equal(t, "local b", st.readRemote("docs/b.txt"))
+	require.Equal(t, "remote c", st.readLocal("photos/c.jpg"))
+	require.Equal(t, "", st.readLocal("empty"))
+
+	// nothing changed
+	require.Equal(t, Result{}, st.sync())
+	require.Equal(t, Result{}, st.sync())
+}
+
+func TestSyncUpdateAndRemove(t *testing.T) {
+	st, clean := newSyncTest(t)
+	defer clean()
+	st.writeLocal("a.txt", "a")
+	st.writeLocal("b.txt", "b")
+	st.writeLocal("dir/c.txt", "c")
+	st.writeLocal("remote/d.txt", "d")
+	st.sync()
+
+	st.writeLocal("a.txt", "local a v2")
+	st.remote.Put(0, "/sync/b.txt", []byte("remote b v2"))
+	require.NoError(t, os.RemoveAll(filepath.Join(st.local, "dir")))
+	st.remote.RemoveFile("/sync/remote", true, true, 0)
+
+	result := st.sync()
+	require.Equal(t, Result{Uploaded: 1, Downloaded: 1, RemovedLocal: 1, RemovedRemote: 1}, result)
+	require.Equal(t, "local a v2", st.readRemote("a.txt"))
+	require.Equal(t, "remote b v2", st.readLocal("b.txt"))
+	require.False(t, st.remoteExists("dir"))
+	require.False(t, st.remoteExists("dir/c.txt"))
+	require.False(t, st.localExists("remote"))
+	require.Equal(t, Result{}, st.sync())
+}
+
+func TestSyncRemovedFolderChangedOtherSide(t *testing.T) {
+	st, clean := newSyncTest(t)
+	defer clean()
+	st.writeLocal("dir/a.txt", "a")
+	st.writeLocal("keep.txt", "keep")
+	st.sync()
+
+	// a file added remotely keeps the folder removed locally
+	require.NoError(t, os.RemoveAll(filepath.Join(st.local, "dir")))
+	st.remote.Put(0, "/sync/dir/b.txt", []byte("b"))
+	result := st.sync()
+	require.Equal(t, 1, result.Downloaded)
+	require.Equal(t, 1, result.RemovedRemote)
+	require.Equal(t, "b", st.readLocal("dir/b.txt"))
+	require.False(t, st.remoteExists("dir/a.txt"))
+	require.Equal(t, Result{}, st.sync())
+}
+
+func TestSyncSideEmpty(t *testing.T) {
+	st, clean := newSyncTest(t)
+	defer clean()
+	st.writeLocal("a.txt", "a")
+	st.writeLocal("dir/b.txt", "b")
+	st.sync()
+
+	// local folder emptied at once does not empty remote folder
+	require.NoError(t, os.RemoveAll(st.local))
+	require.NoError(t, os.Mkdir(st.local, 0755))
+	s := newSyncer(st.pair, st.remote, logrus.New(), st.state)
+	require.Equal(t, ErrSideEmpty, s.sync())
+	require.Equal(t, Result{}, s.result)
+	require.Equal(t, "a", st.readRemote("a.txt"))
+	require.Equal(t, "b", st.readRemote("dir/b.txt"))
+
+	st.remote.RemoveFile("/sync", true, true, 0)
+	st.writeLocal("a.txt", "a")
+	s = newSyncer(st.pair, st.remote, logrus.New(), st.state)
+	require.Equal(t, ErrSideEmpty, s.sync())
+	require.Equal(t, "a", st.readLocal("a.txt"))
+}
+
+func TestSyncRename(t *testing.T) {
+	st, clean := newSyncTest(t)
+	defer clean()
+	st.writeLocal("a.txt", "a")
+	st.writeLocal("b.txt", "b")
+	st.sync()
+	// the first sync learns remote ids
+	st.sync()
+
+	require.NoError(t, os.Rename(filepath.Join(st.local, "a.txt"), filepath.Join(st.local, "a2.txt")))
+	require.NoError(t, st.remote.MoveFile(st.remote.File(0, "/sync/b.txt").ID, "/sync/dir/b2.txt", 0))
+	st.remote.MkFolder("/sync", []string{"dir"}, false, 0)
+	st.remote.Moves = 0
+
+	result := st.sync()
+	require.Equal(t, Result{Moved: 2}, result)
+	require.Equal(t, 1, st.remote.Moves)
+	require.Equal(t, "a", st.readRemote("a2.txt"))
+	require.False(t, st.remoteExists("a.txt"))
+	require.Equal(t, "b", st.readLocal("dir/b2.txt"))
+	require.False(t, st.localExists("b.txt"))
+	require.Equal(t, Result{}, st.sync())
+}
+
+func TestSyncConflict(t *testing.T) {
+	st, clean := newSyncTest(t)
+	defer clean()
+	st.writeLocal("a.txt", "a")
+	st.sync()
+
+	st.writeLocal("a.txt", "local a")
+	st.remote.Put(0, "/sync/a.txt", []byte("remote a"))
+	result := st.sync()
+	require.Equal(t, Result{Uploaded: 1, Downloaded: 1, Conflicts: 1}, result)
+	copyName := "a (conflict 20180601-100000).txt"
+	require.Equal(t, "remote a", st.readLocal("a.txt"))
+	require.Equal(t, "local a", st.readLocal(copyName))
+	require.Equal(t, "remote a", st.readRemote("a.txt"))
+	require.Equal(t, "local a", st.readRemote(copyName))
+	require.Equal(t, Result{}, st.sync())
+
+	// both sides made the same change
+	st.writeLocal("a.txt", "same")
+	st.remote.Put(0, "/sync/a.txt", []byte("same"))
+	require.Equal(t, Result{}, st.sync())
+}
+
+func TestConflictName(t *testing.T) {
+	tm := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	require.Equal(t, "a (conflict 20180601-100000).txt", conflictName("a.txt", tm))
+	require.Equal(t, "dir/a (conflict 20180601-100000).tar", conflictName("dir/a.tar", tm))
+	require.Equal(t, "dir/.bashrc (conflict 20180601-100000)", conflictName("dir/.bashrc", tm))
+	require.Equal(t, "Makefile (conflict 20180601-100000)", conflictName("Makefile", tm))
+}
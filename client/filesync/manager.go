@@ -0,0 +1,265 @@
+package filesync
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DirName directory of sync pairs and their state under config dir
+	DirName   = "sync"
+	pairsFile = "pairs.json"
+)
+
+// Interval between two syncs of every pair
+var Interval = time.Minute
+
+// Status sync status of a pair
+type Status struct {
+	Pair
+	Syncing   bool   `json:"syncing"`
+	LastSync  int64  `json:"last_sync"`
+	LastError string `json:"last_error"`
+	Result    Result `json:"result"`
+}
+
+// Manager keeps configured pairs in step, each pair syncs once every Interval
+type Manager struct {
+	remote Remote
+	log    logrus.FieldLogger
+	dir    string
+
+	mutex  sync.Mutex
+	status map[string]*Status
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// NewManager loads pairs saved in dir
+func NewManager(log logrus.FieldLogger, remote Remote, dir string) (*Manager, error) {
+	m := &Manager{
+		remote: remote,
+		log:    log.WithField("module", "sync"),
+		dir:    dir,
+		status: map[string]*Status{},
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, pairsFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pairs := []Pair{}
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		m.status[pair.ID] = &Status{Pair: pair}
+	}
+	return m, nil
+}
+
+// savePairs must be called with mutex held
+func (m *Manager) savePairs() error {
+	pairs := []Pair{}
+	for _, st := range m.status {
+		pairs = append(pairs, st.Pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].ID < pairs[j].ID })
+	data, err := json.Marshal(pairs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(m.dir, pairsFile), data, 0600)
+}
+
+func (m *Manager) statePath(id string) string {
+	return filepath.Join(m.dir, id+".json")
+}
+
+func pairID(pair *Pair) string {
+	key := sha1.Sum([]byte(fmt.Sprintf("%s:%d:%s", pair.Local, pair.Sno, pair.Remote)))
+	return hex.EncodeToString(key[:8])
+}
+
+// nested tells whether a is b or under it
+func nested(a, b, sep string) bool {
+	return a == b || strings.HasPrefix(a, strings.TrimSuffix(b, sep)+sep)
+}
+
+// AddPair adds pair of an existing local folder and a folder of space, the remote folder is made by the first sync
+func (m *Manager) AddPair(local, remote string, sno uint32, isEncrypt bool) (*Pair, error) {
+	if !filepath.IsAbs(local) || !path.IsAbs(remote) {
+		return nil, errors.New("local and remote path must absolute")
+	}
+	local, remote = filepath.Clean(local), path.Clean(remote)
+	info, err := os.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", local)
+	}
+	pair := Pair{Local: local, Remote: remote, Sno: sno, IsEncrypt: isEncrypt}
+	pair.ID = pairID(&pair)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, st := range m.status {
+		sep := string(filepath.Separator)
+		if nested(local, st.Local, sep) || nested(st.Local, local, sep) {
+			return nil, fmt.Errorf("%s overlaps folder %s of sync pair %s", local, st.Local, st.ID)
+		}
+		if sno == st.Sno && (nested(remote, st.Remote, "/") || nested(st.Remote, remote, "/")) {
+			return nil, fmt.Errorf("%s overlaps folder %s of sync pair %s", remote, st.Remote, st.ID)
+		}
+	}
+	m.status[pair.ID] = &Status{Pair: pair}
+	if err := m.savePairs(); err != nil {
+		delete(m.status, pair.ID)
+		return nil, err
+	}
+	m.log.Infof("Add sync pair %s: %s and space %d %s", pair.ID, local, sno, remote)
+	return &pair, nil
+}
+
+// RemovePair stops syncing pair id, files of both sides are kept
+func (m *Manager) RemovePair(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	st, ok := m.status[id]
+	if !ok {
+		return fmt.Errorf("sync pair %s not exists", id)
+	}
+	if st.Syncing {
+		return fmt.Errorf("sync pair %s is syncing", id)
+	}
+	delete(m.status, id)
+	if err := m.savePairs(); err != nil {
+		m.status[id] = st
+		return err
+	}
+	if err := os.Remove(m.statePath(id)); err != nil && !os.IsNotExist(err) {
+		m.log.Errorf("Remove state of sync pair %s error %v", id, err)
+	}
+	m.log.Infof("Remove sync pair %s", id)
+	return nil
+}
+
+// Status returns status of all pairs ordered by id
+func (m *Manager) Status() []Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	all := []Status{}
+	for _, st := range m.status {
+		all = append(all, *st)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+// Sync syncs pair id now, all pairs if id is empty
+func (m *Manager) Sync(id string) error {
+	ids := []string{}
+	m.mutex.Lock()
+	for pid := range m.status {
+		if id == "" || id == pid {
+			ids = append(ids, pid)
+		}
+	}
+	m.mutex.Unlock()
+	if len(ids) == 0 && id != "" {
+		return fmt.Errorf("sync pair %s not exists", id)
+	}
+	sort.Strings(ids)
+	var errResult error
+	for _, pid := range ids {
+		if err := m.syncPair(pid); err != nil && errResult == nil {
+			errResult = err
+		}
+	}
+	return errResult
+}
+
+func (m *Manager) syncPair(id string) error {
+	m.mutex.Lock()
+	st, ok := m.status[id]
+	if !ok {
+		m.mutex.Unlock()
+		return fmt.Errorf("sync pair %s not exists", id)
+	}
+	if st.Syncing {
+		m.mutex.Unlock()
+		return fmt.Errorf("sync pair %s is syncing", id)
+	}
+	st.Syncing = true
+	pair := st.Pair
+	m.mutex.Unlock()
+
+	log := m.log.WithField("sync pair", id)
+	result, err := m.run(&pair, log)
+	if err != nil {
+		log.Errorf("Sync error %v", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	st.Syncing = false
+	st.LastSync = time.Now().Unix()
+	st.Result = result
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+	}
+	return err
+}
+
+func (m *Manager) run(pair *Pair, log logrus.FieldLogger) (Result, error) {
+	state, err := loadState(m.statePath(pair.ID))
+	if err != nil {
+		return Result{}, err
+	}
+	s := newSyncer(pair, m.remote, log, state)
+	err = s.sync()
+	// changes done are kept even if sync stops halfway
+	if serr := state.save(m.statePath(pair.ID)); serr != nil && err == nil {
+		err = serr
+	}
+	return s.result, err
+}
+
+// Run syncs all pairs every Interval until Shutdown
+func (m *Manager) Run() {
+	defer close(m.done)
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-time.After(Interval):
+			m.Sync("")
+		}
+	}
+}
+
+// Shutdown stops Run after the running sync
+func (m *Manager) Shutdown() {
+	close(m.quit)
+	<-m.done
+}
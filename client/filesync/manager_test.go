@@ -0,0 +1,60 @@
+package filesync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samoslab/nebula/client/daemon/daemontest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerPairs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "sub"), 0755))
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	remote := daemontest.NewRemote()
+	m, err := NewManager(log, remote, filepath.Join(dir, DirName))
+	require.NoError(t, err)
+
+	_, err = m.AddPair("local", "/backup", 1, true)
+	require.Error(t, err)
+	_, err = m.AddPair(filepath.Join(dir, "none"), "/backup", 1, true)
+	require.Error(t, err)
+	pair, err := m.AddPair(local, "/backup/", 1, true)
+	require.NoError(t, err)
+	require.Equal(t, "/backup", pair.Remote)
+	// folders of pairs must not overlap
+	_, err = m.AddPair(filepath.Join(local, "sub"), "/other", 1, true)
+	require.Error(t, err)
+	_, err = m.AddPair(dir, "/other", 1, true)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, m.Sync(pair.ID))
+	require.Equal(t, "a", string(remote.File(1, "/backup/a.txt").Data))
+	require.Error(t, m.Sync("none"))
+
+	// pairs are loaded again
+	m, err = NewManager(log, remote, filepath.Join(dir, DirName))
+	require.NoError(t, err)
+	status := m.Status()
+	require.Len(t, status, 1)
+	require.Equal(t, *pair, status[0].Pair)
+	require.NoError(t, m.Sync(""))
+	status = m.Status()
+	require.Equal(t, Result{}, status[0].Result)
+	require.NotZero(t, status[0].LastSync)
+
+	require.NoError(t, m.RemovePair(pair.ID))
+	require.Len(t, m.Status(), 0)
+	require.Error(t, m.RemovePair(pair.ID))
+	_, err = os.Stat(m.statePath(pair.ID))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,92 @@
+package filesync
+
+import (
+	"encoding/hex"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	util_hash "github.com/samoslab/nebula/util/hash"
+)
+
+// ignored files being downloaded or written by sync itself
+func ignored(name string) bool {
+	return strings.HasSuffix(name, ".download") || strings.HasSuffix(name, ".tmp")
+}
+
+// scanLocal returns files and folders under root, hash of a file whose size and mtime are those of base is not computed again
+func scanLocal(root string, base *State) (map[string]*Entry, error) {
+	entries := map[string]*Entry{}
+	err := filepath.Walk(root, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileName == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, fileName)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if ignored(info.Name()) {
+			return nil
+		}
+		if info.IsDir() {
+			entries[rel] = &Entry{Path: rel, Folder: true}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		entry := &Entry{Path: rel, Size: uint64(info.Size()), ModTime: info.ModTime().UnixNano()}
+		if old, ok := base.Entries[rel]; ok && !old.Folder && old.Size == entry.Size && old.ModTime == entry.ModTime {
+			entry.Hash = old.Hash
+		}
+		if entry.Hash == "" {
+			hash, err := util_hash.Sha1File(fileName)
+			if err != nil {
+				return err
+			}
+			entry.Hash = hex.EncodeToString(hash)
+		}
+		entries[rel] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// scanRemote returns files and folders under root of space sno
+func scanRemote(remote Remote, root string, sno uint32) (map[string]*Entry, error) {
+	entries := map[string]*Entry{}
+	var list func(rel string) error
+	list = func(rel string) error {
+		dir := path.Join(root, rel)
+		files, err := remote.ListFolder(dir, sno)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if ignored(file.FileName) {
+				continue
+			}
+			name := path.Join(rel, file.FileName)
+			entries[name] = &Entry{
+				Path:     name,
+				Folder:   file.Folder,
+				Size:     file.FileSize,
+				ModTime:  int64(file.ModTime),
+				Hash:     file.FileHash,
+				RemoteID: file.ID,
+			}
+			if file.Folder {
+				if err := list(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return entries, list("")
+}
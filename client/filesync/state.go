@@ -0,0 +1,86 @@
+package filesync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Entry a file or folder of sync pair, Path is relative to the pair root and separated by slash
+type Entry struct {
+	Path     string `json:"path"`
+	Folder   bool   `json:"folder"`
+	Size     uint64 `json:"size"`
+	ModTime  int64  `json:"modtime"`
+	Hash     string `json:"hash"`
+	RemoteID string `json:"remote_id"`
+}
+
+// sameContent both nil, both folders or files of the same hash
+func sameContent(a, b *Entry) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if a.Folder || b.Folder {
+		return a.Folder == b.Folder
+	}
+	return a.Hash == b.Hash
+}
+
+// State entries both sides agreed on at the end of last sync, a side differing from it has changed since
+type State struct {
+	Entries map[string]*Entry `json:"entries"`
+}
+
+func newState() *State {
+	return &State{Entries: map[string]*Entry{}}
+}
+
+// loadState returns empty state if the pair has never synced
+func loadState(fileName string) (*State, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return newState(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := newState()
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Entries == nil {
+		state.Entries = map[string]*Entry{}
+	}
+	return state, nil
+}
+
+// save writes a temp file and renames it, an interrupted save keeps the former state
+func (st *State) save(fileName string) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	tmp := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
+
+// agreed records entry of both sides, local size and mtime tell later scans whether the file changed
+func (st *State) agreed(local, remote *Entry) {
+	entry := *local
+	entry.RemoteID = ""
+	if remote != nil {
+		entry.RemoteID = remote.RemoteID
+		if entry.Hash == "" {
+			entry.Hash = remote.Hash
+		}
+	}
+	st.Entries[entry.Path] = &entry
+}
@@ -20,6 +20,8 @@ func main() {
 	collectAddr := pflag.StringP("collect", "", "", "collect server format is ip:port")
 	trackerAddr := pflag.StringP("tracker", "", "", "tracker server format is ip:port")
 	webDir := pflag.StringP("webdir", "d", "./web/build", "web static directory")
+	webdavAddr := pflag.StringP("webdav", "", "", "webdav listen address ip:port, webdav_user and webdav_password of config file are required")
+	s3Addr := pflag.StringP("s3", "", "", "s3 gateway listen address ip:port, s3_access_key and s3_secret_key of config file are required")
 	launchBrowser := pflag.BoolP("launch-browser", "l", false, "launch system default webbrowser at client startup")
 	pflag.Parse()
 	defaultAppDir, _ := daemon.GetConfigFile()
@@ -38,7 +40,7 @@ func main() {
 	if err != nil {
 		fmt.Printf("load config error  %v\n", err)
 		// set default webcfg avoid crash
-		webcfg = &config.Config{}
+		webcfg = &config.Config{APIEnabled: true, WebDAVEncrypt: true, S3Encrypt: true}
 		webcfg.SetDefault()
 	}
 	if *serverAddr != "" {
@@ -55,9 +57,18 @@ func main() {
 	if *trackerAddr != "" {
 		webcfg.TrackerServer = *trackerAddr
 	}
+	if *webdavAddr != "" {
+		webcfg.WebDAVAddr = *webdavAddr
+	}
+	if *s3Addr != "" {
+		webcfg.S3Addr = *s3Addr
+	}
 
-	fmt.Printf("webcfg %+v\n", webcfg)
 	server := service.NewHTTPServer(log, *webcfg)
+	if tokenFile := server.APITokenFile(); tokenFile != "" {
+		// electron shell reads token of API from the file named in this line
+		fmt.Printf("API token file %s\n", tokenFile)
+	}
 
 	defer server.Shutdown()
 	fmt.Printf("start http listen on %s\n", webcfg.HTTPAddr)
@@ -75,8 +86,12 @@ func main() {
 			// Wait a moment just to make sure the http interface is up
 			time.Sleep(time.Millisecond * 100)
 
-			fullAddress := "http://" + *serverAddr + "/index.html"
-			fmt.Printf("Launching System Browser with %s\n", fullAddress)
+			fullAddress, err := server.LaunchURL()
+			if err != nil {
+				fmt.Printf("%v", err)
+				return
+			}
+			fmt.Printf("Launching System Browser with http://%s\n", webcfg.HTTPAddr)
 			if err := browser.Open(fullAddress); err != nil {
 				fmt.Printf("%v", err)
 				return
@@ -11,7 +11,6 @@ import (
 	pb "github.com/samoslab/nebula/tracker/register/client/pb"
 	rsalong "github.com/samoslab/nebula/util/rsa"
 	"github.com/sirupsen/logrus"
-	"google.golang.org/grpc"
 )
 
 // OrderManager order manager
@@ -94,14 +93,8 @@ func NewOrderFromPbOrder(o *pb.Order) *Order {
 	}
 }
 
-// NewOrderManager create order manager ,only communicate with tracker server
-func NewOrderManager(trackerServer string, log logrus.FieldLogger, privateKey *rsa.PrivateKey, nodeId []byte) *OrderManager {
-	conn, err := grpc.Dial(trackerServer, grpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("RPC Dial failed: %s", err.Error())
-		return nil
-	}
-	oc := pb.NewOrderServiceClient(conn)
+// NewOrderManagerWithClient create order manager using order service client oc, only communicate with tracker server
+func NewOrderManagerWithClient(oc pb.OrderServiceClient, log logrus.FieldLogger, privateKey *rsa.PrivateKey, nodeId []byte) *OrderManager {
 	return &OrderManager{
 		orderClient: oc,
 		Log:         log,
@@ -31,6 +31,13 @@ func SetActionLog(err error, al *tcppb.ActionLog) {
 	}
 }
 
+// collect reports al to collector, nil collector drops it
+func collect(collector collectClient.Collector, al *tcppb.ActionLog) {
+	if collector != nil {
+		collector.Collect(al)
+	}
+}
+
 func newActionLogFromStoreReq(req *pb.StoreReq) *tcppb.ActionLog {
 	return &tcppb.ActionLog{Type: 1,
 		Ticket:    req.Ticket,
@@ -55,22 +62,43 @@ func newActionLogFromRetrieveReq(req *pb.RetrieveReq) *tcppb.ActionLog {
 func Ping(client pb.ProviderServiceClient) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	_, err := client.Ping(ctx, &pb.PingReq{})
+	return PingContext(ctx, client)
+}
+
+// PingContext test connectivity, ping is aborted when ctx is done
+func PingContext(ctx context.Context, client pb.ProviderServiceClient) error {
+	_, err := client.Ping(ctx, &pb.PingReq{Version: common.Version})
 	return err
 }
 
 // StorePiece store blocks to privider
-func StorePiece(log logrus.FieldLogger, client pb.ProviderServiceClient, uploadPara *common.UploadParameter, auth []byte, ticket string, tm uint64, pm *common.ProgressManager) error {
-	fileInfo := uploadPara.HF
-	filePath := fileInfo.FileName
-	fileSize := uint64(fileInfo.FileSize)
-	file, err := os.Open(filePath)
+func StorePiece(log logrus.FieldLogger, client pb.ProviderServiceClient, collector collectClient.Collector, uploadPara *common.UploadParameter, auth []byte, ticket string, tm uint64, pm *common.ProgressManager) error {
+	return StorePieceContext(context.Background(), log, client, collector, uploadPara, auth, ticket, tm, pm)
+}
+
+// StorePieceContext store blocks to privider, storing is aborted when ctx is done
+func StorePieceContext(ctx context.Context, log logrus.FieldLogger, client pb.ProviderServiceClient, collector collectClient.Collector, uploadPara *common.UploadParameter, auth []byte, ticket string, tm uint64, pm *common.ProgressManager) error {
+	file, err := os.Open(uploadPara.HF.FileName)
 	if err != nil {
 		log.Errorf("open file failed: %s", err.Error())
 		return err
 	}
 	defer file.Close()
-	realfile, ok := pm.PartitionToOriginMap[filePath]
+	return StorePieceReaderContext(ctx, log, client, collector, uploadPara, file, auth, ticket, tm, pm)
+}
+
+// StorePieceReader store block read from reader to provider, uploadPara.HF.FileName only identifies the block in progress map
+func StorePieceReader(log logrus.FieldLogger, client pb.ProviderServiceClient, collector collectClient.Collector, uploadPara *common.UploadParameter, reader io.Reader, auth []byte, ticket string, tm uint64, pm *common.ProgressManager) error {
+	return StorePieceReaderContext(context.Background(), log, client, collector, uploadPara, reader, auth, ticket, tm, pm)
+}
+
+// StorePieceReaderContext is StorePieceReader which is aborted when ctx is done
+func StorePieceReaderContext(ctx context.Context, log logrus.FieldLogger, client pb.ProviderServiceClient, collector collectClient.Collector, uploadPara *common.UploadParameter, reader io.Reader, auth []byte, ticket string, tm uint64, pm *common.ProgressManager) error {
+	var err error
+	fileInfo := uploadPara.HF
+	filePath := fileInfo.FileName
+	fileSize := uint64(fileInfo.FileSize)
+	realfile, ok := pm.Origin(filePath)
 	if !ok {
 		log.Errorf("file %s not in reverse partition map", filePath)
 	}
@@ -83,15 +111,15 @@ func StorePiece(log logrus.FieldLogger, client pb.ProviderServiceClient, uploadP
 		BlockKey:  fileInfo.FileHash,
 		BlockSize: fileSize}
 	al := newActionLogFromStoreReq(req)
-	defer collectClient.Collect(al)
+	defer collect(collector, al)
 	if fileSize < smallFileSize {
-		req.Data, err = ioutil.ReadAll(file)
+		req.Data, err = ioutil.ReadAll(reader)
 		if err != nil {
 			SetActionLog(err, al)
 			return err
 		}
 		al.TransportSize = uint64(len(req.Data))
-		resp, err := client.StoreSmall(context.Background(), req)
+		resp, err := client.StoreSmall(ctx, req)
 		if err != nil {
 			SetActionLog(err, al)
 			return err
@@ -111,7 +139,7 @@ func StorePiece(log logrus.FieldLogger, client pb.ProviderServiceClient, uploadP
 		return nil
 	}
 
-	stream, err := client.Store(context.Background())
+	stream, err := client.Store(ctx)
 	if err != nil {
 		log.Errorf("RPC Store failed: %s", err.Error())
 		SetActionLog(err, al)
@@ -121,11 +149,12 @@ func StorePiece(log logrus.FieldLogger, client pb.ProviderServiceClient, uploadP
 	buf := make([]byte, streamDataSize)
 	first := true
 	for {
-		bytesRead, err := file.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+		// a pipe may return less than buf before EOF, so read full buf
+		bytesRead, err := io.ReadFull(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
 			log.Errorf("read file failed: %s", err.Error())
 			SetActionLog(err, al)
 			return err
@@ -181,8 +210,24 @@ func StorePiece(log logrus.FieldLogger, client pb.ProviderServiceClient, uploadP
 }
 
 // Retrieve download file from provider piece by piece
-func Retrieve(log logrus.FieldLogger, client pb.ProviderServiceClient, filePath string, auth []byte, ticket string, tm uint64, fileKey, blockKey []byte, fileSize, blockSize uint64, pm *common.ProgressManager) error {
+func Retrieve(log logrus.FieldLogger, client pb.ProviderServiceClient, collector collectClient.Collector, filePath string, auth []byte, ticket string, tm uint64, fileKey, blockKey []byte, fileSize, blockSize uint64, pm *common.ProgressManager) error {
 	fileHashString := hex.EncodeToString(blockKey)
+	realfile, ok := pm.Origin(fileHashString)
+	if !ok {
+		log.Errorf("file %s not in reverse partition map", fileHashString)
+	}
+	return RetrieveContext(context.Background(), log, client, collector, filePath, auth, ticket, tm, fileKey, blockKey, fileSize, blockSize, func(n uint64) {
+		if realfile != "" {
+			if err := pm.SetIncrement(realfile, n); err != nil {
+				log.Errorf("file %s not in progress map", realfile)
+			}
+		}
+	})
+}
+
+// RetrieveContext download block to filePath, the transfer is aborted when ctx is done,
+// received reports the size of each piece written.
+func RetrieveContext(ctx context.Context, log logrus.FieldLogger, client pb.ProviderServiceClient, collector collectClient.Collector, filePath string, auth []byte, ticket string, tm uint64, fileKey, blockKey []byte, fileSize, blockSize uint64, received func(n uint64)) error {
 	file, err := os.OpenFile(filePath,
 		os.O_WRONLY|os.O_TRUNC|os.O_CREATE,
 		0666)
@@ -191,10 +236,6 @@ func Retrieve(log logrus.FieldLogger, client pb.ProviderServiceClient, filePath
 		return err
 	}
 	defer file.Close()
-	realfile, ok := pm.PartitionToOriginMap[fileHashString]
-	if !ok {
-		log.Errorf("file %s not in reverse partition map", fileHashString)
-	}
 	req := &pb.RetrieveReq{
 		Ticket:    ticket,
 		FileKey:   fileKey,
@@ -204,9 +245,9 @@ func Retrieve(log logrus.FieldLogger, client pb.ProviderServiceClient, filePath
 		BlockKey:  blockKey,
 		BlockSize: blockSize}
 	al := newActionLogFromRetrieveReq(req)
-	defer collectClient.Collect(al)
+	defer collect(collector, al)
 	if fileSize < smallFileSize {
-		resp, err := client.RetrieveSmall(context.Background(), req)
+		resp, err := client.RetrieveSmall(ctx, req)
 		if err != nil {
 			SetActionLog(err, al)
 			return err
@@ -216,14 +257,15 @@ func Retrieve(log logrus.FieldLogger, client pb.ProviderServiceClient, filePath
 			log.Errorf("write file %d bytes failed : %s", len(resp.Data), err.Error())
 			return err
 		}
-		if realfile != "" {
-			if err := pm.SetIncrement(realfile, uint64(len(resp.Data))); err != nil {
-				log.Errorf("file %s not in progress map", realfile)
-			}
-		}
+		received(uint64(len(resp.Data)))
 		return nil
 	}
-	stream, err := client.Retrieve(context.Background(), req)
+	stream, err := client.Retrieve(ctx, req)
+	if err != nil {
+		log.Errorf("RPC Retrieve failed: %s", err.Error())
+		SetActionLog(err, al)
+		return err
+	}
 	for {
 		resp, err := stream.Recv()
 		if err == io.EOF {
@@ -237,11 +279,7 @@ func Retrieve(log logrus.FieldLogger, client pb.ProviderServiceClient, filePath
 		if len(resp.Data) == 0 {
 			break
 		}
-		if realfile != "" {
-			if err := pm.SetIncrement(realfile, uint64(len(resp.Data))); err != nil {
-				log.Errorf("file %s not in progress map", realfile)
-			}
-		}
+		received(uint64(len(resp.Data)))
 		if _, err = file.Write(resp.Data); err != nil {
 			log.Errorf("write file %d bytes failed : %s", len(resp.Data), err.Error())
 			return err
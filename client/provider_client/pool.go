@@ -0,0 +1,216 @@
+package provider_client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/samoslab/nebula/provider/pb"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+)
+
+// ErrPoolClosed returned when getting provider from closed pool
+var ErrPoolClosed = errors.New("provider pool closed")
+
+// PoolConfig configures provider connection pool
+type PoolConfig struct {
+	// IdleTimeout connection not used for IdleTimeout is closed
+	IdleTimeout time.Duration
+	// HealthInterval idle connections are pinged every HealthInterval, connection failed is closed
+	HealthInterval time.Duration
+	// HealthTimeout timeout of health check ping, 0 disables ping
+	HealthTimeout time.Duration
+	// KeepaliveTime and KeepaliveTimeout are keepalive parameters of connections,
+	// providers reject pings more frequent than 5 minutes by default
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// MaxPerProvider max concurrent clients of one provider, 0 is unlimited
+	MaxPerProvider int
+}
+
+// DefaultPoolConfig default config of provider connection pool
+var DefaultPoolConfig = PoolConfig{
+	IdleTimeout:      90 * time.Second,
+	HealthInterval:   30 * time.Second,
+	HealthTimeout:    5 * time.Second,
+	KeepaliveTime:    5 * time.Minute,
+	KeepaliveTimeout: 20 * time.Second,
+	MaxPerProvider:   8,
+}
+
+type poolConn struct {
+	conn     *grpc.ClientConn
+	client   pb.ProviderServiceClient
+	slots    chan struct{}
+	inUse    int
+	lastUsed time.Time
+}
+
+// Pool shares one connection per provider server:port between concurrent transfers
+type Pool struct {
+	log    logrus.FieldLogger
+	cfg    PoolConfig
+	mutex  sync.Mutex
+	conns  map[string]*poolConn
+	closed bool
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// NewPool creates provider connection pool, Close stops its health check
+func NewPool(log logrus.FieldLogger, cfg PoolConfig) *Pool {
+	p := &Pool{
+		log:   log,
+		cfg:   cfg,
+		conns: map[string]*poolConn{},
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Provider returns client of provider at addr, it waits while MaxPerProvider clients of addr are in use.
+// release must be called once the client is not used.
+func (p *Pool) Provider(ctx context.Context, addr string) (pb.ProviderServiceClient, func(), error) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, nil, ErrPoolClosed
+	}
+	pc, ok := p.conns[addr]
+	if !ok {
+		conn, err := p.dial(addr)
+		if err != nil {
+			p.mutex.Unlock()
+			return nil, nil, err
+		}
+		pc = &poolConn{conn: conn, client: pb.NewProviderServiceClient(conn)}
+		if p.cfg.MaxPerProvider > 0 {
+			pc.slots = make(chan struct{}, p.cfg.MaxPerProvider)
+		}
+		p.conns[addr] = pc
+	}
+	pc.inUse++
+	p.mutex.Unlock()
+
+	if pc.slots != nil {
+		select {
+		case pc.slots <- struct{}{}:
+		case <-ctx.Done():
+			p.put(pc)
+			return nil, nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	return pc.client, func() {
+		once.Do(func() {
+			if pc.slots != nil {
+				<-pc.slots
+			}
+			p.put(pc)
+		})
+	}, nil
+}
+
+func (p *Pool) dial(addr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(addr, grpc.WithInsecure(), grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:    p.cfg.KeepaliveTime,
+		Timeout: p.cfg.KeepaliveTimeout,
+	}))
+}
+
+func (p *Pool) put(pc *poolConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pc.inUse--
+	pc.lastUsed = time.Now()
+}
+
+// Len returns number of open connections
+func (p *Pool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.conns)
+}
+
+// Close closes all connections, clients in use fail
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	for addr, pc := range p.conns {
+		pc.conn.Close()
+		delete(p.conns, addr)
+	}
+	p.mutex.Unlock()
+	close(p.quit)
+	<-p.done
+	return nil
+}
+
+func (p *Pool) run() {
+	defer close(p.done)
+	if p.cfg.HealthInterval <= 0 {
+		<-p.quit
+		return
+	}
+	ticker := time.NewTicker(p.cfg.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// check closes connections idle too long, broken or failing ping, they are dialed again when needed
+func (p *Pool) check() {
+	now := time.Now()
+	idle := map[string]*poolConn{}
+	p.mutex.Lock()
+	for addr, pc := range p.conns {
+		if pc.inUse > 0 {
+			continue
+		}
+		state := pc.conn.GetState()
+		if p.cfg.IdleTimeout > 0 && now.Sub(pc.lastUsed) >= p.cfg.IdleTimeout ||
+			state == connectivity.TransientFailure || state == connectivity.Shutdown {
+			p.log.Debugf("Close provider connection %s state %s", addr, state)
+			pc.conn.Close()
+			delete(p.conns, addr)
+			continue
+		}
+		idle[addr] = pc
+	}
+	p.mutex.Unlock()
+	if p.cfg.HealthTimeout <= 0 {
+		return
+	}
+
+	for addr, pc := range idle {
+		ctx, cancel := context.WithTimeout(context.Background(), p.cfg.HealthTimeout)
+		err := PingContext(ctx, pc.client)
+		cancel()
+		if err == nil {
+			continue
+		}
+		p.log.Infof("Provider %s health check failed: %v", addr, err)
+		p.mutex.Lock()
+		if p.conns[addr] == pc && pc.inUse == 0 {
+			pc.conn.Close()
+			delete(p.conns, addr)
+		}
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,107 @@
+package provider_client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/samoslab/nebula/provider/pb"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type pingServer struct {
+	pb.ProviderServiceServer
+}
+
+func (pingServer) Ping(ctx context.Context, req *pb.PingReq) (*pb.PingResp, error) {
+	return &pb.PingResp{}, nil
+}
+
+func startProvider(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	pb.RegisterProviderServiceServer(s, pingServer{})
+	go s.Serve(l)
+	return l.Addr().String(), s.Stop
+}
+
+func waitLen(p *Pool, n int) int {
+	for i := 0; i < 100 && p.Len() != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return p.Len()
+}
+
+func TestPool(t *testing.T) {
+	addr, stop := startProvider(t)
+	defer stop()
+	cfg := DefaultPoolConfig
+	cfg.MaxPerProvider = 2
+	p := NewPool(logrus.New(), cfg)
+	defer p.Close()
+	ctx := context.Background()
+
+	// clients of one provider share connection
+	c1, release1, err := p.Provider(ctx, addr)
+	require.NoError(t, err)
+	c2, release2, err := p.Provider(ctx, addr)
+	require.NoError(t, err)
+	require.NoError(t, PingContext(ctx, c1))
+	require.NoError(t, PingContext(ctx, c2))
+	require.Equal(t, 1, p.Len())
+
+	// third client waits for a free slot
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, _, err = p.Provider(waitCtx, addr)
+	cancel()
+	require.Equal(t, context.DeadlineExceeded, err)
+	got := make(chan error)
+	go func() {
+		_, release, err := p.Provider(ctx, addr)
+		if err == nil {
+			release()
+		}
+		got <- err
+	}()
+	release1()
+	release1()
+	require.NoError(t, <-got)
+	release2()
+
+	require.NoError(t, p.Close())
+	_, _, err = p.Provider(ctx, addr)
+	require.Equal(t, ErrPoolClosed, err)
+}
+
+func TestPoolCheck(t *testing.T) {
+	addr, stop := startProvider(t)
+	defer stop()
+	ctx := context.Background()
+
+	// idle connection is closed
+	p := NewPool(logrus.New(), PoolConfig{IdleTimeout: 50 * time.Millisecond, HealthInterval: 20 * time.Millisecond, HealthTimeout: time.Second})
+	defer p.Close()
+	c, release, err := p.Provider(ctx, addr)
+	require.NoError(t, err)
+	require.NoError(t, PingContext(ctx, c))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, p.Len(), "connection in use is kept")
+	release()
+	require.Equal(t, 0, waitLen(p, 0))
+
+	// connection to stopped provider is closed by health check
+	p2 := NewPool(logrus.New(), PoolConfig{IdleTimeout: time.Hour, HealthInterval: 20 * time.Millisecond, HealthTimeout: 100 * time.Millisecond})
+	defer p2.Close()
+	c, release, err = p2.Provider(ctx, addr)
+	require.NoError(t, err)
+	require.NoError(t, PingContext(ctx, c))
+	release()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, p2.Len(), "healthy connection is kept")
+	stop()
+	require.Equal(t, 0, waitLen(p2, 0))
+}
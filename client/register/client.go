@@ -8,20 +8,16 @@ import (
 	"os"
 	"time"
 
-	"google.golang.org/grpc"
-
 	"github.com/samoslab/nebula/client/common"
 	"github.com/samoslab/nebula/client/config"
 	"github.com/samoslab/nebula/provider/node"
 	pb "github.com/samoslab/nebula/tracker/register/client/pb"
-	regpb "github.com/samoslab/nebula/tracker/register/client/pb"
 	"github.com/samoslab/nebula/util/aes"
 	rsalong "github.com/samoslab/nebula/util/rsa"
 	"github.com/sirupsen/logrus"
 )
 
-func doGetPubkey(registClient pb.ClientRegisterServiceClient) ([]byte, []byte, error) {
-	ctx := context.Background()
+func doGetPubkey(ctx context.Context, registClient pb.ClientRegisterServiceClient) ([]byte, []byte, error) {
 	getPublicKeyReq := pb.GetPublicKeyReq{
 		Version: common.Version,
 	}
@@ -37,7 +33,7 @@ func doGetPubkey(registClient pb.ClientRegisterServiceClient) ([]byte, []byte, e
 // DoRegister register client
 func DoRegister(registClient pb.ClientRegisterServiceClient, cfg *config.ClientConfig) (*pb.RegisterResp, error) {
 	ctx := context.Background()
-	pubkey, publicKeyHash, err := doGetPubkey(registClient)
+	pubkey, publicKeyHash, err := doGetPubkey(ctx, registClient)
 	if err != nil {
 		return nil, err
 	}
@@ -108,17 +104,8 @@ func resendVerifyCode(client pb.ClientRegisterServiceClient, node *node.Node) (s
 	return resp.Success, nil
 }
 
-// RegisterClient register client info to tracker
-func RegisterClient(log logrus.FieldLogger, configFile, trackerServer, emailAddress string) error {
-	conn, err := grpc.Dial(trackerServer, grpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("Rpc dial failed: %s", err.Error())
-		return err
-	}
-	defer conn.Close()
-
-	registerClient := regpb.NewClientRegisterServiceClient(conn)
-
+// RegisterClient register client info to tracker by registerClient
+func RegisterClient(log logrus.FieldLogger, registerClient pb.ClientRegisterServiceClient, configFile, emailAddress string) error {
 	cc, err := config.LoadConfig(configFile)
 	if err != nil {
 		log.Errorf("Load config error %v", err)
@@ -157,8 +144,8 @@ func RegisterClient(log logrus.FieldLogger, configFile, trackerServer, emailAddr
 	return nil
 }
 
-// VerifyEmail verify email
-func VerifyEmail(configFile string, trackerServer string, verifyCode string) error {
+// VerifyEmail verify email by registerClient
+func VerifyEmail(registerClient pb.ClientRegisterServiceClient, configFile string, verifyCode string) error {
 	cc, err := config.LoadConfig(configFile)
 	if err != nil {
 		if err == config.ErrNoConf {
@@ -175,13 +162,6 @@ func VerifyEmail(configFile string, trackerServer string, verifyCode string) err
 		fmt.Printf("verifyCode is required.\n")
 		os.Exit(9)
 	}
-	conn, err := grpc.Dial(trackerServer, grpc.WithInsecure())
-	if err != nil {
-		fmt.Printf("RPC Dial failed: %s\n", err.Error())
-		return err
-	}
-	defer conn.Close()
-	registerClient := regpb.NewClientRegisterServiceClient(conn)
 	code, errMsg, err := VerifyContactEmail(registerClient, verifyCode, cc.Node)
 	if err != nil {
 		fmt.Printf("verifyEmail failed: %s\n", err.Error())
@@ -195,8 +175,8 @@ func VerifyEmail(configFile string, trackerServer string, verifyCode string) err
 	return nil
 }
 
-// ResendVerifyCode send verify code again
-func ResendVerifyCode(configFile string, trackerServer string) error {
+// ResendVerifyCode send verify code again by registerClient
+func ResendVerifyCode(registerClient pb.ClientRegisterServiceClient, configFile string) error {
 	cc, err := config.LoadConfig(configFile)
 	if err != nil {
 		if err == config.ErrNoConf {
@@ -209,14 +189,7 @@ func ResendVerifyCode(configFile string, trackerServer string) error {
 		fmt.Println("failed to load config, can not resend verify code email: " + err.Error())
 		return err
 	}
-	conn, err := grpc.Dial(trackerServer, grpc.WithInsecure())
-	if err != nil {
-		fmt.Printf("RPC Dial failed: %s\n", err.Error())
-		return err
-	}
-	defer conn.Close()
-	crsc := regpb.NewClientRegisterServiceClient(conn)
-	success, err := resendVerifyCode(crsc, cc.Node)
+	success, err := resendVerifyCode(registerClient, cc.Node)
 	if err != nil {
 		fmt.Printf("resendVerifyCode failed: %s\n", err.Error())
 		return err
@@ -230,15 +203,9 @@ func ResendVerifyCode(configFile string, trackerServer string) error {
 	return nil
 }
 
-func GetPublicKey(trackerServer string) (*rsa.PublicKey, []byte, error) {
-	conn, err := grpc.Dial(trackerServer, grpc.WithInsecure())
-	if err != nil {
-		fmt.Printf("Rpc dial failed: %s\n", err.Error())
-		return nil, nil, err
-	}
-	defer conn.Close()
-	registClient := regpb.NewClientRegisterServiceClient(conn)
-	pubkey, pubkeyHash, err := doGetPubkey(registClient)
+// GetPublicKeyContext returns tracker public key and its hash by registClient
+func GetPublicKeyContext(ctx context.Context, registClient pb.ClientRegisterServiceClient) (*rsa.PublicKey, []byte, error) {
+	pubkey, pubkeyHash, err := doGetPubkey(ctx, registClient)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -246,6 +213,5 @@ func GetPublicKey(trackerServer string) (*rsa.PublicKey, []byte, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-
-	return rsaPubkey, pubkeyHash, err
+	return rsaPubkey, pubkeyHash, nil
 }
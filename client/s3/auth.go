@@ -0,0 +1,375 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm    = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// streaming payloads of SDKs sending checksum trailers
+	streamingPayloadTrailer = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsigned       = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256             = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxClockSkew            = 15 * time.Minute
+	maxPresignExpires       = 7 * 24 * 3600
+)
+
+// credential of a signed request
+type credential struct {
+	accessKey string
+	date      string
+	region    string
+	service   string
+}
+
+func (c credential) scope() string {
+	return strings.Join([]string{c.date, c.region, c.service, "aws4_request"}, "/")
+}
+
+func parseCredential(value string) (credential, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return credential{}, errAuthorizationMalformed
+	}
+	return credential{accessKey: parts[0], date: parts[1], region: parts[2], service: parts[3]}, nil
+}
+
+// signature of a verified request, streaming payload chunks are signed from it
+type signature struct {
+	cred    credential
+	amzDate string
+	seed    string
+	key     []byte
+}
+
+// uriEncode encodes s as SigV4 requires, slash is kept in path
+func uriEncode(s string, path bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if k != "X-Amz-Signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(r *http.Request, signed []string) string {
+	var buf bytes.Buffer
+	for _, name := range signed {
+		var values []string
+		if name == "host" {
+			values = []string{r.Host}
+		} else {
+			values = append([]string{}, r.Header[http.CanonicalHeaderKey(name)]...)
+		}
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		buf.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return buf.String()
+}
+
+func canonicalRequest(r *http.Request, query url.Values, signed []string, payloadHash string) string {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(path, true),
+		canonicalQuery(query),
+		canonicalHeaders(r, signed),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func signingKey(secret string, cred credential) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), cred.date)
+	key = hmacSHA256(key, cred.region)
+	key = hmacSHA256(key, cred.service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func stringToSign(amzDate string, cred credential, canonical string) string {
+	return strings.Join([]string{signAlgorithm, amzDate, cred.scope(), sha256Hex([]byte(canonical))}, "\n")
+}
+
+// authenticator verifies SigV4 signature of requests by the only key pair of gateway
+type authenticator struct {
+	accessKey string
+	secretKey string
+	now       func() time.Time
+}
+
+// verify checks signature in Authorization header or presigned query
+func (a *authenticator) verify(r *http.Request) (*signature, error) {
+	query := r.URL.Query()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return a.verifyHeader(r, query, auth)
+	}
+	if query.Get("X-Amz-Algorithm") != "" {
+		return a.verifyQuery(r, query)
+	}
+	return nil, errAccessDenied
+}
+
+func (a *authenticator) verifyHeader(r *http.Request, query url.Values, auth string) (*signature, error) {
+	if !strings.HasPrefix(auth, signAlgorithm+" ") {
+		return nil, errAuthorizationMalformed
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, signAlgorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	cred, err := parseCredential(fields["Credential"])
+	if err != nil {
+		return nil, err
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		amzDate = r.Header.Get("Date")
+	}
+	t, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return nil, errAuthorizationMalformed
+	}
+	if d := a.now().Sub(t); d > maxClockSkew || d < -maxClockSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return nil, errAuthorizationMalformed
+	}
+	return a.check(r, query, cred, amzDate, strings.Split(fields["SignedHeaders"], ";"), payloadHash, fields["Signature"])
+}
+
+func (a *authenticator) verifyQuery(r *http.Request, query url.Values) (*signature, error) {
+	if query.Get("X-Amz-Algorithm") != signAlgorithm {
+		return nil, errAuthorizationMalformed
+	}
+	cred, err := parseCredential(query.Get("X-Amz-Credential"))
+	if err != nil {
+		return nil, err
+	}
+	amzDate := query.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return nil, errAuthorizationMalformed
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || expires > maxPresignExpires {
+		return nil, errAuthorizationMalformed
+	}
+	now := a.now()
+	if now.Before(t.Add(-maxClockSkew)) || now.After(t.Add(time.Duration(expires)*time.Second)) {
+		return nil, errExpiredToken
+	}
+	return a.check(r, query, cred, amzDate, strings.Split(query.Get("X-Amz-SignedHeaders"), ";"), unsignedPayload, query.Get("X-Amz-Signature"))
+}
+
+func (a *authenticator) check(r *http.Request, query url.Values, cred credential, amzDate string, signed []string, payloadHash, sig string) (*signature, error) {
+	if cred.accessKey != a.accessKey {
+		return nil, errInvalidAccessKeyID
+	}
+	if !strings.HasPrefix(amzDate, cred.date) {
+		return nil, errAuthorizationMalformed
+	}
+	hasHost := false
+	for _, name := range signed {
+		if name == "host" {
+			hasHost = true
+		}
+	}
+	if !hasHost {
+		return nil, errAuthorizationMalformed
+	}
+	key := signingKey(a.secretKey, cred)
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign(amzDate, cred, canonicalRequest(r, query, signed, payloadHash))))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) != 1 {
+		return nil, errSignatureDoesNotMatch
+	}
+	return &signature{cred: cred, amzDate: amzDate, seed: sig, key: key}, nil
+}
+
+// payloadReader returns reader of decoded request body, the body is checked against signed payload hash while read
+func payloadReader(r *http.Request, sig *signature) (io.Reader, error) {
+	switch payloadHash := r.Header.Get("X-Amz-Content-Sha256"); payloadHash {
+	case "", unsignedPayload:
+		return r.Body, nil
+	case streamingPayload, streamingPayloadTrailer:
+		return newChunkedReader(r.Body, sig), nil
+	case streamingUnsigned:
+		return newChunkedReader(r.Body, nil), nil
+	default:
+		expected, err := hex.DecodeString(payloadHash)
+		if err != nil || len(expected) != sha256.Size {
+			return nil, errInvalidDigest
+		}
+		return &hashReader{r: r.Body, hash: sha256.New(), expected: expected}, nil
+	}
+}
+
+// hashReader fails at EOF if hash of data read is not expected
+type hashReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected []byte
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(h.hash.Sum(nil), h.expected) {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes aws-chunked body, signature of every chunk is checked if sig is not nil
+type chunkedReader struct {
+	r       *bufio.Reader
+	sig     *signature
+	prev    string
+	chunk   []byte
+	pending []byte
+	done    bool
+}
+
+func newChunkedReader(r io.Reader, sig *signature) *chunkedReader {
+	c := &chunkedReader{r: bufio.NewReader(r), sig: sig}
+	if sig != nil {
+		c.prev = sig.seed
+	}
+	return c
+}
+
+// maxChunkSize bytes of a chunk read into memory
+const maxChunkSize = 16 << 20
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *chunkedReader) next() error {
+	header, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(header, ";", 2)
+	size, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errIncompleteBody
+	}
+	if cap(c.chunk) < int(size) {
+		c.chunk = make([]byte, size)
+	}
+	c.chunk = c.chunk[:size]
+	if _, err := io.ReadFull(c.r, c.chunk); err != nil {
+		return errIncompleteBody
+	}
+	if c.sig != nil {
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "chunk-signature=") {
+			return errSignatureDoesNotMatch
+		}
+		toSign := strings.Join([]string{signAlgorithm + "-PAYLOAD", c.sig.amzDate, c.sig.cred.scope(), c.prev, emptySHA256, sha256Hex(c.chunk)}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(c.sig.key, toSign))
+		got := strings.TrimPrefix(parts[1], "chunk-signature=")
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(got)) != 1 {
+			return errSignatureDoesNotMatch
+		}
+		c.prev = expected
+	}
+	if size == 0 {
+		// trailing headers such as checksum end with an empty line
+		for {
+			line, err := c.readLine()
+			if err != nil || line == "" {
+				break
+			}
+		}
+		c.done = true
+		return nil
+	}
+	// data is followed by CRLF
+	if _, err := c.readLine(); err != nil {
+		return errIncompleteBody
+	}
+	c.pending = c.chunk
+	return nil
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
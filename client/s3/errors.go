@@ -0,0 +1,60 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+// apiError error of S3 API, it is written as xml error response
+type apiError struct {
+	code    string
+	message string
+	status  int
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+var (
+	errAccessDenied           = &apiError{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errAuthorizationMalformed = &apiError{"AuthorizationHeaderMalformed", "The authorization is malformed", http.StatusBadRequest}
+	errInvalidAccessKeyID     = &apiError{"InvalidAccessKeyId", "The access key Id you provided does not exist", http.StatusForbidden}
+	errSignatureDoesNotMatch  = &apiError{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided", http.StatusForbidden}
+	errRequestTimeTooSkewed   = &apiError{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+	errExpiredToken           = &apiError{"AccessDenied", "Request has expired", http.StatusForbidden}
+	errInvalidDigest          = &apiError{"InvalidDigest", "The digest you specified is not valid", http.StatusBadRequest}
+	errBadDigest              = &apiError{"BadDigest", "The Content-MD5 you specified did not match what we received", http.StatusBadRequest}
+	errContentSHA256Mismatch  = &apiError{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed", http.StatusBadRequest}
+	errIncompleteBody         = &apiError{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header", http.StatusBadRequest}
+	errNoSuchBucket           = &apiError{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound}
+	errNoSuchKey              = &apiError{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	errNoSuchUpload           = &apiError{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+	errInvalidPart            = &apiError{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	errInvalidPartOrder       = &apiError{"InvalidPartOrder", "The list of parts was not in ascending order", http.StatusBadRequest}
+	errInvalidBucketName      = &apiError{"InvalidBucketName", "The specified bucket is not valid", http.StatusBadRequest}
+	errBucketNotEmpty         = &apiError{"BucketNotEmpty", "The bucket you tried to delete is not empty", http.StatusConflict}
+	errBucketAlreadyOwned     = &apiError{"BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it", http.StatusConflict}
+	errInvalidArgument        = &apiError{"InvalidArgument", "Invalid Argument", http.StatusBadRequest}
+	errInvalidRequest         = &apiError{"InvalidRequest", "The request is not valid", http.StatusBadRequest}
+	errMalformedXML           = &apiError{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	errKeyConflict            = &apiError{"InvalidRequest", "An object and a folder can not have the same name", http.StatusConflict}
+	errNotImplemented         = &apiError{"NotImplemented", "A header or query you provided implies functionality that is not implemented", http.StatusNotImplemented}
+	errMethodNotAllowed       = &apiError{"MethodNotAllowed", "The specified method is not allowed against this resource", http.StatusMethodNotAllowed}
+	errInternal               = &apiError{"InternalError", "We encountered an internal error, please try again", http.StatusInternalServerError}
+)
+
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// toAPIError returns api error of err, errors other than api error are internal errors
+func toAPIError(err error) *apiError {
+	if e, ok := err.(*apiError); ok {
+		return e
+	}
+	return errInternal
+}
@@ -0,0 +1,707 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samoslab/nebula/client/daemon"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// spaceBucket prefix of buckets of whole spaces, bucket space1 is the root folder of space 1
+	spaceBucket = "space"
+	// maxKeyLength max length of object key
+	maxKeyLength = 1024
+	// maxXMLBody max size of xml request body
+	maxXMLBody = 1 << 20
+	timeFormat = "2006-01-02T15:04:05.000Z"
+	s3Xmlns    = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+// Remote net disk operations the gateway needs, *daemon.ClientManager implements it
+type Remote interface {
+	ListFolder(path string, sno uint32) ([]*daemon.DownFile, error)
+	UploadFile(fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error
+	OpenFile(ctx context.Context, fileName, fileHash string, fileSize uint64, sno uint32) (daemon.File, error)
+	MkFolder(filepath string, folders []string, interactive bool, sno uint32) (bool, error)
+	RemoveFile(target string, recursive bool, isPath bool, sno uint32) error
+}
+
+// Gateway S3 API of net disk, requests must be path style and signed by SigV4.
+// Bucket spaceN is space N, other buckets are top level folders of the default space.
+type Gateway struct {
+	remote    Remote
+	spaces    uint32
+	space     uint32
+	tempDir   string
+	isEncrypt bool
+	auth      *authenticator
+	log       logrus.FieldLogger
+}
+
+// NewGateway returns gateway of spaces 0 to spaces-1, buckets of folders are in space,
+// objects are uploaded through tempDir and encrypted if isEncrypt
+func NewGateway(log logrus.FieldLogger, remote Remote, spaces, space uint32, tempDir string, isEncrypt bool, accessKey, secretKey string) (*Gateway, error) {
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("s3 access key and secret key must not empty")
+	}
+	if space >= spaces {
+		return nil, fmt.Errorf("space %d not exists", space)
+	}
+	return &Gateway{
+		remote:    remote,
+		spaces:    spaces,
+		space:     space,
+		tempDir:   tempDir,
+		isEncrypt: isEncrypt,
+		auth:      &authenticator{accessKey: accessKey, secretKey: secretKey, now: time.Now},
+		log:       log,
+	}, nil
+}
+
+// bucket space and folder of a bucket
+type bucket struct {
+	name string
+	sno  uint32
+	root string
+}
+
+func validBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		alnum := (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+		if !alnum && ((c != '.' && c != '-') || i == 0 || i == len(name)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// spaceNo returns space of bucket name spaceN
+func spaceNo(name string) (uint32, bool) {
+	no := strings.TrimPrefix(name, spaceBucket)
+	n, err := strconv.ParseUint(no, 10, 32)
+	if !strings.HasPrefix(name, spaceBucket) || err != nil || strconv.FormatUint(n, 10) != no {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+func (g *Gateway) bucket(name string) (bucket, error) {
+	if no, ok := spaceNo(name); ok {
+		if no >= g.spaces {
+			return bucket{}, errNoSuchBucket
+		}
+		return bucket{name: name, sno: no, root: "/"}, nil
+	}
+	if !validBucketName(name) {
+		return bucket{}, errInvalidBucketName
+	}
+	return bucket{name: name, sno: g.space, root: "/" + name}, nil
+}
+
+// checkBucket returns errNoSuchBucket if folder of bucket not exists
+func (g *Gateway) checkBucket(b bucket) error {
+	file, err := g.stat(b.sno, b.root)
+	if err == errNoSuchKey || (err == nil && !file.Folder) {
+		return errNoSuchBucket
+	}
+	return err
+}
+
+// object returns path of key, key ending with slash is a folder
+func (b bucket) object(key string) (string, bool, error) {
+	folder := strings.HasSuffix(key, "/")
+	name := strings.TrimSuffix(key, "/")
+	if name == "" || len(key) > maxKeyLength {
+		return "", false, errInvalidArgument
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", false, errInvalidArgument
+		}
+	}
+	p := path.Join(b.root, name)
+	// sys file of space keeps space key, it is not a file of user
+	if p == "/"+daemon.SysFile {
+		return "", false, errAccessDenied
+	}
+	return p, folder, nil
+}
+
+// list returns all files of folder dir of space sno
+func (g *Gateway) list(sno uint32, dir string) ([]*daemon.DownFile, error) {
+	return g.remote.ListFolder(dir, sno)
+}
+
+// stat returns file of path p, errNoSuchKey if it not exists
+func (g *Gateway) stat(sno uint32, p string) (*daemon.DownFile, error) {
+	if p == "/" {
+		return &daemon.DownFile{FileName: "/", Folder: true}, nil
+	}
+	dir, name := path.Split(p)
+	dir = path.Clean(dir)
+	files, err := g.list(sno, dir)
+	if err != nil {
+		// listing of a folder not exists fails
+		if parent, perr := g.stat(sno, dir); perr == errNoSuchKey || (perr == nil && !parent.Folder) {
+			return nil, errNoSuchKey
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if file.FileName == name {
+			return file, nil
+		}
+	}
+	return nil, errNoSuchKey
+}
+
+// mkdirAll makes folder p and its parents
+func (g *Gateway) mkdirAll(sno uint32, p string) error {
+	file, err := g.stat(sno, p)
+	if err == nil {
+		if !file.Folder {
+			return errKeyConflict
+		}
+		return nil
+	}
+	if err != errNoSuchKey {
+		return err
+	}
+	if err := g.mkdirAll(sno, path.Dir(p)); err != nil {
+		return err
+	}
+	_, err = g.remote.MkFolder(path.Dir(p), []string{path.Base(p)}, false, sno)
+	return err
+}
+
+// receive writes r into a temp file of name, caller removes the temp folder returned
+func (g *Gateway) receive(r io.Reader, name string) (string, string, []byte, error) {
+	tempDir, err := ioutil.TempDir(g.tempDir, "s3")
+	if err != nil {
+		return "", "", nil, err
+	}
+	fileName := filepath.Join(tempDir, name)
+	sum, err := writeFile(fileName, r)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", "", nil, err
+	}
+	return tempDir, fileName, sum, nil
+}
+
+// writeFile writes r into fileName and returns md5 of it
+func writeFile(fileName string, r io.Reader) ([]byte, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// upload uploads fileName as new version of path p, its folders are made if not exist
+func (g *Gateway) upload(sno uint32, p, fileName string) error {
+	if file, err := g.stat(sno, p); err == nil && file.Folder {
+		return errKeyConflict
+	}
+	dir := path.Dir(p)
+	if err := g.mkdirAll(sno, dir); err != nil {
+		return err
+	}
+	g.log.Infof("S3 upload %s to space %d %s", filepath.Base(fileName), sno, dir)
+	return g.remote.UploadFile(fileName, dir, false, true, g.isEncrypt, sno)
+}
+
+// open returns content of file of path p, it is retrieved by ranges read until ctx is done
+func (g *Gateway) open(ctx context.Context, sno uint32, p string, file *daemon.DownFile) (daemon.File, error) {
+	g.log.Infof("S3 read space %d %s", sno, p)
+	return g.remote.OpenFile(ctx, p, file.FileHash, file.FileSize, sno)
+}
+
+// splitPath returns bucket and key of path style request path
+func splitPath(p string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sig, err := g.auth.verify(r)
+	if err == nil {
+		err = g.serve(w, r, sig)
+	}
+	if err != nil {
+		e := toAPIError(err)
+		if e == errInternal {
+			g.log.Errorf("S3 %s %s error %v", r.Method, r.URL.Path, err)
+		}
+		writeXML(w, e.status, errorResponse{Code: e.code, Message: e.message, Resource: r.URL.Path})
+	}
+}
+
+// serve routes request, nothing is written if error returned
+func (g *Gateway) serve(w http.ResponseWriter, r *http.Request, sig *signature) error {
+	name, key := splitPath(r.URL.Path)
+	query := r.URL.Query()
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+	if name == "" {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+		return g.listBuckets(w)
+	}
+	b, err := g.bucket(name)
+	if err != nil {
+		return err
+	}
+	if key == "" && r.Method == http.MethodPut {
+		return g.createBucket(w, b)
+	}
+	if err := g.checkBucket(b); err != nil {
+		return err
+	}
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			return nil
+		case http.MethodDelete:
+			return g.deleteBucket(w, b)
+		case http.MethodGet:
+			if _, ok := query["location"]; ok {
+				writeXML(w, http.StatusOK, locationConstraint{})
+				return nil
+			}
+			if query.Get("list-type") == "2" {
+				return g.listObjectsV2(w, r, b)
+			}
+			return errNotImplemented
+		case http.MethodPost:
+			if _, ok := query["delete"]; ok {
+				return g.deleteObjects(w, r, sig, b)
+			}
+			return errNotImplemented
+		}
+		return errMethodNotAllowed
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if uploadID != "" {
+			return errNotImplemented
+		}
+		return g.getObject(w, r, b, key)
+	case http.MethodPut:
+		if uploadID != "" {
+			if r.Header.Get("X-Amz-Copy-Source") != "" {
+				return errNotImplemented
+			}
+			return g.uploadPart(w, r, sig, b, key, uploadID)
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return g.copyObject(w, r, b, key)
+		}
+		return g.putObject(w, r, sig, b, key)
+	case http.MethodPost:
+		if uploads {
+			return g.createMultipartUpload(w, b, key)
+		}
+		if uploadID != "" {
+			return g.completeMultipartUpload(w, r, sig, b, key, uploadID)
+		}
+		return errNotImplemented
+	case http.MethodDelete:
+		if uploadID != "" {
+			return g.abortMultipartUpload(w, b, key, uploadID)
+		}
+		return g.deleteObject(w, b, key)
+	}
+	return errMethodNotAllowed
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// readXML decodes xml request body into v
+func readXML(r *http.Request, sig *signature, v interface{}) error {
+	body, err := payloadReader(r, sig)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxXMLBody))
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return errMalformedXML
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+func etag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// checkContentMD5 checks Content-MD5 header if it is set
+func checkContentMD5(r *http.Request, sum []byte) error {
+	value := r.Header.Get("Content-Md5")
+	if value == "" {
+		return nil
+	}
+	expected, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(expected) != md5.Size {
+		return errInvalidDigest
+	}
+	if hex.EncodeToString(expected) != hex.EncodeToString(sum) {
+		return errBadDigest
+	}
+	return nil
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucketInfo struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   owner        `xml:"Owner"`
+	Buckets []bucketInfo `xml:"Buckets>Bucket"`
+}
+
+type locationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+// listBuckets lists buckets of all spaces and top level folders of the default space
+func (g *Gateway) listBuckets(w http.ResponseWriter) error {
+	files, err := g.list(g.space, "/")
+	if err != nil {
+		return err
+	}
+	result := listAllMyBucketsResult{Owner: owner{ID: g.auth.accessKey, DisplayName: g.auth.accessKey}}
+	for sno := uint32(0); sno < g.spaces; sno++ {
+		result.Buckets = append(result.Buckets, bucketInfo{Name: spaceBucket + strconv.FormatUint(uint64(sno), 10), CreationDate: formatTime(time.Unix(0, 0))})
+	}
+	for _, file := range files {
+		if _, ok := spaceNo(file.FileName); file.Folder && !ok && validBucketName(file.FileName) {
+			result.Buckets = append(result.Buckets, bucketInfo{Name: file.FileName, CreationDate: formatTime(time.Unix(int64(file.ModTime), 0))})
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+// createBucket makes top level folder of the default space
+func (g *Gateway) createBucket(w http.ResponseWriter, b bucket) error {
+	if b.root == "/" {
+		return errBucketAlreadyOwned
+	}
+	file, err := g.stat(b.sno, b.root)
+	if err == nil {
+		if file.Folder {
+			return errBucketAlreadyOwned
+		}
+		return errKeyConflict
+	}
+	if err != errNoSuchKey {
+		return err
+	}
+	if _, err := g.remote.MkFolder("/", []string{b.name}, false, b.sno); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/"+b.name)
+	return nil
+}
+
+// deleteBucket removes empty folder of bucket, buckets of spaces can not be removed
+func (g *Gateway) deleteBucket(w http.ResponseWriter, b bucket) error {
+	if b.root == "/" {
+		return errMethodNotAllowed
+	}
+	files, err := g.list(b.sno, b.root)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return errBucketNotEmpty
+	}
+	if err := g.remote.RemoveFile(b.root, true, true, b.sno); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// getObject serves object with Range and conditional headers, object is not downloaded for HEAD
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, b bucket, key string) error {
+	p, folder, err := b.object(key)
+	if err != nil {
+		return err
+	}
+	file, err := g.stat(b.sno, p)
+	if err != nil {
+		return err
+	}
+	if file.Folder != folder {
+		return errNoSuchKey
+	}
+	var content io.ReadSeeker = strings.NewReader("")
+	if !folder {
+		f, err := g.open(r.Context(), b.sno, p, file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		content = f
+		w.Header().Set("ETag", `"`+file.FileHash+`"`)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, path.Base(p), time.Unix(int64(file.ModTime), 0), content)
+	return nil
+}
+
+// putObject uploads request body as object, key ending with slash makes folder
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, sig *signature, b bucket, key string) error {
+	p, folder, err := b.object(key)
+	if err != nil {
+		return err
+	}
+	body, err := payloadReader(r, sig)
+	if err != nil {
+		return err
+	}
+	if folder {
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return err
+		}
+		if err := g.mkdirAll(b.sno, p); err != nil {
+			return err
+		}
+		sum := md5.Sum(nil)
+		w.Header().Set("ETag", etag(sum[:]))
+		return nil
+	}
+	tempDir, fileName, sum, err := g.receive(body, path.Base(p))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	if err := checkContentMD5(r, sum); err != nil {
+		return err
+	}
+	if err := g.upload(b.sno, p, fileName); err != nil {
+		return err
+	}
+	// SDKs check etag of uploaded object against md5 of data
+	w.Header().Set("ETag", etag(sum))
+	return nil
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+// copyObject copies object of x-amz-copy-source by downloading and uploading it
+func (g *Gateway) copyObject(w http.ResponseWriter, r *http.Request, b bucket, key string) error {
+	source := r.Header.Get("X-Amz-Copy-Source")
+	if i := strings.Index(source, "?"); i >= 0 {
+		source = source[:i]
+	}
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		return errInvalidArgument
+	}
+	sourceName, sourceKey := splitPath(source)
+	sb, err := g.bucket(sourceName)
+	if err != nil {
+		return err
+	}
+	if err := g.checkBucket(sb); err != nil {
+		return err
+	}
+	sp, sourceFolder, err := sb.object(sourceKey)
+	if err != nil {
+		return err
+	}
+	p, folder, err := b.object(key)
+	if err != nil {
+		return err
+	}
+	if sourceFolder || folder {
+		return errInvalidRequest
+	}
+	file, err := g.stat(sb.sno, sp)
+	if err != nil {
+		return err
+	}
+	if file.Folder {
+		return errNoSuchKey
+	}
+	content, err := g.open(r.Context(), sb.sno, sp, file)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	tempDir, err := ioutil.TempDir(g.tempDir, "s3")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	// name of uploaded file is the name of local file
+	fileName := filepath.Join(tempDir, path.Base(p))
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := g.upload(b.sno, p, fileName); err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, copyObjectResult{LastModified: formatTime(time.Now()), ETag: etag(hash.Sum(nil))})
+	return nil
+}
+
+// deleteObject removes object, folder is removed only if it is empty, object not exists is not an error
+func (g *Gateway) deleteObject(w http.ResponseWriter, b bucket, key string) error {
+	if err := g.remove(b, key); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *Gateway) remove(b bucket, key string) error {
+	p, folder, err := b.object(key)
+	if err != nil {
+		return err
+	}
+	file, err := g.stat(b.sno, p)
+	if err == errNoSuchKey {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if file.Folder != folder {
+		return nil
+	}
+	if folder {
+		files, err := g.list(b.sno, p)
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			return nil
+		}
+	}
+	return g.remote.RemoveFile(p, folder, true, b.sno)
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+// maxDeleteObjects max objects of a DeleteObjects request
+const maxDeleteObjects = 1000
+
+// deleteObjects removes objects of request body
+func (g *Gateway) deleteObjects(w http.ResponseWriter, r *http.Request, sig *signature, b bucket) error {
+	req := deleteRequest{}
+	if err := readXML(r, sig, &req); err != nil {
+		return err
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > maxDeleteObjects {
+		return errMalformedXML
+	}
+	result := deleteResult{}
+	for _, object := range req.Objects {
+		if err := g.remove(b, object.Key); err != nil {
+			e := toAPIError(err)
+			if e == errInternal {
+				g.log.Errorf("S3 delete %s of bucket %s error %v", object.Key, b.name, err)
+			}
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: e.code, Message: e.message})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, deletedObject{Key: object.Key})
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
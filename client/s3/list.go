@@ -0,0 +1,167 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samoslab/nebula/client/daemon"
+)
+
+// maxListKeys max keys of a list response
+const maxListKeys = 1000
+
+type objectInfo struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         uint64 `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	KeyCount              int            `xml:"KeyCount"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []objectInfo   `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// entry key of a file, or common prefix of a folder which ends with slash
+type entry struct {
+	key  string
+	file *daemon.DownFile
+}
+
+// walk returns entries of bucket with prefix after key after in key order, folders whose key is longer
+// than prefix are rolled up into common prefixes if rollup. It returns true if there are more entries than max.
+func (g *Gateway) walk(b bucket, prefix string, rollup bool, after string, max int) ([]entry, bool, error) {
+	entries := []entry{}
+	var visit func(dir, base string) (bool, error)
+	visit = func(dir, base string) (bool, error) {
+		files, err := g.list(b.sno, dir)
+		if err != nil {
+			return false, err
+		}
+		children := make([]entry, 0, len(files))
+		for _, file := range files {
+			key := base + file.FileName
+			if file.Folder {
+				key += "/"
+			}
+			children = append(children, entry{key: key, file: file})
+		}
+		// keys below a folder share its key as prefix, so visiting children in key order lists keys in order
+		sort.Slice(children, func(i, j int) bool { return children[i].key < children[j].key })
+		for _, child := range children {
+			matched := strings.HasPrefix(child.key, prefix)
+			if !matched && !(child.file.Folder && strings.HasPrefix(prefix, child.key)) {
+				continue
+			}
+			if child.file.Folder && !(rollup && matched && len(child.key) > len(prefix)) {
+				if child.key <= after && !strings.HasPrefix(after, child.key) {
+					continue
+				}
+				if more, err := visit(path.Join(dir, child.file.FileName), child.key); more || err != nil {
+					return more, err
+				}
+				continue
+			}
+			if child.key <= after && !(child.file.Folder && strings.HasPrefix(after, child.key) && after != child.key) {
+				continue
+			}
+			if len(entries) == max {
+				return true, nil
+			}
+			entries = append(entries, child)
+		}
+		return false, nil
+	}
+	more, err := visit(b.root, "")
+	return entries, more, err
+}
+
+// listObjectsV2 lists objects by walking folders with ListFiles paging, continuation token is the last key returned
+func (g *Gateway) listObjectsV2(w http.ResponseWriter, r *http.Request, b bucket) error {
+	query := r.URL.Query()
+	result := listBucketResult{
+		Name:              b.name,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		MaxKeys:           maxListKeys,
+		EncodingType:      query.Get("encoding-type"),
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        query.Get("start-after"),
+	}
+	if result.Delimiter != "" && result.Delimiter != "/" {
+		return errNotImplemented
+	}
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		if n < result.MaxKeys {
+			result.MaxKeys = n
+		}
+	}
+	encode := func(s string) string { return s }
+	switch result.EncodingType {
+	case "":
+	case "url":
+		encode = url.QueryEscape
+	default:
+		return errInvalidArgument
+	}
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return errInvalidArgument
+		}
+		after = string(token)
+	}
+	entries, more, err := g.walk(b, result.Prefix, result.Delimiter == "/", after, result.MaxKeys)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.file.Folder {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(e.key)})
+		} else {
+			result.Contents = append(result.Contents, objectInfo{
+				Key:          encode(e.key),
+				LastModified: formatTime(time.Unix(int64(e.file.ModTime), 0)),
+				ETag:         `"` + e.file.FileHash + `"`,
+				Size:         e.file.FileSize,
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+	result.KeyCount = len(entries)
+	if more && len(entries) > 0 {
+		result.IsTruncated = true
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].key))
+	}
+	result.Prefix, result.StartAfter = encode(result.Prefix), encode(result.StartAfter)
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
@@ -0,0 +1,222 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// uploadsDir folder of multipart uploads in temp dir, parts are kept until upload completed or aborted
+	uploadsDir = "s3-uploads"
+	uploadMeta = "upload.json"
+	maxPartNo  = 10000
+)
+
+// multipartUpload object of a multipart upload
+type multipartUpload struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func partName(no int) string {
+	return fmt.Sprintf("%05d", no)
+}
+
+// uploadDir returns folder of upload id of object key of bucket b
+func (g *Gateway) uploadDir(b bucket, key, id string) (string, error) {
+	if data, err := hex.DecodeString(id); err != nil || len(data) != 16 {
+		return "", errNoSuchUpload
+	}
+	dir := filepath.Join(g.tempDir, uploadsDir, id)
+	data, err := ioutil.ReadFile(filepath.Join(dir, uploadMeta))
+	if err != nil {
+		return "", errNoSuchUpload
+	}
+	upload := multipartUpload{}
+	if err := json.Unmarshal(data, &upload); err != nil || upload.Bucket != b.name || upload.Key != key {
+		return "", errNoSuchUpload
+	}
+	return dir, nil
+}
+
+func (g *Gateway) createMultipartUpload(w http.ResponseWriter, b bucket, key string) error {
+	if _, folder, err := b.object(key); err != nil || folder {
+		return errInvalidArgument
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	dir := filepath.Join(g.tempDir, uploadsDir, hex.EncodeToString(id))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(multipartUpload{Bucket: b.name, Key: key})
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, uploadMeta), data, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{Bucket: b.name, Key: key, UploadID: hex.EncodeToString(id)})
+	return nil
+}
+
+// uploadPart keeps part in folder of upload, part uploaded again replaces the former one
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, sig *signature, b bucket, key, id string) error {
+	no, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || no < 1 || no > maxPartNo {
+		return errInvalidArgument
+	}
+	dir, err := g.uploadDir(b, key, id)
+	if err != nil {
+		return err
+	}
+	body, err := payloadReader(r, sig)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "part")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	sum, err := writeFile(f.Name(), body)
+	if err == nil {
+		err = checkContentMD5(r, sum)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, partName(no)))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	w.Header().Set("ETag", etag(sum))
+	return nil
+}
+
+// completeMultipartUpload uploads parts joined, etag of object is md5 of md5 of parts as S3 does
+func (g *Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, sig *signature, b bucket, key, id string) error {
+	p, _, err := b.object(key)
+	if err != nil {
+		return err
+	}
+	dir, err := g.uploadDir(b, key, id)
+	if err != nil {
+		return err
+	}
+	req := completeMultipartUpload{}
+	if err := readXML(r, sig, &req); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+	for i := 1; i < len(req.Parts); i++ {
+		if req.Parts[i].PartNumber <= req.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+	}
+	tempDir, err := ioutil.TempDir(g.tempDir, "s3")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := filepath.Join(tempDir, path.Base(p))
+	out, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	sums := md5.New()
+	for _, part := range req.Parts {
+		sum, err := appendPart(out, filepath.Join(dir, partName(part.PartNumber)))
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if hex.EncodeToString(sum) != strings.Trim(part.ETag, `"`) {
+			out.Close()
+			return errInvalidPart
+		}
+		sums.Write(sum)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := g.upload(b.sno, p, fileName); err != nil {
+		return err
+	}
+	os.RemoveAll(dir)
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Location: "/" + b.name + "/" + key,
+		Bucket:   b.name,
+		Key:      key,
+		ETag:     fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sums.Sum(nil)), len(req.Parts)),
+	})
+	return nil
+}
+
+// appendPart copies part file to out and returns md5 of the part
+func appendPart(out io.Writer, partFile string) ([]byte, error) {
+	f, err := os.Open(partFile)
+	if os.IsNotExist(err) {
+		return nil, errInvalidPart
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), f); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func (g *Gateway) abortMultipartUpload(w http.ResponseWriter, b bucket, key, id string) error {
+	dir, err := g.uploadDir(b, key, id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/samoslab/nebula/client/api"
+	"github.com/samoslab/nebula/client/auth"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+const readToken = "read-token-0123456789"
+
+func TestEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := config.Config{
+		ConfigDir:  dir,
+		StaticDir:  dir,
+		APIEnabled: true,
+		APITokens:  []config.APIToken{{Name: "viewer", Token: readToken, Scope: "read"}},
+	}
+	a, err := auth.New(logrus.New(), cfg)
+	require.NoError(t, err)
+	s := &HTTPServer{cfg: cfg, log: logrus.New(), auth: a}
+	mux := s.setupMux()
+
+	// every endpoint is served by its handler with its scope
+	for _, e := range api.Endpoints {
+		for _, method := range e.Methods {
+			r := httptest.NewRequest(method, e.Path, nil)
+			r.Header.Set("Authorization", "Bearer "+readToken)
+			_, pattern := mux.Handler(r)
+			require.Equal(t, e.Path, pattern)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			switch {
+			case e.Public:
+				require.NotEqual(t, http.StatusForbidden, w.Code, e.Path)
+			case e.Scope > auth.ScopeRead:
+				require.Equal(t, http.StatusForbidden, w.Code, e.Path)
+			default:
+				require.Equal(t, http.StatusOK, w.Code, e.Path)
+			}
+		}
+	}
+
+	// endpoints taking paths of daemon host need admin scope
+	for _, path := range []string{
+		"/api/v1/store/upload",
+		"/api/v1/store/uploaddir",
+		"/api/v1/store/download",
+		"/api/v1/store/downloaddir",
+		"/api/v1/secret/encrypt",
+		"/api/v1/secret/decrypt",
+		"/api/v1/service/root",
+		"/api/v1/sync/pair/add",
+		"/api/v1/backup/add",
+	} {
+		e, ok := api.Lookup(path)
+		require.True(t, ok, path)
+		require.Equal(t, auth.ScopeAdmin, e.Scope, path)
+	}
+
+	// document is served without token
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, api.OpenAPIPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	doc := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	require.Equal(t, api.OpenAPIVersion, doc["openapi"])
+	require.Len(t, doc["paths"], len(api.Endpoints))
+
+	require.Panics(t, func() {
+		s.cfg.APIEnabled = false
+		endpoints := api.Endpoints
+		defer func() { api.Endpoints = endpoints }()
+		api.Endpoints = endpoints[1:]
+		s.setupMux()
+	})
+}
@@ -0,0 +1,503 @@
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samoslab/nebula/client/api"
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/daemon"
+)
+
+const (
+	// partial files of chunked uploads are kept in browserUploadDir of temp dir
+	browserUploadDir = "browser-upload"
+	formFieldMax     = 4096
+)
+
+var (
+	// chunkExpire partial file of chunked upload not written for chunkExpire is removed
+	chunkExpire = 24 * time.Hour
+
+	errFileNotExist = errors.New("file not exist")
+)
+
+func parseBodyUploadReq(values url.Values) (*api.BodyUploadReq, error) {
+	req := &api.BodyUploadReq{Dest: values.Get("dest_dir")}
+	if req.Dest == "" || !path.IsAbs(req.Dest) {
+		return nil, errors.New("argument dest_dir must be absolute path")
+	}
+	if v := values.Get("space_no"); v != "" {
+		sno, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid space_no %s", v)
+		}
+		req.Sno = uint32(sno)
+	}
+	for name, b := range map[string]*bool{"newversion": &req.NewVersion, "is_encrypt": &req.IsEncrypt} {
+		if v := values.Get(name); v != "" {
+			x, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s", name, v)
+			}
+			*b = x
+		}
+	}
+	return req, nil
+}
+
+// uploadName returns name of file uploaded by browser, it must be a plain file name
+func uploadName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return name, nil
+}
+
+// parseContentRange parses header of form "bytes start-end/total"
+func parseContentRange(h string) (start, end, total int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", h)
+	if !strings.HasPrefix(h, "bytes ") {
+		return 0, 0, 0, invalid
+	}
+	h = strings.TrimPrefix(h, "bytes ")
+	slash := strings.Index(h, "/")
+	dash := strings.Index(h, "-")
+	if dash < 0 || slash < dash {
+		return 0, 0, 0, invalid
+	}
+	if start, err = strconv.ParseInt(h[:dash], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if end, err = strconv.ParseInt(h[dash+1:slash], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if total, err = strconv.ParseInt(h[slash+1:], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if start < 0 || end < start || end >= total {
+		return 0, 0, 0, invalid
+	}
+	return start, end, total, nil
+}
+
+// deadlineWriter response writer of Go 1.20 and later whose connection deadlines can be changed
+type deadlineWriter interface {
+	SetReadDeadline(deadline time.Time) error
+	SetWriteDeadline(deadline time.Time) error
+}
+
+// liftDeadlines removes read and write timeout of server for request of large body or response,
+// response writer of former Go versions can not do it and the server timeouts are kept
+func liftDeadlines(w http.ResponseWriter) {
+	if dw, ok := w.(deadlineWriter); ok {
+		dw.SetReadDeadline(time.Time{})
+		dw.SetWriteDeadline(time.Time{})
+	}
+}
+
+// receiveFile writes r into fileName and returns bytes written
+func receiveFile(fileName string, r io.Reader) (int64, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// uploadBody uploads local file of browser, it is removed after
+func (s *HTTPServer) uploadBody(r *http.Request, req *api.BodyUploadReq, fileName string) (string, error) {
+	defer os.Remove(fileName)
+	s.cm.Log.Infof("Upload %s of browser to space %d %s", filepath.Base(fileName), req.Sno, req.Dest)
+	if err := s.cm.UploadFileContext(r.Context(), fileName, req.Dest, false, req.NewVersion, req.IsEncrypt, req.Sno); err != nil {
+		return "", err
+	}
+	return path.Join(req.Dest, filepath.Base(fileName)), nil
+}
+
+func bodyUploadResponse(ctx context.Context, w http.ResponseWriter, result interface{}, err error) {
+	code, errmsg := 0, ""
+	if err != nil {
+		code, errmsg = 1, err.Error()
+	}
+	rsp, err := common.MakeUnifiedHTTPResponse(code, result, errmsg)
+	if err != nil {
+		errorResponse(ctx, w, http.StatusBadRequest, err)
+		return
+	}
+	JSONResponse(w, rsp)
+}
+
+// UploadFormHandler uploads files of multipart/form-data request body, fields dest_dir, space_no,
+// newversion and is_encrypt must come before files. Uploaded files are returned, also when a later one failed.
+func UploadFormHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+		liftDeadlines(w)
+
+		tempDir, err := ioutil.TempDir(s.cm.TempDir, "browser")
+		if err != nil {
+			errorResponse(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		defer os.RemoveAll(tempDir)
+		fields := url.Values{}
+		var req *api.BodyUploadReq
+		uploaded := []string{}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				bodyUploadResponse(ctx, w, uploaded, fmt.Errorf("Invalid form: %v", err))
+				return
+			}
+			if part.FileName() == "" {
+				value, err := ioutil.ReadAll(io.LimitReader(part, formFieldMax))
+				if err != nil {
+					bodyUploadResponse(ctx, w, uploaded, err)
+					return
+				}
+				fields.Add(part.FormName(), string(value))
+				continue
+			}
+			if req == nil {
+				if req, err = parseBodyUploadReq(fields); err != nil {
+					errorResponse(ctx, w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			name, err := uploadName(part.FileName())
+			if err != nil {
+				bodyUploadResponse(ctx, w, uploaded, err)
+				return
+			}
+			fileName := filepath.Join(tempDir, name)
+			if _, err := receiveFile(fileName, part); err != nil {
+				os.Remove(fileName)
+				bodyUploadResponse(ctx, w, uploaded, err)
+				return
+			}
+			file, err := s.uploadBody(r, req, fileName)
+			if err != nil {
+				log.Errorf("Upload %s of form error %v", name, err)
+				bodyUploadResponse(ctx, w, uploaded, err)
+				return
+			}
+			uploaded = append(uploaded, file)
+		}
+		if len(uploaded) == 0 {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("no file in form"))
+			return
+		}
+		bodyUploadResponse(ctx, w, uploaded, nil)
+	}
+}
+
+// UploadStreamHandler uploads request body as file of query filename, arguments are query of BodyUploadReq.
+// Body with Content-Range is a chunk of file, chunks are sent in order and file is uploaded after the last one.
+func UploadStreamHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+
+		if !validMethod(ctx, w, r, []string{http.MethodPut, http.MethodPost}) {
+			return
+		}
+		defer r.Body.Close()
+		query := r.URL.Query()
+		req, err := parseBodyUploadReq(query)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		name, err := uploadName(query.Get("filename"))
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		liftDeadlines(w)
+
+		if h := r.Header.Get("Content-Range"); h != "" {
+			start, end, total, err := parseContentRange(h)
+			if err != nil {
+				errorResponse(ctx, w, http.StatusBadRequest, err)
+				return
+			}
+			result, err := s.receiveChunk(r, req, name, start, end, total)
+			if err != nil {
+				log.Errorf("Receive chunk %s of %s error %v", h, name, err)
+			}
+			bodyUploadResponse(ctx, w, result, err)
+			return
+		}
+
+		tempDir, err := ioutil.TempDir(s.cm.TempDir, "browser")
+		if err != nil {
+			errorResponse(ctx, w, http.StatusInternalServerError, err)
+			return
+		}
+		defer os.RemoveAll(tempDir)
+		fileName := filepath.Join(tempDir, name)
+		n, err := receiveFile(fileName, r.Body)
+		result := &api.BodyUploadRsp{Received: n, Total: n}
+		if err == nil {
+			result.File, err = s.uploadBody(r, req, fileName)
+		}
+		if err != nil {
+			log.Errorf("Upload stream %s error %v", name, err)
+		}
+		bodyUploadResponse(ctx, w, result, err)
+	}
+}
+
+// receiveChunk appends chunk of request body to partial file, the file is uploaded when it is complete.
+// A chunk not starting at end of partial file is refused, Received of result tells where to go on.
+func (s *HTTPServer) receiveChunk(r *http.Request, req *api.BodyUploadReq, name string, start, end, total int64) (*api.BodyUploadRsp, error) {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d\n%s\n%s\n%d", req.Sno, req.Dest, name, total)))
+	key := hex.EncodeToString(sum[:])
+	if !s.beginChunk(key) {
+		return nil, fmt.Errorf("another chunk of %s is being received", name)
+	}
+	defer s.endChunk(key)
+
+	dir := filepath.Join(s.cm.TempDir, browserUploadDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	partial := filepath.Join(dir, key)
+	received := int64(0)
+	if info, err := os.Stat(partial); err == nil {
+		received = info.Size()
+	}
+	result := &api.BodyUploadRsp{Received: received, Total: total}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if start == 0 {
+		// first chunk starts file again
+		s.expireChunks(dir)
+		flag |= os.O_TRUNC
+		result.Received = 0
+	} else if start != received {
+		return result, fmt.Errorf("chunk starts at %d, %d bytes received", start, received)
+	}
+	f, err := os.OpenFile(partial, flag, 0600)
+	if err != nil {
+		return result, err
+	}
+	size := end - start + 1
+	n, err := io.Copy(f, io.LimitReader(r.Body, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("chunk has %d bytes, expect %d", n, size)
+	}
+	if err != nil {
+		// drop incomplete chunk
+		f.Truncate(result.Received)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Received += n
+	if result.Received < total {
+		return result, nil
+	}
+
+	tempDir, err := ioutil.TempDir(s.cm.TempDir, "browser")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := filepath.Join(tempDir, name)
+	if err := os.Rename(partial, fileName); err != nil {
+		return result, err
+	}
+	result.File, err = s.uploadBody(r, req, fileName)
+	return result, err
+}
+
+func (s *HTTPServer) beginChunk(key string) bool {
+	s.chunkMutex.Lock()
+	defer s.chunkMutex.Unlock()
+	if s.chunking == nil {
+		s.chunking = map[string]bool{}
+	}
+	if s.chunking[key] {
+		return false
+	}
+	s.chunking[key] = true
+	return true
+}
+
+func (s *HTTPServer) endChunk(key string) {
+	s.chunkMutex.Lock()
+	defer s.chunkMutex.Unlock()
+	delete(s.chunking, key)
+}
+
+// expireChunks removes partial files not written for chunkExpire
+func (s *HTTPServer) expireChunks(dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if time.Since(info.ModTime()) > chunkExpire {
+			s.cm.Log.Infof("Remove expired partial upload %s", info.Name())
+			os.Remove(filepath.Join(dir, info.Name()))
+		}
+	}
+}
+
+// statRemote returns file of path p in space sno
+func (s *HTTPServer) statRemote(sno uint32, p string) (*daemon.DownFile, error) {
+	dir, name := path.Split(p)
+	dir = path.Clean(dir)
+	files, err := s.cm.ListFolder(dir, sno)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.FileName == name {
+			return file, nil
+		}
+	}
+	return nil, errFileNotExist
+}
+
+// contentType returns mime type of file by type stored in tracker, or by extension of its name
+func (s *HTTPServer) contentType(file *daemon.DownFile) string {
+	if value, ok := s.cm.FileTypeMap.GetMIMEValue(file.FileType, file.Extension); ok {
+		return value
+	}
+	if ctype := mime.TypeByExtension(path.Ext(file.FileName)); ctype != "" {
+		return ctype
+	}
+	return "application/octet-stream"
+}
+
+// DownloadContentHandler serves file of query path as response body, supports Range and If-Range for media seeking.
+// File is downloaded when body is needed, HEAD and not modified responses need no download. Query inline=true shows
+// file in browser instead of saving it.
+func DownloadContentHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+
+		if !validMethod(ctx, w, r, []string{http.MethodGet, http.MethodHead}) {
+			return
+		}
+		query := r.URL.Query()
+		p := query.Get("path")
+		if p == "" || !path.IsAbs(p) || p == "/" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument path must be absolute path of file"))
+			return
+		}
+		p = path.Clean(p)
+		sno := uint32(0)
+		if v := query.Get("space_no"); v != "" {
+			x, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				errorResponse(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid space_no %s", v))
+				return
+			}
+			sno = uint32(x)
+		}
+		file, err := s.statRemote(sno, p)
+		if err != nil {
+			code := http.StatusBadRequest
+			if err == errFileNotExist {
+				code = http.StatusNotFound
+			}
+			errorResponse(ctx, w, code, err)
+			return
+		}
+		if file.Folder {
+			errorResponse(ctx, w, http.StatusBadRequest, fmt.Errorf("%s is folder", p))
+			return
+		}
+		liftDeadlines(w)
+
+		disposition := "attachment"
+		if inline, _ := strconv.ParseBool(query.Get("inline")); inline {
+			disposition = "inline"
+		}
+		if v := mime.FormatMediaType(disposition, map[string]string{"filename": file.FileName}); v != "" {
+			disposition = v
+		}
+		w.Header().Set("Content-Type", s.contentType(file))
+		w.Header().Set("Content-Disposition", disposition)
+		w.Header().Set("Accept-Ranges", "bytes")
+		if file.FileHash != "" {
+			w.Header().Set("ETag", `"`+file.FileHash+`"`)
+		}
+		s.cm.Log.Infof("Read space %d %s for browser", sno, p)
+		f, err := s.cm.OpenFile(r.Context(), p, file.FileHash, file.FileSize, sno)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		defer f.Close()
+		content := &remoteContent{File: f}
+		http.ServeContent(w, r, file.FileName, time.Unix(int64(file.ModTime), 0), content)
+		if content.err != nil {
+			s.cm.Log.Errorf("Download content %s error %v", p, content.err)
+		}
+	}
+}
+
+// remoteContent content of remote file, only partitions of ranges read are retrieved. The first read error is
+// kept to be logged for ServeContent drops it.
+type remoteContent struct {
+	daemon.File
+	err error
+}
+
+func (c *remoteContent) Read(p []byte) (int, error) {
+	n, err := c.File.Read(p)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
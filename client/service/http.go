@@ -7,23 +7,34 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 
-	"google.golang.org/grpc/status"
-
 	"time"
 
 	"github.com/rs/cors"
+	"github.com/samoslab/nebula/client/api"
+	"github.com/samoslab/nebula/client/auth"
+	"github.com/samoslab/nebula/client/backup"
 	"github.com/samoslab/nebula/client/common"
 	"github.com/samoslab/nebula/client/config"
 	"github.com/samoslab/nebula/client/daemon"
+	"github.com/samoslab/nebula/client/dav"
+	"github.com/samoslab/nebula/client/filesync"
 	regclient "github.com/samoslab/nebula/client/register"
+	"github.com/samoslab/nebula/client/s3"
+	"github.com/samoslab/nebula/client/transfer"
 	"github.com/samoslab/nebula/client/util/filetype"
+	rpb "github.com/samoslab/nebula/tracker/register/client/pb"
 	"github.com/samoslab/nebula/util/aes"
 	"github.com/sirupsen/logrus"
 	"github.com/unrolled/secure"
 	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -36,6 +47,11 @@ const (
 	serverWriteTimeout = time.Second * 60
 	serverIdleTimeout  = time.Second * 120
 
+	// progress event stream ends progressStreamMargin before write timeout, browsers reconnect after progressRetry
+	progressStreamMargin = time.Second * 5
+	progressRetry        = time.Second
+	progressHeartbeat    = time.Second * 15
+
 	// Directory where cached SSL certs from Let's Encrypt are stored
 	tlsAutoCertCache = "cert-cache"
 )
@@ -50,14 +66,24 @@ type HTTPServer struct {
 	log logrus.FieldLogger
 	//log           *logrus.Logger
 	cm            *daemon.ClientManager
+	sm            *filesync.Manager
+	bm            *backup.Manager
+	tm            *transfer.Manager
 	httpListener  *http.Server
 	httpsListener *http.Server
+	davListener   *http.Server
+	s3Listener    *http.Server
+	auth          *auth.Authenticator
+	trackerConn   *grpc.ClientConn // shared by register requests and client manager
 	quit          chan struct{}
 	done          chan struct{}
+
+	chunkMutex sync.Mutex
+	chunking   map[string]bool // partial uploads receiving a chunk
 }
 
-// InitClientManager init client manager
-func InitClientManager(log logrus.FieldLogger, webcfg config.Config) (*daemon.ClientManager, error) {
+// InitClientManager init client manager, opts are passed to daemon.NewClientManager
+func InitClientManager(log logrus.FieldLogger, webcfg config.Config, opts ...daemon.Option) (*daemon.ClientManager, error) {
 	_, defaultConfig := daemon.GetConfigFile()
 	clientConfig, err := config.LoadConfig(defaultConfig)
 	if err != nil {
@@ -68,7 +94,7 @@ func InitClientManager(log logrus.FieldLogger, webcfg config.Config) (*daemon.Cl
 		}
 		log.Errorf("Load config error %v", err)
 	}
-	cm, err := daemon.NewClientManager(log, webcfg, clientConfig)
+	cm, err := daemon.NewClientManager(log, webcfg, clientConfig, opts...)
 	if err != nil {
 		log.Infof("New client manager failed %v\n", err)
 		return cm, err
@@ -78,17 +104,155 @@ func InitClientManager(log logrus.FieldLogger, webcfg config.Config) (*daemon.Cl
 
 // NewHTTPServer creates an HTTPServer
 func NewHTTPServer(log logrus.FieldLogger, cfg config.Config) *HTTPServer {
-	cm, err := InitClientManager(log, cfg)
+	var trackerConn *grpc.ClientConn
+	if cfg.TrackerServer != "" {
+		var err error
+		// connection is established in background
+		if trackerConn, err = grpc.Dial(cfg.TrackerServer, grpc.WithInsecure()); err != nil {
+			log.Errorf("Rpc dial tracker failed, error %v", err)
+		}
+	}
+	cm, err := InitClientManager(log, cfg, trackerOption(trackerConn)...)
 	if err != nil {
 		log.Errorf("Init client manager failed, error %v", err)
 	}
-	return &HTTPServer{
-		cfg:  cfg,
-		log:  log,
-		cm:   cm,
-		quit: make(chan struct{}),
-		done: make(chan struct{}),
+	a, err := auth.New(log, cfg)
+	if err != nil {
+		log.Errorf("Init API token failed, error %v", err)
+	}
+	s := &HTTPServer{
+		cfg:         cfg,
+		log:         log,
+		cm:          cm,
+		auth:        a,
+		trackerConn: trackerConn,
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if cm != nil {
+		s.startTransfer()
+		s.startSync()
+		s.startBackup()
+	}
+	return s
+}
+
+// trackerOption shares conn with client manager, none if conn is nil
+func trackerOption(conn *grpc.ClientConn) []daemon.Option {
+	if conn == nil {
+		return nil
+	}
+	return []daemon.Option{daemon.WithTrackerConn(conn)}
+}
+
+// registerClient returns client of tracker register service on shared tracker connection
+func (s *HTTPServer) registerClient() (rpb.ClientRegisterServiceClient, error) {
+	if s.trackerConn == nil {
+		return nil, errors.New("tracker server not connected")
+	}
+	return rpb.NewClientRegisterServiceClient(s.trackerConn), nil
+}
+
+// APITokenFile returns file of admin token of API of this run, empty if API authentication is disabled
+func (s *HTTPServer) APITokenFile() string {
+	if s.auth.Token() == "" {
+		return ""
+	}
+	return auth.TokenFileName(s.cfg.ConfigDir)
+}
+
+// LaunchURL returns URL of web UI which logs the opening browser in once
+func (s *HTTPServer) LaunchURL() (string, error) {
+	return s.auth.LaunchURL("http://" + s.cfg.HTTPAddr)
+}
+
+// startTransfer starts running transfer jobs once client manager is ready
+func (s *HTTPServer) startTransfer() {
+	tm, err := transfer.NewManager(s.log, s.cm, filepath.Join(s.cfg.ConfigDir, transfer.DirName))
+	if err != nil {
+		s.log.Errorf("Init transfer manager failed, error %v", err)
+		return
+	}
+	tm.Notify = func(job transfer.Job) {
+		if ev, ok := jobEvent(job); ok {
+			s.cm.PM.Publish(ev)
+		}
+	}
+	s.tm = tm
+	tm.Run()
+}
+
+// jobEvent returns lifecycle event of job, a running job has events of its files from client
+func jobEvent(job transfer.Job) (common.Event, bool) {
+	ev := common.Event{Job: job.ID, File: job.Source, Error: job.Error, ETA: -1, Time: time.Now().UnixNano()}
+	switch job.Kind {
+	case transfer.KindDownload:
+		// progress of download is kept by local file
+		ev.File = filepath.Join(job.Dest, path.Base(job.Source))
+	case transfer.KindDownloadDir:
+		ev.File = job.Dest
+	}
+	switch job.State {
+	case transfer.StateQueued:
+		ev.Stage = common.StageQueued
+	case transfer.StatePaused:
+		ev.Stage = common.StagePaused
+	case transfer.StateCancelled:
+		ev.Stage = common.StageCancelled
+	case transfer.StateFailed:
+		ev.Stage = common.StageFailed
+	case transfer.StateDone:
+		ev.Stage = common.StageDone
+	default:
+		return ev, false
+	}
+	return ev, true
+}
+
+// runTransfer queues job, the job is returned at once if async, otherwise it waits for the job done and cancels it if request is gone
+func (s *HTTPServer) runTransfer(ctx context.Context, job transfer.Job, async bool) (interface{}, error) {
+	if s.tm == nil {
+		return nil, errors.New("transfer manager not ready")
+	}
+	j, err := s.tm.Add(job)
+	if err != nil {
+		return nil, err
+	}
+	if async {
+		return j, nil
+	}
+	if j, err = s.tm.Wait(ctx, j.ID); err != nil {
+		return nil, err
+	}
+	switch j.State {
+	case transfer.StateDone:
+		return "ok", nil
+	case transfer.StateFailed:
+		return nil, errors.New(j.Error)
+	}
+	return nil, fmt.Errorf("job %s is %s", j.ID, j.State)
+}
+
+// startSync starts syncing folder pairs once client manager is ready
+func (s *HTTPServer) startSync() {
+	sm, err := filesync.NewManager(s.log, s.cm, filepath.Join(s.cfg.ConfigDir, filesync.DirName))
+	if err != nil {
+		s.log.Errorf("Init sync manager failed, error %v", err)
+		return
+	}
+	s.sm = sm
+	go sm.Run()
+}
+
+// startBackup starts watching backup folders once client manager is ready
+func (s *HTTPServer) startBackup() {
+	bm, err := backup.NewManager(s.log, s.cm, filepath.Join(s.cfg.ConfigDir, backup.DirName))
+	if err != nil {
+		s.log.Errorf("Init backup manager failed, error %v", err)
+		return
 	}
+	s.bm = bm
+	go bm.Run()
 }
 
 func (s *HTTPServer) CanBeWork() bool {
@@ -106,6 +270,16 @@ func (s *HTTPServer) Run() error {
 	defer close(s.done)
 
 	var mux http.Handler = s.setupMux()
+	mux = s.auth.CheckHost(mux)
+	if s.cfg.BehindProxy {
+		mux = realIP(mux, trustedNets(log, s.cfg.TrustedProxies))
+	}
+	if !s.cfg.APIEnabled {
+		log.Warn("API disabled, only static files are served")
+	}
+	if s.cfg.ThrottleMax > 0 {
+		log.Infof("Throttle API requests of a client to %d every %s", s.cfg.ThrottleMax, s.cfg.ThrottleDuration)
+	}
 
 	allowedHosts := []string{} // empty array means all hosts allowed
 	sslHost := ""
@@ -131,13 +305,29 @@ func (s *HTTPServer) Run() error {
 
 	log = log.WithField("sslHost", sslHost)
 
-	secureMiddleware := configureSecureMiddleware(sslHost, allowedHosts)
+	secureMiddleware := configureSecureMiddleware(sslHost, allowedHosts, s.cfg.BehindProxy)
 	mux = secureMiddleware.Handler(mux)
 
 	if s.cfg.HTTPAddr != "" {
 		s.httpListener = setupHTTPListener(s.cfg.HTTPAddr, mux)
 	}
 
+	if s.cfg.WebDAVAddr != "" {
+		if err := s.setupWebDAV(); err != nil {
+			log.WithError(err).Error("WebDAV disabled")
+		} else {
+			log.Info(fmt.Sprintf("WebDAV server listening on http://%s", s.cfg.WebDAVAddr))
+		}
+	}
+
+	if s.cfg.S3Addr != "" {
+		if err := s.setupS3(); err != nil {
+			log.WithError(err).Error("S3 gateway disabled")
+		} else {
+			log.Info(fmt.Sprintf("S3 gateway listening on http://%s", s.cfg.S3Addr))
+		}
+	}
+
 	handleListenErr := func(f func() error) error {
 		if err := f(); err != nil {
 			select {
@@ -214,6 +404,28 @@ func (s *HTTPServer) Run() error {
 			}()
 		}
 
+		if s.davListener != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.davListener.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.WithError(err).Error("WebDAV ListenAndServe error")
+					errC <- err
+				}
+			}()
+		}
+
+		if s.s3Listener != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.s3Listener.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.WithError(err).Error("S3 gateway ListenAndServe error")
+					errC <- err
+				}
+			}()
+		}
+
 		done := make(chan struct{})
 
 		go func() {
@@ -232,16 +444,22 @@ func (s *HTTPServer) Run() error {
 	})
 }
 
-func configureSecureMiddleware(sslHost string, allowedHosts []string) *secure.Secure {
+func configureSecureMiddleware(sslHost string, allowedHosts []string, behindProxy bool) *secure.Secure {
 	sslRedirect := true
 	if sslHost == "" {
 		sslRedirect = false
 	}
+	// proxy terminating TLS tells scheme of client request, so https requests are not redirected again
+	var sslProxyHeaders map[string]string
+	if behindProxy {
+		sslProxyHeaders = map[string]string{"X-Forwarded-Proto": "https"}
+	}
 
 	return secure.New(secure.Options{
-		AllowedHosts: allowedHosts,
-		SSLRedirect:  sslRedirect,
-		SSLHost:      sslHost,
+		AllowedHosts:    allowedHosts,
+		SSLRedirect:     sslRedirect,
+		SSLHost:         sslHost,
+		SSLProxyHeaders: sslProxyHeaders,
 
 		// https://developer.mozilla.org/en-US/docs/Web/HTTP/CSP
 		// FIXME: Web frontend code has inline styles, CSP doesn't work yet
@@ -270,6 +488,42 @@ func configureSecureMiddleware(sslHost string, allowedHosts []string) *secure.Se
 	})
 }
 
+// setupWebDAV makes listener of spaces mounted by WebDAV clients, it has no read and write timeout
+// because big files are uploaded and downloaded in one request
+func (s *HTTPServer) setupWebDAV() error {
+	if !s.CanBeWork() {
+		return errors.New("register first")
+	}
+	fs := dav.NewFileSystem(s.log, s.cm, s.cm.SpaceM.Count, s.cm.TempDir, s.cfg.WebDAVEncrypt)
+	handler, err := dav.NewHandler(s.log, fs, s.cfg.WebDAVUser, s.cfg.WebDAVPassword)
+	if err != nil {
+		return err
+	}
+	s.davListener = &http.Server{
+		Addr:        s.cfg.WebDAVAddr,
+		Handler:     handler,
+		IdleTimeout: serverIdleTimeout,
+	}
+	return nil
+}
+
+// setupS3 makes listener of S3 gateway, it has no read and write timeout as WebDAV
+func (s *HTTPServer) setupS3() error {
+	if !s.CanBeWork() {
+		return errors.New("register first")
+	}
+	gateway, err := s3.NewGateway(s.log, s.cm, s.cm.SpaceM.Count, s.cfg.S3Space, s.cm.TempDir, s.cfg.S3Encrypt, s.cfg.S3AccessKey, s.cfg.S3SecretKey)
+	if err != nil {
+		return err
+	}
+	s.s3Listener = &http.Server{
+		Addr:        s.cfg.S3Addr,
+		Handler:     gateway,
+		IdleTimeout: serverIdleTimeout,
+	}
+	return nil
+}
+
 func setupHTTPListener(addr string, handler http.Handler) *http.Server {
 	return &http.Server{
 		Addr:         addr,
@@ -282,7 +536,31 @@ func setupHTTPListener(addr string, handler http.Handler) *http.Server {
 
 func (s *HTTPServer) setupMux() *http.ServeMux {
 	mux := http.NewServeMux()
+	var limit *throttle
+	if s.cfg.ThrottleMax > 0 && s.cfg.ThrottleDuration > 0 {
+		limit = newThrottle(s.cfg.ThrottleMax, s.cfg.ThrottleDuration)
+	}
+	// guard wraps handler of API path, API is refused if disabled, requests over limit of a client are refused
+	guard := func(h http.Handler) http.Handler {
+		if !s.cfg.APIEnabled {
+			return apiDisabled()
+		}
+		if limit != nil {
+			h = limit.Handler(h)
+		}
+		return h
+	}
+	// handleAPI registers handler of endpoint of path, token of scope of endpoint is required if it is not public
 	handleAPI := func(path string, h http.Handler) {
+		e, ok := api.Lookup(path)
+		if !ok {
+			panic(fmt.Sprintf("endpoint %s not in api.Endpoints", path))
+		}
+		if e.Public {
+			mux.Handle(path, guard(h))
+			return
+		}
+		h = guard(s.auth.Require(e.Scope, h))
 		// Allow requests from a local samos client
 		h = cors.New(cors.Options{
 			AllowedOrigins: []string{"http://127.0.0.1:7788"},
@@ -291,15 +569,30 @@ func (s *HTTPServer) setupMux() *http.ServeMux {
 		mux.Handle(path, h)
 	}
 
+	// OpenAPI document of endpoints
+	handleAPI(api.OpenAPIPath, OpenAPIHandler(s))
+
+	// Session of web UI, the token is in token file of config dir, or the launch URL logs in once
+	mux.Handle(auth.LaunchPath, s.auth.LaunchHandler())
+	handleAPI("/api/v1/auth/login", s.auth.LoginHandler())
+	handleAPI("/api/v1/auth/session", s.auth.SessionHandler())
+	handleAPI("/api/v1/auth/logout", s.auth.LogoutHandler())
+
 	// API Methods
 	handleAPI("/api/v1/store/register", RegisterHandler(s))
 	handleAPI("/api/v1/store/verifyemail", EmailHandler(s))
 	handleAPI("/api/v1/store/folder/add", MkfolderHandler(s))
 	handleAPI("/api/v1/store/upload", UploadHandler(s))
+	handleAPI("/api/v1/store/upload/pending", PendingUploadHandler(s))
+	handleAPI("/api/v1/store/upload/resume", ResumeUploadHandler(s))
+	handleAPI("/api/v1/store/upload/form", UploadFormHandler(s))
+	handleAPI("/api/v1/store/upload/stream", UploadStreamHandler(s))
 	handleAPI("/api/v1/store/download", DownloadHandler(s))
+	handleAPI("/api/v1/store/download/content", DownloadContentHandler(s))
 	handleAPI("/api/v1/store/list", ListHandler(s))
 	handleAPI("/api/v1/store/remove", RemoveHandler(s))
 	handleAPI("/api/v1/store/progress", ProgressHandler(s))
+	handleAPI("/api/v1/store/progress/events", ProgressEventsHandler(s))
 	handleAPI("/api/v1/store/uploaddir", UploadDirHandler(s))
 	handleAPI("/api/v1/store/downloaddir", DownloadDirHandler(s))
 	handleAPI("/api/v1/store/rename", RenameHandler(s))
@@ -326,146 +619,28 @@ func (s *HTTPServer) setupMux() *http.ServeMux {
 
 	handleAPI("/api/v1/space/verify", SpaceVerifyHandler(s))
 	handleAPI("/api/v1/space/password", PasswordHandler(s))
+	handleAPI("/api/v1/space/password/change", ChangePasswordHandler(s))
 	handleAPI("/api/v1/space/status", SpaceStatusHandler(s))
 
-	// Static files
-	mux.Handle("/", http.FileServer(http.Dir(s.cfg.StaticDir)))
-	return mux
-}
-
-// RegisterReq request struct for register
-type RegisterReq struct {
-	Email  string `json:"email"`
-	Resend bool   `josn:"resend"`
-}
-
-// VerifyEmailReq request struct for verify email
-type VerifyEmailReq struct {
-	Code string `json:"code"`
-}
-
-// MkfolderReq request struct for make folder
-type MkfolderReq struct {
-	Folders     []string `json:"folders"`
-	Parent      string   `json:"parent"`
-	Interactive bool     `json:"interactive"`
-	Sno         uint32   `json:"space_no"`
-}
-
-// UploadReq request struct for upload file
-type UploadReq struct {
-	Filename    string `json:"filename"`
-	Dest        string `json:"dest_dir"`
-	Interactive bool   `json:"interactive"`
-	NewVersion  bool   `json:"newversion"`
-	Sno         uint32 `json:"space_no"`
-	IsEncrypt   bool   `json:"is_encrypt"`
-}
-
-// UploadDirReq request struct for upload directory
-type UploadDirReq struct {
-	Parent      string `json:"parent"`
-	Dest        string `json:"dest_dir"`
-	Interactive bool   `json:"interactive"`
-	NewVersion  bool   `json:"newversion"`
-	Sno         uint32 `json:"space_no"`
-	IsEncrypt   bool   `json:"is_encrypt"`
-}
-
-// DownloadDirReq request struct for download directory
-type DownloadDirReq struct {
-	Parent string `json:"parent"`
-	Dest   string `json:"dest_dir"`
-	Sno    uint32 `json:"space_no"`
-}
-
-// RenameReq request struct for move file, src is source file id which get by list
-type RenameReq struct {
-	Source string `json:"src"`
-	Dest   string `json:"dest"`
-	Sno    uint32 `json:"space_no"`
-}
-
-// DownloadReq request struct for download file
-type DownloadReq struct {
-	FileHash string `json:"filehash"`
-	FileSize uint64 `json:"filesize"`
-	FileName string `json:"filename"`
-	Dest     string `json:"dest_dir"`
-	Sno      uint32 `json:"space_no"`
-}
-
-// ListReq request struct for list files
-type ListReq struct {
-	Path     string `json:"path"`
-	PageSize uint32 `json:"pagesize"`
-	PageNum  uint32 `json:"pagenum"`
-	SortType string `json:"sorttype"`
-	AscOrder bool   `json:"ascorder"`
-	Sno      uint32 `json:"space_no"`
-}
-
-// RemoveReq request struct for remove file
-type RemoveReq struct {
-	Target    string `json:"target"`
-	Recursion bool   `json:"recursion"`
-	IsPath    bool   `json:"ispath"`
-	Sno       uint32 `json:"space_no"`
-}
-
-// ProgressReq request struct for progress bar
-type ProgressReq struct {
-	Files []string `json:"files"`
-}
-
-// ProgressRsp response for progress bar
-type ProgressRsp struct {
-	Progress map[string]float64 `json:"progress"`
-}
-
-// EncryFileReq encrypt file request
-type EncryFileReq struct {
-	FileName   string `json:"file"`
-	Password   string `json:"password"`
-	OutputFile string `json:output_file`
-}
-
-// DecryFileReq decrypt file request
-type DecryFileReq struct {
-	FileName   string `json:"file"`
-	Password   string `json:"password"`
-	OutputFile string `json:output_file`
-}
-
-// ServiceStatus service status request
-type ServiceStatus struct {
-	Status bool `json:"status"`
-}
-
-// RootPath root path
-type RootPath struct {
-	Root string `json:"root"`
-}
-
-// PasswordReq set password for privacy space
-type PasswordReq struct {
-	Password string `json:"password"`
-	SpacoNo  uint32 `json:"space_no"`
-}
+	handleAPI("/api/v1/sync/pair/add", AddSyncPairHandler(s))
+	handleAPI("/api/v1/sync/pair/remove", RemoveSyncPairHandler(s))
+	handleAPI("/api/v1/sync/status", SyncStatusHandler(s))
+	handleAPI("/api/v1/sync/run", RunSyncHandler(s))
 
-// SpaceStatusReq space status
-type SpaceStatusReq struct {
-	SpacoNo uint32 `json:"space_no"`
-}
+	handleAPI("/api/v1/backup/add", AddBackupHandler(s))
+	handleAPI("/api/v1/backup/remove", RemoveBackupHandler(s))
+	handleAPI("/api/v1/backup/status", BackupStatusHandler(s))
+	handleAPI("/api/v1/backup/queue", BackupQueueHandler(s))
 
-// ConfigImportReq import config
-type ConfigImportReq struct {
-	FileName string `json:"filename"`
-}
+	handleAPI("/api/v1/transfer/list", TransferListHandler(s))
+	handleAPI("/api/v1/transfer/pause", TransferActionHandler(s, "pause"))
+	handleAPI("/api/v1/transfer/resume", TransferActionHandler(s, "resume"))
+	handleAPI("/api/v1/transfer/cancel", TransferActionHandler(s, "cancel"))
+	handleAPI("/api/v1/transfer/retry", TransferActionHandler(s, "retry"))
 
-// ConfigExportReq export config
-type ConfigExportReq struct {
-	Filename string `json:"filename"`
+	// Static files
+	mux.Handle("/", http.FileServer(http.Dir(s.cfg.StaticDir)))
+	return mux
 }
 
 // ServiceStatusHandler returns service status
@@ -481,7 +656,7 @@ func ServiceStatusHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		ss := ServiceStatus{
+		ss := api.ServiceStatus{
 			Status: s.CanBeWork(),
 		}
 
@@ -511,7 +686,7 @@ func RootPathHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &RootPath{}
+		req := &api.RootPath{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -562,7 +737,7 @@ func PasswordHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &PasswordReq{}
+		req := &api.PasswordReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -593,6 +768,57 @@ func PasswordHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
+// ChangePasswordHandler change space password, files of the space are not encrypted again
+func ChangePasswordHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.log
+		w.Header().Set("Accept", "application/json")
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+
+		req := &api.ChangePasswordReq{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			err = fmt.Errorf("Invalid json request body: %v", err)
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer r.Body.Close()
+		if req.OldPassword == "" || req.NewPassword == "" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument old_password and new_password must not empty"))
+			return
+		}
+
+		err := s.cm.ChangePassword(req.SpacoNo, req.OldPassword, req.NewPassword)
+		result, code, errmsg := "ok", 0, ""
+		if err != nil {
+			result, code, errmsg = "", 1, err.Error()
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(code, result, errmsg)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
 // SpaceVerifyHandler check password correctness
 func SpaceVerifyHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -613,7 +839,7 @@ func SpaceVerifyHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &PasswordReq{}
+		req := &api.PasswordReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -664,7 +890,7 @@ func SpaceStatusHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &SpaceStatusReq{}
+		req := &api.SpaceStatusReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -711,7 +937,7 @@ func ConfigImportHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &ConfigImportReq{}
+		req := &api.ConfigImportReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -784,7 +1010,7 @@ func RegisterHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		regReq := &RegisterReq{}
+		regReq := &api.RegisterReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&regReq); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -798,12 +1024,12 @@ func RegisterHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		var err error
-		if regReq.Resend {
-			err = regclient.ResendVerifyCode(s.cfg.ConfigFile, s.cfg.TrackerServer)
-		} else {
+		rc, err := s.registerClient()
+		if err == nil && regReq.Resend {
+			err = regclient.ResendVerifyCode(rc, s.cfg.ConfigFile)
+		} else if err == nil {
 			log.Infof("Register email %s dir %s", regReq.Email, s.cfg.ConfigFile)
-			err = regclient.RegisterClient(log, s.cfg.ConfigFile, s.cfg.TrackerServer, regReq.Email)
+			err = regclient.RegisterClient(log, rc, s.cfg.ConfigFile, regReq.Email)
 		}
 		result, code, errmsg := "ok", 0, ""
 		if err != nil {
@@ -813,12 +1039,21 @@ func RegisterHandler(s *HTTPServer) http.HandlerFunc {
 			result = ""
 		}
 		if !regReq.Resend {
-			cm, err := InitClientManager(log, s.cfg)
+			cm, err := InitClientManager(log, s.cfg, trackerOption(s.trackerConn)...)
 			if err != nil {
 				code = 1
 				errmsg = err.Error()
 			} else {
 				s.cm = cm
+				if s.tm == nil {
+					s.startTransfer()
+				}
+				if s.sm == nil {
+					s.startSync()
+				}
+				if s.bm == nil {
+					s.startBackup()
+				}
 			}
 		}
 
@@ -853,7 +1088,7 @@ func EmailHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		mailReq := &VerifyEmailReq{}
+		mailReq := &api.VerifyEmailReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&mailReq); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -868,7 +1103,10 @@ func EmailHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		err := regclient.VerifyEmail(s.cfg.ConfigFile, s.cfg.TrackerServer, mailReq.Code)
+		rc, err := s.registerClient()
+		if err == nil {
+			err = regclient.VerifyEmail(rc, s.cfg.ConfigFile, mailReq.Code)
+		}
 		result, code, errmsg := "ok", 0, ""
 		if err != nil {
 			log.Errorf("Verify email %+v error %v", mailReq, err)
@@ -910,7 +1148,7 @@ func MkfolderHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		mkReq := &MkfolderReq{}
+		mkReq := &api.MkfolderReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&mkReq); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -971,7 +1209,7 @@ func UploadHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &UploadReq{}
+		req := &api.UploadReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -987,8 +1225,16 @@ func UploadHandler(s *HTTPServer) http.HandlerFunc {
 		}
 
 		log.Infof("Upload files %+v", req.Filename)
-		err := s.cm.UploadFile(req.Filename, req.Dest, req.Interactive, req.NewVersion, req.IsEncrypt, req.Sno)
-		result, code, errmsg := "ok", 0, ""
+		result, err := s.runTransfer(ctx, transfer.Job{
+			Kind:        transfer.KindUpload,
+			Source:      req.Filename,
+			Dest:        req.Dest,
+			Interactive: req.Interactive,
+			NewVersion:  req.NewVersion,
+			IsEncrypt:   req.IsEncrypt,
+			Sno:         req.Sno,
+		}, req.Async)
+		code, errmsg := 0, ""
 		if err != nil {
 			log.Errorf("Upload %+v error %v", req, err)
 			result, code, errmsg = "", 1, err.Error()
@@ -1005,8 +1251,8 @@ func UploadHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
-// UploadDirHandler upload directory handler
-func UploadDirHandler(s *HTTPServer) http.HandlerFunc {
+// PendingUploadHandler list interrupted uploads handler
+func PendingUploadHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		if !s.CanBeWork() {
@@ -1014,42 +1260,47 @@ func UploadDirHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 		log := s.cm.Log
-		w.Header().Set("Accept", "application/json")
 
-		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+		if !validMethod(ctx, w, r, []string{http.MethodGet}) {
 			return
 		}
 
-		if r.Header.Get("Content-Type") != "application/json" {
-			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
-			return
+		pending, err := s.cm.PendingUploads()
+		code, errmsg := 0, ""
+		if err != nil {
+			log.Errorf("List pending uploads error %v", err)
+			code, errmsg = 1, err.Error()
 		}
 
-		req := &UploadDirReq{}
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&req); err != nil {
-			err = fmt.Errorf("Invalid json request body: %v", err)
+		rsp, err := common.MakeUnifiedHTTPResponse(code, pending, errmsg)
+		if err != nil {
 			errorResponse(ctx, w, http.StatusBadRequest, err)
 			return
 		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
 
-		defer r.Body.Close()
-
-		if req.Parent == "" || req.Dest == "" {
-			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument parent or dest_dir must not empty"))
+// ResumeUploadHandler resume interrupted uploads handler
+func ResumeUploadHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
 			return
 		}
+		log := s.cm.Log
 
-		log.Infof("Upload parent %s", req.Parent)
-		err := s.cm.UploadDir(req.Parent, req.Dest, req.Interactive, req.NewVersion, req.IsEncrypt, req.Sno)
-		st, ok := status.FromError(err)
-		if !ok {
-			log.Infof("Err code %d msg %s", st.Code(), st.Message())
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
 		}
 
+		err := s.cm.ResumeUploads()
 		result, code, errmsg := "ok", 0, ""
 		if err != nil {
-			log.Errorf("Upload %+v error %v", req, err)
+			log.Errorf("Resume uploads error %v", err)
 			result, code, errmsg = "", 1, err.Error()
 		}
 
@@ -1064,8 +1315,8 @@ func UploadDirHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
-// DownloadHandler download file handler
-func DownloadHandler(s *HTTPServer) http.HandlerFunc {
+// UploadDirHandler upload directory handler
+func UploadDirHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		if !s.CanBeWork() {
@@ -1084,9 +1335,9 @@ func DownloadHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		downReq := &DownloadReq{}
+		req := &api.UploadDirReq{}
 		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&downReq); err != nil {
+		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
 			errorResponse(ctx, w, http.StatusBadRequest, err)
 			return
@@ -1094,16 +1345,24 @@ func DownloadHandler(s *HTTPServer) http.HandlerFunc {
 
 		defer r.Body.Close()
 
-		if downReq.FileHash == "" || downReq.Dest == "" || downReq.FileSize == 0 || downReq.FileName == "" {
-			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument filehash, dest_dir, filesize or filename must not empty"))
+		if req.Parent == "" || req.Dest == "" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument parent or dest_dir must not empty"))
 			return
 		}
 
-		log.Infof("Download  %+v", downReq)
-		err := s.cm.DownloadFile(downReq.FileName, downReq.Dest, downReq.FileHash, downReq.FileSize, downReq.Sno)
-		result, code, errmsg := "ok", 0, ""
+		log.Infof("Upload parent %s", req.Parent)
+		result, err := s.runTransfer(ctx, transfer.Job{
+			Kind:        transfer.KindUploadDir,
+			Source:      req.Parent,
+			Dest:        req.Dest,
+			Interactive: req.Interactive,
+			NewVersion:  req.NewVersion,
+			IsEncrypt:   req.IsEncrypt,
+			Sno:         req.Sno,
+		}, req.Async)
+		code, errmsg := 0, ""
 		if err != nil {
-			log.Errorf("Download files %+v error %v", downReq, err)
+			log.Errorf("Upload %+v error %v", req, err)
 			result, code, errmsg = "", 1, err.Error()
 		}
 
@@ -1118,8 +1377,8 @@ func DownloadHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
-// DownloadDirHandler download directory from provider
-func DownloadDirHandler(s *HTTPServer) http.HandlerFunc {
+// DownloadHandler download file handler
+func DownloadHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		if !s.CanBeWork() {
@@ -1138,9 +1397,70 @@ func DownloadDirHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &DownloadDirReq{}
+		downReq := &api.DownloadReq{}
 		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&req); err != nil {
+		if err := decoder.Decode(&downReq); err != nil {
+			err = fmt.Errorf("Invalid json request body: %v", err)
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer r.Body.Close()
+
+		if downReq.FileHash == "" || downReq.Dest == "" || downReq.FileSize == 0 || downReq.FileName == "" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument filehash, dest_dir, filesize or filename must not empty"))
+			return
+		}
+
+		log.Infof("Download  %+v", downReq)
+		result, err := s.runTransfer(ctx, transfer.Job{
+			Kind:     transfer.KindDownload,
+			Source:   downReq.FileName,
+			Dest:     downReq.Dest,
+			FileHash: downReq.FileHash,
+			FileSize: downReq.FileSize,
+			Sno:      downReq.Sno,
+		}, downReq.Async)
+		code, errmsg := 0, ""
+		if err != nil {
+			log.Errorf("Download files %+v error %v", downReq, err)
+			result, code, errmsg = "", 1, err.Error()
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(code, result, errmsg)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// DownloadDirHandler download directory from provider
+func DownloadDirHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+		w.Header().Set("Accept", "application/json")
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+
+		req := &api.DownloadDirReq{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
 			errorResponse(ctx, w, http.StatusBadRequest, err)
 			return
@@ -1154,8 +1474,13 @@ func DownloadDirHandler(s *HTTPServer) http.HandlerFunc {
 		}
 
 		log.Infof("downloaddir request %+v", req)
-		err := s.cm.DownloadDir(req.Parent, req.Dest, req.Sno)
-		result, code, errmsg := "ok", 0, ""
+		result, err := s.runTransfer(ctx, transfer.Job{
+			Kind:   transfer.KindDownloadDir,
+			Source: req.Parent,
+			Dest:   req.Dest,
+			Sno:    req.Sno,
+		}, req.Async)
+		code, errmsg := 0, ""
 		if err != nil {
 			log.Errorf("Download dir %+v error %v", req, err)
 			result, code, errmsg = "", 1, err.Error()
@@ -1192,7 +1517,7 @@ func RenameHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &RenameReq{}
+		req := &api.RenameReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -1246,7 +1571,7 @@ func ListHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &ListReq{}
+		req := &api.ListReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -1299,7 +1624,7 @@ func RemoveHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		rmReq := &RemoveReq{}
+		rmReq := &api.RemoveReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&rmReq); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -1351,7 +1676,7 @@ func ProgressHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		progressReq := &ProgressReq{}
+		progressReq := &api.ProgressReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&progressReq); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -1382,6 +1707,86 @@ func ProgressHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
+// ProgressEventsHandler streams progress and lifecycle events as server-sent events, query file selects files.
+// Current progress is sent first, the stream ends before write timeout of server and browsers reconnect.
+func ProgressEventsHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+
+		if !validMethod(ctx, w, r, []string{http.MethodGet}) {
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			errorResponse(ctx, w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+			return
+		}
+		files := r.URL.Query()["file"]
+		selected := map[string]bool{}
+		for _, file := range files {
+			selected[file] = true
+		}
+
+		// subscribe before snapshot so no event is lost between them
+		events, cancel := s.cm.PM.Subscribe()
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		write := func(ev common.Event) error {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			return err
+		}
+		fmt.Fprintf(w, "retry: %d\n\n", progressRetry/time.Millisecond)
+		for _, ev := range s.cm.PM.Events(files) {
+			if err := write(ev); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		end := time.NewTimer(serverWriteTimeout - progressStreamMargin)
+		defer end.Stop()
+		heartbeat := time.NewTicker(progressHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				if len(selected) != 0 && !selected[ev.File] {
+					continue
+				}
+				if err := write(ev); err != nil {
+					log.Debugf("Write progress event error %v", err)
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			case <-end.C:
+				return
+			case <-ctx.Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 // EncryFileHandler encrypt file handler
 func EncryFileHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1402,7 +1807,7 @@ func EncryFileHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &EncryFileReq{}
+		req := &api.EncryFileReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -1470,7 +1875,7 @@ func DecryFileHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &DecryFileReq{}
+		req := &api.DecryFileReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -1518,6 +1923,437 @@ func DecryFileHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
+// AddSyncPairHandler add sync pair handler
+func AddSyncPairHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.sm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+		w.Header().Set("Accept", "application/json")
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+
+		req := &api.SyncPairReq{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			err = fmt.Errorf("Invalid json request body: %v", err)
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer r.Body.Close()
+		if req.Local == "" || req.Remote == "" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument local or remote must not empty"))
+			return
+		}
+
+		pair, err := s.sm.AddPair(req.Local, req.Remote, req.Sno, req.IsEncrypt)
+		code, errmsg := 0, ""
+		if err != nil {
+			log.Errorf("Add sync pair %+v error %v", req, err)
+			code, errmsg = 1, err.Error()
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(code, pair, errmsg)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// RemoveSyncPairHandler remove sync pair handler, files are kept
+func RemoveSyncPairHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.sm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+		w.Header().Set("Accept", "application/json")
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+
+		req := &api.SyncPairIDReq{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			err = fmt.Errorf("Invalid json request body: %v", err)
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer r.Body.Close()
+		if req.ID == "" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument id must not empty"))
+			return
+		}
+
+		err := s.sm.RemovePair(req.ID)
+		result, code, errmsg := "ok", 0, ""
+		if err != nil {
+			log.Errorf("Remove sync pair %s error %v", req.ID, err)
+			result, code, errmsg = "", 1, err.Error()
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(code, result, errmsg)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// SyncStatusHandler returns sync pairs and their status
+func SyncStatusHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.sm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+
+		if !validMethod(ctx, w, r, []string{http.MethodGet}) {
+			return
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(0, s.sm.Status(), "")
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// RunSyncHandler starts syncing a pair now, all pairs if id is empty, status tells when it is done
+func RunSyncHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.sm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+		w.Header().Set("Accept", "application/json")
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+
+		req := &api.SyncPairIDReq{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			err = fmt.Errorf("Invalid json request body: %v", err)
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer r.Body.Close()
+		result, code, errmsg := "ok", 0, ""
+		found := req.ID == ""
+		for _, st := range s.sm.Status() {
+			if st.ID == req.ID {
+				found = true
+			}
+		}
+		if found {
+			go s.sm.Sync(req.ID)
+		} else {
+			result, code, errmsg = "", 1, fmt.Sprintf("sync pair %s not exists", req.ID)
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(code, result, errmsg)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// AddBackupHandler watch backup folder handler
+func AddBackupHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.bm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+		w.Header().Set("Accept", "application/json")
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+
+		req := &api.BackupReq{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			err = fmt.Errorf("Invalid json request body: %v", err)
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer r.Body.Close()
+		if req.Local == "" || req.Remote == "" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument local or remote must not empty"))
+			return
+		}
+
+		watch, err := s.bm.AddWatch(backup.Watch{
+			Local:         req.Local,
+			Remote:        req.Remote,
+			Sno:           req.Sno,
+			IsEncrypt:     req.IsEncrypt,
+			Include:       req.Include,
+			Exclude:       req.Exclude,
+			StableSeconds: req.StableSeconds,
+		})
+		code, errmsg := 0, ""
+		if err != nil {
+			log.Errorf("Add backup %+v error %v", req, err)
+			code, errmsg = 1, err.Error()
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(code, watch, errmsg)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// RemoveBackupHandler stop backup handler, files uploaded are kept
+func RemoveBackupHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.bm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+		w.Header().Set("Accept", "application/json")
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+
+		req := &api.BackupIDReq{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			err = fmt.Errorf("Invalid json request body: %v", err)
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer r.Body.Close()
+		if req.ID == "" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument id must not empty"))
+			return
+		}
+
+		err := s.bm.RemoveWatch(req.ID)
+		result, code, errmsg := "ok", 0, ""
+		if err != nil {
+			log.Errorf("Remove backup %s error %v", req.ID, err)
+			result, code, errmsg = "", 1, err.Error()
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(code, result, errmsg)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// BackupStatusHandler returns backup folders and their status
+func BackupStatusHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.bm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+
+		if !validMethod(ctx, w, r, []string{http.MethodGet}) {
+			return
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(0, s.bm.Status(), "")
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// BackupQueueHandler returns files waiting for backup
+func BackupQueueHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.bm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+
+		if !validMethod(ctx, w, r, []string{http.MethodGet}) {
+			return
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(0, s.bm.Queue(), "")
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// TransferListHandler returns transfer jobs in order of creation
+func TransferListHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.tm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+
+		if !validMethod(ctx, w, r, []string{http.MethodGet}) {
+			return
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(0, s.tm.Jobs(), "")
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
+// TransferActionHandler pause, resume, cancel or retry transfer job handler
+func TransferActionHandler(s *HTTPServer, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !s.CanBeWork() || s.tm == nil {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("register first"))
+			return
+		}
+		log := s.cm.Log
+		w.Header().Set("Accept", "application/json")
+
+		if !validMethod(ctx, w, r, []string{http.MethodPost}) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			errorResponse(ctx, w, http.StatusUnsupportedMediaType, errors.New("Invalid content type"))
+			return
+		}
+
+		req := &api.TransferIDReq{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			err = fmt.Errorf("Invalid json request body: %v", err)
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer r.Body.Close()
+		if req.ID == "" {
+			errorResponse(ctx, w, http.StatusBadRequest, errors.New("argument id must not empty"))
+			return
+		}
+
+		var err error
+		switch action {
+		case "pause":
+			err = s.tm.Pause(req.ID)
+		case "resume":
+			err = s.tm.Resume(req.ID)
+		case "cancel":
+			err = s.tm.Cancel(req.ID)
+		case "retry":
+			err = s.tm.Retry(req.ID)
+		}
+		result, code, errmsg := "ok", 0, ""
+		if err != nil {
+			log.Errorf("Transfer %s %s error %v", action, req.ID, err)
+			result, code, errmsg = "", 1, err.Error()
+		}
+
+		rsp, err := common.MakeUnifiedHTTPResponse(code, result, errmsg)
+		if err != nil {
+			errorResponse(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		if err := JSONResponse(w, rsp); err != nil {
+			log.Infof("Error %v\n", err)
+		}
+	}
+}
+
 // FileTypeHandler returns service status
 func FileTypeHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1539,6 +2375,19 @@ func FileTypeHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
+// OpenAPIHandler returns OpenAPI document of endpoints, it is served before register
+func OpenAPIHandler(s *HTTPServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !validMethod(ctx, w, r, []string{http.MethodGet}) {
+			return
+		}
+		if err := JSONResponse(w, api.OpenAPI()); err != nil {
+			s.log.Infof("Error %v\n", err)
+		}
+	}
+}
+
 // JSONResponse marshal data into json and write response
 func JSONResponse(w http.ResponseWriter, data interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
@@ -1552,7 +2401,7 @@ func JSONResponse(w http.ResponseWriter, data interface{}) error {
 }
 
 func errorResponse(ctx context.Context, w http.ResponseWriter, code int, err error) {
-	unifiedres, err := common.MakeUnifiedHTTPResponse(code, "", err.Error())
+	unifiedres, err := common.MakeUnifiedHTTPResponse(errorCode(code, err), "", err.Error())
 	if err != nil {
 		return
 	}
@@ -1561,6 +2410,23 @@ func errorResponse(ctx context.Context, w http.ResponseWriter, code int, err err
 	}
 }
 
+// errorCode refines code 400 by class of err, so clients of API tell files not found and tracker unreachable
+func errorCode(code int, err error) int {
+	if code != http.StatusBadRequest {
+		return code
+	}
+	if _, ok := err.(*daemon.NotExistError); ok {
+		return http.StatusNotFound
+	}
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return http.StatusServiceUnavailable
+	}
+	return code
+}
+
 // Shutdown stops the HTTPServer
 func (s *HTTPServer) Shutdown() {
 	log := s.log
@@ -1569,7 +2435,7 @@ func (s *HTTPServer) Shutdown() {
 	close(s.quit)
 
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(4)
 
 	shutdown := func(proto string, ln *http.Server) {
 		defer wg.Done()
@@ -1593,10 +2459,24 @@ func (s *HTTPServer) Shutdown() {
 
 	shutdown("HTTP", s.httpListener)
 	shutdown("HTTPS", s.httpsListener)
+	shutdown("WebDAV", s.davListener)
+	shutdown("S3", s.s3Listener)
 
+	if s.sm != nil {
+		s.sm.Shutdown()
+	}
+	if s.bm != nil {
+		s.bm.Shutdown()
+	}
+	if s.tm != nil {
+		s.tm.Shutdown()
+	}
 	if s.cm != nil {
 		s.cm.Shutdown()
 	}
+	if s.trackerConn != nil {
+		s.trackerConn.Close()
+	}
 	wg.Wait()
 
 	<-s.done
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samoslab/nebula/client/common"
+	"github.com/sirupsen/logrus"
+)
+
+var errAPIDisabled = errors.New("api disabled")
+
+// statusResponse writes error in unified response with http status, for requests refused before handlers
+func statusResponse(w http.ResponseWriter, status int, err error) {
+	rsp, merr := common.MakeUnifiedHTTPResponse(status, "", err.Error())
+	if merr != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// DefaultTrustedProxies proxies trusted when trusted_proxies is not set, a proxy on the same host
+var DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// trustedNets parses CIDRs or ip addresses of proxies, invalid ones are skipped
+func trustedNets(log logrus.FieldLogger, proxies []string) []*net.IPNet {
+	if len(proxies) == 0 {
+		proxies = DefaultTrustedProxies
+	}
+	nets := []*net.IPNet{}
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			log.Errorf("Trusted proxy %s skipped, %v", p, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func trusted(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns ip of client of r. X-Forwarded-For is read only if the peer is a trusted proxy, its addresses
+// are walked from the last one which is added by the nearest proxy, the first address not of a trusted proxy is
+// the client, addresses before it are sent by client and can not be trusted.
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted(ip, proxies) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trusted(ip, proxies) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// realIP sets RemoteAddr of requests to address of client forwarded by trusted proxies, so logs and throttle see client
+func realIP(h http.Handler, proxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = net.JoinHostPort(clientIP(r, proxies), "0")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// apiDisabled refuses all API requests, server serves static files only
+func apiDisabled() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statusResponse(w, http.StatusForbidden, errAPIDisabled)
+	})
+}
+
+type window struct {
+	start time.Time
+	count int64
+}
+
+// throttle allows max requests of a client in every duration
+type throttle struct {
+	max      int64
+	duration time.Duration
+
+	mutex   sync.Mutex
+	windows map[string]*window
+	swept   time.Time
+}
+
+func newThrottle(max int64, duration time.Duration) *throttle {
+	return &throttle{max: max, duration: duration, windows: map[string]*window{}}
+}
+
+// allow counts request of client, it returns time to wait if client has max requests in current duration
+func (t *throttle) allow(client string, now time.Time) (bool, time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if now.Sub(t.swept) > t.duration {
+		for c, w := range t.windows {
+			if now.Sub(w.start) >= t.duration {
+				delete(t.windows, c)
+			}
+		}
+		t.swept = now
+	}
+	w, ok := t.windows[client]
+	if !ok || now.Sub(w.start) >= t.duration {
+		w = &window{start: now}
+		t.windows[client] = w
+	}
+	if w.count >= t.max {
+		return false, w.start.Add(t.duration).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+// Handler refuses requests of client over limit with 429 Too Many Requests
+func (t *throttle) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := t.allow(clientIP(r, nil), time.Now())
+		if !ok {
+			seconds := int64(wait/time.Second) + 1
+			w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+			statusResponse(w, http.StatusTooManyRequests, fmt.Errorf("too many requests, retry after %d seconds", seconds))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/samoslab/nebula/client/auth"
+	"github.com/samoslab/nebula/client/common"
+	"github.com/samoslab/nebula/client/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := trustedNets(logrus.New(), []string{"10.0.0.0/24", "192.168.1.9", "bad"})
+	require.Len(t, proxies, 2)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:51000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	require.Equal(t, "10.0.0.2", clientIP(r, nil))
+	// address sent by client is not trusted
+	require.Equal(t, "5.6.7.8", clientIP(r, proxies))
+	// trusted hops are skipped from right to left
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 192.168.1.9")
+	require.Equal(t, "5.6.7.8", clientIP(r, proxies))
+	r.Header.Set("X-Forwarded-For", "garbage")
+	require.Equal(t, "10.0.0.2", clientIP(r, proxies))
+
+	// client connecting directly can not spoof its address
+	r.RemoteAddr = "8.8.8.8:51000"
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+	require.Equal(t, "8.8.8.8", clientIP(r, proxies))
+	require.Equal(t, "8.8.8.8", clientIP(r, trustedNets(logrus.New(), nil)))
+	r.RemoteAddr = "127.0.0.1:51000"
+	require.Equal(t, "5.6.7.8", clientIP(r, trustedNets(logrus.New(), nil)))
+
+	th := newThrottle(1, time.Minute)
+	h := realIP(th.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})), proxies)
+	for i, code := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "8.8.8.8:51000"
+		r.Header.Set("X-Forwarded-For", fmt.Sprintf("5.6.7.%d", i))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, code, w.Code)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(2, time.Minute)
+	now := time.Now()
+	ok, _ := th.allow("a", now)
+	require.True(t, ok)
+	ok, _ = th.allow("a", now.Add(time.Second))
+	require.True(t, ok)
+	ok, wait := th.allow("a", now.Add(2*time.Second))
+	require.False(t, ok)
+	require.Equal(t, 58*time.Second, wait)
+	ok, _ = th.allow("b", now.Add(2*time.Second))
+	require.True(t, ok)
+	ok, _ = th.allow("a", now.Add(time.Minute))
+	require.True(t, ok)
+	require.Len(t, th.windows, 2)
+	th.allow("a", now.Add(3*time.Minute))
+	require.Len(t, th.windows, 1)
+}
+
+func serveMux(s *HTTPServer, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/api/v1/store/upload/pending", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	s.setupMux().ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIGuard(t *testing.T) {
+	cfg := config.Config{APIAuthDisabled: true, StaticDir: "."}
+	a, err := auth.New(logrus.New(), cfg)
+	require.NoError(t, err)
+	s := &HTTPServer{cfg: cfg, log: logrus.New(), auth: a}
+
+	w := serveMux(s, "10.0.0.2:51000")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	rsp, err := common.DecodeResponse(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, errAPIDisabled.Error(), rsp.Errmsg)
+
+	s.cfg.APIEnabled = true
+	s.cfg.ThrottleMax = 1
+	s.cfg.ThrottleDuration = time.Minute
+	mux := s.setupMux()
+	for i, code := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("GET", "/api/v1/store/upload/pending", nil)
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		require.Equal(t, code, w.Code, i)
+	}
+	require.Equal(t, "60", w.Header().Get("Retry-After"))
+}
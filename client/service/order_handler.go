@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/samoslab/nebula/client/api"
 	"github.com/samoslab/nebula/client/common"
 )
 
@@ -87,13 +88,6 @@ func GetPackageInfoHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
-// BuyPackageReq request struct for buy package
-type BuyPackageReq struct {
-	ID       string `json:"id"`
-	Canceled bool   `json:"canceled"`
-	Quanlity uint32 `json:"quanlity"`
-}
-
 // BuyPackageHandler buy package handler
 func BuyPackageHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -114,7 +108,7 @@ func BuyPackageHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &BuyPackageReq{}
+		req := &api.BuyPackageReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -281,11 +275,6 @@ func GetOrderInfoHandler(s *HTTPServer) http.HandlerFunc {
 	}
 }
 
-// PayOrdorReq request struct for pay order
-type OnlyOrderReq struct {
-	ID string `json:"order_id"`
-}
-
 // PayOrderHandler  pay order handler
 func PayOrderHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -306,7 +295,7 @@ func PayOrderHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &OnlyOrderReq{}
+		req := &api.OnlyOrderReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
@@ -361,7 +350,7 @@ func RemoveOrderHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		req := &OnlyOrderReq{}
+		req := &api.OnlyOrderReq{}
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&req); err != nil {
 			err = fmt.Errorf("Invalid json request body: %v", err)
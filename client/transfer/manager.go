@@ -0,0 +1,472 @@
+package transfer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DirName directory of job state under config dir
+	DirName   = "transfer"
+	stateFile = "jobs.json"
+)
+
+var (
+	// Workers number of transfers run at the same time
+	Workers = 3
+	// HistoryMax number of finished jobs kept, older ones are dropped
+	HistoryMax = 500
+)
+
+// kinds of job
+const (
+	KindUpload      = "upload"
+	KindUploadDir   = "uploaddir"
+	KindDownload    = "download"
+	KindDownloadDir = "downloaddir"
+)
+
+// states of job
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StatePaused    = "paused"
+	StateCancelled = "cancelled"
+	StateFailed    = "failed"
+	StateDone      = "done"
+)
+
+var (
+	// ErrNoJob job id not found
+	ErrNoJob = errors.New("job not exists")
+	// ErrClosed manager is shut down
+	ErrClosed = errors.New("transfer manager closed")
+)
+
+// Transferer runs transfers until ctx is done, *daemon.ClientManager implements it
+type Transferer interface {
+	UploadFileContext(ctx context.Context, fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error
+	UploadDirContext(ctx context.Context, parent, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error
+	DownloadFileContext(ctx context.Context, downFileName, destDir, filehash string, fileSize uint64, sno uint32) error
+	DownloadDirContext(ctx context.Context, path, destDir string, sno uint32) error
+}
+
+// Job a transfer, Source is local path for uploads and path of space for downloads
+type Job struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	State       string `json:"state"`
+	Source      string `json:"source"`
+	Dest        string `json:"dest_dir"`
+	FileHash    string `json:"filehash,omitempty"`
+	FileSize    uint64 `json:"filesize,omitempty"`
+	Interactive bool   `json:"interactive"`
+	NewVersion  bool   `json:"newversion"`
+	IsEncrypt   bool   `json:"is_encrypt"`
+	Sno         uint32 `json:"space_no"`
+	Error       string `json:"error"`
+	Attempts    int    `json:"attempts"`
+	Created     int64  `json:"created"`
+	Started     int64  `json:"started"`
+	Finished    int64  `json:"finished"`
+}
+
+// finished tells whether the job will not run unless it is retried or resumed
+func (j *Job) finished() bool {
+	return j.State != StateQueued && j.State != StateRunning
+}
+
+func (j *Job) validate() error {
+	if j.Source == "" || j.Dest == "" {
+		return errors.New("source and dest_dir must not empty")
+	}
+	switch j.Kind {
+	case KindUpload:
+	case KindUploadDir:
+		if !filepath.IsAbs(j.Source) {
+			return fmt.Errorf("path %s must absolute", j.Source)
+		}
+	case KindDownload:
+		if j.FileHash == "" || j.FileSize == 0 {
+			return errors.New("filehash and filesize must not empty")
+		}
+	case KindDownloadDir:
+		if !path.IsAbs(j.Source) {
+			return fmt.Errorf("path %s must absolute", j.Source)
+		}
+	default:
+		return fmt.Errorf("unknown job kind %s", j.Kind)
+	}
+	return nil
+}
+
+// Manager runs jobs in a bounded pool of workers and keeps jobs in dir, jobs interrupted by shutdown are run again after restart
+type Manager struct {
+	// Notify is called with job changed, mutex of manager is held so it must not call manager
+	Notify func(job Job)
+
+	t   Transferer
+	log logrus.FieldLogger
+	dir string
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	jobs    map[string]*Job
+	cancels map[string]context.CancelFunc
+	waiters map[string][]chan struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewManager loads jobs saved in dir, jobs running when daemon stopped are queued again
+func NewManager(log logrus.FieldLogger, t Transferer, dir string) (*Manager, error) {
+	jobs := []*Job{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &jobs); err != nil {
+			return nil, err
+		}
+	}
+	m := &Manager{
+		t:       t,
+		log:     log.WithField("module", "transfer"),
+		dir:     dir,
+		jobs:    map[string]*Job{},
+		cancels: map[string]context.CancelFunc{},
+		waiters: map[string][]chan struct{}{},
+	}
+	m.cond = sync.NewCond(&m.mutex)
+	for _, j := range jobs {
+		if j.State == StateRunning {
+			j.State = StateQueued
+		}
+		m.jobs[j.ID] = j
+	}
+	return m, nil
+}
+
+// sorted returns jobs in order of creation, must be called with mutex held
+func (m *Manager) sorted() []*Job {
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		if jobs[a].Created != jobs[b].Created {
+			return jobs[a].Created < jobs[b].Created
+		}
+		return jobs[a].ID < jobs[b].ID
+	})
+	return jobs
+}
+
+// save drops oldest finished jobs beyond HistoryMax and saves jobs, must be called with mutex held
+func (m *Manager) save() error {
+	jobs := m.sorted()
+	finished := 0
+	for _, j := range jobs {
+		if j.finished() {
+			finished++
+		}
+	}
+	kept := make([]*Job, 0, len(jobs))
+	for _, j := range jobs {
+		if j.finished() && finished > HistoryMax {
+			finished--
+			delete(m.jobs, j.ID)
+			continue
+		}
+		kept = append(kept, j)
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	fileName := filepath.Join(m.dir, stateFile)
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// update saves jobs and wakes workers and waiters after changed is changed, must be called with mutex held
+func (m *Manager) update(changed *Job) {
+	if err := m.save(); err != nil {
+		m.log.Errorf("Save jobs error %v", err)
+	}
+	if m.Notify != nil {
+		m.Notify(*changed)
+	}
+	for id, chs := range m.waiters {
+		if j, ok := m.jobs[id]; ok && !j.finished() {
+			continue
+		}
+		for _, ch := range chs {
+			close(ch)
+		}
+		delete(m.waiters, id)
+	}
+	m.cond.Broadcast()
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Add queues job, the job queued is returned
+func (m *Manager) Add(job Job) (*Job, error) {
+	if err := job.validate(); err != nil {
+		return nil, err
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	job.ID, job.State, job.Error, job.Attempts = id, StateQueued, "", 0
+	job.Created, job.Started, job.Finished = time.Now().UnixNano(), 0, 0
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	m.jobs[id] = &job
+	m.update(&job)
+	m.log.Infof("Job %s %s %s queued", id, job.Kind, job.Source)
+	j := job
+	return &j, nil
+}
+
+// Get returns job of id
+func (m *Manager) Get(id string) (*Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrNoJob
+	}
+	job := *j
+	return &job, nil
+}
+
+// Jobs returns all jobs in order of creation
+func (m *Manager) Jobs() []Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	jobs := []Job{}
+	for _, j := range m.sorted() {
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+// change sets state of job id to to if it is in one of from, a running job is stopped
+func (m *Manager) change(id string, to string, from ...string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return ErrNoJob
+	}
+	allowed := false
+	for _, state := range from {
+		if j.State == state {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("job %s is %s, can not be %s", id, j.State, to)
+	}
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+	}
+	if to == StateQueued {
+		j.Error = ""
+	}
+	j.State = to
+	if j.finished() {
+		j.Finished = time.Now().UnixNano()
+	}
+	m.update(j)
+	m.log.Infof("Job %s %s", id, to)
+	return nil
+}
+
+// Pause stops queued or running job, uploaded blocks are kept for resume
+func (m *Manager) Pause(id string) error {
+	return m.change(id, StatePaused, StateQueued, StateRunning)
+}
+
+// Resume queues paused job again
+func (m *Manager) Resume(id string) error {
+	return m.change(id, StateQueued, StatePaused)
+}
+
+// Cancel stops job which is not finished
+func (m *Manager) Cancel(id string) error {
+	return m.change(id, StateCancelled, StateQueued, StateRunning, StatePaused)
+}
+
+// Retry queues failed or cancelled job again
+func (m *Manager) Retry(id string) error {
+	return m.change(id, StateQueued, StateFailed, StateCancelled)
+}
+
+// Wait waits until job id is finished or paused, the job is cancelled if ctx is done first
+func (m *Manager) Wait(ctx context.Context, id string) (*Job, error) {
+	m.mutex.Lock()
+	j, ok := m.jobs[id]
+	if !ok {
+		m.mutex.Unlock()
+		return nil, ErrNoJob
+	}
+	if j.finished() {
+		job := *j
+		m.mutex.Unlock()
+		return &job, nil
+	}
+	ch := make(chan struct{})
+	m.waiters[id] = append(m.waiters[id], ch)
+	m.mutex.Unlock()
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		if err := m.Cancel(id); err != nil && err != ErrNoJob {
+			m.log.Infof("Cancel job %s of waiter gone error %v", id, err)
+		}
+		return nil, ctx.Err()
+	}
+	return m.Get(id)
+}
+
+// start marks job running, must be called with mutex held
+func (m *Manager) start(j *Job) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancels[j.ID] = cancel
+	j.State = StateRunning
+	j.Error = ""
+	j.Attempts++
+	j.Started = time.Now().UnixNano()
+	j.Finished = 0
+	m.update(j)
+	return ctx
+}
+
+func (m *Manager) run(ctx context.Context, j Job) error {
+	switch j.Kind {
+	case KindUpload:
+		return m.t.UploadFileContext(ctx, j.Source, j.Dest, j.Interactive, j.NewVersion, j.IsEncrypt, j.Sno)
+	case KindUploadDir:
+		return m.t.UploadDirContext(ctx, j.Source, j.Dest, j.Interactive, j.NewVersion, j.IsEncrypt, j.Sno)
+	case KindDownload:
+		return m.t.DownloadFileContext(ctx, j.Source, j.Dest, j.FileHash, j.FileSize, j.Sno)
+	case KindDownloadDir:
+		return m.t.DownloadDirContext(ctx, j.Source, j.Dest, j.Sno)
+	}
+	return fmt.Errorf("unknown job kind %s", j.Kind)
+}
+
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for {
+		m.mutex.Lock()
+		var j *Job
+		for j == nil && !m.closed {
+			for _, queued := range m.sorted() {
+				// a job resumed before its former run stopped waits for it
+				if _, running := m.cancels[queued.ID]; queued.State == StateQueued && !running {
+					j = queued
+					break
+				}
+			}
+			if j == nil {
+				m.cond.Wait()
+			}
+		}
+		if m.closed {
+			m.mutex.Unlock()
+			return
+		}
+		ctx := m.start(j)
+		job := *j
+		m.mutex.Unlock()
+
+		m.log.Infof("Job %s %s %s started", job.ID, job.Kind, job.Source)
+		err := m.run(ctx, job)
+
+		m.mutex.Lock()
+		m.cancels[job.ID]()
+		delete(m.cancels, job.ID)
+		if j.State == StateRunning && !m.closed {
+			// state is kept if job is paused or cancelled, running job of shutdown is run again after restart
+			j.State = StateDone
+			if err != nil {
+				j.State, j.Error = StateFailed, err.Error()
+				m.log.Errorf("Job %s %s %s failed %v", job.ID, job.Kind, job.Source, err)
+			} else {
+				m.log.Infof("Job %s %s %s done", job.ID, job.Kind, job.Source)
+			}
+			j.Finished = time.Now().UnixNano()
+		}
+		m.update(j)
+		m.mutex.Unlock()
+	}
+}
+
+// Run starts Workers workers, it returns at once
+func (m *Manager) Run() {
+	workers := Workers
+	if workers < 1 {
+		workers = 1
+	}
+	m.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.work()
+	}
+}
+
+// Shutdown stops running jobs and waits for workers, they are run again after restart
+func (m *Manager) Shutdown() {
+	m.mutex.Lock()
+	m.closed = true
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+	m.cond.Broadcast()
+	m.mutex.Unlock()
+	m.wg.Wait()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// waiters get jobs still running, they are run again after restart
+	for id, chs := range m.waiters {
+		for _, ch := range chs {
+			close(ch)
+		}
+		delete(m.waiters, id)
+	}
+	if err := m.save(); err != nil {
+		m.log.Errorf("Save jobs error %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTransferer blocks every transfer until it is released or its ctx is done
+type fakeTransferer struct {
+	mutex   sync.Mutex
+	started chan string
+	release map[string]chan error
+}
+
+func newFakeTransferer() *fakeTransferer {
+	return &fakeTransferer{started: make(chan string, 10), release: map[string]chan error{}}
+}
+
+func (f *fakeTransferer) ch(name string) chan error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.release[name] == nil {
+		f.release[name] = make(chan error, 1)
+	}
+	return f.release[name]
+}
+
+func (f *fakeTransferer) transfer(ctx context.Context, name string) error {
+	f.started <- name
+	select {
+	case err := <-f.ch(name):
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeTransferer) UploadFileContext(ctx context.Context, fileName, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error {
+	return f.transfer(ctx, fileName)
+}
+
+func (f *fakeTransferer) UploadDirContext(ctx context.Context, parent, dest string, interactive, newVersion, isEncrypt bool, sno uint32) error {
+	return f.transfer(ctx, parent)
+}
+
+func (f *fakeTransferer) DownloadFileContext(ctx context.Context, downFileName, destDir, filehash string, fileSize uint64, sno uint32) error {
+	return f.transfer(ctx, downFileName)
+}
+
+func (f *fakeTransferer) DownloadDirContext(ctx context.Context, path, destDir string, sno uint32) error {
+	return f.transfer(ctx, path)
+}
+
+func (f *fakeTransferer) waitStarted(t *testing.T, name string) {
+	select {
+	case started := <-f.started:
+		require.Equal(t, name, started)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s not started", name)
+	}
+}
+
+func waitState(t *testing.T, m *Manager, id, state string) *Job {
+	for i := 0; i < 500; i++ {
+		j, err := m.Get(id)
+		require.NoError(t, err)
+		if j.State == state {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s not %s", id, state)
+	return nil
+}
+
+func TestManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	workers := Workers
+	Workers = 1
+	defer func() { Workers = workers }()
+
+	f := newFakeTransferer()
+	m, err := NewManager(logrus.New(), f, dir)
+	require.NoError(t, err)
+	m.Run()
+
+	_, err = m.Add(Job{Kind: KindUploadDir, Source: "relative", Dest: "/"})
+	require.Error(t, err)
+	_, err = m.Add(Job{Kind: KindDownload, Source: "/a", Dest: "/tmp"})
+	require.Error(t, err)
+
+	a, err := m.Add(Job{Kind: KindUpload, Source: "/local/a", Dest: "/"})
+	require.NoError(t, err)
+	b, err := m.Add(Job{Kind: KindDownload, Source: "/b", Dest: "/tmp", FileHash: "00", FileSize: 1})
+	require.NoError(t, err)
+	f.waitStarted(t, "/local/a")
+	waitState(t, m, a.ID, StateRunning)
+	// one worker, b waits for a
+	require.Equal(t, StateQueued, waitState(t, m, b.ID, StateQueued).State)
+
+	// paused job is stopped and b runs
+	require.NoError(t, m.Pause(a.ID))
+	f.waitStarted(t, "/b")
+	require.Error(t, m.Resume(b.ID))
+	f.ch("/b") <- errors.New("provider down")
+	j := waitState(t, m, b.ID, StateFailed)
+	require.Equal(t, "provider down", j.Error)
+
+	require.NoError(t, m.Resume(a.ID))
+	f.waitStarted(t, "/local/a")
+	f.ch("/local/a") <- nil
+	j, err = m.Wait(context.Background(), a.ID)
+	require.NoError(t, err)
+	require.Equal(t, StateDone, j.State)
+	require.Equal(t, 2, j.Attempts)
+
+	require.NoError(t, m.Retry(b.ID))
+	f.waitStarted(t, "/b")
+	require.NoError(t, m.Cancel(b.ID))
+	waitState(t, m, b.ID, StateCancelled)
+
+	// waiter gone cancels job
+	c, err := m.Add(Job{Kind: KindDownloadDir, Source: "/c", Dest: "/tmp"})
+	require.NoError(t, err)
+	f.waitStarted(t, "/c")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = m.Wait(ctx, c.ID)
+	require.Equal(t, context.DeadlineExceeded, err)
+	waitState(t, m, c.ID, StateCancelled)
+
+	// running job of shutdown is run again after restart
+	d, err := m.Add(Job{Kind: KindUploadDir, Source: "/local/d", Dest: "/"})
+	require.NoError(t, err)
+	f.waitStarted(t, "/local/d")
+	m.Shutdown()
+	_, err = m.Add(Job{Kind: KindUploadDir, Source: "/local/e", Dest: "/"})
+	require.Equal(t, ErrClosed, err)
+
+	m, err = NewManager(logrus.New(), f, dir)
+	require.NoError(t, err)
+	jobs := m.Jobs()
+	require.Len(t, jobs, 4)
+	require.Equal(t, []string{a.ID, b.ID, c.ID, d.ID}, []string{jobs[0].ID, jobs[1].ID, jobs[2].ID, jobs[3].ID})
+	require.Equal(t, StateQueued, jobs[3].State)
+	m.Run()
+	f.waitStarted(t, "/local/d")
+	f.ch("/local/d") <- nil
+	waitState(t, m, d.ID, StateDone)
+	m.Shutdown()
+}
+
+func TestHistoryMax(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	historyMax := HistoryMax
+	HistoryMax = 2
+	defer func() { HistoryMax = historyMax }()
+
+	m, err := NewManager(logrus.New(), newFakeTransferer(), dir)
+	require.NoError(t, err)
+	ids := []string{}
+	for i := 0; i < 4; i++ {
+		j, err := m.Add(Job{Kind: KindUpload, Source: "/local/a", Dest: "/"})
+		require.NoError(t, err)
+		ids = append(ids, j.ID)
+	}
+	for _, id := range ids[:3] {
+		require.NoError(t, m.Cancel(id))
+	}
+	jobs := m.Jobs()
+	require.Len(t, jobs, 3)
+	require.Equal(t, ids[1:], []string{jobs[0].ID, jobs[1].ID, jobs[2].ID})
+}
@@ -38,3 +38,13 @@ func (s SupportType) GetTypeAndExtension(fileType string) (string, string) {
 	}
 	return filetypeObj.Type, filetypeObj.Extension
 }
+
+// GetMIMEValue returns mime value of file type and extension listed by GetTypeAndExtension
+func (s SupportType) GetMIMEValue(fileType, extension string) (string, bool) {
+	for value, mime := range s {
+		if mime.Type == fileType && mime.Extension == extension {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -11,3 +11,13 @@ func TestFileType(t *testing.T) {
 	assert.Equal(t, ft.Type, "unknown")
 	assert.Equal(t, ft.Extension, "unknown")
 }
+
+func TestGetMIMEValue(t *testing.T) {
+	s := SupportTypes()
+	fileType, extension := s.GetTypeAndExtension("video/mp4")
+	value, ok := s.GetMIMEValue(fileType, extension)
+	assert.True(t, ok)
+	assert.Equal(t, "video/mp4", value)
+	_, ok = s.GetMIMEValue("unknown", "unknown")
+	assert.False(t, ok)
+}
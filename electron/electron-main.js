@@ -8,6 +8,8 @@ const path = require('path');
 
 const childProcess = require('child_process');
 
+const fs = require('fs');
+
 const cwd = require('process').cwd();
 
 // This adds refresh and devtools console keybindings
@@ -29,6 +31,8 @@ portfinder.getPort(function (err, p) {
 
 let defaultURL;
 let currentURL;
+// token of API of this samos run, sent by every request of the window
+let apiToken;
 
 // Force everything localhost, in case of a leak
 app.commandLine.appendSwitch('host-rules', 'MAP * 127.0.0.1, EXCLUDE *.store.samos.io, *.samos.io');
@@ -90,6 +94,17 @@ function startSamos() {
 
   samos.stdout.on('data', (data) => {
     console.log(data.toString());
+    // Samos names the file of its API token, the token itself is never printed
+    const tokenMarker = 'API token file ';
+    var t = data.indexOf(tokenMarker);
+    if (t !== -1) {
+      var tokenFile = data.toString().substr(t + tokenMarker.length).split('\n')[0].trim();
+      try {
+        apiToken = fs.readFileSync(tokenFile, 'utf8').trim();
+      } catch (e) {
+        console.log('Read API token failed: ' + e);
+      }
+    }
     // Scan for the web URL string
     if (currentURL) {
       return
@@ -160,6 +175,14 @@ function createWindow(url) {
     console.log('Cleared the stored cached data');
   });
 
+  // Authorize requests of the web UI to samos
+  ses.webRequest.onBeforeSendHeaders({urls: ['http://127.0.0.1:' + port + '/*']}, (details, callback) => {
+    if (apiToken) {
+      details.requestHeaders['Authorization'] = 'Bearer ' + apiToken;
+    }
+    callback({requestHeaders: details.requestHeaders});
+  });
+
   win.loadURL(url);
 
   // Open the DevTools.
@@ -0,0 +1,349 @@
+// Package cache keeps recently or frequently retrieved blocks on a fast tier,
+// either a folder on SSD or a memory budget, so hot blocks do not hit the bulk
+// storages on every Retrieve. Blocks are verified against the block key when admitted,
+// a cached file whose size or modification time changed since is verified again before it is served.
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	util_file "github.com/samoslab/nebula/util/file"
+	util_hash "github.com/samoslab/nebula/util/hash"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+)
+
+const cache_folder = "nebula-cache"
+const sep = string(os.PathSeparator)
+const filename_suffix = ".blk"
+const temp_suffix = ".tmp"
+
+type entry struct {
+	key     string
+	size    uint64
+	hits    uint64
+	data    []byte // only used by memory cache
+	elem    *list.Element
+	modTime time.Time // modification time of the cached file when verified, zero if not verified, eg: left by a previous run
+}
+
+// Stats is a snapshot of cache counters, it is published as metrics by the provider daemon.
+type Stats struct {
+	Policy     string
+	Path       string `json:",omitempty"`
+	Capacity   uint64
+	Used       uint64
+	Entries    int
+	Hits       uint64
+	Misses     uint64
+	Admissions uint64
+	Evictions  uint64
+	HitRatio   float64
+}
+
+type BlockCache struct {
+	path      string // empty means blocks are cached in memory
+	capacity  uint64
+	lfu       bool
+	mutex     sync.Mutex
+	used      uint64
+	entries   map[string]*entry
+	order     *list.List // front is the most recently used
+	admitting map[string]bool
+	pending   sync.WaitGroup
+	stats     Stats
+}
+
+// NewBlockCache creates a cache holding at most capacity bytes. Blocks are kept in folder path
+// if it is not empty, otherwise in memory. Blocks left in path by a previous run are reused.
+func NewBlockCache(path string, capacity uint64, policy string) (*BlockCache, error) {
+	if capacity == 0 {
+		return nil, errors.New("cache volume must be more than 0")
+	}
+	if policy == "" {
+		policy = PolicyLRU
+	}
+	if policy != PolicyLRU && policy != PolicyLFU {
+		return nil, fmt.Errorf("unknown cache policy: %s", policy)
+	}
+	self := &BlockCache{capacity: capacity,
+		lfu:       policy == PolicyLFU,
+		entries:   make(map[string]*entry),
+		order:     list.New(),
+		admitting: make(map[string]bool)}
+	self.stats.Policy, self.stats.Capacity = policy, capacity
+	if path != "" {
+		self.path = strings.TrimSuffix(path, sep) + sep + cache_folder
+		self.stats.Path = self.path
+		if err := self.loadFolder(); err != nil {
+			return nil, err
+		}
+	}
+	return self, nil
+}
+
+func (self *BlockCache) loadFolder() error {
+	if !util_file.Exists(self.path) {
+		return os.MkdirAll(self.path, 0700)
+	}
+	files, err := ioutil.ReadDir(self.path)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(name, filename_suffix) || self.used+uint64(f.Size()) > self.capacity {
+			if err = os.Remove(self.path + sep + name); err != nil {
+				log.Warnf("remove cache file %s failed, error: %s", name, err)
+			}
+			continue
+		}
+		key := strings.TrimSuffix(name, filename_suffix)
+		if _, err = hex.DecodeString(key); err != nil {
+			continue
+		}
+		e := &entry{key: key, size: uint64(f.Size())}
+		e.elem = self.order.PushBack(e)
+		self.entries[key] = e
+		self.used += e.size
+	}
+	return nil
+}
+
+func (self *BlockCache) filePath(key string) string {
+	return self.path + sep + key + filename_suffix
+}
+
+// Open returns a reader of the cached block, the content has been verified against key.
+func (self *BlockCache) Open(key []byte) (io.ReadCloser, bool) {
+	k := hex.EncodeToString(key)
+	self.mutex.Lock()
+	e, ok := self.entries[k]
+	if !ok {
+		self.stats.Misses++
+		self.mutex.Unlock()
+		return nil, false
+	}
+	e.hits++
+	self.order.MoveToFront(e.elem)
+	data := e.data
+	self.mutex.Unlock()
+	if self.path == "" {
+		// memory is verified when admitted
+		self.hit()
+		return ioutil.NopCloser(bytes.NewReader(data)), true
+	}
+	file, err := self.openFile(e, key, self.filePath(k))
+	if err == nil {
+		self.hit()
+		return file, true
+	}
+	log.Warnf("cached block verify failed, drop it, blockKey: %x", key)
+	self.Remove(key)
+	self.mutex.Lock()
+	self.stats.Misses++
+	self.mutex.Unlock()
+	return nil, false
+}
+
+// openFile opens the cached file, it is hashed only if not verified yet or its size or modification time changed
+func (self *BlockCache) openFile(e *entry, key []byte, path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	self.mutex.Lock()
+	verified := e.modTime
+	self.mutex.Unlock()
+	if uint64(info.Size()) == e.size && !verified.IsZero() && info.ModTime().Equal(verified) {
+		return file, nil
+	}
+	h := sha1.New()
+	if _, err = io.Copy(h, file); err == nil && !bytes.Equal(h.Sum(nil), key) {
+		err = errors.New("hash verify failed")
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	self.mutex.Lock()
+	e.modTime = info.ModTime()
+	self.mutex.Unlock()
+	return file, nil
+}
+
+func (self *BlockCache) hit() {
+	self.mutex.Lock()
+	self.stats.Hits++
+	self.mutex.Unlock()
+}
+
+// Admit copies the block at path into the cache, it is a no-op if the block is already cached
+// or larger than the cache. The copy is verified against key before it becomes visible.
+func (self *BlockCache) Admit(key []byte, path string, size uint64) {
+	k := hex.EncodeToString(key)
+	self.mutex.Lock()
+	_, cached := self.entries[k]
+	if cached || self.admitting[k] || size > self.capacity {
+		self.mutex.Unlock()
+		return
+	}
+	self.admitting[k] = true
+	self.mutex.Unlock()
+	e := &entry{key: k, size: size, hits: 1}
+	var err error
+	if self.path == "" {
+		e.data, err = readVerified(key, path)
+	} else if err = copyVerified(key, path, self.filePath(k)); err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(self.filePath(k)); err == nil {
+			e.modTime = info.ModTime()
+		}
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.admitting[k] {
+		// removed while copying
+		err = errors.New("block removed")
+	}
+	delete(self.admitting, k)
+	if err != nil {
+		if self.path != "" {
+			os.Remove(self.filePath(k))
+		}
+		log.Debugf("admit block to cache failed, blockKey: %x error: %s", key, err)
+		return
+	}
+	for self.used+size > self.capacity && self.order.Len() > 0 {
+		self.evict()
+	}
+	e.elem = self.order.PushFront(e)
+	self.entries[k] = e
+	self.used += size
+	self.stats.Admissions++
+}
+
+// AdmitAsync admits the block in background, Flush waits for it
+func (self *BlockCache) AdmitAsync(key []byte, path string, size uint64) {
+	self.pending.Add(1)
+	go func() {
+		defer self.pending.Done()
+		self.Admit(key, path, size)
+	}()
+}
+
+// Flush waits until admissions started by AdmitAsync are done
+func (self *BlockCache) Flush() {
+	self.pending.Wait()
+}
+
+// evict drops the least recently used entry, or for LFU the least frequently used one
+// with ties broken by recency. It must be called with mutex held.
+func (self *BlockCache) evict() {
+	victim := self.order.Back()
+	if self.lfu {
+		for el := victim.Prev(); el != nil; el = el.Prev() {
+			if el.Value.(*entry).hits < victim.Value.(*entry).hits {
+				victim = el
+			}
+		}
+	}
+	self.drop(victim.Value.(*entry))
+	self.stats.Evictions++
+}
+
+func (self *BlockCache) drop(e *entry) {
+	self.order.Remove(e.elem)
+	delete(self.entries, e.key)
+	self.used -= e.size
+	if self.path != "" {
+		if err := os.Remove(self.filePath(e.key)); err != nil && !os.IsNotExist(err) {
+			log.Warnf("remove cache file of %s failed, error: %s", e.key, err)
+		}
+	}
+}
+
+// Remove drops the block from the cache, an admission in progress is abandoned.
+func (self *BlockCache) Remove(key []byte) {
+	k := hex.EncodeToString(key)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.admitting, k)
+	if e, ok := self.entries[k]; ok {
+		self.drop(e)
+	}
+}
+
+func (self *BlockCache) Stats() Stats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	s := self.stats
+	s.Used, s.Entries = self.used, len(self.entries)
+	if s.Hits+s.Misses > 0 {
+		s.HitRatio = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+	return s
+}
+
+func readVerified(key []byte, path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(util_hash.Sha1(data), key) {
+		return nil, errors.New("hash verify failed")
+	}
+	return data, nil
+}
+
+func copyVerified(key []byte, src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tempPath := dest + temp_suffix
+	out, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if er := out.Close(); err == nil {
+		err = er
+	}
+	if err == nil && !bytes.Equal(h.Sum(nil), key) {
+		err = errors.New("hash verify failed")
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, dest)
+}
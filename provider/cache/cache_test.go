@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	util_hash "github.com/samoslab/nebula/util/hash"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBlock(t *testing.T, dir string, size int, fill byte) (key []byte, path string) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = fill + byte(i%7)
+	}
+	f, err := ioutil.TempFile(dir, "block")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return util_hash.Sha1(data), f.Name()
+}
+
+func readAll(t *testing.T, c *BlockCache, key []byte) ([]byte, bool) {
+	r, ok := c.Open(key)
+	if !ok {
+		return nil, false
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return data, true
+}
+
+func TestMemoryLRU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := NewBlockCache("", 2500, PolicyLRU)
+	require.NoError(t, err)
+	k1, p1 := writeBlock(t, dir, 1000, 1)
+	k2, p2 := writeBlock(t, dir, 1000, 2)
+	k3, p3 := writeBlock(t, dir, 1000, 3)
+	_, ok := c.Open(k1)
+	require.False(t, ok)
+	c.Admit(k1, p1, 1000)
+	c.Admit(k2, p2, 1000)
+	data, ok := readAll(t, c, k1)
+	require.True(t, ok)
+	expect, _ := ioutil.ReadFile(p1)
+	require.Equal(t, expect, data)
+	c.Admit(k3, p3, 1000)
+	_, ok = c.Open(k2)
+	require.False(t, ok, "least recently used block should be evicted")
+	_, ok = c.Open(k1)
+	require.True(t, ok)
+	s := c.Stats()
+	require.Equal(t, 2, s.Entries)
+	require.Equal(t, uint64(2000), s.Used)
+	require.Equal(t, uint64(2), s.Hits)
+	require.Equal(t, uint64(2), s.Misses)
+	require.Equal(t, uint64(1), s.Evictions)
+	require.Equal(t, 0.5, s.HitRatio)
+}
+
+func TestDiskLFU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := NewBlockCache(dir, 2500, PolicyLFU)
+	require.NoError(t, err)
+	k1, p1 := writeBlock(t, dir, 1000, 1)
+	k2, p2 := writeBlock(t, dir, 1000, 2)
+	k3, p3 := writeBlock(t, dir, 1000, 3)
+	c.Admit(k1, p1, 1000)
+	c.Admit(k2, p2, 1000)
+	for i := 0; i < 3; i++ {
+		_, ok := readAll(t, c, k1)
+		require.True(t, ok)
+	}
+	_, ok := readAll(t, c, k2)
+	require.True(t, ok)
+	c.Admit(k3, p3, 1000)
+	_, ok = c.Open(k3)
+	require.True(t, ok)
+	_, ok = c.Open(k2)
+	require.False(t, ok, "least frequently used block should be evicted")
+
+	// cached blocks survive restart
+	c, err = NewBlockCache(dir, 2500, PolicyLFU)
+	require.NoError(t, err)
+	_, ok = readAll(t, c, k1)
+	require.True(t, ok)
+	c.Remove(k1)
+	_, ok = c.Open(k1)
+	require.False(t, ok)
+}
+
+func TestVerifyAgainstKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := NewBlockCache(dir, 2500, "")
+	require.NoError(t, err)
+	k1, p1 := writeBlock(t, dir, 1000, 1)
+	k2, _ := writeBlock(t, dir, 1000, 2)
+	c.Admit(k2, p1, 1000)
+	require.Equal(t, 0, c.Stats().Entries, "block not match key should not be admitted")
+	c.Admit(k1, p1, 1000)
+	require.NoError(t, ioutil.WriteFile(c.filePath(c.order.Front().Value.(*entry).key), []byte("corrupted"), 0600))
+	_, ok := c.Open(k1)
+	require.False(t, ok, "corrupted cached block should not be served")
+	require.Equal(t, 0, c.Stats().Entries)
+	_, err = NewBlockCache(dir, 2500, "mru")
+	require.Error(t, err)
+}
+
+func TestDiskVerifyStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := NewBlockCache(dir, 2500, "")
+	require.NoError(t, err)
+	k1, p1 := writeBlock(t, dir, 1000, 1)
+	_, p2 := writeBlock(t, dir, 1000, 2)
+	_, ok := c.Open(k1)
+	require.False(t, ok)
+	c.AdmitAsync(k1, p1, 1000)
+	c.Flush()
+	for i := 0; i < 2; i++ {
+		_, ok = readAll(t, c, k1)
+		require.True(t, ok)
+	}
+	s := c.Stats()
+	require.Equal(t, uint64(2), s.Hits)
+	require.Equal(t, uint64(1), s.Misses)
+	require.Equal(t, uint64(1), s.Admissions)
+
+	// file of same size changed on disk is verified again
+	data, err := ioutil.ReadFile(p2)
+	require.NoError(t, err)
+	path := c.filePath(c.order.Front().Value.(*entry).key)
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	_, ok = c.Open(k1)
+	require.False(t, ok, "changed cached block should not be served")
+	require.Equal(t, 0, c.Stats().Entries)
+}
@@ -54,6 +54,16 @@ func Stop() {
 	conn.Close()
 }
 
+// Flush sends all queued action logs, it waits for the sending in progress.
+func Flush() error {
+	if conn == nil {
+		return nil
+	}
+	<-sendLock
+	defer sendLockOff()
+	return doSend()
+}
+
 func send() {
 	select {
 	case _ = <-sendLock:
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 
 	"github.com/koding/multiconfig"
 	"github.com/robfig/cron"
@@ -42,10 +43,18 @@ type ProviderConfig struct {
 	DownBandwidth     uint64
 	EncryptKey        map[string]string  // key: version, eg: 0, 1, 2
 	ExtraStorage      []ExtraStorageInfo `json:",omitempty"` //key:storage index, 1-based eg: 1, 2, 3
+	CacheStoragePath  string             `json:",omitempty"` // fast disk (SSD) folder for hot blocks, empty means cache in memory
+	CacheVolume       uint64             `json:",omitempty"` // max bytes of hot block cache, 0 means disabled
+	CachePolicy       string             `json:",omitempty"` // lru or lfu, default lru
+	Host              string             `json:",omitempty"` // host or dynamic domain advertised to tracker at register
+	Port              uint32             `json:",omitempty"` // port advertised to tracker at register
 }
 
 var providerConfig *ProviderConfig
 
+// configMutex guards providerConfig and configFileModTs, they are replaced by reload on SIGHUP and by auto check of config file
+var configMutex sync.RWMutex
+
 const config_filename = "config.json"
 
 var configFilePath string
@@ -62,6 +71,8 @@ func LoadConfig(configDir string) error {
 	if !util_file.Exists(configFilePath) {
 		return NoConfErr
 	}
+	configMutex.Lock()
+	defer configMutex.Unlock()
 	pc, err := readConfig()
 	if err != nil {
 		return err
@@ -139,6 +150,7 @@ func StartAutoCheck() {
 	cronRunner.AddFunc("0,15,30,45 * * * * *", checkAndReload)
 	cronRunner.AddFunc("7 */3 * * * *", checkStorageAvailableSpace)
 	cronRunner.AddFunc("37 1,31 * * * *", checkStorageAvailableSpaceOfConf)
+	cronRunner.AddFunc("23 * * * * *", probeStorage)
 	cronRunner.Start()
 }
 
@@ -148,6 +160,8 @@ func StopAutoCheck() {
 }
 
 func checkAndReload() {
+	configMutex.Lock()
+	defer configMutex.Unlock()
 	modTs, err := getConfigFileModTime()
 	if err != nil {
 		log.Errorf("getConfigFileModTime Error: %s", err)
@@ -169,6 +183,33 @@ func checkAndReload() {
 	}
 }
 
+// Reload reads and verifies config file immediately, then reloads storages.
+// The running config is kept if the new one is not valid.
+func Reload() error {
+	if err := reloadConfig(); err != nil {
+		return err
+	}
+	checkStorageAvailableSpaceOfConf()
+	return nil
+}
+
+func reloadConfig() error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	pc, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if err = verifyConfig(pc); err != nil {
+		return err
+	}
+	if providerConfig != nil && pc.NodeId != providerConfig.NodeId {
+		return errors.New("NodeId can not be changed without restart")
+	}
+	providerConfig = pc
+	return nil
+}
+
 func getConfigFileModTime() (int64, error) {
 	fileInfo, err := os.Stat(configFilePath)
 	if err != nil {
@@ -177,6 +218,7 @@ func getConfigFileModTime() (int64, error) {
 	return fileInfo.ModTime().Unix(), nil
 }
 
+// readConfig reads config file, configMutex must be held.
 func readConfig() (*ProviderConfig, error) {
 	m := multiconfig.NewWithPath(configFilePath)
 	pc := new(ProviderConfig)
@@ -193,6 +235,8 @@ func readConfig() (*ProviderConfig, error) {
 }
 
 func GetProviderConfig() *ProviderConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
 	return providerConfig
 }
 
@@ -226,7 +270,7 @@ func saveProviderConfig(configPath string, pc *ProviderConfig) error {
 }
 
 func SaveProviderConfig() {
-	if err := saveProviderConfig(configFilePath, providerConfig); err != nil {
+	if err := saveProviderConfig(configFilePath, GetProviderConfig()); err != nil {
 		log.Errorf("save config file err: %s", err)
 	}
 }
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type StorageState int32
+
+const (
+	StorageOnline   StorageState = 0
+	StorageReadOnly StorageState = 1 // blocks can be retrieved, no new block is stored
+	StorageOffline  StorageState = 2 // blocks on it should be repaired elsewhere
+)
+
+func (self StorageState) String() string {
+	switch self {
+	case StorageOnline:
+		return "online"
+	case StorageReadOnly:
+		return "readOnly"
+	case StorageOffline:
+		return "offline"
+	}
+	return "unknown"
+}
+
+// consecutive I/O errors of Store/Retrieve before a storage is fenced to read-only
+const max_consecutive_errors = 5
+
+// consecutive successful probes before a fenced storage is back online
+const recover_probe_count = 10
+
+// a probe slower than this is counted as an error
+const probe_latency_limit = 10 * time.Second
+
+const probe_data_size = 4096
+
+// StorageHealth tracks I/O errors and probe latency of a storage.
+type StorageHealth struct {
+	mutex             sync.Mutex
+	state             StorageState
+	consecutiveErrors uint32
+	totalErrors       uint64
+	lastError         string
+	probeSuccess      uint32
+	lastProbeLatency  time.Duration
+	maxProbeLatency   time.Duration
+}
+
+// StorageHealthStats is a snapshot of StorageHealth, it is published as metrics by the provider daemon.
+type StorageHealthStats struct {
+	Index             byte
+	Path              string
+	State             string
+	ConsecutiveErrors uint32
+	TotalErrors       uint64
+	LastError         string `json:",omitempty"`
+	LastProbeLatency  time.Duration
+	MaxProbeLatency   time.Duration
+}
+
+var stateListener func(s *Storage, old StorageState, new StorageState, reason string)
+
+// SetStorageStateListener registers the callback invoked when a storage changes state, eg: to report to collector.
+func SetStorageStateListener(listener func(s *Storage, old StorageState, new StorageState, reason string)) {
+	stateListener = listener
+}
+
+func (self *Storage) State() StorageState {
+	self.health.mutex.Lock()
+	defer self.health.mutex.Unlock()
+	return self.health.state
+}
+
+// Writable tells if new blocks can be stored on the storage.
+func (self *Storage) Writable() bool {
+	return self.State() == StorageOnline
+}
+
+// Readable tells if blocks on the storage can be retrieved.
+func (self *Storage) Readable() bool {
+	return self.State() != StorageOffline
+}
+
+// ReportError records an I/O error of the storage, too many consecutive errors fence the storage to read-only.
+func (self *Storage) ReportError(err error) {
+	h := &self.health
+	h.mutex.Lock()
+	h.recordErrorLocked(err)
+	old, changed := StorageOnline, false
+	if h.consecutiveErrors >= max_consecutive_errors {
+		old, changed = h.escalateLocked(StorageReadOnly)
+	}
+	h.mutex.Unlock()
+	if changed {
+		self.notifyState(old, StorageReadOnly, "too many I/O errors, last error: "+err.Error())
+	}
+}
+
+// ReportSuccess resets the consecutive error counter after a successful I/O operation.
+func (self *Storage) ReportSuccess() {
+	self.health.mutex.Lock()
+	self.health.consecutiveErrors = 0
+	self.health.mutex.Unlock()
+}
+
+// recordErrorLocked counts an error, h.mutex must be held.
+func (h *StorageHealth) recordErrorLocked(err error) {
+	h.consecutiveErrors++
+	h.totalErrors++
+	h.lastError = err.Error()
+	h.probeSuccess = 0
+}
+
+// escalateLocked raises the state to a severer one, a state is never lowered by a fault, only by recovery of probe.
+// h.mutex must be held, the change is notified by notifyState after the mutex is released.
+func (h *StorageHealth) escalateLocked(state StorageState) (old StorageState, changed bool) {
+	old = h.state
+	if state <= old {
+		return old, false
+	}
+	h.state = state
+	return old, true
+}
+
+func (self *Storage) notifyState(old StorageState, state StorageState, reason string) {
+	if state == StorageOnline {
+		log.Infof("storage %s is %s: %s", self.Path, state, reason)
+	} else {
+		log.Errorf("storage %s is %s: %s", self.Path, state, reason)
+	}
+	if stateListener != nil {
+		stateListener(self, old, state, reason)
+	}
+}
+
+func (self *Storage) HealthStats() StorageHealthStats {
+	h := &self.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return StorageHealthStats{Index: self.Index,
+		Path:              self.Path,
+		State:             h.state.String(),
+		ConsecutiveErrors: h.consecutiveErrors,
+		TotalErrors:       h.totalErrors,
+		LastError:         h.lastError,
+		LastProbeLatency:  h.lastProbeLatency,
+		MaxProbeLatency:   h.maxProbeLatency}
+}
+
+func (self *Storage) indexFilePath() string {
+	return self.Path + sep + sys_folder + sep + "storage-" + strconv.FormatInt(int64(self.Index), 10) + ".nebula"
+}
+
+// probe writes, syncs, reads back and removes a small file in temp path, then checks the index file is still readable.
+func (self *Storage) probe() {
+	start := time.Now()
+	writeErr := self.probeWrite()
+	_, readErr := ioutil.ReadFile(self.indexFilePath())
+	latency := time.Since(start)
+	if writeErr == nil && readErr == nil && latency > probe_latency_limit {
+		writeErr = errors.New("probe too slow: " + latency.String())
+	}
+	h := &self.health
+	h.mutex.Lock()
+	h.lastProbeLatency = latency
+	if latency > h.maxProbeLatency {
+		h.maxProbeLatency = latency
+	}
+	// the transition is decided and applied under the mutex, so a concurrent ReportError can not be overwritten
+	var state StorageState
+	var reason string
+	old, changed := h.state, false
+	switch {
+	case readErr != nil:
+		h.recordErrorLocked(readErr)
+		state, reason = StorageOffline, "probe read failed: "+readErr.Error()
+		old, changed = h.escalateLocked(state)
+	case writeErr != nil:
+		h.recordErrorLocked(writeErr)
+		state, reason = StorageReadOnly, "probe write failed: "+writeErr.Error()
+		old, changed = h.escalateLocked(state)
+	default:
+		h.probeSuccess++
+		if h.state != StorageOnline && h.probeSuccess >= recover_probe_count {
+			h.consecutiveErrors = 0
+			state, reason = StorageOnline, "probe succeeded "+strconv.Itoa(recover_probe_count)+" times"
+			h.state, changed = StorageOnline, true
+		}
+	}
+	h.mutex.Unlock()
+	if changed {
+		self.notifyState(old, state, reason)
+	}
+}
+
+func (self *Storage) probeWrite() error {
+	data := make([]byte, probe_data_size)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	path := self.TempPath() + sep + "probe-" + randStr(8)
+	defer os.Remove(path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if er := file.Close(); err == nil {
+		err = er
+	}
+	if err != nil {
+		return err
+	}
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, data) {
+		return errors.New("probe data read back not match")
+	}
+	return nil
+}
+
+func probeStorage() {
+	checkStorageOfConf.Lock()
+	sl := make([]*Storage, 0, len(storageMap))
+	for _, s := range storageMap {
+		sl = append(sl, s)
+	}
+	checkStorageOfConf.Unlock()
+	for _, s := range sl {
+		s.probe()
+	}
+}
+
+// AllStorageHealthStats returns health of all configured storages.
+func AllStorageHealthStats() []StorageHealthStats {
+	checkStorageOfConf.Lock()
+	defer checkStorageOfConf.Unlock()
+	res := make([]StorageHealthStats, 0, len(storageMap))
+	for _, s := range storageMap {
+		res = append(res, s.HealthStats())
+	}
+	return res
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStorageFencing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-health-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStorage(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.SmallFileDb.Close()
+	changes := make([]StorageState, 0, 3)
+	SetStorageStateListener(func(_ *Storage, _ StorageState, new StorageState, _ string) {
+		changes = append(changes, new)
+	})
+	defer SetStorageStateListener(nil)
+	storageSlice = []*Storage{s}
+	defer func() { storageSlice = nil }()
+
+	s.probe()
+	if s.State() != StorageOnline || GetWriteStorage(1024) != s {
+		t.Errorf("healthy storage should be writable")
+	}
+	for i := 0; i < max_consecutive_errors-1; i++ {
+		s.ReportError(errors.New("input/output error"))
+	}
+	s.ReportSuccess()
+	s.ReportError(errors.New("input/output error"))
+	if !s.Writable() {
+		t.Errorf("storage should not be fenced after non-consecutive errors")
+	}
+	for i := 0; i < max_consecutive_errors; i++ {
+		s.ReportError(errors.New("input/output error"))
+	}
+	if s.State() != StorageReadOnly || !s.Readable() {
+		t.Errorf("expected read-only, got %s", s.State())
+	}
+	if GetWriteStorage(1024) != nil {
+		t.Errorf("read-only storage should be excluded from GetWriteStorage")
+	}
+	for i := 0; i < recover_probe_count; i++ {
+		s.probe()
+	}
+	if !s.Writable() {
+		t.Errorf("storage should be back online after successful probes, got %s", s.State())
+	}
+	if err = os.Remove(s.indexFilePath()); err != nil {
+		t.Fatal(err)
+	}
+	s.probe()
+	if s.Readable() {
+		t.Errorf("expected offline, got %s", s.State())
+	}
+	for i := 0; i < max_consecutive_errors; i++ {
+		s.ReportError(errors.New("input/output error"))
+	}
+	if s.State() != StorageOffline {
+		t.Errorf("I/O errors should not lower offline storage to read-only, got %s", s.State())
+	}
+	expect := []StorageState{StorageReadOnly, StorageOnline, StorageOffline}
+	if len(changes) != len(expect) {
+		t.Fatalf("expected state changes %v, got %v", expect, changes)
+	}
+	for i := range expect {
+		if changes[i] != expect[i] {
+			t.Errorf("expected state changes %v, got %v", expect, changes)
+		}
+	}
+	if st := s.HealthStats(); st.TotalErrors != 3*max_consecutive_errors+1 || st.State != "offline" {
+		t.Errorf("unexpected health stats: %+v", st)
+	}
+}
@@ -34,6 +34,7 @@ type Storage struct {
 	Index       byte // 0 as Main Storage
 	Volume      uint64
 	SmallFileDb *leveldb.DB
+	health      StorageHealth
 }
 
 func (self *Storage) initStorage() error {
@@ -51,7 +52,7 @@ func (self *Storage) initStorage() error {
 		if err != nil {
 			return fmt.Errorf("mkdir sys folder: %s failed: %s", p, err)
 		}
-		newFile, err := os.Create(p + sep + "storage-" + strconv.FormatInt(int64(self.Index), 10) + ".nebula")
+		newFile, err := os.Create(self.indexFilePath())
 		if err != nil {
 			return fmt.Errorf("create storage index file failed: %s", err)
 		}
@@ -164,13 +165,21 @@ func GetWriteStorage(size uint64) *Storage {
 		return nil
 	}
 	defer incrementStorageIdx()
+	first := int(currentStorageIdx % uint64(l))
 	//104857600 = 100M
 	if size < 104857600 {
-		return sl[currentStorageIdx%uint64(l)]
+		for i := first; i < first+l; i++ {
+			if s := sl[i%l]; s.Writable() {
+				return s
+			}
+		}
+		return nil
 	} else {
-		first := int(currentStorageIdx % uint64(l))
 		for i := first; i < first+l; i++ {
 			s := sl[i%l]
+			if !s.Writable() {
+				continue
+			}
 			_, free, err := disk.Space(s.Path)
 			if err != nil {
 				log.Warnf("get storage %s free space error:%s", s.Path, err)
@@ -237,19 +246,22 @@ var checkStorageOfConfFirst = true
 func checkStorageAvailableSpaceOfConf() {
 	checkStorageOfConf.Lock()
 	defer checkStorageOfConf.Unlock()
+	pc := GetProviderConfig()
 	if storageMap == nil {
-		storageMap = make(map[string]*Storage, 1+len(providerConfig.ExtraStorage))
+		storageMap = make(map[string]*Storage, 1+len(pc.ExtraStorage))
 	}
-	sl := make([]*Storage, 0, 1+len(providerConfig.ExtraStorage))
+	sl := make([]*Storage, 0, 1+len(pc.ExtraStorage))
 	var ok bool
 	var s *Storage
 	var err error
 	if s, ok = storageMap["0"]; !ok {
-		s, err = NewStorage(providerConfig.MainStoragePath, 0)
+		s, err = NewStorage(pc.MainStoragePath, 0)
 		if err != nil {
 			log.Fatalf("main storage error: %s", err)
 		}
 		storageMap["0"] = s
+	} else if path := cleanPath(pc.MainStoragePath); path != s.Path {
+		log.Warnf("main storage path changed from %s to %s, it takes effect after restart", s.Path, path)
 	}
 	s.cleanTemp()
 	if s.Volume > min_available_volume_of_main {
@@ -257,8 +269,8 @@ func checkStorageAvailableSpaceOfConf() {
 	} else {
 		log.Errorf("main storage available space less than 1GB")
 	}
-	if len(providerConfig.ExtraStorage) > 0 {
-		for _, v := range providerConfig.ExtraStorage {
+	if len(pc.ExtraStorage) > 0 {
+		for _, v := range pc.ExtraStorage {
 			idx := strconv.FormatInt(int64(v.Index), 10)
 			if s, ok = storageMap[idx]; !ok {
 				s, err = NewStorage(v.Path, v.Index)
@@ -271,6 +283,8 @@ func checkStorageAvailableSpaceOfConf() {
 					continue
 				}
 				storageMap[idx] = s
+			} else if path := cleanPath(v.Path); path != s.Path {
+				log.Warnf("path of extra storage %d changed from %s to %s, it takes effect after restart", v.Index, s.Path, path)
 			}
 			if s.Volume > min_available_volume {
 				sl = append(sl, s)
@@ -298,6 +312,9 @@ func AvailableVolume() (total uint64, max uint64) {
 		return
 	}
 	for _, s := range storageSlice {
+		if !s.Writable() {
+			continue
+		}
 		_, free, err := disk.Space(s.Path)
 		if err != nil {
 			log.Errorf("get disk space of path %s error: %s", s.Path, err)
@@ -0,0 +1,445 @@
+// Package conformance checks that a ProviderService implementation honours the
+// provider RPC contract described in provider.proto. It serves the
+// implementation on a loopback listener and drives it through a real gRPC
+// client, so any backend can reuse the same suite from its own tests.
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/samoslab/nebula/provider/pb"
+	util_hash "github.com/samoslab/nebula/util/hash"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SmallFileLimit is the block size boundary between StoreSmall/RetrieveSmall and Store/Retrieve.
+const SmallFileLimit = 512 * 1024
+
+const stream_data_size = 32 * 1024
+
+// max_recv_msg_size matches the grpc server option used by the provider daemon.
+const max_recv_msg_size = 520 * 1024
+
+// auth_expired_seconds is older than the 900 seconds accepted by CheckAuth.
+const auth_expired_seconds = 3600
+
+const mock_ticket = "conformance-ticket"
+
+// Suite describes the implementation under test.
+type Suite struct {
+	// Server is the implementation under test, it must be ready to serve.
+	Server pb.ProviderServiceServer
+	// PubKeyBytes is the provider node public key used to sign request auth.
+	PubKeyBytes []byte
+	// Flush is called between repeated retrieves of a block, implementations caching blocks in background
+	// wait for the cache there, so later retrieves are served by the cache. It is optional.
+	Flush func()
+}
+
+// Run serves the implementation on a loopback listener and runs every contract check as a subtest.
+func Run(t *testing.T, s *Suite) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen loopback failed: %s", err)
+	}
+	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(max_recv_msg_size))
+	pb.RegisterProviderServiceServer(grpcServer, s.Server)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("dial %s failed: %s", lis.Addr(), err)
+	}
+	defer conn.Close()
+	c := &checker{client: pb.NewProviderServiceClient(conn), pubKeyBytes: s.PubKeyBytes, flush: s.Flush}
+	t.Run("Ping", c.testPing)
+	t.Run("StoreSmallSizeBoundary", c.testStoreSmallSizeBoundary)
+	t.Run("StoreSizeBoundary", c.testStoreSizeBoundary)
+	t.Run("StoreHashMismatch", c.testStoreHashMismatch)
+	t.Run("StoreAuthExpired", c.testStoreAuthExpired)
+	t.Run("SmallRoundTrip", c.testSmallRoundTrip)
+	t.Run("RoundTrip", c.testRoundTrip)
+	t.Run("RetrieveSizeBoundary", c.testRetrieveSizeBoundary)
+	t.Run("RetrieveAuthExpired", c.testRetrieveAuthExpired)
+	t.Run("Remove", c.testRemove)
+	t.Run("GetFragmentBounds", c.testGetFragmentBounds)
+	t.Run("CheckAvailable", c.testCheckAvailable)
+}
+
+type checker struct {
+	client      pb.ProviderServiceClient
+	pubKeyBytes []byte
+	flush       func()
+}
+
+type block struct {
+	data []byte
+	key  []byte
+}
+
+func newBlock(t *testing.T, size int) *block {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("generate random data failed: %s", err)
+	}
+	return &block{data: data, key: util_hash.Sha1(data)}
+}
+
+func now() uint64 {
+	return uint64(time.Now().Unix())
+}
+
+func timeoutCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 30*time.Second)
+}
+
+func (self *checker) storeReq(b *block, blockSize uint64, timestamp uint64) *pb.StoreReq {
+	req := &pb.StoreReq{Ticket: mock_ticket,
+		Timestamp: timestamp,
+		FileKey:   b.key,
+		FileSize:  blockSize,
+		BlockKey:  b.key,
+		BlockSize: blockSize}
+	req.GenAuth(self.pubKeyBytes)
+	return req
+}
+
+func (self *checker) retrieveReq(b *block, blockSize uint64, timestamp uint64) *pb.RetrieveReq {
+	req := &pb.RetrieveReq{Ticket: mock_ticket,
+		Timestamp: timestamp,
+		FileKey:   b.key,
+		FileSize:  blockSize,
+		BlockKey:  b.key,
+		BlockSize: blockSize}
+	req.GenAuth(self.pubKeyBytes)
+	return req
+}
+
+func (self *checker) removeReq(b *block) *pb.RemoveReq {
+	req := &pb.RemoveReq{Timestamp: now(), Key: b.key, Size: uint64(len(b.data))}
+	req.GenAuth(self.pubKeyBytes)
+	return req
+}
+
+func (self *checker) storeSmall(b *block, req *pb.StoreReq) error {
+	ctx, cancel := timeoutCtx()
+	defer cancel()
+	req.Data = b.data
+	_, err := self.client.StoreSmall(ctx, req)
+	return err
+}
+
+// storeStream sends data in chunks like the client does and returns the status the server closed the stream with.
+func (self *checker) storeStream(data []byte, req *pb.StoreReq) error {
+	ctx, cancel := timeoutCtx()
+	defer cancel()
+	stream, err := self.client.Store(ctx)
+	if err != nil {
+		return err
+	}
+	first := true
+	for len(data) > 0 {
+		n := stream_data_size
+		if n > len(data) {
+			n = len(data)
+		}
+		var chunk *pb.StoreReq
+		if first {
+			chunk, first = req, false
+			chunk.Data = data[:n]
+		} else {
+			chunk = &pb.StoreReq{Data: data[:n]}
+		}
+		if err = stream.Send(chunk); err != nil {
+			// the server has already closed the stream, CloseAndRecv returns the real status
+			break
+		}
+		data = data[n:]
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func (self *checker) store(b *block) error {
+	if len(b.data) < SmallFileLimit {
+		return self.storeSmall(b, self.storeReq(b, uint64(len(b.data)), now()))
+	}
+	return self.storeStream(b.data, self.storeReq(b, uint64(len(b.data)), now()))
+}
+
+func (self *checker) retrieveSmall(req *pb.RetrieveReq) ([]byte, error) {
+	ctx, cancel := timeoutCtx()
+	defer cancel()
+	resp, err := self.client.RetrieveSmall(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (self *checker) retrieveStream(req *pb.RetrieveReq) ([]byte, error) {
+	ctx, cancel := timeoutCtx()
+	defer cancel()
+	stream, err := self.client.Retrieve(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(resp.Data)
+	}
+	return buf.Bytes(), nil
+}
+
+func (self *checker) retrieve(b *block) ([]byte, error) {
+	req := self.retrieveReq(b, uint64(len(b.data)), now())
+	if len(b.data) < SmallFileLimit {
+		return self.retrieveSmall(req)
+	}
+	return self.retrieveStream(req)
+}
+
+func (self *checker) remove(b *block) error {
+	ctx, cancel := timeoutCtx()
+	defer cancel()
+	_, err := self.client.Remove(ctx, self.removeReq(b))
+	return err
+}
+
+func (self *checker) cleanup(t *testing.T, b *block) {
+	if err := self.remove(b); err != nil {
+		t.Errorf("remove block %x failed: %s", b.key, err)
+	}
+}
+
+func expectCode(t *testing.T, what string, err error, code codes.Code) {
+	if code == codes.OK {
+		if err != nil {
+			t.Errorf("%s: expected success, got %s", what, err)
+		}
+		return
+	}
+	if err == nil {
+		t.Errorf("%s: expected %s, got success", what, code)
+		return
+	}
+	if c := status.Code(err); c != code {
+		t.Errorf("%s: expected %s, got %s: %s", what, code, c, err)
+	}
+}
+
+func (self *checker) testPing(t *testing.T) {
+	ctx, cancel := timeoutCtx()
+	defer cancel()
+	_, err := self.client.Ping(ctx, &pb.PingReq{})
+	expectCode(t, "Ping", err, codes.OK)
+}
+
+func (self *checker) testStoreSmallSizeBoundary(t *testing.T) {
+	b := newBlock(t, 1024)
+	req := self.storeReq(b, SmallFileLimit, now())
+	expectCode(t, "StoreSmall blockSize equal to limit", self.storeSmall(b, req), codes.InvalidArgument)
+	req = self.storeReq(b, uint64(len(b.data)+1), now())
+	expectCode(t, "StoreSmall blockSize not match data", self.storeSmall(b, req), codes.InvalidArgument)
+	b = newBlock(t, SmallFileLimit-1)
+	expectCode(t, "StoreSmall blockSize just below limit", self.store(b), codes.OK)
+	self.cleanup(t, b)
+}
+
+func (self *checker) testStoreSizeBoundary(t *testing.T) {
+	b := newBlock(t, SmallFileLimit-1)
+	req := self.storeReq(b, uint64(len(b.data)), now())
+	expectCode(t, "Store blockSize below limit", self.storeStream(b.data, req), codes.InvalidArgument)
+	b = newBlock(t, SmallFileLimit)
+	expectCode(t, "Store blockSize equal to limit", self.store(b), codes.OK)
+	self.cleanup(t, b)
+	b = newBlock(t, SmallFileLimit+stream_data_size)
+	req = self.storeReq(b, uint64(len(b.data)-stream_data_size), now())
+	expectCode(t, "Store data exceed blockSize", self.storeStream(b.data, req), codes.InvalidArgument)
+	req = self.storeReq(b, uint64(len(b.data)+stream_data_size), now())
+	expectCode(t, "Store data less than blockSize", self.storeStream(b.data, req), codes.InvalidArgument)
+}
+
+func (self *checker) testStoreHashMismatch(t *testing.T) {
+	b := newBlock(t, 1024)
+	b.key = util_hash.Sha1(b.key)
+	expectCode(t, "StoreSmall hash mismatch", self.store(b), codes.InvalidArgument)
+	b = newBlock(t, SmallFileLimit+1)
+	b.key = util_hash.Sha1(b.key)
+	expectCode(t, "Store hash mismatch", self.store(b), codes.InvalidArgument)
+}
+
+func (self *checker) testStoreAuthExpired(t *testing.T) {
+	expired := now() - auth_expired_seconds
+	b := newBlock(t, 1024)
+	expectCode(t, "StoreSmall auth expired", self.storeSmall(b, self.storeReq(b, uint64(len(b.data)), expired)), codes.Unauthenticated)
+	req := self.storeReq(b, uint64(len(b.data)), now())
+	req.Ticket = "tampered-ticket"
+	expectCode(t, "StoreSmall auth tampered", self.storeSmall(b, req), codes.Unauthenticated)
+	b = newBlock(t, SmallFileLimit+1)
+	expectCode(t, "Store auth expired", self.storeStream(b.data, self.storeReq(b, uint64(len(b.data)), expired)), codes.Unauthenticated)
+}
+
+func (self *checker) testSmallRoundTrip(t *testing.T) {
+	self.roundTrip(t, newBlock(t, 4096))
+}
+
+func (self *checker) testRoundTrip(t *testing.T) {
+	self.roundTrip(t, newBlock(t, SmallFileLimit+3*stream_data_size+17))
+}
+
+func (self *checker) roundTrip(t *testing.T, b *block) {
+	if err := self.store(b); err != nil {
+		t.Fatalf("store block %x failed: %s", b.key, err)
+	}
+	defer self.cleanup(t, b)
+	expectCode(t, "duplicate store", self.store(b), codes.AlreadyExists)
+	// retrieve repeatedly, implementations may serve later reads from a cache
+	for i := 0; i < 3; i++ {
+		data, err := self.retrieve(b)
+		if err != nil {
+			t.Fatalf("retrieve block %x failed: %s", b.key, err)
+		}
+		if !bytes.Equal(data, b.data) {
+			t.Errorf("retrieve block %x: got %d bytes not equal to stored %d bytes", b.key, len(data), len(b.data))
+		}
+		if self.flush != nil {
+			self.flush()
+		}
+	}
+}
+
+func (self *checker) testRetrieveSizeBoundary(t *testing.T) {
+	small := newBlock(t, 2048)
+	big := newBlock(t, SmallFileLimit+1)
+	for _, b := range []*block{small, big} {
+		if err := self.store(b); err != nil {
+			t.Fatalf("store block %x failed: %s", b.key, err)
+		}
+		defer self.cleanup(t, b)
+	}
+	_, err := self.retrieveSmall(self.retrieveReq(big, uint64(len(big.data)), now()))
+	expectCode(t, "RetrieveSmall blockSize over limit", err, codes.InvalidArgument)
+	_, err = self.retrieveStream(self.retrieveReq(small, uint64(len(small.data)), now()))
+	expectCode(t, "Retrieve blockSize below limit", err, codes.InvalidArgument)
+	_, err = self.retrieveSmall(self.retrieveReq(big, uint64(len(small.data)), now()))
+	expectCode(t, "RetrieveSmall of big block", err, codes.FailedPrecondition)
+	_, err = self.retrieveSmall(self.retrieveReq(small, uint64(len(small.data)-1), now()))
+	expectCode(t, "RetrieveSmall blockSize not match data", err, codes.InvalidArgument)
+	_, err = self.retrieve(newBlock(t, 1024))
+	expectCode(t, "RetrieveSmall not exist", err, codes.NotFound)
+	_, err = self.retrieve(newBlock(t, SmallFileLimit))
+	expectCode(t, "Retrieve not exist", err, codes.NotFound)
+}
+
+func (self *checker) testRetrieveAuthExpired(t *testing.T) {
+	expired := now() - auth_expired_seconds
+	b := newBlock(t, 1024)
+	_, err := self.retrieveSmall(self.retrieveReq(b, uint64(len(b.data)), expired))
+	expectCode(t, "RetrieveSmall auth expired", err, codes.Unauthenticated)
+	b = newBlock(t, SmallFileLimit)
+	_, err = self.retrieveStream(self.retrieveReq(b, uint64(len(b.data)), expired))
+	expectCode(t, "Retrieve auth expired", err, codes.Unauthenticated)
+}
+
+func (self *checker) testRemove(t *testing.T) {
+	for _, b := range []*block{newBlock(t, 1024), newBlock(t, SmallFileLimit)} {
+		if err := self.store(b); err != nil {
+			t.Fatalf("store block %x failed: %s", b.key, err)
+		}
+		ctx, cancel := timeoutCtx()
+		req := self.removeReq(b)
+		req.Timestamp = now() - auth_expired_seconds
+		req.GenAuth(self.pubKeyBytes)
+		_, err := self.client.Remove(ctx, req)
+		cancel()
+		expectCode(t, "Remove auth expired", err, codes.Unauthenticated)
+		expectCode(t, "Remove", self.remove(b), codes.OK)
+		expectCode(t, "Remove again", self.remove(b), codes.NotFound)
+		_, err = self.retrieve(b)
+		expectCode(t, "Retrieve removed block", err, codes.NotFound)
+		expectCode(t, "Store removed block again", self.store(b), codes.OK)
+		self.cleanup(t, b)
+	}
+}
+
+func (self *checker) getFragment(b *block, positions []byte, size uint32, timestamp uint64) ([][]byte, error) {
+	ctx, cancel := timeoutCtx()
+	defer cancel()
+	req := &pb.GetFragmentReq{Timestamp: timestamp, Key: b.key, Positions: positions, Size: size}
+	req.GenAuth(self.pubKeyBytes)
+	resp, err := self.client.GetFragment(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (self *checker) testGetFragmentBounds(t *testing.T) {
+	for _, b := range []*block{newBlock(t, 1000), newBlock(t, SmallFileLimit+1000)} {
+		if err := self.store(b); err != nil {
+			t.Fatalf("store block %x failed: %s", b.key, err)
+		}
+		defer self.cleanup(t, b)
+		size := uint32(len(b.data))
+		_, err := self.getFragment(b, nil, 8, now())
+		expectCode(t, "GetFragment without positions", err, codes.InvalidArgument)
+		_, err = self.getFragment(b, []byte{10}, 0, now())
+		expectCode(t, "GetFragment zero size", err, codes.InvalidArgument)
+		_, err = self.getFragment(b, []byte{10, 100}, 8, now())
+		expectCode(t, "GetFragment position 100", err, codes.InvalidArgument)
+		_, err = self.getFragment(b, []byte{99}, size/50, now())
+		expectCode(t, "GetFragment position plus size out of bounds", err, codes.InvalidArgument)
+		_, err = self.getFragment(b, []byte{10}, 8, now()-auth_expired_seconds)
+		expectCode(t, "GetFragment auth expired", err, codes.Unauthenticated)
+		_, err = self.getFragment(newBlock(t, 1000), []byte{10}, 8, now())
+		expectCode(t, "GetFragment not exist", err, codes.NotFound)
+		positions := []byte{0, 37, 99}
+		fragments, err := self.getFragment(b, positions, 8, now())
+		expectCode(t, "GetFragment", err, codes.OK)
+		if err != nil {
+			continue
+		}
+		if len(fragments) != len(positions) {
+			t.Errorf("GetFragment: expected %d fragments, got %d", len(positions), len(fragments))
+			continue
+		}
+		for i, p := range positions {
+			pos := uint32(p) * size / 100
+			if !bytes.Equal(fragments[i], b.data[pos:pos+8]) {
+				t.Errorf("GetFragment: fragment at %d%% not match stored data", p)
+			}
+		}
+	}
+}
+
+func (self *checker) testCheckAvailable(t *testing.T) {
+	ctx, cancel := timeoutCtx()
+	defer cancel()
+	req := &pb.CheckAvailableReq{Timestamp: now() - auth_expired_seconds}
+	req.GenAuth(self.pubKeyBytes)
+	_, err := self.client.CheckAvailable(ctx, req)
+	expectCode(t, "CheckAvailable auth expired", err, codes.Unauthenticated)
+	req = &pb.CheckAvailableReq{Timestamp: now()}
+	req.GenAuth(self.pubKeyBytes)
+	resp, err := self.client.CheckAvailable(ctx, req)
+	expectCode(t, "CheckAvailable", err, codes.OK)
+	if err == nil && resp.MaxFileSize > resp.Total {
+		t.Errorf("CheckAvailable: maxFileSize %d more than total %d", resp.MaxFileSize, resp.Total)
+	}
+}
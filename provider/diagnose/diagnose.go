@@ -0,0 +1,266 @@
+// Package diagnose checks if the provider can be reached by clients from the public network
+// and gives actionable advice when it can not.
+package diagnose
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prestonTao/upnp"
+	"github.com/samoslab/nebula/provider/nat"
+	pb "github.com/samoslab/nebula/provider/pb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+type Level int
+
+const (
+	Pass Level = iota
+	Warn
+	Fail
+)
+
+func (self Level) String() string {
+	switch self {
+	case Pass:
+		return "OK"
+	case Warn:
+		return "WARN"
+	}
+	return "FAIL"
+}
+
+type Result struct {
+	Name   string
+	Level  Level
+	Detail string
+	Advice string `json:",omitempty"`
+}
+
+func (self *Result) String() string {
+	s := fmt.Sprintf("[%4s] %s: %s", self.Level, self.Name, self.Detail)
+	if self.Advice != "" {
+		s += "\n       advice: " + self.Advice
+	}
+	return s
+}
+
+type Options struct {
+	ListenPort int                    // local listen port of provider service
+	Host       string                 // advertised host or dynamic domain, empty means the ip seen by tracker is advertised
+	Port       int                    // advertised port clients connect to
+	TrackerIp  func() (string, error) // public ip of this provider seen by tracker
+}
+
+const ping_timeout = 5 * time.Second
+
+// Ping calls Ping of the provider service at addr.
+func Ping(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ping_timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = pb.NewProviderServiceClient(conn).Ping(ctx, &pb.PingReq{})
+	return err
+}
+
+// CheckReachable pings the provider service at public ip and port like a client does.
+func CheckReachable(ip string, port int, listenPort int) *Result {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	r := &Result{Name: "reachability"}
+	if err := Ping(addr); err != nil {
+		r.Level, r.Detail = Fail, fmt.Sprintf("ping %s failed: %s", addr, err)
+		r.Advice = fmt.Sprintf("forward TCP port %d on your router to port %d of %s, and allow TCP port %d in the firewall of this host. "+
+			"Some routers can not connect to their own public address (no NAT loopback), in that case verify from another network.",
+			port, listenPort, localIp(), listenPort)
+		return r
+	}
+	r.Detail = "ping " + addr + " success"
+	return r
+}
+
+// Run does all checks, later checks are skipped if the public ip can not be learned from tracker.
+func Run(opts *Options) []*Result {
+	res := make([]*Result, 0, 8)
+	res = append(res, checkLocal(opts.ListenPort))
+	r, trackerIp := checkTracker(opts.TrackerIp)
+	res = append(res, r)
+	if trackerIp == nil {
+		return res
+	}
+	res = append(res, checkInterface(trackerIp))
+	upnpRes, upnpIp := checkUpnp(opts.ListenPort, opts.Port)
+	res = append(res, upnpRes)
+	natpmpRes, natpmpIp := checkNatPmp(opts.ListenPort, opts.Port)
+	res = append(res, natpmpRes)
+	for _, gatewayIp := range []net.IP{upnpIp, natpmpIp} {
+		if gatewayIp != nil {
+			res = append(res, CheckGatewayIp(gatewayIp, trackerIp))
+			break
+		}
+	}
+	res = append(res, CheckReachable(trackerIp.String(), opts.Port, opts.ListenPort))
+	if opts.Host != "" {
+		res = append(res, CheckAdvertisedHost(opts.Host, trackerIp))
+	}
+	if opts.Port != opts.ListenPort && upnpIp == nil && natpmpIp == nil {
+		res = append(res, &Result{Name: "advertised port", Level: Warn,
+			Detail: fmt.Sprintf("advertised port %d is not the listen port %d and no port mapping is created automatically", opts.Port, opts.ListenPort),
+			Advice: fmt.Sprintf("forward TCP port %d on your router to port %d of %s", opts.Port, opts.ListenPort, localIp())})
+	}
+	return res
+}
+
+// Failed tells if any result is Fail.
+func Failed(res []*Result) bool {
+	for _, r := range res {
+		if r.Level == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+func checkLocal(listenPort int) *Result {
+	r := &Result{Name: "local service"}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort))
+	if err := Ping(addr); err != nil {
+		r.Level, r.Detail = Fail, fmt.Sprintf("ping %s failed: %s", addr, err)
+		r.Advice = fmt.Sprintf("port %d may be used by another program, check it with \"netstat -tlnp\" or use another listen port", listenPort)
+		return r
+	}
+	r.Detail = "provider service is listening on port " + strconv.Itoa(listenPort)
+	return r
+}
+
+func checkTracker(trackerIp func() (string, error)) (*Result, net.IP) {
+	r := &Result{Name: "tracker"}
+	ipStr, err := trackerIp()
+	if err != nil {
+		r.Level, r.Detail = Fail, "get public ip from tracker failed: "+err.Error()
+		r.Advice = "check the network connection of this host and the -trackerServer argument"
+		return r, nil
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		r.Level, r.Detail = Fail, "tracker returned invalid ip: "+ipStr
+		return r, nil
+	}
+	r.Detail = "tracker sees this provider at " + ipStr
+	return r, ip
+}
+
+func checkInterface(trackerIp net.IP) *Result {
+	r := &Result{Name: "public address"}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		r.Level, r.Detail = Warn, "list interface address failed: "+err.Error()
+		return r
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(trackerIp) {
+			r.Detail = trackerIp.String() + " is bound to this host, no NAT in between"
+			return r
+		}
+	}
+	r.Detail = fmt.Sprintf("this host (%s) is behind NAT, public ip is %s", localIp(), trackerIp)
+	return r
+}
+
+func checkUpnp(listenPort int, port int) (*Result, net.IP) {
+	r := &Result{Name: "upnp"}
+	upnpMan := new(upnp.Upnp)
+	if err := upnpMan.ExternalIPAddr(); err != nil {
+		r.Level, r.Detail = Warn, "no UPnP gateway: "+err.Error()
+		r.Advice = "enable UPnP on your router, or forward the port manually"
+		return r, nil
+	}
+	ip := net.ParseIP(upnpMan.GatewayOutsideIP)
+	if err := upnpMan.AddPortMapping(listenPort, port, "TCP"); err != nil {
+		r.Level, r.Detail = Warn, fmt.Sprintf("gateway public ip is %s, but map port %d failed: %s", upnpMan.GatewayOutsideIP, port, err)
+		r.Advice = fmt.Sprintf("port %d may be mapped to another host, check the port forwarding of your router", port)
+		return r, ip
+	}
+	r.Detail = fmt.Sprintf("gateway public ip is %s, port %d is mapped to %d", upnpMan.GatewayOutsideIP, port, listenPort)
+	return r, ip
+}
+
+func checkNatPmp(listenPort int, port int) (*Result, net.IP) {
+	r := &Result{Name: "nat-pmp"}
+	gateway, err := nat.DefaultGateway()
+	if err != nil {
+		r.Level, r.Detail = Warn, "find default gateway failed: "+err.Error()
+		return r, nil
+	}
+	client := nat.NewNatPmp(gateway)
+	ip, err := client.ExternalAddress()
+	if err != nil {
+		r.Level, r.Detail = Warn, fmt.Sprintf("gateway %s: %s", gateway, err)
+		r.Advice = "enable NAT-PMP on your router if it supports, or forward the port manually"
+		return r, nil
+	}
+	mapped, _, err := client.AddPortMapping(listenPort, port, nat.MappingLifetime)
+	if err != nil {
+		r.Level, r.Detail = Warn, fmt.Sprintf("gateway public ip is %s, but map port %d failed: %s", ip, port, err)
+		return r, ip
+	}
+	if mapped != port {
+		r.Level, r.Detail = Warn, fmt.Sprintf("gateway mapped port %d instead of %d", mapped, port)
+		r.Advice = fmt.Sprintf("port %d is taken on the gateway, register with port %d or free port %d on the gateway", port, mapped, port)
+		return r, ip
+	}
+	r.Detail = fmt.Sprintf("gateway public ip is %s, port %d is mapped to %d", ip, port, listenPort)
+	return r, ip
+}
+
+// CheckGatewayIp compares public ip of the gateway with the ip seen by tracker.
+func CheckGatewayIp(gatewayIp net.IP, trackerIp net.IP) *Result {
+	r := &Result{Name: "gateway"}
+	if nat.IsPrivate(gatewayIp) {
+		r.Level, r.Detail = Fail, fmt.Sprintf("public ip of your router is %s, which is a private or carrier-grade NAT address", gatewayIp)
+		r.Advice = "your router is behind another NAT of the ISP or an upstream router, ask the ISP for a public ip or forward the port on the upstream router too"
+		return r
+	}
+	if !gatewayIp.Equal(trackerIp) {
+		r.Level, r.Detail = Warn, fmt.Sprintf("public ip of your router is %s, but tracker sees %s", gatewayIp, trackerIp)
+		r.Advice = "traffic may leave through another router or proxy, port forwarding must be done on that one"
+		return r
+	}
+	r.Detail = "public ip of your router matches the ip seen by tracker"
+	return r
+}
+
+// CheckAdvertisedHost tells if host advertised to tracker resolves to the ip seen by tracker.
+func CheckAdvertisedHost(host string, trackerIp net.IP) *Result {
+	r := &Result{Name: "advertised host"}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		r.Level, r.Detail = Fail, fmt.Sprintf("resolve %s failed: %s", host, err)
+		r.Advice = "check the dynamic domain is registered and updated by your DDNS client"
+		return r
+	}
+	for _, ip := range ips {
+		if ip.Equal(trackerIp) {
+			r.Detail = host + " matches the ip seen by tracker"
+			return r
+		}
+	}
+	r.Level, r.Detail = Warn, fmt.Sprintf("%s resolves to %v, but tracker sees %s", host, ips, trackerIp)
+	r.Advice = "update the DDNS record, or the host advertised to tracker, clients will connect to a wrong address"
+	return r
+}
+
+func localIp() string {
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return "this host"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
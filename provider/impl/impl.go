@@ -2,12 +2,16 @@ package impl
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/samoslab/nebula/provider/cache"
 	client "github.com/samoslab/nebula/provider/collector_client"
 	"github.com/samoslab/nebula/provider/config"
 	"github.com/samoslab/nebula/provider/node"
@@ -29,6 +33,8 @@ var skip_check_auth = false
 type ProviderService struct {
 	node       *node.Node
 	providerDb *leveldb.DB
+	cache      *cache.BlockCache
+	draining   int32
 }
 
 func NewProviderService() *ProviderService {
@@ -42,6 +48,13 @@ func NewProviderService() *ProviderService {
 	if err != nil {
 		log.Fatalf("open Provider DB failed:%s", err)
 	}
+	config.SetStorageStateListener(reportStorageState)
+	if pc := config.GetProviderConfig(); pc.CacheVolume > 0 {
+		ps.cache, err = cache.NewBlockCache(pc.CacheStoragePath, pc.CacheVolume, pc.CachePolicy)
+		if err != nil {
+			log.Fatalf("open block cache failed:%s", err)
+		}
+	}
 	return ps
 }
 
@@ -49,6 +62,35 @@ func (self *ProviderService) Close() {
 	self.providerDb.Close()
 }
 
+// Drain rejects new transfers with codes.Unavailable, transfers in progress are not affected.
+func (self *ProviderService) Drain() {
+	atomic.StoreInt32(&self.draining, 1)
+}
+
+func (self *ProviderService) checkDraining() error {
+	if atomic.LoadInt32(&self.draining) == 1 {
+		err := status.Errorf(codes.Unavailable, "provider is draining, no new transfer is accepted")
+		log.Debugln(err)
+		return err
+	}
+	return nil
+}
+
+// FlushCache waits until blocks retrieved are admitted to the hot block cache
+func (self *ProviderService) FlushCache() {
+	if self.cache != nil {
+		self.cache.Flush()
+	}
+}
+
+// CacheStats returns counters of the hot block cache, ok is false if the cache is disabled.
+func (self *ProviderService) CacheStats() (stats cache.Stats, ok bool) {
+	if self.cache == nil {
+		return
+	}
+	return self.cache.Stats(), true
+}
+
 func (self *ProviderService) Ping(ctx context.Context, req *pb.PingReq) (*pb.PingResp, error) {
 	return &pb.PingResp{}, nil
 }
@@ -64,6 +106,30 @@ func logWarnAndSetActionLog(err error, al *tcppb.ActionLog) {
 	}
 }
 
+type storageStateInfo struct {
+	Index  byte
+	Path   string
+	From   string
+	State  string
+	Reason string
+}
+
+// reportStorageState sends storage state change to collector as action log of type 3. It is a contract only:
+// the collector does not consume it yet, tracker side handling such as repairing blocks of a fenced storage is to be done.
+func reportStorageState(s *config.Storage, old config.StorageState, new config.StorageState, reason string) {
+	info, err := json.Marshal(&storageStateInfo{Index: s.Index, Path: s.Path, From: old.String(), State: new.String(), Reason: reason})
+	if err != nil {
+		log.Errorf("marshal storage state info failed: %s", err)
+		return
+	}
+	ts := now()
+	client.Collect(&tcppb.ActionLog{Type: 3,
+		Success:   new == config.StorageOnline,
+		BeginTime: ts,
+		EndTime:   ts,
+		Info:      string(info)})
+}
+
 func newActionLogFromStoreReq(req *pb.StoreReq) *tcppb.ActionLog {
 	return &tcppb.ActionLog{Type: 1,
 		Ticket:    req.Ticket,
@@ -85,6 +151,9 @@ func newActionLogFromRetrieveReq(req *pb.RetrieveReq) *tcppb.ActionLog {
 }
 
 func (self *ProviderService) StoreSmall(ctx context.Context, req *pb.StoreReq) (resp *pb.StoreResp, err error) {
+	if err = self.checkDraining(); err != nil {
+		return
+	}
 	al := newActionLogFromStoreReq(req)
 	al.TransportSize = uint64(len(req.Data))
 	defer client.Collect(al)
@@ -118,6 +187,7 @@ func (self *ProviderService) StoreSmall(ctx context.Context, req *pb.StoreReq) (
 		return
 	}
 	if err = storage.SmallFileDb.Put(req.BlockKey, req.Data, nil); err != nil {
+		storage.ReportError(err)
 		err = status.Errorf(codes.Internal, "save to small file db failed, blockKey: %x error: %s", req.BlockKey, err)
 		logWarnAndSetActionLog(err, al)
 		return
@@ -127,11 +197,15 @@ func (self *ProviderService) StoreSmall(ctx context.Context, req *pb.StoreReq) (
 		logWarnAndSetActionLog(err, al)
 		return
 	}
+	storage.ReportSuccess()
 	al.Success, al.EndTime = true, now()
 	return &pb.StoreResp{Success: true}, nil
 }
 
 func (self *ProviderService) Store(stream pb.ProviderService_StoreServer) (er error) {
+	if er = self.checkDraining(); er != nil {
+		return
+	}
 	var al *tcppb.ActionLog
 	first := true
 	var tempFilePath string
@@ -186,6 +260,7 @@ func (self *ProviderService) Store(stream pb.ProviderService_StoreServer) (er er
 				os.O_WRONLY|os.O_TRUNC|os.O_CREATE,
 				0600)
 			if err != nil {
+				storage.ReportError(err)
 				er = status.Errorf(codes.Internal, "open temp write file failed, blockKey: %x error: %s", blockKey, err)
 				logWarnAndSetActionLog(er, al)
 				al.TransportSize += uint64(len(req.Data))
@@ -203,6 +278,7 @@ func (self *ProviderService) Store(stream pb.ProviderService_StoreServer) (er er
 			return
 		}
 		if _, err = file.Write(req.Data); err != nil {
+			storage.ReportError(err)
 			er = status.Errorf(codes.Internal, "write file failed, blockKey: %x error: %s", blockKey, err)
 			logWarnAndSetActionLog(er, al)
 			return
@@ -210,6 +286,7 @@ func (self *ProviderService) Store(stream pb.ProviderService_StoreServer) (er er
 	}
 	fileInfo, err := os.Stat(tempFilePath)
 	if err != nil {
+		storage.ReportError(err)
 		er = status.Errorf(codes.Internal, "stat temp file failed, blockKey: %x error: %s", blockKey, err)
 		logWarnAndSetActionLog(er, al)
 		return
@@ -221,6 +298,7 @@ func (self *ProviderService) Store(stream pb.ProviderService_StoreServer) (er er
 	}
 	hash, err := util_hash.Sha1File(tempFilePath)
 	if err != nil {
+		storage.ReportError(err)
 		er = status.Errorf(codes.Internal, "sha1 sum file %s failed, blockKey: %x error: %s", tempFilePath, blockKey, err)
 		logWarnAndSetActionLog(er, al)
 		return
@@ -231,10 +309,12 @@ func (self *ProviderService) Store(stream pb.ProviderService_StoreServer) (er er
 		return
 	}
 	if err := self.saveFile(blockKey, blockSize, tempFilePath, storage); err != nil {
+		storage.ReportError(err)
 		er = status.Errorf(codes.Internal, "save file failed, tempFilePath: %s blockKey: %x error: %s", tempFilePath, blockKey, err)
 		logWarnAndSetActionLog(er, al)
 		return
 	}
+	storage.ReportSuccess()
 	if err := stream.SendAndClose(&pb.StoreResp{Success: true}); err != nil {
 		er = status.Errorf(codes.Unknown, "RPC SendAndClose failed, blockKey: %x error: %s", blockKey, err)
 		logWarnAndSetActionLog(er, al)
@@ -246,7 +326,12 @@ func (self *ProviderService) Store(stream pb.ProviderService_StoreServer) (er er
 	return nil
 }
 
+// RetrieveSmall does not use the hot block cache, small blocks are read in one call from small file db
+// which has its own block cache, a copy on the cache tier saves little.
 func (self *ProviderService) RetrieveSmall(ctx context.Context, req *pb.RetrieveReq) (resp *pb.RetrieveResp, err error) {
+	if err = self.checkDraining(); err != nil {
+		return
+	}
 	al := newActionLogFromRetrieveReq(req)
 	defer client.Collect(al)
 	if req.BlockSize >= small_file_limit {
@@ -273,8 +358,14 @@ func (self *ProviderService) RetrieveSmall(ctx context.Context, req *pb.Retrieve
 		return
 	}
 	storage := config.GetStorage(storageIdx)
+	if !storage.Readable() {
+		err = status.Errorf(codes.Unavailable, "storage is offline, blockKey: %x", req.BlockKey)
+		logWarnAndSetActionLog(err, al)
+		return
+	}
 	data, err := storage.SmallFileDb.Get(req.BlockKey, nil)
 	if err != nil {
+		storage.ReportError(err)
 		err = status.Errorf(codes.Internal, "read small file error, blockKey: %x error: %s", req.BlockKey, err)
 		logWarnAndSetActionLog(err, al)
 		return
@@ -285,15 +376,20 @@ func (self *ProviderService) RetrieveSmall(ctx context.Context, req *pb.Retrieve
 		return
 	}
 	if !bytes.Equal(util_hash.Sha1(data), req.BlockKey) {
+		storage.ReportError(errors.New("small file hash verify failed"))
 		err = status.Errorf(codes.DataLoss, "hash verify failed, blockKey: %x error: %s", req.BlockKey, err)
 		logWarnAndSetActionLog(err, al)
 		return
 	}
+	storage.ReportSuccess()
 	al.Success, al.EndTime, al.TransportSize = true, now(), uint64(len(data))
 	return &pb.RetrieveResp{Data: data}, nil
 }
 
 func (self *ProviderService) Retrieve(req *pb.RetrieveReq, stream pb.ProviderService_RetrieveServer) (err error) {
+	if err = self.checkDraining(); err != nil {
+		return
+	}
 	al := newActionLogFromRetrieveReq(req)
 	defer client.Collect(al)
 	if req.BlockSize < small_file_limit {
@@ -319,33 +415,57 @@ func (self *ProviderService) Retrieve(req *pb.RetrieveReq, stream pb.ProviderSer
 		logWarnAndSetActionLog(err, al)
 		return
 	}
+	if self.cache != nil {
+		if reader, ok := self.cache.Open(req.BlockKey); ok {
+			defer reader.Close()
+			if err = sendFileToStream(req.BlockKey, "cache", reader, stream, al); err != nil {
+				return err
+			}
+			al.Success, al.EndTime = true, now()
+			return nil
+		}
+	}
+	storage := config.GetStorage(storageIdx)
+	if !storage.Readable() {
+		err = status.Errorf(codes.Unavailable, "storage is offline, blockKey: %x", req.BlockKey)
+		logWarnAndSetActionLog(err, al)
+		return
+	}
 	path := config.GetStoragePath(storageIdx, subPath)
 	hash, err := util_hash.Sha1File(path)
 	if err != nil {
+		storage.ReportError(err)
 		err = status.Errorf(codes.Internal, "sha1 sum file %s failed, blockKey: %x error: %s", path, req.BlockKey, err)
 		logWarnAndSetActionLog(err, al)
 		return
 	}
 	if !bytes.Equal(hash, req.BlockKey) {
+		storage.ReportError(errors.New("file hash verify failed"))
 		err = status.Errorf(codes.DataLoss, "hash verify failed, blockKey: %x error: %s", req.BlockKey, err)
 		logWarnAndSetActionLog(err, al)
 		return
 	}
 	file, err := os.Open(path)
 	if err != nil {
+		storage.ReportError(err)
 		err = status.Errorf(codes.Internal, "open file failed, blockKey: %x error: %s", req.BlockKey, err)
 		logWarnAndSetActionLog(err, al)
 		return
 	}
 	defer file.Close()
 	if err = sendFileToStream(req.BlockKey, path, file, stream, al); err != nil {
+		storage.ReportError(err)
 		return err
 	}
+	storage.ReportSuccess()
+	if self.cache != nil {
+		self.cache.AdmitAsync(req.BlockKey, path, req.BlockSize)
+	}
 	al.Success, al.EndTime = true, now()
 	return nil
 }
 
-func sendFileToStream(key []byte, path string, file *os.File, stream pb.ProviderService_RetrieveServer, al *tcppb.ActionLog) (er error) {
+func sendFileToStream(key []byte, path string, file io.Reader, stream pb.ProviderService_RetrieveServer, al *tcppb.ActionLog) (er error) {
 	buf := make([]byte, stream_data_size)
 	for {
 		bytesRead, err := file.Read(buf)
@@ -387,9 +507,13 @@ func (self *ProviderService) Remove(ctx context.Context, req *pb.RemoveReq) (res
 		log.Warnln(err)
 		return
 	}
+	if self.cache != nil {
+		self.cache.Remove(req.Key)
+	}
+	storage := config.GetStorage(storageIdx)
 	if smallFile {
-		storage := config.GetStorage(storageIdx)
 		if err = storage.SmallFileDb.Delete(req.Key, nil); err != nil {
+			storage.ReportError(err)
 			err = status.Errorf(codes.Internal, "delete from small file db failed, key: %x error: %s", req.Key, err)
 			log.Warnln(err)
 			return
@@ -397,6 +521,10 @@ func (self *ProviderService) Remove(ctx context.Context, req *pb.RemoveReq) (res
 	} else {
 		path := config.GetStoragePath(storageIdx, subPath)
 		if err = os.Remove(path); err != nil {
+			// a missing file is not an I/O error of the disk, it must not fence the storage
+			if !os.IsNotExist(err) {
+				storage.ReportError(err)
+			}
 			err = status.Errorf(codes.Internal, "remove file failed, key: %x error: %s", req.Key, err)
 			log.Warnln(err)
 			return
@@ -406,6 +534,9 @@ func (self *ProviderService) Remove(ctx context.Context, req *pb.RemoveReq) (res
 }
 
 func (self *ProviderService) GetFragment(ctx context.Context, req *pb.GetFragmentReq) (resp *pb.GetFragmentResp, err error) {
+	if err = self.checkDraining(); err != nil {
+		return
+	}
 	if len(req.Positions) == 0 || req.Size == 0 {
 		err = status.Errorf(codes.InvalidArgument, "invalid req, key: %x", req.Key)
 		log.Warnln(err)
@@ -431,11 +562,17 @@ func (self *ProviderService) GetFragment(ctx context.Context, req *pb.GetFragmen
 		log.Warnln(err)
 		return
 	}
+	storage := config.GetStorage(storageIdx)
+	if !storage.Readable() {
+		err = status.Errorf(codes.Unavailable, "storage is offline, key: %x", req.Key)
+		log.Warnln(err)
+		return
+	}
 	var res [][]byte
 	if smallFile {
-		storage := config.GetStorage(storageIdx)
 		data, er := storage.SmallFileDb.Get(req.Key, nil)
 		if er != nil {
+			storage.ReportError(er)
 			err = status.Errorf(codes.Internal, "read small file error, blockKey: %x error: %s", req.Key, er)
 			log.Warnln(err)
 			return
@@ -446,6 +583,9 @@ func (self *ProviderService) GetFragment(ctx context.Context, req *pb.GetFragmen
 		res, err = getFragmentFromFile(req.Key, path, req.Positions, req.Size)
 	}
 	if err != nil {
+		if status.Code(err) == codes.Internal {
+			storage.ReportError(err)
+		}
 		return
 	}
 	return &pb.GetFragmentResp{Data: res}, nil
@@ -544,6 +684,9 @@ func (self *ProviderService) querySubPath(key []byte) (found bool, smallFile boo
 }
 
 func (self *ProviderService) CheckAvailable(ctx context.Context, req *pb.CheckAvailableReq) (resp *pb.CheckAvailableResp, err error) {
+	if err = self.checkDraining(); err != nil {
+		return
+	}
 	if !skip_check_auth {
 		if err = req.CheckAuth(self.node.PubKeyBytes); err != nil {
 			err = status.Errorf(codes.Unauthenticated, "check auth failed,  error: %s", err)
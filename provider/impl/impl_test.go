@@ -1 +1,55 @@
 package impl
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/samoslab/nebula/provider/config"
+	"github.com/samoslab/nebula/provider/conformance"
+	"github.com/samoslab/nebula/provider/node"
+	pb "github.com/samoslab/nebula/provider/pb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-provider-impl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	no := node.NewNode(10)
+	pc := &config.ProviderConfig{
+		NodeId:            no.NodeIdStr(),
+		PublicKey:         no.PublicKeyStr(),
+		PrivateKey:        no.PrivateKeyStr(),
+		MainStoragePath:   dir,
+		MainStorageVolume: 10000000000,
+		CacheVolume:       64 * 1024 * 1024,
+		EncryptKey:        map[string]string{"0": hex.EncodeToString(no.EncryptKey["0"])},
+	}
+	config.CreateProviderConfig(dir, pc)
+	if err = config.LoadConfig(dir); err != nil {
+		t.Fatal(err)
+	}
+	config.StartAutoCheck()
+	defer config.StopAutoCheck()
+	ps := NewProviderService()
+	defer ps.Close()
+	conformance.Run(t, &conformance.Suite{Server: ps, PubKeyBytes: ps.node.PubKeyBytes, Flush: ps.FlushCache})
+	// blocks retrieved again are served by cache
+	if stats, ok := ps.CacheStats(); !ok || stats.Hits == 0 || stats.Misses == 0 || stats.Admissions == 0 {
+		t.Errorf("expected cache hits, misses and admissions, got %+v", stats)
+	}
+
+	ps.Drain()
+	if _, err = ps.StoreSmall(context.Background(), &pb.StoreReq{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("StoreSmall when draining: expected %s, got %v", codes.Unavailable, err)
+	}
+	if _, err = ps.Ping(context.Background(), &pb.PingReq{}); err != nil {
+		t.Errorf("Ping when draining: expected success, got %s", err)
+	}
+}
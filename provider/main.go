@@ -5,9 +5,11 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"os/user"
@@ -21,8 +23,10 @@ import (
 	"github.com/robfig/cron"
 	collector "github.com/samoslab/nebula/provider/collector_client"
 	"github.com/samoslab/nebula/provider/config"
+	"github.com/samoslab/nebula/provider/diagnose"
 	"github.com/samoslab/nebula/provider/disk"
 	"github.com/samoslab/nebula/provider/impl"
+	"github.com/samoslab/nebula/provider/nat"
 	"github.com/samoslab/nebula/provider/node"
 	pb "github.com/samoslab/nebula/provider/pb"
 	client "github.com/samoslab/nebula/provider/register_client"
@@ -36,6 +40,9 @@ import (
 
 const home_config_folder = ".samos-nebula-provider"
 
+// interval of renewing upnp mapping which has no lease, and retrying failed mapping
+const mapping_renew_interval = 30 * time.Minute
+
 func main() {
 	usr, err := user.Current()
 	if err != nil {
@@ -49,6 +56,8 @@ func main() {
 	daemonCollectorServerFlag := daemonCommand.String("collectorServer", "collector.store.samos.io:6688", "collector server address, eg: collector.store.samos.io:6688")
 	listenFlag := daemonCommand.String("listen", ":6666", "listen address and port, eg: 111.111.111.111:6666 or :6666")
 	disableAutoRefreshIpFlag := daemonCommand.Bool("disableAutoRefreshIp", false, "disable auto refresh provider ip or enable auto refresh provider ip")
+	drainTimeoutFlag := daemonCommand.Duration("drainTimeout", 2*time.Minute, "when stopping, max time to wait for transfers in progress to finish, eg: 30s, 5m")
+	metricsListenFlag := daemonCommand.String("metricsListen", "", "listen address and port of metrics http server, metrics such as block cache hit ratio and storage health is served at /debug/vars, disabled if empty, eg: 127.0.0.1:6667")
 
 	registerCommand := flag.NewFlagSet("register", flag.ExitOnError)
 	registerConfigDirFlag := registerCommand.String("configDir", usr.HomeDir+string(os.PathSeparator)+home_config_folder, "config director")
@@ -80,6 +89,12 @@ func main() {
 	addStorageTrackerServerFlag := addStorageCommand.String("trackerServer", "tracker.store.samos.io:6677", "tracker server address, eg: tracker.store.samos.io:6677")
 	pathFlag := addStorageCommand.String("path", "", "add storage path")
 	volumeFlag := addStorageCommand.String("volume", "", "add storage volume size, unit TB or GB, eg: 2TB or 500GB")
+
+	diagnoseCommand := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	diagnoseTrackerServerFlag := diagnoseCommand.String("trackerServer", "tracker.store.samos.io:6677", "tracker server address, eg: tracker.store.samos.io:6677")
+	diagnoseListenFlag := diagnoseCommand.String("listen", ":6666", "listen address and port, eg: 111.111.111.111:6666 or :6666")
+	diagnosePortFlag := diagnoseCommand.Uint("port", 0, "outer network port for client to connect, default is the listen port, eg:6666")
+	diagnoseHostFlag := diagnoseCommand.String("host", "", "outer ip or dynamic domain advertised to tracker, eg: 123.123.123.123 or mydomain.xicp.net")
 	if len(os.Args) == 1 {
 		fmt.Printf("usage: %s <command> [<args>]\n", os.Args[0])
 		fmt.Println("The most commonly used commands are: ")
@@ -89,17 +104,19 @@ func main() {
 		verifyEmailCommand.PrintDefaults()
 		fmt.Println(" resendVerifyCode [-configDir config-dir] [-trackerServer tracker-server-and-port]")
 		resendVerifyCodeCommand.PrintDefaults()
-		fmt.Println(" daemon [-configDir config-dir] [-trackerServer tracker-server-and-port] [-listen listen-address-and-port] [-disableAutoRefreshIp]")
+		fmt.Println(" daemon [-configDir config-dir] [-trackerServer tracker-server-and-port] [-listen listen-address-and-port] [-disableAutoRefreshIp] [-drainTimeout drain-timeout] [-metricsListen metrics-listen-address-and-port]")
 		daemonCommand.PrintDefaults()
 		fmt.Println(" addStorage [-configDir config-dir] [-trackerServer tracker-server-and-port] -path storage-path -volume storage-volume")
 		addStorageCommand.PrintDefaults()
+		fmt.Println(" diagnose [-trackerServer tracker-server-and-port] [-listen listen-address-and-port] [-host outer-host] [-port outer-port]")
+		diagnoseCommand.PrintDefaults()
 		os.Exit(101)
 	}
 
 	switch os.Args[1] {
 	case "daemon":
 		daemonCommand.Parse(os.Args[2:])
-		daemon(*daemonConfigDirFlag, *daemonTrackerServerFlag, *daemonCollectorServerFlag, *listenFlag, *disableAutoRefreshIpFlag)
+		daemon(*daemonConfigDirFlag, *daemonTrackerServerFlag, *daemonCollectorServerFlag, *listenFlag, *disableAutoRefreshIpFlag, *drainTimeoutFlag, *metricsListenFlag)
 	case "register":
 		registerCommand.Parse(os.Args[2:])
 		register(*registerConfigDirFlag, *registerTrackerServerFlag, *registerListenFlag, *walletAddressFlag, *billEmailFlag, *availabilityFlag,
@@ -113,6 +130,9 @@ func main() {
 	case "resendVerifyCode":
 		resendVerifyCodeCommand.Parse(os.Args[2:])
 		resendVerifyCode(*resendVerifyCodeConfigDirFlag, *resendVerifyCodeTrackerServerFlag)
+	case "diagnose":
+		diagnoseCommand.Parse(os.Args[2:])
+		diagnoseNetwork(*diagnoseTrackerServerFlag, *diagnoseListenFlag, *diagnoseHostFlag, *diagnosePortFlag)
 	default:
 		fmt.Printf("%q is not valid command.\n", os.Args[1])
 		os.Exit(102)
@@ -186,7 +206,7 @@ func resendVerifyCode(configDir string, trackerServer string) {
 	fmt.Println("resendVerifyCode success, you can verify bill email.")
 }
 
-func daemon(configDir string, trackerServer string, collectorServer string, listen string, disableAutoRefreshIpFlag bool) {
+func daemon(configDir string, trackerServer string, collectorServer string, listen string, disableAutoRefreshIpFlag bool, drainTimeout time.Duration, metricsListen string) {
 	err := config.LoadConfig(configDir)
 	if err != nil {
 		if err == config.NoConfErr {
@@ -201,6 +221,9 @@ func daemon(configDir string, trackerServer string, collectorServer string, list
 	}
 	config.StartAutoCheck()
 	defer config.StopAutoCheck()
+	expvar.Publish("storageHealth", expvar.Func(func() interface{} {
+		return config.AllStorageHealthStats()
+	}))
 	collector.Start(collectorServer)
 	defer collector.Stop()
 	port, err := strconv.Atoi(strings.Split(listen, ":")[1])
@@ -208,10 +231,19 @@ func daemon(configDir string, trackerServer string, collectorServer string, list
 		fmt.Println("parse listen port error: " + err.Error())
 		os.Exit(2)
 	}
-	portMapping(port)
+	mapper := nat.NewRenewer(func() (*nat.Mapping, error) {
+		return portMapping(port)
+	}, mapping_renew_interval)
+	if err := mapper.Start(); err != nil {
+		fmt.Println("port mapping failed: " + err.Error())
+	}
+	defer mapper.Stop()
 	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(520 * 1024))
-	go startServer(listen, grpcServer)
-	defer grpcServer.GracefulStop()
+	providerServer := impl.NewProviderService()
+	go startServer(listen, grpcServer, providerServer)
+	if metricsListen != "" {
+		go startMetricsServer(metricsListen)
+	}
 	if !disableAutoRefreshIpFlag && !config.GetProviderConfig().Ddns {
 		refreshIp(trackerServer, port, true)
 		cronRunner := cron.New()
@@ -221,23 +253,182 @@ func daemon(configDir string, trackerServer string, collectorServer string, list
 		cronRunner.Start()
 		defer cronRunner.Stop()
 	}
+	refreshIpFlag := !disableAutoRefreshIpFlag && !config.GetProviderConfig().Ddns
+	go checkReachable(trackerServer, port, mapper.Mapping(), refreshIpFlag)
+	reachableCron := cron.New()
+	reachableCron.AddFunc("53 */30 * * * *", func() {
+		checkReachable(trackerServer, port, mapper.Mapping(), refreshIpFlag)
+	})
+	reachableCron.Start()
+	defer reachableCron.Stop()
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := config.Reload(); err != nil {
+			log.Errorf("reload config failed, keep running with current config: %s", err)
+		} else {
+			log.Info("reload config and storage success")
+		}
+	}
+	drain(grpcServer, providerServer, drainTimeout)
+}
+
+// drain stops accepting new transfers, waits for transfers in progress until timeout,
+// then flushes action logs to collector and closes provider db.
+func drain(grpcServer *grpc.Server, providerServer *impl.ProviderService, timeout time.Duration) {
+	log.Infof("draining, wait at most %s for transfers in progress", timeout)
+	deadline := time.Now().Add(timeout)
+	providerServer.Drain()
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Warning("drain timeout, abort transfers in progress")
+		grpcServer.Stop()
+	}
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- collector.Flush()
+	}()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			log.Errorf("flush action log to collector failed: %s", err)
+		}
+	case <-time.After(flushTimeout(deadline)):
+		log.Warning("flush action log to collector timeout")
+	}
+	providerServer.Close()
+}
+
+// flushTimeout is the time left before deadline, but at least 10 seconds
+func flushTimeout(deadline time.Time) time.Duration {
+	if left := time.Until(deadline); left > 10*time.Second {
+		return left
+	}
+	return 10 * time.Second
+}
+
+// checkReachable compares the public ip seen by tracker with the host advertised and the gateway mapping,
+// then pings the provider at its advertised address like a client does. It runs at startup and periodically.
+// refreshIp tells if the tracker is told the ip it sees and the listen port periodically.
+func checkReachable(trackerServer string, listenPort int, mapping *nat.Mapping, refreshIp bool) {
+	ipStr, err := trackerSeenIp(trackerServer)
+	if err != nil {
+		log.Errorf("get public ip from tracker failed: %s", err)
+		return
+	}
+	trackerIp := net.ParseIP(ipStr)
+	if trackerIp == nil {
+		log.Errorf("tracker returned invalid ip: %s", ipStr)
+		return
+	}
+	pc := config.GetProviderConfig()
+	port := listenPort
+	if !refreshIp && pc.Port != 0 {
+		port = int(pc.Port)
+	}
+	res := make([]*diagnose.Result, 0, 4)
+	host := trackerIp.String()
+	if !refreshIp && pc.Host != "" {
+		host = pc.Host
+		res = append(res, diagnose.CheckAdvertisedHost(pc.Host, trackerIp))
+	}
+	if mapping != nil {
+		if mapping.ExternalIp != nil {
+			res = append(res, diagnose.CheckGatewayIp(mapping.ExternalIp, trackerIp))
+		}
+		if mapping.Port != port {
+			res = append(res, &diagnose.Result{Name: "advertised port", Level: diagnose.Warn,
+				Detail: fmt.Sprintf("gateway mapped port %d by %s, but port %d is advertised", mapping.Port, mapping.Protocol, port),
+				Advice: fmt.Sprintf("free port %d on the gateway, or register with port %d", port, mapping.Port)})
+		}
+	}
+	res = append(res, diagnose.CheckReachable(host, port, listenPort))
+	for _, r := range res {
+		if r.Level != diagnose.Pass {
+			log.Warningf("provider may not be reachable from public network: %s, advice: %s", r.Detail, r.Advice)
+		}
+	}
+}
+
+func trackerSeenIp(trackerServer string) (string, error) {
+	conn, err := grpc.Dial(trackerServer, grpc.WithInsecure())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_, _, ip, err := client.GetPublicKey(trp_pb.NewProviderRegisterServiceClient(conn))
+	return ip, err
+}
+
+func diagnoseNetwork(trackerServer string, listen string, host string, port uint) {
+	listenPort, err := strconv.Atoi(strings.Split(listen, ":")[1])
+	if err != nil {
+		fmt.Println("parse listen port error: " + err.Error())
+		os.Exit(2)
+	}
+	if port == 0 {
+		port = uint(listenPort)
+	}
+	if port > 65535 {
+		fmt.Println("port must between 1 and 65535.")
+		os.Exit(3)
+	}
+	if lis, err := net.Listen("tcp", listen); err == nil {
+		// daemon is not running, serve ping only while diagnosing
+		lis.Close()
+		grpcServer := grpc.NewServer()
+		go startPingServer(listen, grpcServer)
+		defer grpcServer.Stop()
+		time.Sleep(time.Second)
+	}
+	res := diagnose.Run(&diagnose.Options{ListenPort: listenPort,
+		Host: host,
+		Port: int(port),
+		TrackerIp: func() (string, error) {
+			return trackerSeenIp(trackerServer)
+		}})
+	for _, r := range res {
+		fmt.Println(r)
+	}
+	if diagnose.Failed(res) {
+		fmt.Println("provider is not reachable by clients, please follow the advice above.")
+		os.Exit(4)
+	}
+	fmt.Println("diagnose finished, provider is reachable.")
 }
 
-func startServer(listen string, grpcServer *grpc.Server) {
+func startServer(listen string, grpcServer *grpc.Server, providerServer *impl.ProviderService) {
 	lis, err := net.Listen("tcp", listen)
 	if err != nil {
 		fmt.Printf("failed to listen: %s, error: %s\n", listen, err.Error())
 		os.Exit(3)
 	}
-	providerServer := impl.NewProviderService()
-	defer providerServer.Close()
+	expvar.Publish("blockCache", expvar.Func(func() interface{} {
+		if stats, ok := providerServer.CacheStats(); ok {
+			return stats
+		}
+		return nil
+	}))
 	pb.RegisterProviderServiceServer(grpcServer, providerServer)
 	grpcServer.Serve(lis)
 }
 
+// startMetricsServer serves expvar metrics, eg: hit ratio of hot block cache, at /debug/vars
+func startMetricsServer(listen string) {
+	if err := http.ListenAndServe(listen, nil); err != nil {
+		fmt.Printf("failed to serve metrics: %s, error: %s\n", listen, err.Error())
+	}
+}
+
 func register(configDir string, trackerServer string, listen string, walletAddress string, billEmail string,
 	availability string, upBandwidth uint, downBandwidth uint, port uint, host string, dynamicDomain string,
 	mainStoragePath string, mainStorageVolume string, extraStorageFlag string) {
@@ -422,7 +613,11 @@ func doRegister(configDir string, trackerServer string, listen string, walletAdd
 	for _, v := range extraStorage {
 		extraStorageSlice = append(extraStorageSlice, v.Volume)
 	}
-	portMapping(int(port))
+	if m, err := portMapping(int(port)); err != nil {
+		fmt.Println("port mapping failed: " + err.Error())
+	} else {
+		fmt.Printf("use %s port mapping success.\n", m.Protocol)
+	}
 	externalIp, err := externalIpAddr()
 	if err != nil {
 		fmt.Println("use upnp get outer ip failed: " + err.Error())
@@ -488,8 +683,10 @@ func doRegister(configDir string, trackerServer string, listen string, walletAdd
 			}
 			os.Exit(56)
 		}
+		pc.Host, pc.Port = host, port
 		if len(host) == 0 && len(dynamicDomain) > 0 {
 			pc.Ddns = true
+			pc.Host = dynamicDomain
 		}
 		path := config.CreateProviderConfig(configDir, pc)
 		fmt.Println("Register success, please recieve verify code email to verify bill email and backup your config file: " + path)
@@ -614,13 +811,31 @@ func newProviderConfig(no *node.Node, walletAddress string, billEmail string,
 	return pc
 }
 
-func portMapping(port int) {
+// portMapping maps port on the gateway by upnp, or by nat-pmp if upnp failed
+func portMapping(port int) (*nat.Mapping, error) {
 	upnpMan := new(upnp.Upnp)
-	if err := upnpMan.AddPortMapping(port, port, "TCP"); err != nil {
-		fmt.Println("use upnp port mapping failed: " + err.Error())
-	} else {
-		fmt.Println("use upnp port mapping success.")
+	upnpErr := upnpMan.AddPortMapping(port, port, "TCP")
+	if upnpErr == nil {
+		m := &nat.Mapping{Protocol: "upnp", Port: port}
+		if upnpMan.ExternalIPAddr() == nil {
+			m.ExternalIp = net.ParseIP(upnpMan.GatewayOutsideIP)
+		}
+		return m, nil
+	}
+	gateway, err := nat.DefaultGateway()
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %s, nat-pmp: find default gateway failed: %s", upnpErr, err)
+	}
+	client := nat.NewNatPmp(gateway)
+	mapped, lifetime, err := client.AddPortMapping(port, port, nat.MappingLifetime)
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %s, nat-pmp: %s", upnpErr, err)
+	}
+	m := &nat.Mapping{Protocol: "nat-pmp", Port: mapped, Lease: time.Duration(lifetime) * time.Second}
+	if ip, err := client.ExternalAddress(); err == nil {
+		m.ExternalIp = ip
 	}
+	return m, nil
 }
 
 func externalIpAddr() (string, error) {
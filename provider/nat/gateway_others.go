@@ -0,0 +1,15 @@
+// +build !linux
+
+package nat
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+// DefaultGateway is only supported on linux, the gateway is not guessed from the local address
+// because a wrong guess sends NAT-PMP requests to another host.
+func DefaultGateway() (net.IP, error) {
+	return nil, errors.New("find default gateway is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,133 @@
+// Package nat talks to the home gateway to learn the public address and map
+// the provider port, it complements the UPnP port mapping with NAT-PMP (RFC 6886).
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const natpmp_port = 5351
+
+const natpmp_version = 0
+
+const (
+	op_external_address = 0
+	op_map_udp          = 1
+	op_map_tcp          = 2
+)
+
+// initial timeout is 250ms and doubled on each retry as RFC 6886 suggests, 4 tries wait at most about 4s
+const natpmp_initial_timeout = 250 * time.Millisecond
+const natpmp_tries = 4
+
+// MappingLifetime NAT-PMP mapping lifetime in seconds requested by the provider and its diagnosis,
+// the mapping is renewed at half of the lifetime granted
+const MappingLifetime = 7200
+
+var natpmpResultMessages = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused, NAT-PMP may be disabled on the gateway",
+	3: "network failure, the gateway may not have a public address yet",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+type NatPmp struct {
+	addr string // gateway address and port
+}
+
+// NewNatPmp creates a NAT-PMP client of the gateway, eg: the result of DefaultGateway().
+func NewNatPmp(gateway net.IP) *NatPmp {
+	return &NatPmp{addr: net.JoinHostPort(gateway.String(), fmt.Sprint(natpmp_port))}
+}
+
+// ExternalAddress asks the gateway for its public address.
+func (self *NatPmp) ExternalAddress() (net.IP, error) {
+	resp, err := self.call([]byte{natpmp_version, op_external_address}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// AddPortMapping maps TCP external port to internalPort of this host for lifetime seconds,
+// the gateway may choose another external port and lifetime which are returned.
+func (self *NatPmp) AddPortMapping(internalPort int, externalPort int, lifetime uint32) (mappedPort int, mappedLifetime uint32, err error) {
+	req := make([]byte, 12)
+	req[0], req[1] = natpmp_version, op_map_tcp
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:], lifetime)
+	resp, err := self.call(req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if int(binary.BigEndian.Uint16(resp[8:])) != internalPort {
+		return 0, 0, errors.New("NAT-PMP response internal port not match")
+	}
+	return int(binary.BigEndian.Uint16(resp[10:])), binary.BigEndian.Uint32(resp[12:]), nil
+}
+
+func (self *NatPmp) call(req []byte, respLen int) ([]byte, error) {
+	conn, err := net.Dial("udp", self.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	timeout := natpmp_initial_timeout
+	for i := 0; i < natpmp_tries; i++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+		n, err := conn.Read(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		if n < respLen || buf[0] != natpmp_version || buf[1] != req[1]|0x80 {
+			continue
+		}
+		if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+			if msg, ok := natpmpResultMessages[code]; ok {
+				return nil, fmt.Errorf("NAT-PMP error: %s", msg)
+			}
+			return nil, fmt.Errorf("NAT-PMP error code: %d", code)
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("no NAT-PMP response from gateway %s", self.addr)
+}
+
+// IsPrivate tells if ip is a private or carrier-grade NAT (100.64.0.0/10) address, a gateway
+// with such public address is behind another NAT.
+func IsPrivate(ip net.IP) bool {
+	for _, cidr := range private_cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var private_cidrs = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "fc00::/7", "fe80::/10", "::1/128")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, n)
+	}
+	return res
+}
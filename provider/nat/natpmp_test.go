@@ -0,0 +1,79 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// fakeGateway answers NAT-PMP requests like a router with public ip 203.0.113.7
+func fakeGateway(t *testing.T, resultCode uint16) (*NatPmp, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 12)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var resp []byte
+			switch {
+			case n == 2 && buf[1] == op_external_address:
+				resp = make([]byte, 12)
+				copy(resp[8:], []byte{203, 0, 113, 7})
+			case n == 12 && buf[1] == op_map_tcp:
+				resp = make([]byte, 16)
+				copy(resp[8:10], buf[4:6])
+				binary.BigEndian.PutUint16(resp[10:], binary.BigEndian.Uint16(buf[6:])+1)
+				copy(resp[12:], buf[8:12])
+			default:
+				continue
+			}
+			resp[1] = buf[1] | 0x80
+			binary.BigEndian.PutUint16(resp[2:], resultCode)
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return &NatPmp{addr: conn.LocalAddr().String()}, func() { conn.Close() }
+}
+
+func TestNatPmp(t *testing.T) {
+	client, stop := fakeGateway(t, 0)
+	defer stop()
+	ip, err := client.ExternalAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Errorf("expected external address 203.0.113.7, got %s", ip)
+	}
+	mapped, lifetime, err := client.AddPortMapping(6666, 6666, 7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped != 6667 {
+		t.Errorf("expected mapped port 6667, got %d", mapped)
+	}
+	if lifetime != 7200 {
+		t.Errorf("expected lifetime 7200, got %d", lifetime)
+	}
+}
+
+func TestNatPmpRefused(t *testing.T) {
+	client, stop := fakeGateway(t, 2)
+	defer stop()
+	if _, err := client.ExternalAddress(); err == nil {
+		t.Errorf("expected error when gateway refused")
+	}
+}
+
+func TestIsPrivate(t *testing.T) {
+	for ip, expect := range map[string]bool{"192.168.1.1": true, "100.64.3.4": true, "10.1.1.1": true, "203.0.113.7": false, "8.8.8.8": false} {
+		if IsPrivate(net.ParseIP(ip)) != expect {
+			t.Errorf("IsPrivate(%s) expected %t", ip, expect)
+		}
+	}
+}
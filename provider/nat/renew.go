@@ -0,0 +1,84 @@
+package nat
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Mapping is a TCP port mapping on the gateway
+type Mapping struct {
+	Protocol   string        // upnp or nat-pmp
+	ExternalIp net.IP        // public ip of the gateway, nil if unknown
+	Port       int           // external port mapped to the provider
+	Lease      time.Duration // lifetime granted by the gateway, 0 means no lease
+}
+
+// Renewer keeps the port mapped on the gateway. Mapping with lease is renewed at half of the lease,
+// mapping without lease is renewed every interval in case the gateway restarts, failed mapping is retried every interval.
+type Renewer struct {
+	mapFn    func() (*Mapping, error)
+	interval time.Duration
+	mutex    sync.Mutex
+	current  *Mapping
+	err      error
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// NewRenewer creates renewer which maps port by mapFn
+func NewRenewer(mapFn func() (*Mapping, error), interval time.Duration) *Renewer {
+	return &Renewer{mapFn: mapFn, interval: interval, quit: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start maps the port at once and renews it in background until Stop, it returns error of the first mapping.
+func (self *Renewer) Start() error {
+	err := self.renew()
+	go self.run()
+	return err
+}
+
+// Mapping returns current mapping, nil if the port is not mapped
+func (self *Renewer) Mapping() *Mapping {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.current
+}
+
+// Stop stops renewing, the mapping is kept on the gateway until its lease expires
+func (self *Renewer) Stop() {
+	close(self.quit)
+	<-self.done
+}
+
+func (self *Renewer) renew() error {
+	m, err := self.mapFn()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.current, self.err = m, err
+	return err
+}
+
+func (self *Renewer) next() time.Duration {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.err == nil && self.current != nil && self.current.Lease > 0 && self.current.Lease/2 < self.interval {
+		return self.current.Lease / 2
+	}
+	return self.interval
+}
+
+func (self *Renewer) run() {
+	defer close(self.done)
+	timer := time.NewTimer(self.next())
+	defer timer.Stop()
+	for {
+		select {
+		case <-self.quit:
+			return
+		case <-timer.C:
+			self.renew()
+			timer.Reset(self.next())
+		}
+	}
+}
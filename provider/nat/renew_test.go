@@ -0,0 +1,38 @@
+package nat
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenewer(t *testing.T) {
+	var calls int32
+	r := NewRenewer(func() (*Mapping, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, errors.New("no gateway")
+		}
+		return &Mapping{Protocol: "nat-pmp", Port: 6666, Lease: 40 * time.Millisecond}, nil
+	}, 100*time.Millisecond)
+	if err := r.Start(); err == nil {
+		t.Fatal("expected error of first mapping")
+	}
+	if r.Mapping() != nil {
+		t.Errorf("expected no mapping")
+	}
+	// failed mapping is retried at interval, then renewed at half of the lease
+	time.Sleep(180 * time.Millisecond)
+	r.Stop()
+	n := atomic.LoadInt32(&calls)
+	if n < 4 {
+		t.Errorf("expected mapping renewed at half of lease, mapped %d times", n)
+	}
+	if m := r.Mapping(); m == nil || m.Port != 6666 {
+		t.Errorf("expected mapping of port 6666, got %v", m)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != n {
+		t.Errorf("expected no renew after stop")
+	}
+}
@@ -0,0 +1,302 @@
+package aes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Encrypted file format version 1:
+//
+//	header: magic "NEBENC" | version 1 byte | algorithm 1 byte | chunk size 4 bytes | nonce 16 bytes
+//	chunks: AES-GCM sealed chunks of chunk size plaintext, the last one may be shorter or empty
+//
+// Every file has its own key derived from the key and the random nonce in header. The nonce of chunk i
+// is i followed by the final flag, the header is authenticated by every chunk, so reordered, truncated
+// or tampered chunks fail to open. Data without the magic is taken as legacy AES-CBC of Encrypt.
+const (
+	// FormatVersion version of encrypted file format written
+	FormatVersion = 1
+	// NonceSize bytes of random nonce in header
+	NonceSize = 16
+
+	magic        = "NEBENC"
+	algAESGCM    = 1
+	headerSize   = len(magic) + 1 + 1 + 4 + NonceSize
+	maxChunkSize = 16 * 1024 * 1024
+)
+
+// ChunkSize bytes of plaintext sealed in a chunk
+var ChunkSize = 64 * 1024
+
+var (
+	// ErrAuthFailed encrypted data is tampered or the key is wrong
+	ErrAuthFailed = errors.New("message authentication failed")
+	errBadHeader  = errors.New("invalid header of encrypted data")
+)
+
+// NewNonce returns a random nonce for NewWriterWithNonce
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func newAEAD(key, nonce []byte) (cipher.AEAD, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	block, err := aes.NewCipher(mac.Sum(nil)[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(nonce []byte, index uint64, final bool) []byte {
+	binary.BigEndian.PutUint64(nonce, index)
+	nonce[len(nonce)-1] = 0
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	buf     []byte // plaintext of chunk not sealed yet
+	out     []byte
+	index   uint64
+	started bool
+	closed  bool
+}
+
+// NewWriter returns a writer encrypting to w with a random nonce, Close must be called to seal the last chunk.
+// Close does not close w.
+func NewWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	nonce, err := NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterWithNonce(w, key, nonce)
+}
+
+// NewWriterWithNonce returns a writer encrypting to w with given nonce, the same data, key and nonce give the same output.
+// A nonce must not be used for different data.
+func NewWriterWithNonce(w io.Writer, key, nonce []byte) (io.WriteCloser, error) {
+	if len(nonce) != NonceSize {
+		return nil, fmt.Errorf("nonce size %d, expect %d", len(nonce), NonceSize)
+	}
+	aead, err := newAEAD(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = append(header, FormatVersion, algAESGCM)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(magic)+2:], uint32(ChunkSize))
+	header = append(header, nonce...)
+	return &sealWriter{w: w, aead: aead, header: header, nonce: make([]byte, aead.NonceSize()), buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (self *sealWriter) Write(p []byte) (int, error) {
+	if self.closed {
+		return 0, errors.New("write to closed writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is sealed only when more data comes, the last chunk must be sealed as final
+		if len(self.buf) == cap(self.buf) {
+			if err := self.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := cap(self.buf) - len(self.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		self.buf = append(self.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (self *sealWriter) Close() error {
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	return self.seal(true)
+}
+
+func (self *sealWriter) seal(final bool) error {
+	if !self.started {
+		self.started = true
+		if _, err := self.w.Write(self.header); err != nil {
+			return err
+		}
+	}
+	self.out = self.aead.Seal(self.out[:0], chunkNonce(self.nonce, self.index, final), self.buf, self.header)
+	self.index++
+	self.buf = self.buf[:0]
+	_, err := self.w.Write(self.out)
+	return err
+}
+
+type openReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	raw     []byte // a sealed chunk and one more byte telling the chunk is not the last
+	have    int
+	out     []byte
+	pending []byte // decrypted data not read yet, out is reused only after it is consumed
+	index   uint64
+	done    bool
+}
+
+// NewReader returns a reader decrypting data of NewWriter, legacy data of Encrypt is decrypted as well
+func NewReader(r io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if n < len(magic) || string(header[:len(magic)]) != magic {
+		return NewDecryptReader(io.MultiReader(bytes.NewReader(header[:n]), r), key)
+	}
+	if n < headerSize {
+		return nil, errBadHeader
+	}
+	if header[len(magic)] != FormatVersion {
+		return nil, fmt.Errorf("unsupported version %d of encrypted data", header[len(magic)])
+	}
+	if header[len(magic)+1] != algAESGCM {
+		return nil, fmt.Errorf("unsupported algorithm %d of encrypted data", header[len(magic)+1])
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(magic)+2:])
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, errBadHeader
+	}
+	aead, err := newAEAD(key, header[len(magic)+6:])
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{r: r, aead: aead, header: header, nonce: make([]byte, aead.NonceSize()),
+		raw: make([]byte, int(chunkSize)+aead.Overhead()+1)}, nil
+}
+
+func (self *openReader) Read(p []byte) (int, error) {
+	for len(self.pending) == 0 {
+		if self.done {
+			return 0, io.EOF
+		}
+		if err := self.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+func (self *openReader) open() error {
+	n, err := io.ReadFull(self.r, self.raw[self.have:])
+	n += self.have
+	final := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+	sealed := self.raw[:n]
+	if !final {
+		sealed = self.raw[:n-1]
+	}
+	if len(sealed) < self.aead.Overhead() {
+		return io.ErrUnexpectedEOF
+	}
+	plain, err := self.aead.Open(self.out[:0], chunkNonce(self.nonce, self.index, final), sealed, self.header)
+	if err != nil {
+		return ErrAuthFailed
+	}
+	self.index++
+	self.out, self.pending = plain, plain
+	self.have, self.done = 0, final
+	if !final {
+		// the extra byte is the first of next chunk
+		self.raw[0] = self.raw[n-1]
+		self.have = 1
+	}
+	return nil
+}
+
+// Seal encrypts data in format of NewWriter
+func Seal(data, key []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Open decrypts data of Seal or legacy Encrypt
+func Open(data, key []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// copyFile streams inputfile through convert to a temporary file renamed to outputfile at last,
+// so inputfile may be the same as outputfile and a failure leaves no partial output.
+func copyFile(inputfile, outputfile string, convert func(w io.Writer, r io.Reader) error) error {
+	in, err := os.Open(inputfile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := outputfile + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = convert(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, outputfile)
+}
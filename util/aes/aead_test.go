@@ -0,0 +1,119 @@
+package aes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	defer func(size int) { ChunkSize = size }(ChunkSize)
+	ChunkSize = 1024
+	for _, keySize := range []int{16, 24, 32} {
+		for _, size := range []int{0, 1, 1023, 1024, 1025, 3 * 1024, 5000} {
+			key := randAesKey(keySize)
+			data := randAesKey(size)
+			en, err := Seal(data, key)
+			checkErr(err)
+			en2, err := Seal(data, key)
+			checkErr(err)
+			if bytes.Equal(en, en2) {
+				t.Errorf("size %d: same output of random nonce", size)
+			}
+			de, err := Open(en, key)
+			checkErr(err)
+			if !bytes.Equal(data, de) {
+				t.Errorf("key %d size %d: decrypted data differs", keySize, size)
+			}
+			r, err := NewReader(oneByteReader{bytes.NewReader(en)}, key)
+			checkErr(err)
+			de, err = ioutil.ReadAll(r)
+			checkErr(err)
+			if !bytes.Equal(data, de) {
+				t.Errorf("key %d size %d: decrypted data of slow reader differs", keySize, size)
+			}
+		}
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	defer func(size int) { ChunkSize = size }(ChunkSize)
+	ChunkSize = 100
+	key := randAesKey(16)
+	en, err := Seal(randAesKey(250), key)
+	checkErr(err)
+	chunk := 100 + 16
+	cases := map[string][]byte{
+		// the last chunk is dropped, the former one is not final
+		"truncated": en[:headerSize+2*chunk],
+		"cut":       en[:len(en)-1],
+		"reordered": append(append(append(append([]byte{}, en[:headerSize]...), en[headerSize+chunk:headerSize+2*chunk]...), en[headerSize:headerSize+chunk]...), en[headerSize+2*chunk:]...),
+		"flipped":   append(append(append([]byte{}, en[:headerSize+10]...), en[headerSize+10]^1), en[headerSize+11:]...),
+		"header":    append(append(append([]byte{}, en[:headerSize-1]...), en[headerSize-1]^1), en[headerSize:]...),
+	}
+	for name, data := range cases {
+		if _, err := Open(data, key); err == nil {
+			t.Errorf("%s: expect error", name)
+		}
+	}
+	if _, err := Open(en, randAesKey(16)); err != ErrAuthFailed {
+		t.Errorf("wrong key: expect ErrAuthFailed, got %v", err)
+	}
+}
+
+func TestNonceWriter(t *testing.T) {
+	key := randAesKey(16)
+	nonce, err := NewNonce()
+	checkErr(err)
+	data := randAesKey(1000)
+	var a, b bytes.Buffer
+	for _, buf := range []*bytes.Buffer{&a, &b} {
+		w, err := NewWriterWithNonce(buf, key, nonce)
+		checkErr(err)
+		_, err = w.Write(data)
+		checkErr(err)
+		checkErr(w.Close())
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("same nonce gives different output")
+	}
+}
+
+func TestLegacyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aes")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+	key := randAesKey(16)
+	data := randAesKey(100000)
+	legacy, err := Encrypt(data, key)
+	checkErr(err)
+	de, err := Open(legacy, key)
+	checkErr(err)
+	if !bytes.Equal(data, de) {
+		t.Error("legacy data decrypted differs")
+	}
+
+	fileName := filepath.Join(dir, "file")
+	checkErr(ioutil.WriteFile(fileName, legacy, 0644))
+	checkErr(DecryptFile(fileName, key, fileName))
+	de, err = ioutil.ReadFile(fileName)
+	checkErr(err)
+	if !bytes.Equal(data, de) {
+		t.Error("legacy file decrypted in place differs")
+	}
+
+	checkErr(EncryptFile(fileName, key, fileName))
+	en, err := ioutil.ReadFile(fileName)
+	checkErr(err)
+	if !bytes.HasPrefix(en, []byte(magic)) {
+		t.Error("file not encrypted in new format")
+	}
+	checkErr(DecryptFile(fileName, key, fileName+".de"))
+	de, err = ioutil.ReadFile(fileName + ".de")
+	checkErr(err)
+	if !bytes.Equal(data, de) {
+		t.Error("file decrypted differs")
+	}
+}
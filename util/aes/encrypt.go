@@ -5,10 +5,11 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"fmt"
-	"io/ioutil"
+	"io"
 )
 
+// Encrypt encrypts by legacy AES-CBC with key as IV, the same data gives the same output and it is not authenticated.
+// Use Seal or NewWriter for file data.
 func Encrypt(origData, key []byte) ([]byte, error) {
 	//https://github.com/polaris1119/myblog_article_code/blob/master/aes/aes.go
 	block, err := aes.NewCipher(key)
@@ -23,6 +24,7 @@ func Encrypt(origData, key []byte) ([]byte, error) {
 	return crypted, nil
 }
 
+// Decrypt decrypts data of Encrypt
 func Decrypt(crypted []byte, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -71,41 +73,28 @@ func RandStr(str_size int) string {
 	return string(bytes)
 }
 
-// EncryptFile encrypt file using aes alg
+// EncryptFile encrypts file in format of NewWriter without reading it into memory
 func EncryptFile(inputfile string, key []byte, outputfile string) error {
-	b, err := ioutil.ReadFile(inputfile) //Read the target file
-	if err != nil {
-		fmt.Printf("Unable to open the input file!\n")
-		return err
-	}
-	ciphertext, err := Encrypt(b, key)
-	if err != nil {
-		fmt.Printf("encrypt file failed")
-		return err
-	}
-	err = ioutil.WriteFile(outputfile, ciphertext, 0644)
-	if err != nil {
-		fmt.Printf("Unable to create encrypted file!\n")
-		return err
-	}
-
-	return nil
+	return copyFile(inputfile, outputfile, func(out io.Writer, in io.Reader) error {
+		w, err := NewWriter(out, key)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, in); err != nil {
+			return err
+		}
+		return w.Close()
+	})
 }
 
-// DecryptFile decrypt file
+// DecryptFile decrypts file of EncryptFile, legacy file of former versions is decrypted as well
 func DecryptFile(inputfile string, key []byte, outputfile string) error {
-	z, err := ioutil.ReadFile(inputfile)
-	if err != nil {
-		return err
-	}
-	result, err := Decrypt(z, key)
-	if err != nil {
+	return copyFile(inputfile, outputfile, func(out io.Writer, in io.Reader) error {
+		r, err := NewReader(in, key)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
 		return err
-	}
-	err = ioutil.WriteFile(outputfile, result, 0644)
-	if err != nil {
-		fmt.Printf("Unable to create decrypted file!\n")
-		return err
-	}
-	return nil
+	})
 }
@@ -0,0 +1,65 @@
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// SIV deterministic authenticated encryption, the nonce is synthesized from the plaintext by HMAC-SHA256,
+// so the same plaintext gives the same ciphertext and nothing but equality is leaked.
+type SIV struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+func subKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// NewSIV derives keys of encryption and nonce from key
+func NewSIV(key []byte) (*SIV, error) {
+	if len(key) < 16 {
+		return nil, aes.KeySizeError(len(key))
+	}
+	block, err := aes.NewCipher(subKey(key, "nebula siv encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SIV{aead: aead, macKey: subKey(key, "nebula siv nonce")}, nil
+}
+
+func (self *SIV) nonce(plaintext, ad []byte) []byte {
+	mac := hmac.New(sha256.New, self.macKey)
+	mac.Write(ad)
+	mac.Write([]byte{0})
+	mac.Write(plaintext)
+	return mac.Sum(nil)[:self.aead.NonceSize()]
+}
+
+// Seal returns nonce followed by sealed plaintext, ad is authenticated but not encrypted
+func (self *SIV) Seal(plaintext, ad []byte) []byte {
+	nonce := self.nonce(plaintext, ad)
+	return self.aead.Seal(nonce, nonce, plaintext, ad)
+}
+
+// Open returns plaintext of Seal, ErrAuthFailed if ciphertext is tampered or not made by the key
+func (self *SIV) Open(ciphertext, ad []byte) ([]byte, error) {
+	n := self.aead.NonceSize()
+	if len(ciphertext) < n+self.aead.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+	plaintext, err := self.aead.Open(nil, ciphertext[:n], ciphertext[n:], ad)
+	if err != nil || !hmac.Equal(ciphertext[:n], self.nonce(plaintext, ad)) {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
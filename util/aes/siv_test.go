@@ -0,0 +1,36 @@
+package aes
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSIV(t *testing.T) {
+	siv, err := NewSIV(randAesKey(32))
+	checkErr(err)
+	name := []byte("report.pdf")
+	a, b := siv.Seal(name, nil), siv.Seal(name, nil)
+	if !bytes.Equal(a, b) {
+		t.Error("same plaintext gives different ciphertext")
+	}
+	if bytes.Equal(a, siv.Seal([]byte("report.pdf "), nil)) || bytes.Equal(a, siv.Seal(name, []byte("ad"))) {
+		t.Error("different input gives same ciphertext")
+	}
+	de, err := siv.Open(a, nil)
+	checkErr(err)
+	if !bytes.Equal(name, de) {
+		t.Error("decrypted name differs")
+	}
+	a[len(a)-1] ^= 1
+	if _, err := siv.Open(a, nil); err != ErrAuthFailed {
+		t.Errorf("tampered: expect ErrAuthFailed, got %v", err)
+	}
+	other, err := NewSIV(randAesKey(32))
+	checkErr(err)
+	if _, err := other.Open(b, nil); err != ErrAuthFailed {
+		t.Errorf("wrong key: expect ErrAuthFailed, got %v", err)
+	}
+	if _, err := siv.Open([]byte("short"), nil); err == nil {
+		t.Error("expect error of short ciphertext")
+	}
+}
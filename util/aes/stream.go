@@ -0,0 +1,123 @@
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+)
+
+const streamBufSize = 32 * 1024
+
+var errInvalidPadding = errors.New("invalid padding of encrypted data")
+
+type encryptWriter struct {
+	w    io.Writer
+	mode cipher.BlockMode
+	buf  []byte
+	out  []byte
+}
+
+// NewEncryptWriter returns a writer encrypting to w, the output is the same as Encrypt of all data written.
+// Close must be called to write the padding, it does not close w.
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, mode: cipher.NewCBCEncrypter(block, key[:block.BlockSize()])}, nil
+}
+
+func (self *encryptWriter) Write(p []byte) (int, error) {
+	self.buf = append(self.buf, p...)
+	n := len(self.buf) / aes.BlockSize * aes.BlockSize
+	if n > 0 {
+		if err := self.flush(self.buf[:n]); err != nil {
+			return 0, err
+		}
+		self.buf = append(self.buf[:0], self.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+func (self *encryptWriter) Close() error {
+	return self.flush(pkcs5Padding(self.buf, aes.BlockSize))
+}
+
+func (self *encryptWriter) flush(data []byte) error {
+	if cap(self.out) < len(data) {
+		self.out = make([]byte, len(data))
+	}
+	out := self.out[:len(data)]
+	self.mode.CryptBlocks(out, data)
+	_, err := self.w.Write(out)
+	return err
+}
+
+type decryptReader struct {
+	r       io.Reader
+	mode    cipher.BlockMode
+	buf     []byte
+	raw     []byte // encrypted data not decrypted yet, the last block is held until EOF for padding
+	pending []byte // decrypted data not read yet
+	eof     bool
+}
+
+// NewDecryptReader returns a reader decrypting the output of Encrypt or NewEncryptWriter from r.
+func NewDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, mode: cipher.NewCBCDecrypter(block, key[:block.BlockSize()]), buf: make([]byte, streamBufSize)}, nil
+}
+
+func (self *decryptReader) Read(p []byte) (int, error) {
+	for len(self.pending) == 0 {
+		if self.eof {
+			return 0, io.EOF
+		}
+		if err := self.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+func (self *decryptReader) fill() error {
+	n, err := self.r.Read(self.buf)
+	self.raw = append(self.raw, self.buf[:n]...)
+	if err == io.EOF {
+		self.eof = true
+		if len(self.raw) == 0 || len(self.raw)%aes.BlockSize != 0 {
+			return io.ErrUnexpectedEOF
+		}
+		data := self.decrypt(self.raw)
+		padding := int(data[len(data)-1])
+		if padding == 0 || padding > aes.BlockSize {
+			return errInvalidPadding
+		}
+		self.pending, self.raw = data[:len(data)-padding], nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	full := len(self.raw) / aes.BlockSize * aes.BlockSize
+	if full == len(self.raw) {
+		full -= aes.BlockSize
+	}
+	if full > 0 {
+		self.pending = self.decrypt(self.raw[:full])
+		self.raw = append(self.raw[:0], self.raw[full:]...)
+	}
+	return nil
+}
+
+func (self *decryptReader) decrypt(data []byte) []byte {
+	out := make([]byte, len(data))
+	self.mode.CryptBlocks(out, data)
+	return out
+}
@@ -0,0 +1,66 @@
+package aes
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// oneByteReader returns data byte by byte to exercise partial blocks
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (self oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return self.r.Read(p[:1])
+}
+
+func TestStream(t *testing.T) {
+	for _, size := range []int{0, 1, 15, 16, 17, 1000, streamBufSize, streamBufSize + 5, 3*streamBufSize + 16} {
+		key := randAesKey(16)
+		data := randAesKey(size)
+		expect, err := Encrypt(data, key)
+		checkErr(err)
+
+		var buf bytes.Buffer
+		w, err := NewEncryptWriter(&buf, key)
+		checkErr(err)
+		for i := 0; i < len(data); i += 7 {
+			end := i + 7
+			if end > len(data) {
+				end = len(data)
+			}
+			_, err = w.Write(data[i:end])
+			checkErr(err)
+		}
+		checkErr(w.Close())
+		if !bytes.Equal(expect, buf.Bytes()) {
+			t.Errorf("size %d: encrypt writer output differs from Encrypt", size)
+		}
+
+		for _, r := range []io.Reader{bytes.NewReader(expect), oneByteReader{bytes.NewReader(expect)}} {
+			dr, err := NewDecryptReader(r, key)
+			checkErr(err)
+			de, err := ioutil.ReadAll(dr)
+			checkErr(err)
+			if !bytes.Equal(data, de) {
+				t.Errorf("size %d: decrypt reader output differs", size)
+			}
+		}
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	key := randAesKey(16)
+	en, err := Encrypt(randAesKey(100), key)
+	checkErr(err)
+	dr, err := NewDecryptReader(bytes.NewReader(en[:len(en)-3]), key)
+	checkErr(err)
+	if _, err = ioutil.ReadAll(dr); err == nil {
+		t.Error("expect error of truncated data")
+	}
+}